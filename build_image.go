@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mydocker/container"
+	"mydocker/images"
+	"mydocker/network"
+	"mydocker/util"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 按构建文件构建镜像，buildfile 为空时使用构建上下文中的 Buildfile
+func BuildImage(contextDir, buildfile string, tags []string, noCache bool) error {
+	if buildfile == "" {
+		buildfile = filepath.Join(contextDir, "Buildfile")
+	}
+	file, err := os.Open(buildfile)
+	if err != nil {
+		return fmt.Errorf("open build file %s error %v", buildfile, err)
+	}
+	defer file.Close()
+	contextDir, err = filepath.Abs(contextDir)
+	if err != nil {
+		return err
+	}
+	_, err = images.Build(file, &images.BuildOptions{
+		ContextDir: contextDir,
+		Tags:       tags,
+		NoCache:    noCache,
+		Run:        runBuildContainer,
+		RunExclude: container.EtcMountPoints(),
+	})
+	return err
+}
+
+// 在临时容器中执行 RUN 的命令，容器使用宿主机网络，输出直接打印到构建输出中
+// 命令成功时返回容器读写层目录，调用方提交镜像后删除容器
+func runBuildContainer(img *images.Image, config images.ImageConfig, cmd []string) (string, func(), error) {
+	containerId := util.RandStringBytes(10)
+	cinfo := &container.ContainerInfo{
+		Id:          containerId,
+		Name:        "build-" + containerId,
+		Image:       img.ID,
+		NetworkMode: container.NetworkModeHost,
+		Cmd:         cmd,
+		WorkingDir:  config.WorkingDir,
+		User:        config.User,
+	}
+	rootURL := fmt.Sprintf(container.AUFSRootUrl, containerId)
+	mntURL := path.Join(rootURL, container.AUFSMountLayer)
+	cleanup := func() {
+		container.DeleteAUFSWorkSpace(rootURL, mntURL, "")
+		container.DeleteContainerInfo(containerId)
+	}
+
+	parent, writePipe := container.NewParentProcess(true, "", containerId, img.ID, config.Env, cinfo.NetworkMode)
+	if parent == nil {
+		cleanup()
+		return "", nil, fmt.Errorf("new parent process error")
+	}
+	// 构建时不读取终端输入
+	parent.Stdin = nil
+	if err := parent.Start(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	fmt.Printf(" ---> Running in %s\n", containerId)
+	if _, err := container.RecordContainerInfo(cinfo, parent.Process.Pid, cmd); err != nil {
+		parent.Process.Kill()
+		parent.Wait()
+		cleanup()
+		return "", nil, err
+	}
+	if err := network.UpdateEtcFiles(cinfo); err != nil {
+		logrus.Errorf("write container etc files error %v", err)
+	}
+	sendInitCommand(cmd, writePipe)
+	if err := parent.Wait(); err != nil {
+		cleanup()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", nil, fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(cmd, " "), exitErr.ExitCode())
+		}
+		return "", nil, err
+	}
+	return path.Join(rootURL, container.AUFSWriteLayer), cleanup, nil
+}
@@ -42,3 +42,13 @@ func (c *CgroupManager) Destroy() error {
 	}
 	return nil
 }
+
+// Freeze 暂停 cgroup 中的所有进程
+func (c *CgroupManager) Freeze() error {
+	return subsystems.Freezer.Freeze(c.Path)
+}
+
+// Thaw 恢复 cgroup 中被暂停的进程
+func (c *CgroupManager) Thaw() error {
+	return subsystems.Freezer.Thaw(c.Path)
+}
@@ -0,0 +1,76 @@
+package subsystems
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	freezerState = "freezer.state"
+	frozen       = "FROZEN"
+	thawed       = "THAWED"
+)
+
+// FreezerSubSystem freezer subsystem 的实现，没有资源限制，用于暂停和恢复 cgroup 中的所有进程
+type FreezerSubSystem struct {
+}
+
+func (s *FreezerSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	return nil
+}
+
+func (s *FreezerSubSystem) Remove(cgroupPath string) error {
+	return remove(s.Name(), cgroupPath)
+}
+
+func (s *FreezerSubSystem) Apply(cgroupPath string, pid int) error {
+	return apply(s.Name(), cgroupPath, pid)
+}
+
+func (s *FreezerSubSystem) Name() string {
+	return "freezer"
+}
+
+// Freeze 暂停 cgroup 中的所有进程，等待 freezer.state 变为 FROZEN 后返回
+func (s *FreezerSubSystem) Freeze(cgroupPath string) error {
+	return s.setState(cgroupPath, frozen)
+}
+
+// Thaw 恢复 cgroup 中被暂停的进程
+func (s *FreezerSubSystem) Thaw(cgroupPath string) error {
+	return s.setState(cgroupPath, thawed)
+}
+
+func (s *FreezerSubSystem) setState(cgroupPath, state string) error {
+	freezerPath, err := GetCgroupPath(s.Name(), cgroupPath)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+	// 容器进程不在 freezer cgroup 中时（例如旧版本启动的容器）冻结不会生效
+	procs, err := os.ReadFile(path.Join(freezerPath, cgroupProcs))
+	if err != nil {
+		return err
+	}
+	if state == frozen && len(strings.TrimSpace(string(procs))) == 0 {
+		return fmt.Errorf("no process in freezer cgroup %s", cgroupPath)
+	}
+	stateFile := path.Join(freezerPath, freezerState)
+	if err := os.WriteFile(stateFile, []byte(state), 0644); err != nil {
+		return fmt.Errorf("set cgroup freezer state %s fail %v", state, err)
+	}
+	// 冻结过程中状态为 FREEZING，所有进程都停止后才变为 FROZEN
+	for i := 0; i < 100; i++ {
+		current, err := os.ReadFile(stateFile)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(current)) == state {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("wait cgroup freezer state %s timeout", state)
+}
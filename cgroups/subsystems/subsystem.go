@@ -20,4 +20,8 @@ var SubsystemsIns = []Subsystem{
 	&CpusetSubSystem{},
 	&MemorySubSystem{},
 	&CpuSubSystem{},
+	Freezer,
 }
+
+// Freezer 用于 commit 时暂停容器
+var Freezer = &FreezerSubSystem{}
@@ -41,7 +41,18 @@ func FindCgroupMountpoint(subsystemName string) string {
 		// 42 33 0:37 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:19 - cgroup cgroup rw,memory
 		txt := scanner.Text() // a line
 		fields := strings.Split(txt, " ")
-		if fields[8] == cgroup && fields[9] == cgroup && strings.HasSuffix(fields[4], subsystemName) {
+		// 可选字段（例如 shared:17）的个数不固定，文件系统类型位于分隔符 - 之后
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		if fields[sep+1] == cgroup && fields[sep+2] == cgroup && strings.HasSuffix(fields[4], subsystemName) {
 			return fields[4]
 		}
 	}
@@ -2,31 +2,86 @@ package main
 
 import (
 	"fmt"
+	"mydocker/cgroups"
 	"mydocker/container"
+	"mydocker/images"
 	"mydocker/util"
-	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-func commitContainer(containerId string) {
-	imageName := containerId
-	mntURL := fmt.Sprintf(container.AUFSRootUrl, containerId)
-	mntURL = path.Join(mntURL, container.AUFSMountLayer)
-	exist, err := util.FileOrDirExits(mntURL)
+type commitOptions struct {
+	author  string
+	message string
+	// CMD、ENV 指令，修改新镜像的配置
+	changes []string
+	// 提交过程中暂停容器，保证读写层的一致性
+	pause bool
+}
+
+// 将容器提交为镜像仓库中的新镜像，ref 为空时新镜像没有 tag
+// 新镜像以容器使用的镜像为父镜像，根文件系统为父镜像叠加容器读写层中的修改，配置继承父镜像并记录容器的命令和环境变量
+func CommitContainer(containerId, ref string, opts *commitOptions) error {
+	c, err := container.GetContainerInfoById(containerId)
+	if err != nil {
+		return fmt.Errorf("can not get container info %s error %v", containerId, err)
+	}
+	rootURL := fmt.Sprintf(container.AUFSRootUrl, containerId)
+	src := path.Join(rootURL, container.AUFSWriteLayer)
+
+	imgOpts := images.ImageOptions{Author: opts.author, Comment: opts.message}
+	if ref != "" {
+		imgOpts.Tags = []string{ref}
+	}
+	// 读写层中 /etc 下的挂载点只是运行时创建的空文件，不提交到新镜像层
+	var exclude []string
+	if parent, err := images.GetImage(c.Image); c.Image != "" && err == nil {
+		imgOpts.Parent = parent.ID
+		imgOpts.Config = parent.Config
+		exclude = container.EtcMountPoints()
+	} else {
+		// 没有记录镜像的旧容器或者镜像已被删除，提交合并后的完整根文件系统
+		logrus.Warnf("image of container %s not found, commit the whole rootfs without parent", containerId)
+		src = path.Join(rootURL, container.AUFSMountLayer)
+	}
+	exist, err := util.FileOrDirExits(src)
 	if err != nil {
-		logrus.Errorf("mntUrl %s judge error %v", mntURL, err)
-		return
+		return fmt.Errorf("judge %s error %v", src, err)
 	}
 	if !exist {
-		logrus.Errorf("mnt url %s not found", mntURL)
-		return
+		return fmt.Errorf("container layer %s not found", src)
 	}
-	imageTar := "/root/" + imageName + ".tar"
-	fmt.Printf("%s", imageTar)
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
-		logrus.Errorf("Tar folder %s error %v", mntURL, err)
-		return
+
+	imgOpts.Config.SetEnv(c.Env...)
+	if len(c.Entrypoint) > 0 || len(c.Cmd) > 0 {
+		imgOpts.Config.Entrypoint, imgOpts.Config.Cmd = c.Entrypoint, c.Cmd
+	} else if c.Command != "" {
+		// 旧版本的容器只记录了完整的命令
+		imgOpts.Config.Entrypoint, imgOpts.Config.Cmd = nil, strings.Fields(c.Command)
+	}
+	for _, change := range opts.changes {
+		if err := imgOpts.Config.ApplyChange(change); err != nil {
+			return err
+		}
+	}
+
+	if opts.pause && c.Status == container.RUNNING {
+		cgroupManager := cgroups.CgroupManager{Path: fmt.Sprintf(container.CGroup, containerId)}
+		if err := cgroupManager.Freeze(); err != nil {
+			return fmt.Errorf("pause container %s error %v", containerId, err)
+		}
+		defer func() {
+			if err := cgroupManager.Thaw(); err != nil {
+				logrus.Errorf("unpause container %s error %v", containerId, err)
+			}
+		}()
+	}
+	img, err := images.CommitImage(src, imgOpts, exclude...)
+	if err != nil {
+		return fmt.Errorf("commit container %s error %v", containerId, err)
 	}
+	fmt.Printf("sha256:%s\n", img.ID)
+	return nil
 }
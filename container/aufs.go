@@ -3,21 +3,24 @@ package container
 import (
 	"fmt"
 	"mydocker/images"
-	"mydocker/util"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-func NewAUFSWorkSpace(rootURL, mntURL, volume, imageName string) error{
-	if err := CreateReadonlyLayer(imageName); err != nil{
+func NewAUFSWorkSpace(rootURL, mntURL, volume, imageID string) error{
+	// 镜像的各层作为只读层
+	lowerDirs, err := images.LayerLinks(imageID)
+	if err != nil{
 		return err
 	}
 	CreateWriteLayer(rootURL)
-	readonlyLayer := path.Join(images.ImagesStoreDir, imageName)
-	CreateMountPoint(rootURL, mntURL, readonlyLayer )
+	if err := CreateMountPoint(rootURL, mntURL, lowerDirs); err != nil {
+		return err
+	}
 	if volume != "" {
 		volumeURLs := volumeUrlExtract(volume)
 		length := len(volumeURLs)
@@ -44,42 +47,17 @@ func CreateVolumeMount(source, target string) error {
 	}
 	options := fmt.Sprintf("dirs=%s", source)
 	cmd := exec.Command("mount", "-t", "aufs", "-o", options, "none", target)
-	logrus.Info("mount volume command: mount", " -t ", " aufs ", " -o ", options, " none ", target)
+	if images.StorageDriver() == images.DriverOverlay {
+		// 没有 aufs 时使用 bind mount 挂载数据卷
+		cmd = exec.Command("mount", "--bind", source, target)
+	}
+	logrus.Info("mount volume command: ", strings.Join(cmd.Args, " "))
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to mount local volume: %v", err)
 	}
 	return nil
 }
 
-// CreateReadonlyLayer 将busybox.tar解压到busybox目录下，作为容器的只读层
-func CreateReadonlyLayer(imageName string) error{
-	// busyBoxURL := BusyBoxUrl
-	// busyBoxTarURL := BusyBoxTarUrl
-	imageUrl := path.Join(images.ImagesStoreDir, imageName)
-	exits, err := util.FileOrDirExits(imageUrl)
-	if err != nil {
-		return fmt.Errorf("fail to judge whether dir %s exists. %v", imageUrl, err)
-	}
-	if !exits {
-		
-		return fmt.Errorf("image not in %s , please create target image URL %s with readonly leayer manually", images.ImagesStoreDir, imageName)
-
-		// err := os.MkdirAll(busyBoxURL, os.ModePerm)
-		// if err != nil {
-		// 	logrus.Errorf("Mkdir dir %s error. %v", busyBoxURL, err)
-		// 	return
-		// }
-
-		// CombinedOutput runs the command and returns its combined standard output and standard error 立即运行
-		// _, err = exec.Command("tar", "-xvf", busyBoxTarURL, "-C", busyBoxURL).CombinedOutput()
-		// if err != nil {
-		// 	logrus.Errorf("untar dir %s error. %v", busyBoxTarURL, err)
-		// 	return
-		// }
-	}
-	return nil
-}
-
 // CreateWriteLayer 创建一个名称为 writeLayer 的目录作为容器的唯一可写层
 func CreateWriteLayer(rootURL string) {
 	writeURL := path.Join(rootURL, AUFSWriteLayer)
@@ -90,27 +68,49 @@ func CreateWriteLayer(rootURL string) {
 	}
 }
 
-func CreateMountPoint(rootURL, mntURL, readonlyURL string){
+// CreateMountPoint 将读写层和镜像各层叠加挂载到 mnt 目录，lowerDirs 按从下到上的顺序
+// lowerDirs 为相对于镜像层目录的短链接，mount 命令在镜像层目录中执行，挂载选项不会超过一页的长度限制
+func CreateMountPoint(rootURL, mntURL string, lowerDirs []string) error {
 	// 创建 mnt 目录作为挂载点
 	err := os.MkdirAll(mntURL, os.ModePerm)
 	if err != nil {
-		logrus.Errorf("Mkdir dir %s error. %v", mntURL, err)
-		return
+		return fmt.Errorf("mkdir dir %s error. %v", mntURL, err)
+	}
+	// 挂载选项中上层的目录在左边
+	var layers []string
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		layers = append(layers, lowerDirs[i])
 	}
+	writeURL := path.Join(rootURL, AUFSWriteLayer)
 
-	// 把 writeLayer 目录和 baseLayer 目录 mount 到mnt目录下
-	// dirs 指定的左边起第一个目录是 read-write 权限，后续目录都是 read-only 权限
-	// 由于 aufs 是虚拟文件系统，挂载点设置为 none
-	// https://www.cnblogs.com/sparkdev/p/11237347.html
-	dirs := "dirs=" + path.Join(rootURL, AUFSWriteLayer) + ":" + readonlyURL
-	cmd := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL)
-	logrus.Info("mount command : mount", " -t", " aufs", " -o ", dirs, " none ", mntURL)
+	var cmd *exec.Cmd
+	switch images.StorageDriver() {
+	case images.DriverOverlay:
+		workURL := path.Join(rootURL, OverlayWorkLayer)
+		if err := os.MkdirAll(workURL, os.ModePerm); err != nil {
+			return fmt.Errorf("mkdir dir %s error. %v", workURL, err)
+		}
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(layers, ":"), writeURL, workURL)
+		cmd = exec.Command("mount", "-t", "overlay", "-o", options, "overlay", mntURL)
+	default:
+		// 把 writeLayer 目录和镜像各层 mount 到mnt目录下
+		// dirs 指定的左边起第一个目录是 read-write 权限，镜像层为 ro+wh，即只读并且其中的 whiteout 文件生效
+		// 由于 aufs 是虚拟文件系统，挂载点设置为 none
+		// https://www.cnblogs.com/sparkdev/p/11237347.html
+		dirs := "dirs=" + writeURL
+		for _, layer := range layers {
+			dirs += ":" + layer + "=ro+wh"
+		}
+		cmd = exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL)
+	}
+	logrus.Info("mount command : ", strings.Join(cmd.Args, " "))
+	cmd.Dir = images.LayersDir()
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	if err := cmd.Run(); err != nil {
-		logrus.Errorf("mount aufs error, mount command: mount -t aufs -o %v none %v. err: %v", dirs, mntURL, err)
-		return
+		return fmt.Errorf("mount error, mount command: %s. err: %v", strings.Join(cmd.Args, " "), err)
 	}
+	return nil
 }
 
 func DeleteAUFSWorkSpace(rootURL, mntURL, volume string) {
@@ -145,10 +145,12 @@ func DeleteMountPoint(mntURL string) {
 }
 
 func DeleteWriteLayer(rootURL string) {
-	writeURL := path.Join(rootURL, AUFSWriteLayer)
-	if err := os.RemoveAll(writeURL); err != nil {
-		logrus.Errorf("Remove dir %s error %v", writeURL, err)
-		return
+	for _, layer := range []string{AUFSWriteLayer, OverlayWorkLayer} {
+		writeURL := path.Join(rootURL, layer)
+		if err := os.RemoveAll(writeURL); err != nil {
+			logrus.Errorf("Remove dir %s error %v", writeURL, err)
+			return
+		}
 	}
 }
 
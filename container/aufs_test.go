@@ -0,0 +1,46 @@
+package container
+
+import (
+	"fmt"
+	"mydocker/images"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMountManyLayers(t *testing.T) {
+	if images.StorageDriver() != images.DriverOverlay {
+		t.Skip("overlay not supported")
+	}
+	dir := t.TempDir()
+	oldStoreDir := images.ImagesStoreDir
+	images.ImagesStoreDir = path.Join(dir, "images")
+	defer func() { images.ImagesStoreDir = oldStoreDir }()
+
+	// 每层一个文件，完整路径拼接后远超一页的挂载选项长度限制
+	parent := ""
+	for i := 0; i < 60; i++ {
+		diff := t.TempDir()
+		os.WriteFile(path.Join(diff, fmt.Sprintf("file%d", i)), []byte("data"), 0644)
+		img, err := images.CommitImage(diff, images.ImageOptions{Parent: parent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = img.ID
+	}
+	links, err := images.LayerLinks(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootURL, mntURL := path.Join(dir, "root"), path.Join(dir, "mnt")
+	CreateWriteLayer(rootURL)
+	if err := CreateMountPoint(rootURL, mntURL, links); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteMountPoint(mntURL)
+	for _, name := range []string{"file0", "file59"} {
+		if _, err := os.Stat(path.Join(mntURL, name)); err != nil {
+			t.Errorf("layer file %s not mounted: %v", name, err)
+		}
+	}
+}
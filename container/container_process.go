@@ -11,16 +11,20 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func NewParentProcess(tty bool, volume, containerId, imagesName string, envSlice []string) (*exec.Cmd, *os.File) {
+func NewParentProcess(tty bool, volume, containerId, imageID string, envSlice []string, networkMode string) (*exec.Cmd, *os.File) {
 	readPipe, writePipe, err := newPipe()
 	if err != nil {
 		logrus.Errorf("New pipe error %v", err)
 		return nil, nil
 	}
-	cmd := exec.Command("/proc/self/exe", "init")
+	// 容器ID传给 init 进程，用于找到容器状态目录下生成的 hosts 等文件
+	cmd := exec.Command("/proc/self/exe", "init", containerId)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC,
+	}
+	// host 模式直接使用宿主机网络，container:<id> 模式由 init 进程加入其他容器的 Net Namespace
+	if newNetNamespace(networkMode) {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
 	}
 
 	if tty {
@@ -62,7 +66,7 @@ func NewParentProcess(tty bool, volume, containerId, imagesName string, envSlice
 
 	rootURL := fmt.Sprintf(AUFSRootUrl, containerId)
 	mntURL := path.Join(rootURL, AUFSMountLayer)
-	err = NewAUFSWorkSpace(rootURL, mntURL, volume, imagesName)
+	err = NewAUFSWorkSpace(rootURL, mntURL, volume, imageID)
 	if err != nil {
 		logrus.Error("Error when create new AUFS work space")
 		return nil, nil
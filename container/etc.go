@@ -0,0 +1,223 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HostsFileName    = "hosts"
+	HostnameFileName = "hostname"
+	ResolvConfName   = "resolv.conf"
+
+	hostResolvConf = "/etc/resolv.conf"
+	hostHosts      = "/etc/hosts"
+)
+
+// 宿主机没有可用的 DNS 服务器时使用的默认服务器
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// 解析 --add-host 参数，格式为 host:ip
+func ParseExtraHost(s string) (string, net.IP, error) {
+	idx := strings.Index(s, ":")
+	if idx <= 0 {
+		return "", nil, fmt.Errorf("invalid add-host %q, eg: --add-host myhost:192.168.1.10", s)
+	}
+	host := s[:idx]
+	ip := net.ParseIP(strings.Trim(s[idx+1:], "[]"))
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid ip address in add-host %q", s)
+	}
+	return host, ip, nil
+}
+
+// 容器的主机名，未指定时使用容器ID，host 网络模式下使用宿主机的主机名
+func (c *ContainerInfo) hostname() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	if c.NetworkMode == NetworkModeHost {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname
+		}
+	}
+	return c.Id
+}
+
+// 在容器的状态目录下生成 /etc/hosts、/etc/hostname 和 /etc/resolv.conf
+// 容器 init 进程启动时将这些文件 bind mount 到容器内，容器连接或断开网络后重新调用更新文件内容
+// ips 为容器在各个网络中的地址，nameservers 为容器所在网络的内置 DNS 服务地址
+func WriteEtcFiles(cinfo *ContainerInfo, ips []net.IP, nameservers []string) error {
+	dirUrl := fmt.Sprintf(DefaultInfoLocation, cinfo.Id)
+	if err := os.MkdirAll(dirUrl, 0644); err != nil {
+		return fmt.Errorf("mkdir %s error %v", dirUrl, err)
+	}
+
+	hostResolv, err := os.ReadFile(hostResolvConf)
+	if err != nil {
+		logrus.Warnf("read %s error %v", hostResolvConf, err)
+	}
+	hosts := buildHosts(cinfo, ips)
+	// host 网络模式下沿用宿主机的 hosts，只追加 --add-host 指定的记录
+	if cinfo.NetworkMode == NetworkModeHost {
+		content, err := os.ReadFile(hostHosts)
+		if err != nil {
+			logrus.Warnf("read %s error %v", hostHosts, err)
+		}
+		hosts = string(content) + extraHosts(cinfo)
+	}
+	files := map[string]string{
+		HostnameFileName: cinfo.hostname() + "\n",
+		HostsFileName:    hosts,
+		ResolvConfName:   buildResolvConf(hostResolv, cinfo, nameservers),
+	}
+	for name, content := range files {
+		// 直接覆盖写入而不是重建文件，保持 inode 不变，容器内已经 bind mount 的文件可以看到更新
+		filePath := path.Join(dirUrl, name)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			return fmt.Errorf("write %s error %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+func buildHosts(cinfo *ContainerInfo, ips []net.IP) string {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("fe00::0\tip6-localnet\n")
+	b.WriteString("ff00::0\tip6-mcastprefix\n")
+	b.WriteString("ff02::1\tip6-allnodes\n")
+	b.WriteString("ff02::2\tip6-allrouters\n")
+
+	names := cinfo.hostname()
+	if cinfo.Name != "" && cinfo.Name != names {
+		names += " " + cinfo.Name
+	}
+	for _, ip := range ips {
+		fmt.Fprintf(&b, "%s\t%s\n", ip, names)
+	}
+	b.WriteString(extraHosts(cinfo))
+	return b.String()
+}
+
+// --add-host 指定的 hosts 记录
+func extraHosts(cinfo *ContainerInfo) string {
+	var b strings.Builder
+	for _, extra := range cinfo.ExtraHosts {
+		host, ip, err := ParseExtraHost(extra)
+		if err != nil {
+			logrus.Warnf("skip add-host: %v", err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", ip, host)
+	}
+	return b.String()
+}
+
+// 生成容器的 resolv.conf
+// nameserver 优先使用 --dns 指定的服务器，其次使用网络内置的 DNS 服务，最后沿用宿主机的配置
+// 容器处于独立的网络 namespace 中，宿主机上的本地地址服务器（如 systemd-resolved 的 127.0.0.53）在容器内不可用，需要过滤
+// host 网络模式下容器与宿主机共用网络，本地地址服务器可以直接使用
+func buildResolvConf(hostResolv []byte, cinfo *ContainerInfo, nameservers []string) string {
+	var hostNameservers, hostSearch, hostOptions []string
+	scanner := bufio.NewScanner(bytes.NewReader(hostResolv))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil && (!ip.IsLoopback() || cinfo.NetworkMode == NetworkModeHost) {
+				hostNameservers = append(hostNameservers, fields[1])
+			}
+		case "search", "domain":
+			hostSearch = fields[1:]
+		case "options":
+			hostOptions = append(hostOptions, fields[1:]...)
+		}
+	}
+
+	switch {
+	case len(cinfo.DNS) > 0:
+		nameservers = cinfo.DNS
+	case len(nameservers) > 0:
+	case len(hostNameservers) > 0:
+		nameservers = hostNameservers
+	default:
+		nameservers = defaultNameservers
+	}
+	search := hostSearch
+	if len(cinfo.DNSSearch) > 0 {
+		search = cinfo.DNSSearch
+	}
+
+	var b strings.Builder
+	for _, ns := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(hostOptions) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(hostOptions, " "))
+	}
+	return b.String()
+}
+
+// 容器 rootfs 中 bind mount 状态目录下文件的路径（相对于根目录），挂载点会在读写层中留下空文件
+// 与 docker 相同，提交镜像时忽略这些文件，镜像中原来的文件（例如 resolv.conf 的软链接）保持不变
+func EtcMountPoints() []string {
+	var files []string
+	for _, name := range []string{HostsFileName, HostnameFileName, ResolvConfName} {
+		files = append(files, path.Join("etc", name))
+	}
+	return files
+}
+
+// 将容器状态目录下生成的文件 bind mount 到 rootfs 的 /etc 下，必须在 rootfs 挂载传播设置为 private 之后调用
+// 并根据 hostname 文件设置容器 UTS namespace 的主机名
+func mountEtcFiles(rootfs, containerId string) error {
+	dirUrl := fmt.Sprintf(DefaultInfoLocation, containerId)
+	for _, name := range []string{HostsFileName, HostnameFileName, ResolvConfName} {
+		source := path.Join(dirUrl, name)
+		if _, err := os.Stat(source); err != nil {
+			logrus.Warnf("skip mount %s: %v", source, err)
+			continue
+		}
+		target := path.Join(rootfs, "etc", name)
+		// 镜像中的文件可能是指向宿主机路径的软链接，或者不存在，替换为普通文件作为挂载点
+		if fi, err := os.Lstat(target); err != nil || !fi.Mode().IsRegular() {
+			_ = os.Remove(target)
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, nil, 0644); err != nil {
+				return fmt.Errorf("create mount point %s error %v", target, err)
+			}
+		}
+		if err := syscall.Mount(source, target, "bind", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mount %s to %s error %v", source, target, err)
+		}
+	}
+
+	content, err := os.ReadFile(path.Join(dirUrl, HostnameFileName))
+	if err != nil {
+		return nil
+	}
+	if hostname := strings.TrimSpace(string(content)); hostname != "" {
+		if err := syscall.Sethostname([]byte(hostname)); err != nil {
+			return fmt.Errorf("set hostname %s error %v", hostname, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package container
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBuildHosts(t *testing.T) {
+	cinfo := &ContainerInfo{
+		Id:         "1234567890",
+		Name:       "web",
+		ExtraHosts: []string{"db:10.0.0.5", "v6host:[2001:db8::1]"},
+	}
+	hosts := buildHosts(cinfo, []net.IP{net.ParseIP("192.168.10.2")})
+	for _, line := range []string{"127.0.0.1\tlocalhost\n", "192.168.10.2\t1234567890 web\n", "10.0.0.5\tdb\n", "2001:db8::1\tv6host\n"} {
+		if !strings.Contains(hosts, line) {
+			t.Errorf("hosts missing %q:\n%s", line, hosts)
+		}
+	}
+
+	cinfo.Hostname = "myhost"
+	if hosts := buildHosts(cinfo, []net.IP{net.ParseIP("192.168.10.2")}); !strings.Contains(hosts, "192.168.10.2\tmyhost web\n") {
+		t.Errorf("hosts missing hostname:\n%s", hosts)
+	}
+}
+
+func TestBuildResolvConf(t *testing.T) {
+	host := []byte("nameserver 127.0.0.53\nsearch example.com\noptions edns0 trust-ad\n")
+	tests := []struct {
+		cinfo       *ContainerInfo
+		nameservers []string
+		want        string
+	}{
+		{
+			// 宿主机只有本地 DNS 服务时使用默认服务器
+			cinfo: &ContainerInfo{},
+			want:  "nameserver 8.8.8.8\nnameserver 8.8.4.4\nsearch example.com\noptions edns0 trust-ad\n",
+		},
+		{
+			cinfo:       &ContainerInfo{},
+			nameservers: []string{"192.168.10.1"},
+			want:        "nameserver 192.168.10.1\nsearch example.com\noptions edns0 trust-ad\n",
+		},
+		{
+			cinfo:       &ContainerInfo{DNS: []string{"1.1.1.1"}, DNSSearch: []string{"a.local", "b.local"}},
+			nameservers: []string{"192.168.10.1"},
+			want:        "nameserver 1.1.1.1\nsearch a.local b.local\noptions edns0 trust-ad\n",
+		},
+	}
+	for i, tt := range tests {
+		if got := buildResolvConf(host, tt.cinfo, tt.nameservers); got != tt.want {
+			t.Errorf("case %d got %q, want %q", i, got, tt.want)
+		}
+	}
+
+	// host 网络模式下宿主机的本地 DNS 服务可以直接使用
+	hostMode := &ContainerInfo{NetworkMode: NetworkModeHost}
+	if got := buildResolvConf(host, hostMode, nil); !strings.HasPrefix(got, "nameserver 127.0.0.53\n") {
+		t.Errorf("host mode got %q", got)
+	}
+}
+
+func TestParseExtraHost(t *testing.T) {
+	for _, s := range []string{"nohost", ":1.2.3.4", "host:notip"} {
+		if _, _, err := ParseExtraHost(s); err == nil {
+			t.Errorf("parse %q expect error", s)
+		}
+	}
+}
+
+func TestIsNetworkName(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"":                 false,
+		"host":             false,
+		"none":             false,
+		"container:abc123": false,
+		"mybridge":         true,
+	} {
+		if got := IsNetworkName(mode); got != want {
+			t.Errorf("IsNetworkName(%q) = %v", mode, got)
+		}
+	}
+	if id := NetworkContainer("container:abc123"); id != "abc123" {
+		t.Errorf("network container %s", id)
+	}
+}
@@ -22,6 +22,36 @@ type ContainerInfo struct {
 	Status      string   `json:"status"`
 	Volume      string   `json:"volume"`
 	PortMapping []string `json:"portmapping"`
+	// 容器使用的镜像ID
+	Image string `json:"image"`
+	// -e 指定的环境变量，commit 时写入镜像配置
+	Env []string `json:"env,omitempty"`
+	// 容器的 Entrypoint 和 Cmd，Command 为两者相加，commit 时写入镜像配置
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	// 镜像配置中的工作目录和用户，由 init 进程在执行用户命令前设置
+	WorkingDir string `json:"workingDir,omitempty"`
+	User       string `json:"user,omitempty"`
+	// 端口映射是否使用用户态代理
+	UserlandProxy bool `json:"userlandProxy"`
+	// 容器在网络内置 DNS 中的别名
+	NetworkAliases []string `json:"networkAliases"`
+
+	// --net 参数，网络名或者 host、none、container:<id> 网络模式
+	NetworkMode string `json:"networkMode"`
+
+	// 容器的主机名以及 /etc/hosts、/etc/resolv.conf 的自定义配置
+	Hostname   string   `json:"hostname"`
+	ExtraHosts []string `json:"extraHosts"`
+	DNS        []string `json:"dns"`
+	DNSSearch  []string `json:"dnsSearch"`
+
+	// 容器的带宽限制，ingress 为进入容器的流量，egress 为容器发出的流量
+	// 速率单位为字节每秒，突发大小单位为字节，速率为 0 时不限制
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
 }
 
 var (
@@ -36,30 +66,26 @@ var (
 	AUFSRootUrl    = "/var/run/mydocker/%s/"
 	AUFSWriteLayer = "writerlayer"
 	AUFSMountLayer = "mnt"
+	// overlay 驱动需要的工作目录，与读写层位于同一个文件系统
+	OverlayWorkLayer = "work"
 
 	// cgroup配置
 	CGroup = "mydocker-cgroup/%s"
 )
 
-func RecordContainerInfo(containerPID int, cmdArr []string, containerName, id, volume string) (string, error) {
+// 记录容器信息，containerInfo 中已经填写了 run 命令指定的配置，这里补充进程号、启动命令等运行时信息
+func RecordContainerInfo(containerInfo *ContainerInfo, containerPID int, cmdArr []string) (string, error) {
 
 	// current time is container create time
-	createTime := time.Now().Format(util.TIMESTAP)
-	command := strings.Join(cmdArr, " ")
+	containerInfo.CreateTime = time.Now().Format(util.TIMESTAP)
+	containerInfo.Command = strings.Join(cmdArr, " ")
 	// default name is id
-	if containerName == "" {
-		containerName = id
-	}
-	// generate struct instance
-	containerInfo := &ContainerInfo{
-		Id:         id,
-		Pid:        strconv.Itoa(containerPID),
-		Name:       containerName,
-		Command:    command,
-		CreateTime: createTime,
-		Status:     RUNNING,
-		Volume:     volume,
+	if containerInfo.Name == "" {
+		containerInfo.Name = containerInfo.Id
 	}
+	containerInfo.Pid = strconv.Itoa(containerPID)
+	containerInfo.Status = RUNNING
+	id := containerInfo.Id
 	// 将容器信息对象json序列化为字符串
 	jsonBytes, err := json.Marshal(containerInfo)
 	if err != nil {
@@ -97,6 +123,19 @@ func RecordContainerInfo(containerPID int, cmdArr []string, containerName, id, v
 	return id, nil
 }
 
+// 覆盖写入容器的 config.json，用于修改已经记录的容器信息
+func SaveContainerInfo(containerInfo *ContainerInfo) error {
+	jsonBytes, err := json.Marshal(containerInfo)
+	if err != nil {
+		return fmt.Errorf("json marshal container %s error %v", containerInfo.Id, err)
+	}
+	configFile := path.Join(fmt.Sprintf(DefaultInfoLocation, containerInfo.Id), ConfigName)
+	if err := os.WriteFile(configFile, jsonBytes, 0622); err != nil {
+		return fmt.Errorf("write config file %s error %v", configFile, err)
+	}
+	return nil
+}
+
 func DeleteContainerInfo(containerId string) {
 	dirUrl := fmt.Sprintf(DefaultInfoLocation, containerId)
 	if err := os.RemoveAll(dirUrl); err != nil {
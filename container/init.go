@@ -9,13 +9,33 @@ import (
 	"syscall"
 )
 
-func RunContainerInitProcess() error {
+func RunContainerInitProcess(containerId string) error {
 	cmdArray := readUserCommand()
 	if len(cmdArray) == 0 {
 		return fmt.Errorf("run container get user command error, cmdArray is nil")
 	}
 
-	_ = setupMount()
+	// 根据 --net 指定的网络模式配置容器网络，需要在 pivot_root 之前完成，此时还可以访问宿主机的 /proc 和容器状态目录
+	etcContainerId := containerId
+	cinfo, err := GetContainerInfoById(containerId)
+	if err != nil {
+		logrus.Errorf("get container info error %v", err)
+	} else if etcContainerId, err = setupNetworkMode(cinfo); err != nil {
+		logrus.Errorf("setup network mode %s error %v", cinfo.NetworkMode, err)
+		return err
+	}
+
+	if err := setupMount(etcContainerId); err != nil {
+		logrus.Errorf("setup mount error %v", err)
+	}
+
+	// 按镜像配置切换工作目录和用户，查找命令之前完成，相对路径的命令相对于工作目录
+	if cinfo != nil {
+		if err := setupUserAndWorkingDir(cinfo); err != nil {
+			logrus.Errorf("setup user and working dir error %v", err)
+			return err
+		}
+	}
 
 	// LookPath在环境变量中查找可执行二进制文件，如果file中包含一个斜杠，则直接根据绝对路径或者相对本目录的相对路径去查找
 	pth, err := exec.LookPath(cmdArray[0])
@@ -33,9 +53,30 @@ func RunContainerInitProcess() error {
 	return nil
 }
 
-func setupMount() error {
+// etcContainerId 为提供 hosts、hostname 和 resolv.conf 的容器，共享其他容器网络时为被共享的容器
+func setupMount(etcContainerId string) error {
 	pwd, _ := os.Getwd()
 	logrus.Infof("Current location is '%s', this path will be rootfs.", pwd)
+
+	// Make oldroot rprivate to make sure our unmounts don't propogate to the host (and thus bork the machine).
+	// systemd 加入linux之后, mount namespace 就变成 shared by default, 所以你必须显示声明这个新的mount namespace独立
+	// 使后续挂载操作在容器进程退出后不影响原主进程
+	// note: runc use the flags MS_SLAVE and MS_REC.
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to enable the mount namespace work properly: %v", err)
+	}
+	/*
+		MS_PRIVATE：Make this mount private. Mount and unmount events do not propagate into or out of this mount.
+					此系统调用使得创建private挂载方式
+		MS_REC (since Linux 2.4.11)： Used in conjunction with MS_BIND to create a recursive bind mount, and in
+				conjunction with the propagation type flags to recursively change the propagation type of all the
+				mounts in a subtree. 此系统调用用于更改当前namespace的进程调用树
+	*/
+
+	// 将生成的 hosts、hostname、resolv.conf 挂载到容器中，pivot_root 前 rootfs 的递归 bind mount 会带上这些挂载
+	if err := mountEtcFiles(pwd, etcContainerId); err != nil {
+		logrus.Errorf("mount etc files error %v", err)
+	}
 	_ = pivotRoot(pwd)
 
 	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
@@ -60,21 +101,6 @@ func setupMount() error {
 
 func pivotRoot(rootfs string) error {
 
-	// Make oldroot rprivate to make sure our unmounts don't propogate to the host (and thus bork the machine).
-	// systemd 加入linux之后, mount namespace 就变成 shared by default, 所以你必须显示声明这个新的mount namespace独立
-	// 使后续挂载操作在容器进程退出后不影响原主进程
-	// note: runc use the flags MS_SLAVE and MS_REC.
-	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
-		return fmt.Errorf("failed to enable the mount namespace work properly: %v", err)
-	}
-	/*
-		MS_PRIVATE：Make this mount private. Mount and unmount events do not propagate into or out of this mount.
-					此系统调用使得创建private挂载方式
-		MS_REC (since Linux 2.4.11)： Used in conjunction with MS_BIND to create a recursive bind mount, and in
-				conjunction with the propagation type flags to recursively change the propagation type of all the
-				mounts in a subtree. 此系统调用用于更改当前namespace的进程调用树
-	*/
-
 	// 使当前rootfs的老root和新root不在同一个文件夹下，需要把rootfs重新mount一次，bind mount 是把相同的内容换一个挂载点的挂载方法
 	if err := syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 		return fmt.Errorf("failed to mount rootfs to itself: %v", err)
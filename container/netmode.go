@@ -0,0 +1,87 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// --net 参数除了网络名之外支持的网络模式
+const (
+	// 使用宿主机的 Net Namespace
+	NetworkModeHost = "host"
+	// 独立的 Net Namespace，只有 lo 接口
+	NetworkModeNone = "none"
+	// container:<id>，加入另一个容器的 Net Namespace
+	NetworkModeContainerPrefix = "container:"
+)
+
+// 网络模式是否为 mydocker 网络的名称，需要通过 network.Connect 连接网络
+func IsNetworkName(networkMode string) bool {
+	return networkMode != "" && networkMode != NetworkModeHost && networkMode != NetworkModeNone &&
+		!strings.HasPrefix(networkMode, NetworkModeContainerPrefix)
+}
+
+// 网络模式为 container:<id> 时返回共享 Net Namespace 的容器ID
+func NetworkContainer(networkMode string) string {
+	return strings.TrimPrefix(networkMode, NetworkModeContainerPrefix)
+}
+
+// 容器是否需要创建新的 Net Namespace
+func newNetNamespace(networkMode string) bool {
+	return networkMode != NetworkModeHost && !strings.HasPrefix(networkMode, NetworkModeContainerPrefix)
+}
+
+// 获取 container:<id> 模式下被共享 Net Namespace 的容器，容器必须处于运行状态
+func GetNetworkContainer(networkMode string) (*ContainerInfo, error) {
+	id := NetworkContainer(networkMode)
+	if id == "" {
+		return nil, fmt.Errorf("missing container id in network mode %s", networkMode)
+	}
+	cinfo, err := GetContainerInfoById(id)
+	if err != nil {
+		return nil, err
+	}
+	if cinfo.Status != RUNNING {
+		return nil, fmt.Errorf("container %s is not running", id)
+	}
+	return cinfo, nil
+}
+
+// 在 init 进程中根据网络模式配置容器网络，返回提供 hosts 等文件的容器ID
+// container:<id> 模式下通过 setns 加入目标容器的 Net Namespace，并共享目标容器的 hosts、hostname 和 resolv.conf
+// setns 只对当前线程生效，这里锁定线程，之后 init 在同一个线程中 exec 用户进程，用户进程继承该 Net Namespace
+func setupNetworkMode(cinfo *ContainerInfo) (string, error) {
+	switch {
+	case cinfo.NetworkMode == NetworkModeHost:
+		return cinfo.Id, nil
+	case strings.HasPrefix(cinfo.NetworkMode, NetworkModeContainerPrefix):
+		target, err := GetNetworkContainer(cinfo.NetworkMode)
+		if err != nil {
+			return cinfo.Id, err
+		}
+		f, err := os.Open(fmt.Sprintf("/proc/%s/ns/net", target.Pid))
+		if err != nil {
+			return cinfo.Id, err
+		}
+		defer f.Close()
+		runtime.LockOSThread()
+		if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+			return cinfo.Id, fmt.Errorf("join net namespace of container %s error %v", target.Id, err)
+		}
+		logrus.Infof("join net namespace of container %s", target.Id)
+		return target.Id, nil
+	default:
+		// 新建的 Net Namespace 中 lo 接口默认关闭，相当于 ip link set lo up
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return cinfo.Id, err
+		}
+		return cinfo.Id, netlink.LinkSetUp(lo)
+	}
+}
@@ -0,0 +1,142 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 容器内的用户，根据容器中的 /etc/passwd 和 /etc/group 解析
+type execUser struct {
+	Uid    int
+	Gid    int
+	Groups []int
+	Home   string
+}
+
+// 解析 user[:group] 格式的用户，user 和 group 可以是名字或者数字ID
+// 数字ID在 passwd 中不存在时直接使用，主组默认为 passwd 中记录的组，附加组为 group 中包含该用户名的组
+func lookupUser(spec, passwdPath, groupPath string) (*execUser, error) {
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	u := &execUser{Home: "/"}
+	name := ""
+	uid, uidErr := strconv.Atoi(userSpec)
+	found := false
+	for _, fields := range readColonFile(passwdPath, 7) {
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if fields[0] == userSpec || (uidErr == nil && id == uid) {
+			name, u.Uid, u.Home = fields[0], id, fields[5]
+			u.Gid, _ = strconv.Atoi(fields[3])
+			found = true
+			break
+		}
+	}
+	if !found {
+		if uidErr != nil || uid < 0 {
+			return nil, fmt.Errorf("unable to find user %s in %s", userSpec, passwdPath)
+		}
+		u.Uid, u.Gid = uid, uid
+	}
+
+	groups := readColonFile(groupPath, 4)
+	if hasGroup {
+		gid, gidErr := strconv.Atoi(groupSpec)
+		found = false
+		for _, fields := range groups {
+			id, err := strconv.Atoi(fields[2])
+			if err != nil {
+				continue
+			}
+			if fields[0] == groupSpec || (gidErr == nil && id == gid) {
+				u.Gid, found = id, true
+				break
+			}
+		}
+		if !found {
+			if gidErr != nil || gid < 0 {
+				return nil, fmt.Errorf("unable to find group %s in %s", groupSpec, groupPath)
+			}
+			u.Gid = gid
+		}
+	} else if name != "" {
+		for _, fields := range groups {
+			id, err := strconv.Atoi(fields[2])
+			if err != nil || id == u.Gid {
+				continue
+			}
+			for _, member := range strings.Split(fields[3], ",") {
+				if member == name {
+					u.Groups = append(u.Groups, id)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// 读取 passwd、group 格式的文件，忽略注释和字段个数不对的行，文件不存在时返回空
+func readColonFile(file string, fieldCount int) [][]string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, ":"); len(fields) == fieldCount {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
+
+// 切换工作目录和用户，在 pivot_root 之后执行，此时的 /etc/passwd 为容器中的文件
+func setupUserAndWorkingDir(cinfo *ContainerInfo) error {
+	if cinfo.WorkingDir != "" {
+		// 与 docker 相同，镜像中不存在的工作目录自动创建
+		if err := os.MkdirAll(cinfo.WorkingDir, 0755); err != nil {
+			return fmt.Errorf("create working dir %s error %v", cinfo.WorkingDir, err)
+		}
+		if err := syscall.Chdir(cinfo.WorkingDir); err != nil {
+			return fmt.Errorf("chdir to %s error %v", cinfo.WorkingDir, err)
+		}
+	}
+	if cinfo.User == "" {
+		return nil
+	}
+	u, err := lookupUser(cinfo.User, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return err
+	}
+	logrus.Infof("switch to user uid %d gid %d", u.Uid, u.Gid)
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf("setgroups error %v", err)
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("setgid %d error %v", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("setuid %d error %v", u.Uid, err)
+	}
+	// 没有通过 -e 指定 HOME 时使用用户的主目录
+	for _, env := range cinfo.Env {
+		if strings.HasPrefix(env, "HOME=") {
+			return nil
+		}
+	}
+	return os.Setenv("HOME", u.Home)
+}
@@ -0,0 +1,42 @@
+package container
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	dir := t.TempDir()
+	passwd, group := path.Join(dir, "passwd"), path.Join(dir, "group")
+	os.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/sh\n# comment\nnginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin\n"), 0644)
+	os.WriteFile(group, []byte("root:x:0:\nnginx:x:101:\nwww:x:33:nginx,other\nadm:x:4:root\n"), 0644)
+
+	tests := []struct {
+		spec     string
+		expected execUser
+	}{
+		{"root", execUser{Uid: 0, Gid: 0, Groups: []int{4}, Home: "/root"}},
+		{"nginx", execUser{Uid: 101, Gid: 101, Groups: []int{33}, Home: "/var/cache/nginx"}},
+		{"101", execUser{Uid: 101, Gid: 101, Groups: []int{33}, Home: "/var/cache/nginx"}},
+		{"nginx:www", execUser{Uid: 101, Gid: 33, Home: "/var/cache/nginx"}},
+		{"1000", execUser{Uid: 1000, Gid: 1000, Home: "/"}},
+		{"1000:50", execUser{Uid: 1000, Gid: 50, Home: "/"}},
+	}
+	for _, test := range tests {
+		u, err := lookupUser(test.spec, passwd, group)
+		if err != nil {
+			t.Errorf("lookup %s error %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(*u, test.expected) {
+			t.Errorf("lookup %s: %+v, expect %+v", test.spec, *u, test.expected)
+		}
+	}
+	for _, spec := range []string{"nobody", "nginx:nogroup", "-1"} {
+		if _, err := lookupUser(spec, passwd, group); err == nil {
+			t.Errorf("lookup %s should fail", spec)
+		}
+	}
+}
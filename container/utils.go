@@ -27,8 +27,12 @@ func readUserCommand() []string {
 		logrus.Errorf("init read pipe error %v", err)
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	var cmdArray []string
+	if err := json.Unmarshal(msg, &cmdArray); err != nil {
+		logrus.Errorf("init unmarshal command %s error %v", msg, err)
+		return nil
+	}
+	return cmdArray
 }
 
 func GetContainerInfoById (containerId string) (*ContainerInfo, error) {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mydocker/container"
+	"mydocker/images"
+	"mydocker/util"
+	"os"
+	"path"
+)
+
+// 将容器合并后的根文件系统以 tar 格式输出，output 为空时输出到标准输出
+func ExportContainer(containerId, output string) error {
+	mntURL := path.Join(fmt.Sprintf(container.AUFSRootUrl, containerId), container.AUFSMountLayer)
+	exist, err := util.FileOrDirExits(mntURL)
+	if err != nil {
+		return fmt.Errorf("mntUrl %s judge error %v", mntURL, err)
+	}
+	if !exist {
+		return fmt.Errorf("mnt url %s not found", mntURL)
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("create %s error %v", output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := images.Pack(w, mntURL); err != nil {
+		if output != "" {
+			os.Remove(output)
+		}
+		return fmt.Errorf("export container %s error %v", containerId, err)
+	}
+	return nil
+}
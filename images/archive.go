@@ -0,0 +1,460 @@
+package images
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 镜像层中表示删除下层文件的 whiteout 文件前缀，.wh.{文件名} 表示删除同目录下的 {文件名}
+	whiteoutPrefix = ".wh."
+	// 表示删除下层目录中所有内容的 opaque whiteout 文件
+	whiteoutOpaque = ".wh..wh..opq"
+	// aufs 读写层根目录下的 .wh..wh.aufs、.wh..wh.plnk 等元数据文件，不属于文件系统内容
+	aufsMetaPrefix = ".wh..wh."
+	// tar 的 PAX 扩展头中保存扩展属性的前缀
+	paxXattrPrefix = "SCHILY.xattr."
+	// tar 头中普通文件的类型位
+	modeRegular = 0100000
+)
+
+// 解压时 whiteout 文件的处理方式
+type whiteoutMode int
+
+const (
+	// 删除 dest 中被 whiteout 的文件，得到叠加后的根文件系统
+	whiteoutApply whiteoutMode = iota
+	// 原样保留 .wh. 文件，aufs 的只读分支使用这种格式
+	whiteoutAUFS
+	// 转换为 overlay 的格式：被删除的文件为 0/0 字符设备，opaque 目录带有 trusted.overlay.opaque 扩展属性
+	whiteoutOverlay
+)
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// 将 tar 包解压到 dest 目录，支持 gzip 压缩的 tar 包
+// 所有路径都限制在 dest 之内：包含 .. 逃逸出 dest 的条目直接报错，路径中的符号链接在 dest 之内解析
+// whiteout 文件删除 dest 中已有的对应文件，保留文件的属主、权限、修改时间和扩展属性
+func Unpack(r io.Reader, dest string) error {
+	return unpack(r, dest, whiteoutApply)
+}
+
+func unpack(r io.Reader, dest string, mode whiteoutMode) error {
+	r, err := decompress(r)
+	if err != nil {
+		return err
+	}
+
+	// 目录的修改时间在目录中的文件全部解压之后再设置
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTime
+	// 当前 tar 包中解压的文件，opaque whiteout 只删除下层已有的文件
+	unpacked := map[string]bool{}
+	rootSeen := false
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar error %v", err)
+		}
+		rel, err := cleanArchivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(rel, aufsMetaPrefix) && rel != whiteoutOpaque {
+			continue
+		}
+		if rel == "." {
+			// 根目录只设置属性
+			if hdr.Typeflag == tar.TypeDir {
+				rootSeen = true
+				dirs = append(dirs, dirTime{dest, hdr.ModTime})
+				applyMetadata(dest, hdr)
+			}
+			continue
+		}
+		parent, err := secureJoin(dest, filepath.Dir(rel))
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(rel)
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if name == whiteoutOpaque && mode != whiteoutAUFS {
+			if err := unpackOpaque(parent, unpacked, mode); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) && name != whiteoutOpaque {
+			deleted := strings.TrimPrefix(name, whiteoutPrefix)
+			if deleted == "" || deleted == "." || deleted == ".." {
+				return fmt.Errorf("invalid whiteout %q in archive", hdr.Name)
+			}
+			switch mode {
+			case whiteoutApply:
+				if err := os.RemoveAll(filepath.Join(parent, deleted)); err != nil {
+					return err
+				}
+				continue
+			case whiteoutOverlay:
+				// 转换为同名的 0/0 字符设备，保留 whiteout 文件的属性
+				hdr.Typeflag, hdr.Devmajor, hdr.Devminor, hdr.Size = tar.TypeChar, 0, 0, 0
+				name = deleted
+			}
+		}
+
+		target := filepath.Join(parent, name)
+		if err := unpackEntry(tr, hdr, dest, target); err != nil {
+			return fmt.Errorf("unpack %s error %v", hdr.Name, err)
+		}
+		unpacked[target] = true
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{target, hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		setModTime(dirs[i].path, dirs[i].modTime)
+	}
+	if !rootSeen && mode != whiteoutApply {
+		// tar 包中没有根目录时镜像层根目录使用固定的修改时间，相同内容的镜像层摘要相同
+		setModTime(dest, time.Unix(0, 0))
+	}
+	return nil
+}
+
+// 清理 tar 中的路径，绝对路径按相对于根目录处理，逃逸出根目录的路径返回错误
+func cleanArchivePath(name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("invalid path %q in archive: outside of the rootfs", name)
+	}
+	return rel, nil
+}
+
+// 在 root 目录之内解析路径中的符号链接，绝对路径的符号链接相对于 root 解析，.. 最多回到 root
+// 返回的路径一定在 root 之内，路径中不存在的部分原样保留
+func secureJoin(root, unsafePath string) (string, error) {
+	resolved := ""
+	remaining := unsafePath
+	links := 0
+	for remaining != "" {
+		var comp string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			comp, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			comp, remaining = remaining, ""
+		}
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+		next := filepath.Join(resolved, comp)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many symlinks in %s", unsafePath)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = ""
+		}
+		remaining = link + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// opaque whiteout 删除目录中不是由当前 tar 包解压的文件，overlay 格式在目录上设置 opaque 扩展属性
+func unpackOpaque(dir string, unpacked map[string]bool, mode whiteoutMode) error {
+	if mode == whiteoutOverlay {
+		if err := unix.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return fmt.Errorf("set opaque xattr on %s error %v", dir, err)
+		}
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if unpacked[p] {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpackEntry(tr *tar.Reader, hdr *tar.Header, root, target string) error {
+	// 目标位置已有的文件（例如下层镜像中的文件）先删除，已有的目录保留并合并
+	if fi, err := os.Lstat(target); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// 符号链接的内容不做检查，之后解析路径时限制在根目录之内
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		rel, err := cleanArchivePath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		parent, err := secureJoin(root, filepath.Dir(rel))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(parent, filepath.Base(rel)), target); err != nil {
+			return err
+		}
+		// 硬链接与源文件共用属性
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		typ := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, typ|mode, int(dev)); err != nil {
+			// 在没有 CAP_MKNOD 的环境中忽略设备文件，容器的 /dev 由 init 进程重新挂载
+			logrus.Warnf("skip device %s: %v", hdr.Name, err)
+			return nil
+		}
+	default:
+		logrus.Warnf("skip unsupported tar entry %s type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	applyMetadata(target, hdr)
+	if hdr.Typeflag != tar.TypeDir {
+		setModTime(target, hdr.ModTime)
+	}
+	return nil
+}
+
+// 设置文件的属主、权限和扩展属性，非 root 用户无法修改属主和部分扩展属性时只输出警告
+func applyMetadata(target string, hdr *tar.Header) {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			logrus.Warnf("chown %s error %v", target, err)
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// chown 会清除 setuid 位，权限在 chown 之后设置
+		if err := os.Chmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			logrus.Warnf("chmod %s error %v", target, err)
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			logrus.Warnf("set xattr %s on %s error %v", attr, target, err)
+		}
+	}
+}
+
+func setModTime(target string, modTime time.Time) {
+	ts := []unix.Timespec{unix.NsecToTimespec(modTime.UnixNano()), unix.NsecToTimespec(modTime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		logrus.Warnf("set mtime of %s error %v", target, err)
+	}
+}
+
+// 将 src 目录打包为 tar 写入 w，保留属主、权限、修改时间、扩展属性、硬链接和设备文件
+// 不记录访问时间和用户名，相同内容的目录生成相同的 tar
+// exclude 中的路径（相对于 src）不打包，用于忽略容器运行时创建的挂载点
+func Pack(w io.Writer, src string, exclude ...string) error {
+	excluded := map[string]bool{}
+	for _, p := range exclude {
+		excluded[strings.TrimPrefix(filepath.Clean("/"+p), "/")] = true
+	}
+	tw := tar.NewWriter(w)
+	// 已经打包的硬链接文件，key 为 inode
+	inodes := map[uint64]string{}
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		if excluded[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.ModTime = info.ModTime().Truncate(time.Second)
+		whiteout := hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0
+		if whiteout {
+			// overlay 的 whiteout 转换为 .wh. 文件
+			hdr.Typeflag, hdr.Mode = tar.TypeReg, hdr.Mode&07777|modeRegular
+			hdr.Name = filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel))
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := inodes[stat.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[stat.Ino] = rel
+			}
+		}
+		if err := readXattrs(p, hdr); err != nil {
+			logrus.Warnf("read xattrs of %s error %v", p, err)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() && isOverlayOpaque(p) {
+			// overlay 的 opaque 目录转换为目录中的 .wh..wh..opq 文件
+			opaque := &tar.Header{
+				Name:     filepath.Join(rel, whiteoutOpaque),
+				Typeflag: tar.TypeReg,
+				Mode:     0644 | modeRegular,
+				ModTime:  hdr.ModTime,
+			}
+			if err := tw.WriteHeader(opaque); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg || whiteout {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// overlay 格式的 whiteout 为 0/0 字符设备
+func isWhiteout(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+func isOverlayOpaque(dir string) bool {
+	value := make([]byte, 1)
+	size, err := unix.Lgetxattr(dir, overlayOpaqueXattr, value)
+	return err == nil && size == 1 && value[0] == 'y'
+}
+
+// 读取文件的扩展属性保存到 PAX 扩展头中，overlay 文件系统内部使用的属性不打包
+func readXattrs(p string, hdr *tar.Header) error {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return err
+	}
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, "trusted.overlay.") {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(p, attr, value); err != nil {
+			return err
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+attr] = string(value[:vsize])
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeTar(t *testing.T, entries []tar.Header, contents map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range entries {
+		hdr := hdr
+		data := contents[hdr.Name]
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	return buf
+}
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(path.Join(src, "bin"), 0755)
+	os.WriteFile(path.Join(src, "bin", "busybox"), []byte("busybox"), 0755)
+	os.Chmod(path.Join(src, "bin", "busybox"), os.ModeSetuid|0755)
+	os.Link(path.Join(src, "bin", "busybox"), path.Join(src, "bin", "sh"))
+	os.Symlink("busybox", path.Join(src, "bin", "ls"))
+
+	buf := &bytes.Buffer{}
+	if err := Pack(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := Unpack(bytes.NewReader(buf.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path.Join(dest, "bin", "busybox"))
+	if err != nil || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("busybox %v %v", fi, err)
+	}
+	if sh, err := os.Stat(path.Join(dest, "bin", "sh")); err != nil || !os.SameFile(fi, sh) {
+		t.Errorf("hardlink not preserved %v", err)
+	}
+	if link, err := os.Readlink(path.Join(dest, "bin", "ls")); err != nil || link != "busybox" {
+		t.Errorf("symlink %s %v", link, err)
+	}
+}
+
+func TestUnpackOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	dest := path.Join(dir, "rootfs")
+	os.MkdirAll(dest, 0755)
+
+	traversal := writeTar(t, []tar.Header{
+		{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"../evil": "evil"})
+	if err := Unpack(traversal, dest); err == nil {
+		t.Errorf("unpack ../evil expect error")
+	}
+
+	// 指向根目录之外的符号链接在 rootfs 内解析
+	escape := writeTar(t, []tar.Header{
+		{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: dir},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		{Name: "lib/shadow", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/passwd": "root", "lib/shadow": "root"})
+	if err := Unpack(escape, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dest, dir, "passwd")); err != nil {
+		t.Errorf("absolute symlink not resolved in rootfs %v", err)
+	}
+	if _, err := os.Stat(path.Join(dest, "shadow")); err != nil {
+		t.Errorf("relative symlink not resolved in rootfs %v", err)
+	}
+	for _, name := range []string{"passwd", "shadow"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			t.Errorf("%s written outside of rootfs", name)
+		}
+	}
+}
+
+func TestUnpackWhiteout(t *testing.T) {
+	dest := t.TempDir()
+	base := writeTar(t, []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/cache/old", Typeflag: tar.TypeReg, Mode: 0644},
+	}, nil)
+	if err := Unpack(base, dest); err != nil {
+		t.Fatal(err)
+	}
+	layer := writeTar(t, []tar.Header{
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg},
+		{Name: "var/cache/new", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg},
+	}, nil)
+	if err := Unpack(layer, dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, exist := range map[string]bool{
+		"etc/hosts":              false,
+		"etc/hostname":           true,
+		"etc/.wh.hosts":          false,
+		"var/cache/old":          false,
+		"var/cache/new":          true,
+		"var/cache/.wh..wh..opq": false,
+	} {
+		if _, err := os.Lstat(path.Join(dest, name)); (err == nil) != exist {
+			t.Errorf("%s exist %v, expect %v", name, err == nil, exist)
+		}
+	}
+	if err := Unpack(writeTar(t, []tar.Header{{Name: ".wh...", Typeflag: tar.TypeReg}}, nil), dest); err == nil {
+		t.Errorf("whiteout of parent directory expect error")
+	}
+}
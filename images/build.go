@@ -0,0 +1,675 @@
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 构建镜像的参数
+type BuildOptions struct {
+	// 构建上下文目录，COPY 和 ADD 的源文件都在该目录中
+	ContextDir string
+	Tags       []string
+	// 不使用构建缓存
+	NoCache bool
+	// 以 img 为镜像在临时容器中执行 RUN 的命令，返回容器读写层目录和删除容器的函数
+	Run func(img *Image, config ImageConfig, cmd []string) (string, func(), error)
+	// 提交 RUN 的读写层时忽略的文件，例如临时容器中挂载的 /etc/hosts
+	RunExclude []string
+}
+
+// 构建文件中的一条指令
+type buildInstruction struct {
+	Line        int
+	Instruction string
+	Args        string
+	// 合并续行后的原始内容，用于构建输出、构建历史和缓存
+	Original string
+}
+
+// 解析构建文件，忽略空行和 # 开头的注释，行尾的 \ 表示续行
+func parseBuildfile(r io.Reader) ([]buildInstruction, error) {
+	var instructions []buildInstruction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var current strings.Builder
+	lineNo, start := 0, 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || (line == "" && current.Len() == 0) {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		fields := strings.SplitN(strings.TrimSpace(current.String()), " ", 2)
+		current.Reset()
+		inst := buildInstruction{Line: start, Instruction: strings.ToUpper(fields[0])}
+		if len(fields) == 2 {
+			inst.Args = strings.TrimSpace(fields[1])
+		}
+		if inst.Args == "" {
+			return nil, fmt.Errorf("line %d: %s requires at least one argument", start, inst.Instruction)
+		}
+		inst.Original = inst.Instruction + " " + inst.Args
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unexpected end of file after line continuation", start)
+	}
+	if len(instructions) == 0 || instructions[0].Instruction != "FROM" {
+		return nil, fmt.Errorf("build file must start with FROM")
+	}
+	return instructions, nil
+}
+
+// 构建过程中的状态，每个步骤生成一个以上一步镜像为父镜像的中间镜像
+type builder struct {
+	opts *BuildOptions
+	// 当前步骤的镜像，FROM scratch 之后没有执行过步骤时为 nil
+	image  *Image
+	config ImageConfig
+	// 是否已经执行过 FROM，不支持多阶段构建
+	fromSet bool
+	// 本次构建中是否设置过 CMD，ENTRYPOINT 在没有设置过 CMD 时清除基础镜像的 CMD
+	cmdSet bool
+	// COPY 和 ADD 在镜像层中创建的目录及其修改时间
+	// 向目录中复制文件会更新目录的修改时间，所有源文件复制完之后再统一设置，相同的输入生成相同的镜像层
+	dirTimes map[string]time.Time
+}
+
+// 按构建文件构建镜像，各步骤的结果按父镜像、指令和输入内容缓存，最后一步的镜像打上 tag
+func Build(buildfile io.Reader, opts *BuildOptions) (*Image, error) {
+	instructions, err := parseBuildfile(buildfile)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return nil, err
+	}
+	b := &builder{opts: opts}
+	for i, inst := range instructions {
+		fmt.Printf("Step %d/%d : %s\n", i+1, len(instructions), inst.Original)
+		if err := b.dispatch(inst); err != nil {
+			return nil, fmt.Errorf("line %d: %s error %v", inst.Line, inst.Instruction, err)
+		}
+		if b.image != nil {
+			fmt.Printf(" ---> %s\n", ShortID(b.image.ID))
+		}
+	}
+	if b.image == nil {
+		return nil, fmt.Errorf("no image was built")
+	}
+	err = withStore(true, func(s *store) error {
+		img, ok := s.Images[b.image.ID]
+		if !ok {
+			return fmt.Errorf("image %s has been removed", ShortID(b.image.ID))
+		}
+		for _, ref := range tags {
+			s.setTag(img, ref)
+		}
+		b.image = img
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Successfully built %s\n", ShortID(b.image.ID))
+	for _, tag := range tags {
+		fmt.Printf("Successfully tagged %s\n", tag)
+	}
+	return b.image, nil
+}
+
+func (b *builder) dispatch(inst buildInstruction) error {
+	switch inst.Instruction {
+	case "FROM":
+		return b.from(inst)
+	case "RUN":
+		return b.run(inst)
+	case "COPY", "ADD":
+		return b.copy(inst)
+	case "ENV", "WORKDIR", "CMD", "ENTRYPOINT", "USER", "LABEL":
+		return b.commitConfig(inst)
+	}
+	return fmt.Errorf("unsupported instruction %s", inst.Instruction)
+}
+
+func (b *builder) from(inst buildInstruction) error {
+	if b.fromSet {
+		return fmt.Errorf("multiple FROM is not supported")
+	}
+	b.fromSet = true
+	fields := strings.Fields(inst.Args)
+	if len(fields) != 1 {
+		return fmt.Errorf("FROM requires exactly one image")
+	}
+	if fields[0] == "scratch" {
+		return nil
+	}
+	img, err := GetImage(fields[0])
+	if err != nil {
+		return fmt.Errorf("%v, pull or load the base image first", err)
+	}
+	b.image, b.config = img, img.Config.Clone()
+	return nil
+}
+
+// ENV、CMD 等只修改镜像配置的指令生成不含新镜像层的镜像
+func (b *builder) commitConfig(inst buildInstruction) error {
+	config := b.config.Clone()
+	if err := config.ApplyChange(inst.Original); err != nil {
+		return err
+	}
+	switch inst.Instruction {
+	case "CMD":
+		b.cmdSet = true
+	case "ENTRYPOINT":
+		if !b.cmdSet {
+			config.Cmd = nil
+		}
+	}
+	return b.commit(inst, "", config, func(opts ImageOptions) (*Image, error) {
+		opts.History[0].EmptyLayer = true
+		return createImage(nil, nil, opts)
+	})
+}
+
+// RUN 在以当前镜像启动的临时容器中执行，容器读写层作为新的镜像层
+func (b *builder) run(inst buildInstruction) error {
+	if b.image == nil || len(b.image.Layers) == 0 {
+		return fmt.Errorf("RUN requires a base image with a shell")
+	}
+	if b.opts.Run == nil {
+		return fmt.Errorf("RUN is not supported")
+	}
+	cmd, err := parseCommand(inst.Args)
+	if err != nil {
+		return err
+	}
+	return b.commit(inst, "", b.config, func(opts ImageOptions) (*Image, error) {
+		diff, cleanup, err := b.opts.Run(b.image, b.config, cmd)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		return CommitImage(diff, opts, b.opts.RunExclude...)
+	})
+}
+
+// COPY 和 ADD 先将文件复制到临时目录中组成镜像层，输入内容的摘要不包括文件的修改时间
+// ADD 还会解压本地的 tar 包，以及下载 http 和 https 地址的文件
+func (b *builder) copy(inst buildInstruction) error {
+	var args []string
+	if strings.HasPrefix(inst.Args, "[") {
+		if err := json.Unmarshal([]byte(inst.Args), &args); err != nil {
+			return fmt.Errorf("invalid arguments %s error %v", inst.Args, err)
+		}
+	} else {
+		args = strings.Fields(inst.Args)
+	}
+	if len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		return fmt.Errorf("option %s is not supported", args[0])
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s requires at least one source and a destination", inst.Instruction)
+	}
+	srcs, dest := args[:len(args)-1], args[len(args)-1]
+	// 目标以 / 结尾、有多个源文件或者是镜像中已有的目录时目标为目录
+	destIsDir := strings.HasSuffix(dest, "/") || dest == "." || strings.HasSuffix(dest, "/.") || len(srcs) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", b.config.WorkingDir, dest)
+	}
+	dest = b.resolve(dest)
+	if info, _ := b.lstat(dest); info != nil && info.IsDir() {
+		destIsDir = true
+	}
+
+	dir, err := TempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+	// 镜像层根目录使用镜像中根目录的修改时间，FROM scratch 时使用固定的时间
+	b.dirTimes = map[string]time.Time{dir: time.Unix(0, 0)}
+	if info, _ := b.lstat("/"); info != nil {
+		b.dirTimes[dir] = info.ModTime()
+	}
+	for _, src := range srcs {
+		if err := b.copySource(inst.Instruction == "ADD", src, dir, dest, destIsDir); err != nil {
+			return err
+		}
+	}
+	for p, modTime := range b.dirTimes {
+		setModTime(p, modTime)
+	}
+	digest, err := contentDigest(dir)
+	if err != nil {
+		return err
+	}
+	return b.commit(inst, digest, b.config, func(opts ImageOptions) (*Image, error) {
+		return CommitImage(dir, opts)
+	})
+}
+
+func (b *builder) copySource(add bool, src, layer, dest string, destIsDir bool) error {
+	if add && (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) {
+		target := dest
+		if destIsDir {
+			u, err := url.Parse(src)
+			if err != nil || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+				return fmt.Errorf("can not determine file name of %s, specify a destination file", src)
+			}
+			target = path.Join(dest, path.Base(u.Path))
+		}
+		return b.download(src, layer, target)
+	}
+	pattern, err := secureJoin(b.opts.ContextDir, src)
+	if err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%s not found in build context", src)
+	}
+	if len(matches) > 1 {
+		destIsDir = true
+	}
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// 复制目录中的内容，而不是目录本身
+			if err := b.mkdirAll(layer, dest); err != nil {
+				return err
+			}
+			if err := b.copyTree(match, layer, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if add && info.Mode().IsRegular() {
+			ok, err := b.extractArchive(match, layer, dest)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+		target := dest
+		if destIsDir {
+			target = path.Join(dest, info.Name())
+		}
+		if err := b.mkdirAll(layer, path.Dir(target)); err != nil {
+			return err
+		}
+		abs, err := layerPath(layer, target)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(match, abs, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 本地的 tar 包（可以是 gzip 压缩的）解压到目标目录，不是 tar 包时返回 false
+func (b *builder) extractArchive(file, layer, dest string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return false, nil
+	}
+	if _, err := tar.NewReader(r).Next(); err != nil {
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := b.mkdirAll(layer, dest); err != nil {
+		return false, err
+	}
+	abs, err := secureJoin(layer, dest)
+	if err != nil {
+		return false, err
+	}
+	return true, Unpack(f, abs)
+}
+
+func (b *builder) download(src, layer, target string) error {
+	if err := b.mkdirAll(layer, path.Dir(target)); err != nil {
+		return err
+	}
+	abs, err := layerPath(layer, target)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Get(src)
+	if err != nil {
+		return fmt.Errorf("download %s error %v", src, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", src, resp.Status)
+	}
+	// 与 docker 相同，下载的文件权限为 600
+	if err := os.RemoveAll(abs); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(abs, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("download %s error %v", src, err)
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		setModTime(abs, modified)
+	}
+	return nil
+}
+
+// 在镜像当前的文件系统中查找文件，从上到下查找各镜像层，遇到 whiteout 时表示文件已被删除
+func (b *builder) lstat(p string) (os.FileInfo, string) {
+	if b.image == nil {
+		return nil, ""
+	}
+	for i := len(b.image.Layers) - 1; i >= 0; i-- {
+		file := filepath.Join(LayerDir(b.image.Layers[i]), p)
+		info, err := os.Lstat(file)
+		if err != nil {
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(file), whiteoutPrefix+filepath.Base(file))); err == nil {
+				return nil, ""
+			}
+			continue
+		}
+		if isWhiteout(info) {
+			return nil, ""
+		}
+		return info, file
+	}
+	return nil, ""
+}
+
+// 按镜像中的符号链接解析路径，例如镜像中 /bin 指向 usr/bin 时，/bin/app 解析为 /usr/bin/app
+func (b *builder) resolve(p string) string {
+	resolved := "/"
+	remaining := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	for links := 0; len(remaining) > 0; {
+		comp := remaining[0]
+		remaining = remaining[1:]
+		if comp == "" {
+			continue
+		}
+		next := path.Join(resolved, comp)
+		info, file := b.lstat(next)
+		if info == nil || info.Mode()&os.ModeSymlink == 0 || links > 255 {
+			resolved = next
+			continue
+		}
+		links++
+		link, err := os.Readlink(file)
+		if err != nil {
+			resolved = next
+			continue
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+	return resolved
+}
+
+// 在镜像层目录中创建 dir 及其上级目录，镜像中已有的目录保留原来的权限、属主和修改时间，其他目录使用固定的修改时间
+// 之前复制的符号链接在镜像层之内解析，不会在镜像层之外创建目录
+func (b *builder) mkdirAll(layer, dir string) error {
+	current := "/"
+	for _, comp := range strings.Split(strings.TrimPrefix(path.Clean(dir), "/"), "/") {
+		if comp == "" {
+			continue
+		}
+		current = path.Join(current, comp)
+		abs, err := secureJoin(layer, current)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(abs); err == nil {
+			continue
+		}
+		info, _ := b.lstat(current)
+		if info == nil || !info.IsDir() {
+			if err := os.Mkdir(abs, 0755); err != nil {
+				return err
+			}
+			b.dirTimes[abs] = time.Unix(0, 0)
+			continue
+		}
+		if err := os.Mkdir(abs, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(abs, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(abs, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+		b.dirTimes[abs] = info.ModTime()
+	}
+	return nil
+}
+
+// 镜像层目录中 p 对应的路径，上级目录中的符号链接在镜像层之内解析，最后一级不解析
+// 之前复制的源文件可能在镜像层中留下指向任意位置的符号链接，直接拼接路径会写到镜像层之外
+func layerPath(layer, p string) (string, error) {
+	parent, err := secureJoin(layer, path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(p)), nil
+}
+
+// 复制目录中的内容到镜像层的 dest 目录，保留权限、修改时间和符号链接，目录的修改时间在所有源文件复制完之后设置
+// 与解压镜像层相同，目标位置已有的文件或符号链接先删除，已有的目录保留并合并
+func (b *builder) copyTree(src, layer, dest string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			// 目标目录已经按镜像中的属性创建
+			return nil
+		}
+		target, err := layerPath(layer, path.Join(dest, filepath.ToSlash(rel)))
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			b.dirTimes[target] = info.ModTime()
+			return nil
+		}
+		return copyFile(p, target, info)
+	})
+}
+
+// 复制文件到 dst，dst 已有的文件、目录或符号链接先删除，以 O_NOFOLLOW 创建文件，不会写到符号链接指向的位置
+func copyFile(src, dst string, info os.FileInfo) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.Mode().IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		setModTime(dst, info.ModTime())
+		return nil
+	}
+	return fmt.Errorf("unsupported file type %s", src)
+}
+
+// 目录内容的摘要，包括文件路径、权限、内容和符号链接，不包括修改时间，用作 COPY 和 ADD 的缓存 key
+func contentDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fh := sha256.New()
+			if _, err := io.Copy(fh, f); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%x\x00", fh.Sum(nil))
+		}
+		return nil
+	})
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), err
+}
+
+// 查找构建缓存，没有命中时调用 create 生成镜像并记录到缓存中
+func (b *builder) commit(inst buildInstruction, inputDigest string, config ImageConfig, create func(ImageOptions) (*Image, error)) error {
+	parent := ""
+	if b.image != nil {
+		parent = b.image.ID
+	}
+	sum := sha256.Sum256([]byte(parent + "\x00" + inst.Original + "\x00" + inputDigest))
+	key := "sha256:" + hex.EncodeToString(sum[:])
+	if !b.opts.NoCache {
+		var cached *Image
+		err := withStore(false, func(s *store) error {
+			cached = s.Images[s.BuildCache[key]]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cached != nil {
+			fmt.Println(" ---> Using cache")
+			b.image, b.config = cached, cached.Config.Clone()
+			return nil
+		}
+	}
+
+	createdBy := "/bin/sh -c #(nop) " + inst.Original
+	if inst.Instruction == "RUN" {
+		createdBy = inst.Args
+		if !strings.HasPrefix(inst.Args, "[") {
+			createdBy = "/bin/sh -c " + inst.Args
+		}
+	}
+	now := time.Now()
+	img, err := create(ImageOptions{
+		Parent:  parent,
+		Config:  config,
+		Created: now,
+		History: []History{{Created: &now, CreatedBy: createdBy}},
+	})
+	if err != nil {
+		return err
+	}
+	err = withStore(true, func(s *store) error {
+		if _, ok := s.Images[img.ID]; ok {
+			s.BuildCache[key] = img.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.image, b.config = img, img.Config.Clone()
+	return nil
+}
@@ -0,0 +1,272 @@
+package images
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBuildfile(t *testing.T) {
+	content := "# comment\nFROM busybox\n\nrun echo a \\\n  && echo b\nCMD [\"sh\"]\n"
+	instructions, err := parseBuildfile(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []buildInstruction{
+		{Line: 2, Instruction: "FROM", Args: "busybox", Original: "FROM busybox"},
+		{Line: 4, Instruction: "RUN", Args: "echo a  && echo b", Original: "RUN echo a  && echo b"},
+		{Line: 6, Instruction: "CMD", Args: `["sh"]`, Original: `CMD ["sh"]`},
+	}
+	if !reflect.DeepEqual(instructions, expected) {
+		t.Errorf("parse build file:\n%+v\nexpect\n%+v", instructions, expected)
+	}
+	for _, content := range []string{"RUN echo\n", "FROM busybox\nRUN echo \\\n", "FROM busybox\nENV\n"} {
+		if _, err := parseBuildfile(strings.NewReader(content)); err == nil {
+			t.Errorf("parse %q should fail", content)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "usr", "bin"), 0755)
+	os.Symlink("usr/bin", path.Join(rootfs, "bin"))
+	os.Mkdir(path.Join(rootfs, "tmp"), 0755)
+	os.Chmod(path.Join(rootfs, "tmp"), 0777|os.ModeSticky)
+	if _, err := CommitImage(rootfs, ImageOptions{Tags: []string{"base"}, Config: ImageConfig{Cmd: []string{"sh"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctxDir := t.TempDir()
+	os.WriteFile(path.Join(ctxDir, "app"), []byte("app v1"), 0755)
+	os.MkdirAll(path.Join(ctxDir, "conf"), 0755)
+	os.WriteFile(path.Join(ctxDir, "conf", "app.conf"), []byte("debug=false"), 0644)
+	os.MkdirAll(path.Join(ctxDir, "conf", "ssl"), 0755)
+	os.WriteFile(path.Join(ctxDir, "conf", "ssl", "cert.pem"), []byte("cert"), 0644)
+	confTime := time.Unix(1600000000, 0)
+	os.Chtimes(path.Join(ctxDir, "conf", "ssl"), confTime, confTime)
+	archive, _ := os.Create(path.Join(ctxDir, "data.tar"))
+	archive.Write(writeTar(t, []tar.Header{{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}, {Name: "data/db", Typeflag: tar.TypeReg, Mode: 0600}},
+		map[string]string{"data/db": "db"}).Bytes())
+	archive.Close()
+	buildfile := `FROM base
+LABEL maintainer="mydocker team" version=1
+ENV APP_HOME=/opt/app MSG="hello world"
+WORKDIR /opt/app
+COPY app /bin/
+COPY conf ./conf
+ADD data.tar /var/lib
+COPY ["app", "/tmp/app"]
+RUN echo built > /opt/app/built
+USER nobody
+ENTRYPOINT ["/bin/app"]
+`
+	runs := 0
+	run := func(img *Image, config ImageConfig, cmd []string) (string, func(), error) {
+		runs++
+		if config.WorkingDir != "/opt/app" || !reflect.DeepEqual(cmd, []string{"/bin/sh", "-c", "echo built > /opt/app/built"}) {
+			t.Errorf("run %v with config %+v", cmd, config)
+		}
+		diff := t.TempDir()
+		os.MkdirAll(path.Join(diff, "opt", "app"), 0755)
+		os.WriteFile(path.Join(diff, "opt", "app", "built"), []byte("built\n"), 0644)
+		return diff, func() {}, nil
+	}
+	opts := &BuildOptions{ContextDir: ctxDir, Tags: []string{"app:v1"}, Run: run}
+	img, err := Build(strings.NewReader(buildfile), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ImageConfig{
+		User:       "nobody",
+		Env:        []string{"APP_HOME=/opt/app", "MSG=hello world"},
+		Entrypoint: []string{"/bin/app"},
+		WorkingDir: "/opt/app",
+		Labels:     map[string]string{"maintainer": "mydocker team", "version": "1"},
+	}
+	if !reflect.DeepEqual(img.Config, expected) {
+		t.Errorf("image config %+v, expect %+v", img.Config, expected)
+	}
+	if len(img.History) != 11 || len(img.Layers) != 6 || !img.History[3].EmptyLayer || img.History[4].CreatedBy != "/bin/sh -c #(nop) COPY app /bin/" {
+		t.Errorf("image history %+v layers %d", img.History, len(img.Layers))
+	}
+
+	dir := flatten(t, img)
+	for file, content := range map[string]string{
+		"usr/bin/app":           "app v1",
+		"opt/app/conf/app.conf": "debug=false",
+		"var/lib/data/db":       "db",
+		"tmp/app":               "app v1",
+		"opt/app/built":         "built\n",
+	} {
+		if data, err := os.ReadFile(path.Join(dir, file)); err != nil || string(data) != content {
+			t.Errorf("%s: %q %v", file, data, err)
+		}
+	}
+	// 复制的目录保留源目录的修改时间，相同的输入生成相同的镜像层
+	if info, err := os.Stat(path.Join(dir, "opt/app/conf/ssl")); err != nil || !info.ModTime().Equal(confTime) {
+		t.Errorf("copied dir mtime %v %v, expect %v", info.ModTime(), err, confTime)
+	}
+	if link, err := os.Readlink(path.Join(dir, "bin")); err != nil || link != "usr/bin" {
+		t.Errorf("/bin should still be a symlink: %q %v", link, err)
+	}
+	if info, err := os.Stat(path.Join(dir, "tmp")); err != nil || info.Mode()&os.ModeSticky == 0 {
+		t.Errorf("/tmp lost sticky bit: %v %v", info.Mode(), err)
+	}
+
+	// 输入不变时所有步骤使用缓存
+	cached, err := Build(strings.NewReader(buildfile), opts)
+	if err != nil || cached.ID != img.ID || runs != 1 {
+		t.Errorf("cached build %v %v, runs %d", cached, err, runs)
+	}
+	// 修改 COPY 的文件后，从该步骤开始重新构建
+	os.WriteFile(path.Join(ctxDir, "app"), []byte("app v2"), 0755)
+	rebuilt, err := Build(strings.NewReader(buildfile), opts)
+	if err != nil || rebuilt.ID == img.ID || runs != 2 {
+		t.Fatalf("rebuild %v %v, runs %d", rebuilt, err, runs)
+	}
+	if data, _ := os.ReadFile(path.Join(flatten(t, rebuilt), "usr/bin/app")); string(data) != "app v2" {
+		t.Errorf("rebuilt app %q", data)
+	}
+
+	// 删除镜像时同时删除中间镜像，共用的基础镜像保留
+	if err := RemoveImage(img.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveImage("app:v1", false); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := Images()
+	if len(list) != 1 || list[0].Tags[0] != "base:latest" {
+		t.Errorf("images after rmi: %d", len(list))
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Error(err)
+	}
+
+	for _, content := range []string{"FROM base\nCOPY ../etc/passwd /\n", "FROM base\nEXPOSE 80\n", "FROM missing\n", "FROM scratch\nRUN true\n"} {
+		if _, err := Build(strings.NewReader(content), opts); err == nil {
+			t.Errorf("build %q should fail", content)
+		}
+	}
+}
+
+// 之前复制的符号链接指向镜像层之外时，后面的源文件不能通过它写到宿主机上
+func TestBuildCopySymlinkEscape(t *testing.T) {
+	setupStore(t)
+	if _, err := CommitImage(t.TempDir(), ImageOptions{Tags: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	os.Chmod(outside, 0700)
+	ctxDir := t.TempDir()
+	os.MkdirAll(path.Join(ctxDir, "a"), 0755)
+	os.Symlink(outside, path.Join(ctxDir, "a", "x"))
+	os.MkdirAll(path.Join(ctxDir, "b", "x"), 0755)
+	os.WriteFile(path.Join(ctxDir, "b", "x", "pwned"), []byte("pwned"), 0644)
+
+	img, err := Build(strings.NewReader("FROM base\nCOPY a b /dst/\n"), &BuildOptions{ContextDir: ctxDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the layer: %v", err)
+	}
+	if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("outside dir changed: %v %v", info.Mode(), err)
+	}
+	if data, err := os.ReadFile(path.Join(flatten(t, img), "dst", "x", "pwned")); err != nil || string(data) != "pwned" {
+		t.Errorf("dst/x/pwned: %q %v", data, err)
+	}
+}
+
+// RUN 的临时容器中 /etc 下的挂载点不提交到镜像层，镜像中原来的软链接保持不变
+func TestBuildRunExclude(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	os.Symlink("../run/resolv.conf", path.Join(rootfs, "etc", "resolv.conf"))
+	if _, err := CommitImage(rootfs, ImageOptions{Tags: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	run := func(img *Image, config ImageConfig, cmd []string) (string, func(), error) {
+		diff := t.TempDir()
+		os.MkdirAll(path.Join(diff, "etc"), 0755)
+		for _, name := range []string{"hosts", "hostname", "resolv.conf"} {
+			os.WriteFile(path.Join(diff, "etc", name), nil, 0644)
+		}
+		os.WriteFile(path.Join(diff, "etc", "app.conf"), []byte("conf"), 0644)
+		return diff, func() {}, nil
+	}
+	opts := &BuildOptions{ContextDir: t.TempDir(), Run: run, RunExclude: []string{"etc/hosts", "etc/hostname", "/etc/resolv.conf"}}
+	img, err := Build(strings.NewReader("FROM base\nRUN true\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := flatten(t, img)
+	if link, err := os.Readlink(path.Join(dir, "etc", "resolv.conf")); err != nil || link != "../run/resolv.conf" {
+		t.Errorf("resolv.conf: %q %v", link, err)
+	}
+	for _, name := range []string{"hosts", "hostname"} {
+		if _, err := os.Lstat(path.Join(dir, "etc", name)); !os.IsNotExist(err) {
+			t.Errorf("mount point %s committed: %v", name, err)
+		}
+	}
+	if data, err := os.ReadFile(path.Join(dir, "etc", "app.conf")); err != nil || string(data) != "conf" {
+		t.Errorf("etc/app.conf: %q %v", data, err)
+	}
+}
+
+// 通配符匹配到多个 tar 包时每个都要解压
+func TestBuildAddArchives(t *testing.T) {
+	setupStore(t)
+	if _, err := CommitImage(t.TempDir(), ImageOptions{Tags: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxDir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		os.WriteFile(path.Join(ctxDir, name+".tar"), writeTar(t, []tar.Header{{Name: name, Typeflag: tar.TypeReg, Mode: 0644}},
+			map[string]string{name: name}).Bytes(), 0644)
+	}
+
+	img, err := Build(strings.NewReader("FROM base\nADD *.tar /dst/\n"), &BuildOptions{ContextDir: ctxDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := flatten(t, img)
+	for _, name := range []string{"a", "b"} {
+		if data, err := os.ReadFile(path.Join(dir, "dst", name)); err != nil || string(data) != name {
+			t.Errorf("dst/%s: %q %v", name, data, err)
+		}
+	}
+}
+
+// 不使用缓存重新构建时，COPY 生成的镜像层与之前相同
+func TestBuildReproducible(t *testing.T) {
+	setupStore(t)
+	if _, err := CommitImage(t.TempDir(), ImageOptions{Tags: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxDir := t.TempDir()
+	os.MkdirAll(path.Join(ctxDir, "conf", "ssl"), 0755)
+	os.WriteFile(path.Join(ctxDir, "conf", "ssl", "cert.pem"), []byte("cert"), 0644)
+	os.WriteFile(path.Join(ctxDir, "app"), []byte("app"), 0755)
+	var layers []string
+	for i := 0; i < 2; i++ {
+		img, err := Build(strings.NewReader("FROM base\nCOPY conf /etc/app/\nCOPY app /opt/bin/\n"), &BuildOptions{ContextDir: ctxDir, NoCache: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, strings.Join(img.Layers, ","))
+		// tar 中的修改时间精确到秒
+		time.Sleep(time.Second)
+	}
+	if layers[0] != layers[1] {
+		t.Errorf("layers of identical builds differ:\n%s\n%s", layers[0], layers[1])
+	}
+}
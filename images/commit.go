@@ -0,0 +1,10 @@
+package images
+
+// 将容器的读写层 diff 目录提交为新镜像，读写层作为父镜像之上的新镜像层
+// 读写层中 aufs 或者 overlay 格式的 whiteout 在新镜像层中删除父镜像中对应的文件
+// exclude 为不提交的文件，例如容器中 /etc/hosts 等挂载点在读写层中留下的空文件
+func CommitImage(diff string, opts ImageOptions, exclude ...string) (*Image, error) {
+	r := packReader(diff, exclude...)
+	defer r.Close()
+	return CreateImage(r, opts)
+}
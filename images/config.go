@@ -0,0 +1,186 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// 镜像的运行配置，字段名与 OCI 镜像配置相同
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+	// 镜像的标签，例如 maintainer=someone
+	Labels map[string]string `json:"Labels,omitempty"`
+}
+
+// 复制镜像配置，修改副本不影响原来的镜像
+func (c ImageConfig) Clone() ImageConfig {
+	c.Env = append([]string(nil), c.Env...)
+	c.Entrypoint = append([]string(nil), c.Entrypoint...)
+	c.Cmd = append([]string(nil), c.Cmd...)
+	if c.Labels != nil {
+		labels := make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		c.Labels = labels
+	}
+	return c
+}
+
+// 设置环境变量，已有同名变量时覆盖
+func (c *ImageConfig) SetEnv(envs ...string) {
+	for _, env := range envs {
+		key := strings.SplitN(env, "=", 2)[0]
+		replaced := false
+		for i, old := range c.Env {
+			if strings.SplitN(old, "=", 2)[0] == key {
+				c.Env[i] = env
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Env = append(c.Env, env)
+		}
+	}
+}
+
+// 按 Dockerfile 指令修改镜像配置，支持 CMD、ENTRYPOINT、ENV、WORKDIR、USER 和 LABEL，例如 CMD ["sh"]、ENV PATH=/bin
+func (c *ImageConfig) ApplyChange(change string) error {
+	fields := strings.SplitN(strings.TrimSpace(change), " ", 2)
+	instruction := strings.ToUpper(fields[0])
+	args := ""
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	if args == "" {
+		return fmt.Errorf("%s requires at least one argument", instruction)
+	}
+	switch instruction {
+	case "CMD":
+		cmd, err := parseCommand(args)
+		if err != nil {
+			return err
+		}
+		c.Cmd = cmd
+	case "ENV":
+		envs, err := parseEnv(args)
+		if err != nil {
+			return err
+		}
+		c.SetEnv(envs...)
+	case "ENTRYPOINT":
+		entrypoint, err := parseCommand(args)
+		if err != nil {
+			return err
+		}
+		c.Entrypoint = entrypoint
+	case "WORKDIR":
+		// 相对路径相对于之前的工作目录
+		if !path.IsAbs(args) {
+			args = path.Join("/", c.WorkingDir, args)
+		}
+		c.WorkingDir = path.Clean(args)
+	case "USER":
+		c.User = args
+	case "LABEL":
+		labels, err := parseEnv(args)
+		if err != nil {
+			return err
+		}
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		for _, label := range labels {
+			k, v, _ := strings.Cut(label, "=")
+			c.Labels[k] = v
+		}
+	default:
+		return fmt.Errorf("unsupported change instruction %s", instruction)
+	}
+	return nil
+}
+
+// JSON 数组格式直接作为命令参数，否则使用 /bin/sh -c 执行
+func parseCommand(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err != nil {
+			return nil, fmt.Errorf("invalid command %s error %v", args, err)
+		}
+		return cmd, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// ENV key=value [key=value...] 或者 ENV key value，值可以用引号包含空格，例如 ENV MSG="hello world"
+func parseEnv(args string) ([]string, error) {
+	if !strings.Contains(strings.Fields(args)[0], "=") {
+		fields := strings.SplitN(args, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ENV %s requires a value", args)
+		}
+		return []string{fields[0] + "=" + strings.TrimSpace(fields[1])}, nil
+	}
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	var envs []string
+	for _, env := range words {
+		if !strings.Contains(env, "=") || strings.HasPrefix(env, "=") {
+			return nil, fmt.Errorf("invalid environment %s", env)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// 按空白分割参数，支持单引号、双引号和反斜杠转义
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,199 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// 两个镜像之间的文件变化，Kind 为 A（新增）、C（修改）或者 D（删除）
+type FileChange struct {
+	Kind byte
+	Path string
+}
+
+// 镜像叠加后根文件系统中的一个文件，File 为该文件所在镜像层中的路径
+type mergedFile struct {
+	Info os.FileInfo
+	File string
+}
+
+// 打印从镜像 a 到镜像 b 新增、修改和删除的文件
+func DiffImages(a, b string) error {
+	changes, err := diffImages(a, b)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Printf("%c %s\n", c.Kind, c.Path)
+	}
+	return nil
+}
+
+func diffImages(a, b string) ([]FileChange, error) {
+	from, err := mergeImage(a)
+	if err != nil {
+		return nil, err
+	}
+	to, err := mergeImage(b)
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for p, f := range to {
+		old, ok := from[p]
+		if !ok {
+			changes = append(changes, FileChange{Kind: 'A', Path: p})
+			continue
+		}
+		changed, err := fileChanged(old, f)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			changes = append(changes, FileChange{Kind: 'C', Path: p})
+		}
+	}
+	for p := range from {
+		if _, ok := to[p]; !ok {
+			changes = append(changes, FileChange{Kind: 'D', Path: p})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// 从下到上叠加镜像的各层，得到根文件系统中所有文件，key 为以 / 开头的路径
+// whiteout 删除下层中的文件和目录，opaque 目录删除下层中该目录的内容，两种存储驱动的格式都支持
+func mergeImage(ref string) (map[string]mergedFile, error) {
+	img, err := GetImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]mergedFile{}
+	removeTree := func(p string, self bool) {
+		if self {
+			delete(files, p)
+		}
+		prefix := strings.TrimSuffix(p, "/") + "/"
+		for name := range files {
+			if strings.HasPrefix(name, prefix) {
+				delete(files, name)
+			}
+		}
+	}
+	for _, digest := range img.Layers {
+		root := LayerDir(digest)
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				if isOpaqueDir(file) {
+					removeTree("/", false)
+				}
+				return nil
+			}
+			p := "/" + filepath.ToSlash(rel)
+			name := info.Name()
+			switch {
+			case name == whiteoutOpaque:
+				// 访问目录时已经处理
+				return nil
+			case strings.HasPrefix(name, aufsMetaPrefix):
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			case strings.HasPrefix(name, whiteoutPrefix):
+				removeTree(filepath.Join(filepath.Dir(p), strings.TrimPrefix(name, whiteoutPrefix)), true)
+				return nil
+			case isWhiteout(info):
+				removeTree(p, true)
+				return nil
+			}
+			if info.IsDir() {
+				// 在访问目录中的文件之前删除下层的内容，aufs 格式的标记文件可能排在同一层的其他文件之后
+				if isOpaqueDir(file) {
+					removeTree(p, false)
+				}
+			} else {
+				// 下层中的同名目录被文件代替
+				removeTree(p, false)
+			}
+			files[p] = mergedFile{Info: info, File: file}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk layer %s error %v", digest, err)
+		}
+	}
+	return files, nil
+}
+
+// overlay 格式的 opaque 目录有扩展属性，aufs 格式的目录中有 .wh..wh..opq 标记文件
+func isOpaqueDir(dir string) bool {
+	if isOverlayOpaque(dir) {
+		return true
+	}
+	_, err := os.Lstat(filepath.Join(dir, whiteoutOpaque))
+	return err == nil
+}
+
+// 比较文件类型、权限、属主、符号链接和文件内容，不比较修改时间
+func fileChanged(a, b mergedFile) (bool, error) {
+	if a.File == b.File {
+		return false, nil
+	}
+	if a.Info.Mode() != b.Info.Mode() {
+		return true, nil
+	}
+	sa, oka := a.Info.Sys().(*syscall.Stat_t)
+	sb, okb := b.Info.Sys().(*syscall.Stat_t)
+	if oka && okb && (sa.Uid != sb.Uid || sa.Gid != sb.Gid || sa.Rdev != sb.Rdev) {
+		return true, nil
+	}
+	switch {
+	case a.Info.Mode()&os.ModeSymlink != 0:
+		la, err := os.Readlink(a.File)
+		if err != nil {
+			return false, err
+		}
+		lb, err := os.Readlink(b.File)
+		return la != lb, err
+	case a.Info.Mode().IsRegular():
+		if a.Info.Size() != b.Info.Size() {
+			return true, nil
+		}
+		ha, err := fileDigest(a.File)
+		if err != nil {
+			return false, err
+		}
+		hb, err := fileDigest(b.File)
+		return !bytes.Equal(ha, hb), err
+	}
+	return false, nil
+}
+
+func fileDigest(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
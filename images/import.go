@@ -0,0 +1,14 @@
+package images
+
+import (
+	"io"
+)
+
+// 将根文件系统的 tar 包导入为只有一层的镜像，tag 为空时导入的镜像没有 tag
+func ImportImage(r io.Reader, tag string) (*Image, error) {
+	var tags []string
+	if tag != "" {
+		tags = append(tags, tag)
+	}
+	return CreateImage(r, ImageOptions{Tags: tags})
+}
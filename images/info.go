@@ -2,8 +2,11 @@ package images
 
 import "os"
 
-var(
+var (
 	ImagesStoreDir = "/var/lib/mydocker/images"
+	// 容器信息目录，与 container.DefaultInfoLocation 相同，用于检查镜像是否被容器使用
+	// container 包引用了 images 包，这里不能反过来引用 container 包
+	containerInfoDir = "/var/run/mydocker"
 )
 
 func init(){
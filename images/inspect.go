@@ -0,0 +1,156 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"mydocker/util"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// image history 中 CREATED BY 默认显示的最大长度
+const createdByWidth = 45
+
+// 构建历史中的一条记录和对应的镜像层，不产生镜像层的记录 Layer 为 nil
+type historyEntry struct {
+	History
+	Layer *Layer
+}
+
+// 按镜像层对应构建历史，旧版本创建的镜像没有完整的构建历史，每层生成一条
+func imageHistory(s *store, img *Image) []historyEntry {
+	history := imageConfig(img).History
+	var entries []historyEntry
+	i := 0
+	for _, h := range history {
+		entry := historyEntry{History: h}
+		if !h.EmptyLayer && i < len(img.Layers) {
+			digest := img.Layers[i]
+			i++
+			entry.Layer = s.Layers[digest]
+			if entry.Layer == nil {
+				entry.Layer = &Layer{Digest: digest}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// 从新到旧列出镜像的构建历史，包括每层的摘要、大小和创建该层的指令
+func ImageHistory(ref string, noTrunc bool) error {
+	var entries []historyEntry
+	err := withStore(false, func(s *store) error {
+		img, _, err := s.lookup(ref)
+		if err != nil {
+			return err
+		}
+		entries = imageHistory(s, img)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		layer, size := "<empty>", int64(0)
+		if e.Layer != nil {
+			layer, size = ShortID(e.Layer.Digest), e.Layer.Size
+			if noTrunc {
+				layer = e.Layer.Digest
+			}
+		}
+		created := ""
+		if e.Created != nil {
+			created = e.Created.Format(util.TIMESTAP)
+		}
+		createdBy := strings.ReplaceAll(e.CreatedBy, "\t", " ")
+		if !noTrunc {
+			createdBy = truncateText(createdBy, createdByWidth)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", layer, created, createdBy, util.HumanSize(size), e.Comment)
+	}
+	return w.Flush()
+}
+
+// 超过 width 个字符时截断并以 ... 结尾，按字符而不是字节截断，不会拆开多字节的 UTF-8 字符
+func truncateText(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+// image inspect 输出的镜像信息，Config 和 Manifest 与 save 和 push 生成的内容相同
+type imageInspect struct {
+	ID       string         `json:"Id"`
+	RepoTags []string       `json:"RepoTags"`
+	Parent   string         `json:"Parent"`
+	Created  time.Time      `json:"Created"`
+	Author   string         `json:"Author"`
+	Comment  string         `json:"Comment"`
+	Size     int64          `json:"Size"`
+	Config   ociImageConfig `json:"Config"`
+	Manifest ociManifest    `json:"Manifest"`
+}
+
+// 以 JSON 格式打印镜像的元数据、完整的 OCI 镜像配置和 manifest
+// manifest 中镜像层的大小为打包后 tar 包的大小，需要重新打包各层计算
+func InspectImages(refs []string) error {
+	var list []*imageInspect
+	for _, ref := range refs {
+		img, err := GetImage(ref)
+		if err != nil {
+			return err
+		}
+		detail := &imageInspect{
+			ID:       "sha256:" + img.ID,
+			RepoTags: img.Tags,
+			Created:  img.Created,
+			Author:   img.Author,
+			Comment:  img.Comment,
+			Size:     img.Size,
+			Config:   imageConfig(img),
+			Manifest: ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest},
+		}
+		if detail.RepoTags == nil {
+			detail.RepoTags = []string{}
+		}
+		if img.Parent != "" {
+			detail.Parent = "sha256:" + img.Parent
+		}
+		for _, digest := range img.Layers {
+			counter := &countingWriter{}
+			if err := Pack(counter, LayerDir(digest)); err != nil {
+				return fmt.Errorf("pack layer %s error %v", digest, err)
+			}
+			detail.Manifest.Layers = append(detail.Manifest.Layers, descriptor{MediaType: mediaTypeOCILayer, Digest: digest, Size: counter.n})
+		}
+		config, err := json.Marshal(detail.Config)
+		if err != nil {
+			return err
+		}
+		detail.Manifest.Config = descriptor{MediaType: mediaTypeOCIConfig, Digest: sha256Digest(config), Size: int64(len(config))}
+		list = append(list, detail)
+	}
+	out, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,90 @@
+package images
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestImageDiffAndHistory(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	os.MkdirAll(path.Join(rootfs, "data", "old"), 0755)
+	os.WriteFile(path.Join(rootfs, "etc", "hosts"), []byte("hosts"), 0644)
+	os.WriteFile(path.Join(rootfs, "etc", "passwd"), []byte("root"), 0644)
+	os.WriteFile(path.Join(rootfs, "etc", "group"), []byte("root"), 0644)
+	os.WriteFile(path.Join(rootfs, "data", "old", "a"), []byte("a"), 0644)
+	base, err := CommitImage(rootfs, ImageOptions{Tags: []string{"base"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除 hosts，修改 passwd 的内容和 group 的权限，清空 data 目录后新增 .profile 和 b，新增 app
+	// .profile 排在 opaque 标记文件之前，不能被 opaque 标记删除
+	diff := t.TempDir()
+	os.MkdirAll(path.Join(diff, "etc"), 0755)
+	os.MkdirAll(path.Join(diff, "data"), 0755)
+	os.WriteFile(path.Join(diff, "etc", ".wh.hosts"), nil, 0444)
+	os.WriteFile(path.Join(diff, "etc", "passwd"), []byte("app!"), 0644)
+	os.WriteFile(path.Join(diff, "etc", "group"), []byte("root"), 0600)
+	os.WriteFile(path.Join(diff, "data", ".wh..wh..opq"), nil, 0444)
+	os.WriteFile(path.Join(diff, "data", "b"), []byte("b"), 0644)
+	os.WriteFile(path.Join(diff, "data", ".profile"), []byte("profile"), 0644)
+	os.WriteFile(path.Join(diff, "app"), []byte("app"), 0755)
+	created := time.Now()
+	app, err := CommitImage(diff, ImageOptions{Parent: base.ID, Tags: []string{"app"}, History: []History{{Created: &created, CreatedBy: "COPY app /", Comment: "add app"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FileChange{
+		{'A', "/app"}, {'A', "/data/.profile"}, {'A', "/data/b"}, {'D', "/data/old"}, {'D', "/data/old/a"},
+		{'C', "/etc/group"}, {'D', "/etc/hosts"}, {'C', "/etc/passwd"},
+	}
+	changes, err := diffImages("base", "app")
+	if err != nil || !reflect.DeepEqual(changes, expected) {
+		t.Errorf("diff base app:\n%v %v\nexpect\n%v", changes, err, expected)
+	}
+	// 转换为 aufs 格式：opaque 目录用 .wh..wh..opq 文件标记
+	dataDir := path.Join(LayerDir(app.Layers[1]), "data")
+	unix.Lremovexattr(dataDir, overlayOpaqueXattr)
+	os.WriteFile(path.Join(dataDir, whiteoutOpaque), nil, 0444)
+	changes, err = diffImages("base", "app")
+	if err != nil || !reflect.DeepEqual(changes, expected) {
+		t.Errorf("diff base app with aufs opaque marker:\n%v %v\nexpect\n%v", changes, err, expected)
+	}
+	if changes, err := diffImages("app", "app"); err != nil || len(changes) != 0 {
+		t.Errorf("diff same image: %v %v", changes, err)
+	}
+
+	var entries []historyEntry
+	withStore(false, func(s *store) error {
+		entries = imageHistory(s, app)
+		return nil
+	})
+	if len(entries) != 2 || entries[0].Layer.Digest != base.Layers[0] || entries[1].Layer.Digest != app.Layers[1] ||
+		entries[1].CreatedBy != "COPY app /" || entries[1].Comment != "add app" || entries[1].Layer.Size == 0 {
+		t.Errorf("image history %+v", entries)
+	}
+	if err := InspectImages([]string{"app", "base"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	for _, c := range []struct{ s, want string }{
+		{"COPY app /", "COPY app /"},
+		{"RUN echo 你好世界你好世界", "RUN echo 你好..."},
+		{"RUN echo 你好世", "RUN echo 你好世"},
+	} {
+		if got := truncateText(c.s, 14); got != c.want || !utf8.ValidString(got) {
+			t.Errorf("truncateText(%q) = %q, want %q", c.s, got, c.want)
+		}
+	}
+}
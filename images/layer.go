@@ -0,0 +1,188 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// 镜像层目录 layers/{摘要}，目录内容为解压后的镜像层
+	layersDir = "layers"
+	// 镜像层的短链接目录 layers/l/{摘要前 12 位}，指向 ../{摘要}
+	// 挂载时在 layers 目录中使用相对路径 l/{短链接}，避免镜像层较多时挂载选项超过一页的长度限制
+	layerLinkDir = "l"
+	layerLinkLen = 12
+
+	// 存储驱动，决定镜像层中 whiteout 的格式和容器根文件系统的挂载方式
+	DriverAUFS    = "aufs"
+	DriverOverlay = "overlay"
+)
+
+// 镜像层，多个镜像共用同一个镜像层
+type Layer struct {
+	// 镜像层打包成 tar 后的 sha256 摘要，格式为 sha256:{hex}
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	// 引用该层的镜像个数，为 0 时删除
+	References int `json:"references"`
+}
+
+// 镜像层的目录
+func LayerDir(digest string) string {
+	return path.Join(ImagesStoreDir, layersDir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+// 镜像层所在的目录，LayerLinks 返回的路径相对于该目录
+func LayersDir() string {
+	return path.Join(ImagesStoreDir, layersDir)
+}
+
+// 镜像层相对于 layers 目录的短链接，不存在时创建
+// 短链接已经指向其他镜像层时（摘要前缀相同）直接使用完整的目录名
+func layerLink(digest string) (string, error) {
+	id := strings.TrimPrefix(digest, "sha256:")
+	rel := path.Join(layerLinkDir, id[:layerLinkLen])
+	link, target := path.Join(LayersDir(), rel), path.Join("..", id)
+	if err := os.MkdirAll(path.Dir(link), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Symlink(target, link); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("create link of layer %s error %v", digest, err)
+	}
+	if existing, err := os.Readlink(link); err != nil || existing != target {
+		return id, nil
+	}
+	return rel, nil
+}
+
+// 删除镜像层时一起删除指向它的短链接
+func removeLayerLink(digest string) {
+	id := strings.TrimPrefix(digest, "sha256:")
+	link := path.Join(LayersDir(), layerLinkDir, id[:layerLinkLen])
+	if existing, err := os.Readlink(link); err == nil && existing == path.Join("..", id) {
+		os.Remove(link)
+	}
+}
+
+// 内核支持 overlay 时使用 overlay，否则使用 aufs
+func StorageDriver() string {
+	content, err := os.ReadFile("/proc/filesystems")
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[len(fields)-1] == DriverOverlay {
+				return DriverOverlay
+			}
+		}
+	}
+	return DriverAUFS
+}
+
+func layerWhiteoutMode() whiteoutMode {
+	if StorageDriver() == DriverOverlay {
+		return whiteoutOverlay
+	}
+	return whiteoutAUFS
+}
+
+// 将 tar 格式的镜像层解压到临时目录，whiteout 转换为存储驱动的格式，返回临时目录和镜像层摘要
+// 摘要根据解压后的目录重新打包计算，verify 时对镜像层目录做同样的计算
+func unpackLayer(r io.Reader) (dir string, digest string, err error) {
+	dir, err = TempDir()
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	if err := unpack(r, dir, layerWhiteoutMode()); err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("unpack layer error %v", err)
+	}
+	digest, err = layerDigest(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, digest, nil
+}
+
+func layerDigest(dir string) (string, error) {
+	h := sha256.New()
+	if err := Pack(h, dir); err != nil {
+		return "", fmt.Errorf("pack layer %s error %v", dir, err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 将解压好的镜像层目录登记到仓库中，已经存在相同摘要的镜像层时删除 dir 直接共用
+func (s *store) addLayer(dir, digest string) (*Layer, error) {
+	if layer, ok := s.Layers[digest]; ok {
+		os.RemoveAll(dir)
+		return layer, nil
+	}
+	if err := os.MkdirAll(path.Join(ImagesStoreDir, layersDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dir, LayerDir(digest)); err != nil {
+		return nil, fmt.Errorf("move layer %s to image store error %v", digest, err)
+	}
+	size, _ := DirSize(LayerDir(digest))
+	layer := &Layer{Digest: digest, Size: size}
+	s.Layers[digest] = layer
+	return layer, nil
+}
+
+// 减少镜像的各层的引用计数，删除不再被引用的镜像层
+func (s *store) releaseLayers(img *Image) error {
+	for _, digest := range img.Layers {
+		layer, ok := s.Layers[digest]
+		if !ok {
+			continue
+		}
+		if layer.References--; layer.References > 0 {
+			continue
+		}
+		removeLayerLink(digest)
+		if err := os.RemoveAll(LayerDir(digest)); err != nil {
+			return fmt.Errorf("remove layer %s error %v", digest, err)
+		}
+		delete(s.Layers, digest)
+	}
+	return nil
+}
+
+// 以 tar 格式打包 src 目录并通过管道读取，读取方关闭时结束打包
+func packReader(src string, exclude ...string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Pack(pw, src, exclude...))
+	}()
+	return pr
+}
+
+// 镜像各层的短链接，按从下到上的顺序，作为容器根文件系统的只读层，路径相对于 LayersDir()
+func LayerLinks(ref string) ([]string, error) {
+	img, err := GetImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	for _, digest := range img.Layers {
+		if _, err := os.Stat(LayerDir(digest)); err != nil {
+			return nil, fmt.Errorf("layer %s of image %s not found", digest, ShortID(img.ID))
+		}
+		link, err := layerLink(digest)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
@@ -0,0 +1,39 @@
+package images
+
+import (
+	"fmt"
+	"mydocker/util"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// 列出所有镜像，有多个 tag 的镜像每个 tag 一行，没有 tag 的镜像显示为 <none>，all 为 false 时不显示 build 生成的中间镜像
+func ListImages(all bool) error {
+	list, err := Images()
+	if err != nil {
+		return err
+	}
+	parents := map[string]bool{}
+	for _, img := range list {
+		parents[img.Parent] = true
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+	for _, img := range list {
+		tags := img.Tags
+		if len(tags) == 0 && parents[img.ID] && !all {
+			// 没有 tag 的父镜像是 build 生成的中间镜像，-a 时才显示
+			continue
+		}
+		if len(tags) == 0 {
+			tags = []string{"<none>:<none>"}
+		}
+		for _, tag := range tags {
+			i := strings.LastIndex(tag, ":")
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", tag[:i], tag[i+1:], ShortID(img.ID),
+				img.Created.Format(util.TIMESTAP), util.HumanSize(img.Size))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,267 @@
+package images
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 从 docker save 生成的 tar 包或者 OCI 镜像布局的 tar 包中加载镜像
+// 两种格式都存在时（docker 25 之后的 docker save）使用 manifest.json
+func LoadImages(r io.Reader) ([]*Image, error) {
+	dir, err := TempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// 镜像层的 tar 包原样解压，加载镜像层时再处理其中的 whiteout
+	if err := unpack(r, dir, whiteoutAUFS); err != nil {
+		return nil, fmt.Errorf("unpack image archive error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dockerManifestFile)); err == nil {
+		return loadDockerArchive(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ociIndexFile)); err == nil {
+		return loadOCILayout(dir)
+	}
+	return nil, fmt.Errorf("invalid image archive: neither %s nor %s found", dockerManifestFile, ociIndexFile)
+}
+
+func loadDockerArchive(dir string) ([]*Image, error) {
+	var manifests []dockerManifest
+	if err := readJSON(dir, dockerManifestFile, &manifests); err != nil {
+		return nil, err
+	}
+	var loaded []*Image
+	for _, m := range manifests {
+		img, err := loadImage(dir, m.Config, m.Layers, m.RepoTags)
+		if err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, img)
+	}
+	return loaded, nil
+}
+
+func loadOCILayout(dir string) ([]*Image, error) {
+	var index ociIndex
+	if err := readJSON(dir, ociIndexFile, &index); err != nil {
+		return nil, err
+	}
+	var loaded []*Image
+	for _, desc := range index.Manifests {
+		var tags []string
+		if name := desc.Annotations[annotationImageName]; name != "" {
+			tags = append(tags, name)
+		} else if name := desc.Annotations[annotationRefName]; strings.ContainsAny(name, ":/") {
+			// OCI 规范的 ref.name 可以只有 tag，只有 tag 时无法得到镜像名
+			tags = append(tags, name)
+		}
+		manifest, err := readOCIManifest(dir, desc)
+		if err != nil {
+			return loaded, err
+		}
+		var layers []string
+		for _, layer := range manifest.Layers {
+			if err := verifyBlob(dir, layer); err != nil {
+				return loaded, err
+			}
+			layers = append(layers, blobPath(layer.Digest))
+		}
+		if err := verifyBlob(dir, manifest.Config); err != nil {
+			return loaded, err
+		}
+		img, err := loadImage(dir, blobPath(manifest.Config.Digest), layers, tags)
+		if err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, img)
+	}
+	return loaded, nil
+}
+
+// 读取镜像的 manifest，desc 指向 manifest list 时选择当前平台的镜像
+func readOCIManifest(dir string, desc descriptor) (*ociManifest, error) {
+	for isIndex(desc.MediaType) {
+		if err := verifyBlob(dir, desc); err != nil {
+			return nil, err
+		}
+		var index ociIndex
+		if err := readJSON(dir, blobPath(desc.Digest), &index); err != nil {
+			return nil, err
+		}
+		selected, err := selectManifest(&index, hostPlatform())
+		if err != nil {
+			return nil, err
+		}
+		desc = selected
+	}
+	if err := verifyBlob(dir, desc); err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := readJSON(dir, blobPath(desc.Digest), &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// 按镜像配置加载镜像，layers 为镜像层 tar 包（可以是 gzip 压缩的）在 dir 中的路径
+func loadImage(dir, configPath string, layers, tags []string) (*Image, error) {
+	var config ociImageConfig
+	if err := readJSON(dir, configPath, &config); err != nil {
+		return nil, err
+	}
+	normalized, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	img, err := createImageFromConfig(dir, &config, layers, normalized)
+	if err != nil {
+		return nil, err
+	}
+	if len(normalized) == 0 {
+		fmt.Printf("Loaded image ID: sha256:%s\n", img.ID)
+	}
+	for _, tag := range normalized {
+		fmt.Printf("Loaded image: %s\n", tag)
+	}
+	return img, nil
+}
+
+// 解压各镜像层并按镜像配置创建镜像，load 和 pull 时使用
+func createImageFromConfig(dir string, config *ociImageConfig, layers, tags []string) (*Image, error) {
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return nil, fmt.Errorf("image config has %d diff ids but %d layers", len(config.RootFS.DiffIDs), len(layers))
+	}
+	host := hostPlatform()
+	if config.Architecture != "" && config.Architecture != host.Architecture {
+		logrus.Warnf("image architecture %s does not match host %s", config.Architecture, host.Architecture)
+	}
+
+	var dirs, digests []string
+	cleanup := func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}
+	for i, layer := range layers {
+		layerDir, digest, err := loadLayer(dir, layer, config.RootFS.DiffIDs[i])
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		dirs, digests = append(dirs, layerDir), append(digests, digest)
+	}
+
+	opts := ImageOptions{Tags: tags, Author: config.Author, Config: config.Config}
+	if config.Created != nil {
+		opts.Created = *config.Created
+	}
+	// 历史中不产生镜像层的记录不对应镜像层，与镜像层个数一致时才保留
+	nonEmpty := 0
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == len(layers) {
+		opts.History = config.History
+	}
+	return createImage(dirs, digests, opts)
+}
+
+// 解压镜像层，同时计算解压前未压缩的 tar 包的摘要，与镜像配置中的 diff id 比较
+func loadLayer(dir, layer, diffID string) (string, string, error) {
+	p, err := secureJoin(dir, layer)
+	if err != nil {
+		return "", "", err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", "", fmt.Errorf("open layer %s error %v", layer, err)
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return "", "", fmt.Errorf("decompress layer %s error %v", layer, err)
+	}
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	layerDir, digest, err := unpackLayer(tee)
+	if err != nil {
+		return "", "", err
+	}
+	// tar 包结束标记之后可能还有填充数据，全部读取后再计算摘要
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		os.RemoveAll(layerDir)
+		return "", "", err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != diffID {
+		os.RemoveAll(layerDir)
+		return "", "", fmt.Errorf("layer %s diff id mismatch: expect %s, got %s", layer, diffID, actual)
+	}
+	return layerDir, digest, nil
+}
+
+// 自动识别 gzip 压缩
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func blobPath(digest string) string {
+	return filepath.Join(ociBlobsDir, strings.Replace(digest, ":", "/", 1))
+}
+
+// 检查 blob 的大小和摘要
+func verifyBlob(dir string, desc descriptor) error {
+	if !strings.HasPrefix(desc.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %s", desc.Digest)
+	}
+	p, err := secureJoin(dir, blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("open blob %s error %v", desc.Digest, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != desc.Digest || size != desc.Size {
+		return fmt.Errorf("blob %s is corrupted: got %s size %d", desc.Digest, actual, size)
+	}
+	return nil
+}
+
+func readJSON(dir, name string, v interface{}) error {
+	p, err := secureJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("read %s error %v", name, err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("unmarshal %s error %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "bin"), 0755)
+	os.WriteFile(path.Join(rootfs, "bin", "sh"), []byte("sh"), 0755)
+	config := ImageConfig{Env: []string{"PATH=/bin"}, Entrypoint: []string{"/bin/sh"}, Cmd: []string{"-c", "top"}, WorkingDir: "/bin", User: "1000"}
+	base, err := CommitImage(rootfs, ImageOptions{Tags: []string{"base"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := CommitImage(t.TempDir(), ImageOptions{Parent: base.ID, Tags: []string{"app:v1"}, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := SaveImages(buf, []string{"app:v1", "base"}); err != nil {
+		t.Fatal(err)
+	}
+
+	setupStore(t)
+	loaded, err := LoadImages(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("load %v %v", loaded, err)
+	}
+	img, err := GetImage("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(img.Layers, app.Layers) || !reflect.DeepEqual(img.Config, config) || !img.Created.Equal(app.Created) {
+		t.Errorf("loaded image %+v, saved %+v", img, app)
+	}
+	if _, err := GetImage("base:latest"); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Error(err)
+	}
+
+	// 去掉 manifest.json 后按 OCI 镜像布局加载
+	setupStore(t)
+	oci := &bytes.Buffer{}
+	tr, tw := tar.NewReader(bytes.NewReader(buf.Bytes())), tar.NewWriter(oci)
+	for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+		if hdr.Name != dockerManifestFile {
+			tw.WriteHeader(hdr)
+			io.Copy(tw, tr)
+		}
+	}
+	tw.Close()
+	if _, err := LoadImages(oci); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := GetImage("app:v1"); err != nil || !reflect.DeepEqual(img.Layers, app.Layers) {
+		t.Errorf("load oci layout %+v %v", img, err)
+	}
+}
+
+// 按 docker save 的格式生成镜像 tar 包，layers 为各层的文件，gzip 表示压缩对应的镜像层
+func dockerArchive(t *testing.T, layers []map[string]string, gzipped []bool, config ociImageConfig, tags []string) *bytes.Buffer {
+	files := map[string][]byte{}
+	manifest := dockerManifest{RepoTags: tags}
+	for i, layer := range layers {
+		var entries []tar.Header
+		for name := range layer {
+			entries = append(entries, tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+		}
+		raw := writeTar(t, entries, layer).Bytes()
+		sum := sha256.Sum256(raw)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, "sha256:"+hex.EncodeToString(sum[:]))
+		if gzipped[i] {
+			gz := &bytes.Buffer{}
+			zw := gzip.NewWriter(gz)
+			zw.Write(raw)
+			zw.Close()
+			raw = gz.Bytes()
+		}
+		name := hex.EncodeToString(sum[:8]) + "/layer.tar"
+		files[name] = raw
+		manifest.Layers = append(manifest.Layers, name)
+	}
+	files["config.json"], _ = json.Marshal(config)
+	manifest.Config = "config.json"
+	files[dockerManifestFile], _ = json.Marshal([]dockerManifest{manifest})
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+	}
+	tw.Close()
+	return buf
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	setupStore(t)
+	config := ociImageConfig{Architecture: hostPlatform().Architecture, OS: "linux"}
+	config.Config = ImageConfig{Env: []string{"PATH=/bin"}, Cmd: []string{"sh"}, WorkingDir: "/root", User: "nobody"}
+	layers := []map[string]string{
+		{"etc/hosts": "hosts", "etc/passwd": "root:x:0:0"},
+		{"etc/.wh.hosts": "", "root/.profile": "profile"},
+	}
+	archive := dockerArchive(t, layers, []bool{true, false}, config, []string{"docker.io/library/busybox:1.36"})
+	if _, err := LoadImages(archive); err != nil {
+		t.Fatal(err)
+	}
+	img, err := GetImage("busybox:1.36")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Layers) != 2 || !reflect.DeepEqual(img.Config, config.Config) {
+		t.Errorf("loaded image %+v", img)
+	}
+	merged := flatten(t, img)
+	for name, exist := range map[string]bool{"etc/hosts": false, "etc/passwd": true, "root/.profile": true} {
+		if _, err := os.Stat(path.Join(merged, name)); (err == nil) != exist {
+			t.Errorf("%s exist %v, expect %v", name, err == nil, exist)
+		}
+	}
+
+	// diff id 与镜像层内容不一致
+	corrupted := dockerArchive(t, layers[:1], []bool{false}, config, []string{"corrupted"})
+	content := bytes.Replace(corrupted.Bytes(), []byte("root:x:0:0"), []byte("root:x:0:1"), 1)
+	if _, err := LoadImages(bytes.NewReader(content)); err == nil {
+		t.Errorf("load corrupted layer expect error")
+	}
+}
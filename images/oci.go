@@ -0,0 +1,151 @@
+package images
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// OCI 镜像格式中使用的媒体类型和文件
+const (
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayerGz      = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	ociLayoutFile      = "oci-layout"
+	ociIndexFile       = "index.json"
+	ociBlobsDir        = "blobs"
+	dockerManifestFile = "manifest.json"
+
+	// index.json 中记录镜像名的注解，containerd 和 docker 使用完整的镜像名，OCI 规范只记录 tag
+	annotationImageName = "io.containerd.image.name"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+)
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *platform         `json:"platform,omitempty"`
+}
+
+// OCI 镜像索引或者 docker 的 manifest list，manifests 指向不同平台的镜像
+type ociIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// 镜像的构建历史，每个镜像层对应一条，不产生镜像层的操作（例如修改 ENV）标记为 EmptyLayer
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// OCI 镜像配置，docker 的镜像配置格式相同
+type ociImageConfig struct {
+	Created      *time.Time  `json:"created,omitempty"`
+	Author       string      `json:"author,omitempty"`
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Variant      string      `json:"variant,omitempty"`
+	Config       ImageConfig `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []History `json:"history,omitempty"`
+}
+
+// docker save 生成的 manifest.json 中的一项
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// 当前机器的平台，选择 manifest list 中的镜像时使用
+func hostPlatform() platform {
+	p := platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+	if runtime.GOARCH == "arm64" {
+		p.Variant = "v8"
+	}
+	return p
+}
+
+// 解析 os/arch[/variant] 格式的平台，为空时返回当前平台
+func parsePlatform(s string) (platform, error) {
+	if s == "" {
+		return hostPlatform(), nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf("invalid platform %s, expect os/arch[/variant]", s)
+	}
+	p := platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// 从 manifest list 中选择指定平台的镜像，没有平台信息并且只有一个镜像时直接使用
+func selectManifest(index *ociIndex, host platform) (descriptor, error) {
+	var candidates []descriptor
+	for _, m := range index.Manifests {
+		if m.Platform == nil {
+			candidates = append(candidates, m)
+			continue
+		}
+		if m.Platform.OS != host.OS || m.Platform.Architecture != host.Architecture {
+			continue
+		}
+		if m.Platform.Variant != "" && host.Variant != "" && m.Platform.Variant != host.Variant {
+			continue
+		}
+		return m, nil
+	}
+	if len(candidates) == 1 && len(index.Manifests) == 1 {
+		return candidates[0], nil
+	}
+	return descriptor{}, fmt.Errorf("no image for platform %s/%s", host.OS, host.Architecture)
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerManifestList
+}
+
+// 完整的镜像引用，Docker Hub 的镜像补全仓库地址，例如 busybox:latest 为 docker.io/library/busybox:latest
+func fullReference(ref string) string {
+	name, tag, err := ParseReference(ref)
+	if err != nil {
+		return ref
+	}
+	domain, remote := SplitDomain(name)
+	return domain + "/" + remote + ":" + tag
+}
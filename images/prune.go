@@ -0,0 +1,331 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 临时目录中超过该时间没有变化的内容视为中断的解压或下载留下的，GC 时删除
+var tmpExpiry = time.Hour
+
+// 清理镜像的参数
+type PruneOptions struct {
+	// 删除所有没有被容器使用的镜像，为 false 时只删除没有 tag 的悬空镜像
+	All bool
+	// 只删除在该时间之前创建的镜像，为零值时不限制
+	Until time.Time
+	// 只打印将要删除的内容，不做修改
+	DryRun bool
+}
+
+// 磁盘空间的使用情况，Active 为正在使用的个数，Reclaimable 为清理后可以释放的空间
+type Usage struct {
+	Total       int
+	Active      int
+	Size        int64
+	Reclaimable int64
+}
+
+// 删除没有被容器使用、也没有子镜像的镜像，返回释放的空间
+// 删除子镜像后父镜像满足条件时也一起删除，例如 build 生成的中间镜像
+func PruneImages(opts PruneOptions) (int64, error) {
+	var reclaimed int64
+	err := withStore(!opts.DryRun, func(s *store) error {
+		users, err := imageUsers()
+		if err != nil {
+			return err
+		}
+		children := map[string]int{}
+		for _, img := range s.Images {
+			if img.Parent != "" {
+				children[img.Parent]++
+			}
+		}
+		// 先在内存中计算要删除的镜像，子镜像在前，dry run 时不修改镜像仓库
+		removed := map[string]bool{}
+		var victims []*Image
+		for {
+			var batch []*Image
+			for id, img := range s.Images {
+				if removed[id] || children[id] > 0 || len(users[id]) > 0 {
+					continue
+				}
+				if !opts.All && len(img.Tags) > 0 {
+					continue
+				}
+				if !opts.Until.IsZero() && !img.Created.Before(opts.Until) {
+					continue
+				}
+				batch = append(batch, img)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			sort.Slice(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+			for _, img := range batch {
+				removed[img.ID] = true
+				children[img.Parent]--
+			}
+			victims = append(victims, batch...)
+		}
+
+		references := map[string]int{}
+		for digest, layer := range s.Layers {
+			references[digest] = layer.References
+		}
+		for _, img := range victims {
+			for _, digest := range img.Layers {
+				layer, ok := s.Layers[digest]
+				if !ok {
+					continue
+				}
+				if references[digest]--; references[digest] == 0 {
+					reclaimed += layer.Size
+				}
+			}
+		}
+		for _, img := range victims {
+			if opts.DryRun {
+				for _, tag := range img.Tags {
+					fmt.Printf("Would untag: %s\n", tag)
+				}
+				fmt.Printf("Would delete: sha256:%s\n", img.ID)
+				continue
+			}
+			if err := s.removeImage(img, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return reclaimed, err
+}
+
+// 标记-清除方式回收镜像层，返回释放的空间
+// 标记所有镜像引用的镜像层并修正引用计数，删除没有被引用的镜像层、layers 目录中没有登记的目录、
+// 过期的临时文件以及指向已删除镜像的构建缓存
+func GarbageCollect(dryRun bool) (int64, error) {
+	var reclaimed int64
+	err := withStore(!dryRun, func(s *store) error {
+		marked := markLayers(s)
+		for id, img := range s.Images {
+			for _, digest := range img.Layers {
+				if _, ok := s.Layers[digest]; !ok {
+					logrus.Warnf("image %s references missing layer %s", ShortID(id), digest)
+				}
+			}
+		}
+
+		digests := make([]string, 0, len(s.Layers))
+		for digest := range s.Layers {
+			digests = append(digests, digest)
+		}
+		sort.Strings(digests)
+		for _, digest := range digests {
+			layer := s.Layers[digest]
+			if marked[digest] > 0 {
+				if layer.References != marked[digest] {
+					logrus.Warnf("layer %s references %d, expect %d", digest, layer.References, marked[digest])
+					layer.References = marked[digest]
+				}
+				continue
+			}
+			reclaimed += layer.Size
+			if dryRun {
+				fmt.Printf("Would delete layer: %s\n", digest)
+				continue
+			}
+			removeLayerLink(digest)
+			if err := os.RemoveAll(LayerDir(digest)); err != nil {
+				return fmt.Errorf("remove layer %s error %v", digest, err)
+			}
+			delete(s.Layers, digest)
+			fmt.Printf("Deleted layer: %s\n", digest)
+		}
+
+		orphans, size, err := orphanLayerDirs(s)
+		if err != nil {
+			return err
+		}
+		reclaimed += size
+		for _, dir := range orphans {
+			if dryRun {
+				fmt.Printf("Would delete unregistered layer directory: %s\n", dir)
+				continue
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("remove %s error %v", dir, err)
+			}
+			fmt.Printf("Deleted unregistered layer directory: %s\n", dir)
+		}
+
+		stale, size, err := staleTempFiles()
+		if err != nil {
+			return err
+		}
+		reclaimed += size
+		for _, file := range stale {
+			if dryRun {
+				fmt.Printf("Would delete temporary file: %s\n", file)
+				continue
+			}
+			if err := os.RemoveAll(file); err != nil {
+				return fmt.Errorf("remove %s error %v", file, err)
+			}
+			fmt.Printf("Deleted temporary file: %s\n", file)
+		}
+
+		if !dryRun {
+			for key, id := range s.BuildCache {
+				if _, ok := s.Images[id]; !ok {
+					delete(s.BuildCache, key)
+				}
+			}
+		}
+		return nil
+	})
+	return reclaimed, err
+}
+
+// 统计每个镜像层被多少个镜像引用
+func markLayers(s *store) map[string]int {
+	marked := map[string]int{}
+	for _, img := range s.Images {
+		for _, digest := range img.Layers {
+			marked[digest]++
+		}
+	}
+	return marked
+}
+
+// layers 目录中没有登记到镜像仓库的目录，例如登记前进程被杀死留下的
+func orphanLayerDirs(s *store) ([]string, int64, error) {
+	dir := path.Join(ImagesStoreDir, layersDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	var orphans []string
+	var total int64
+	for _, entry := range entries {
+		if _, ok := s.Layers["sha256:"+entry.Name()]; ok || entry.Name() == layerLinkDir {
+			continue
+		}
+		file := path.Join(dir, entry.Name())
+		size, _ := DirSize(file)
+		total += size
+		orphans = append(orphans, file)
+	}
+	return orphans, total, nil
+}
+
+// 临时目录中超过 tmpExpiry 没有变化的内容，下载目录中的文件单独判断
+// 解压镜像层时不持有镜像仓库的锁，按目录中最近的 ctime 判断，避免删除其他进程正在使用的目录
+// 解压时文件的修改时间会恢复为 tar 包中的时间（save 生成的 tar 包中为 1970 年），不能按修改时间判断，
+// ctime 在恢复修改时间时也会更新为当前时间
+func staleTempFiles() ([]string, int64, error) {
+	deadline := time.Now().Add(-tmpExpiry)
+	var stale []string
+	var total int64
+	var scan func(dir string) error
+	scan = func(dir string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			file := path.Join(dir, entry.Name())
+			if dir == path.Join(ImagesStoreDir, tmpDir) && entry.Name() == downloadDir {
+				if err := scan(file); err != nil {
+					return err
+				}
+				continue
+			}
+			if latestChangeTime(file).After(deadline) {
+				continue
+			}
+			size, _ := DirSize(file)
+			total += size
+			stale = append(stale, file)
+		}
+		return nil
+	}
+	err := scan(path.Join(ImagesStoreDir, tmpDir))
+	return stale, total, err
+}
+
+func latestChangeTime(file string) time.Time {
+	var latest time.Time
+	filepath.Walk(file, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		changed := info.ModTime()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			changed = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+		}
+		if changed.After(latest) {
+			latest = changed
+		}
+		return nil
+	})
+	return latest
+}
+
+// 镜像和镜像层占用的空间
+// 镜像可以释放的空间为没有被容器使用的镜像独占的镜像层，镜像层可以释放的空间为 GC 可以回收的空间
+func DiskUsage() (imageUsage, layerUsage Usage, err error) {
+	err = withStore(false, func(s *store) error {
+		users, err := imageUsers()
+		if err != nil {
+			return err
+		}
+		active := map[string]bool{}
+		for id, img := range s.Images {
+			imageUsage.Total++
+			if len(users[id]) == 0 {
+				continue
+			}
+			imageUsage.Active++
+			for _, digest := range img.Layers {
+				active[digest] = true
+			}
+		}
+		marked := markLayers(s)
+		for digest, layer := range s.Layers {
+			imageUsage.Size += layer.Size
+			if !active[digest] {
+				imageUsage.Reclaimable += layer.Size
+			}
+			layerUsage.Total++
+			layerUsage.Size += layer.Size
+			if marked[digest] > 0 {
+				layerUsage.Active++
+			} else {
+				layerUsage.Reclaimable += layer.Size
+			}
+		}
+		orphans, size, err := orphanLayerDirs(s)
+		if err != nil {
+			return err
+		}
+		layerUsage.Total += len(orphans)
+		layerUsage.Size += size
+		layerUsage.Reclaimable += size
+		return nil
+	})
+	return imageUsage, layerUsage, err
+}
@@ -0,0 +1,116 @@
+package images
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPruneAndGarbageCollect(t *testing.T) {
+	setupStore(t)
+	old := time.Now().Add(-48 * time.Hour)
+	commit := func(file string, opts ImageOptions) *Image {
+		rootfs := t.TempDir()
+		os.WriteFile(path.Join(rootfs, file), []byte(file), 0644)
+		img, err := CommitImage(rootfs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	base := commit("base", ImageOptions{Tags: []string{"base"}, Created: old})
+	dangling := commit("dangling", ImageOptions{Parent: base.ID, Created: old})
+	recent := commit("recent", ImageOptions{})
+	used := commit("used", ImageOptions{Created: old})
+	os.MkdirAll(path.Join(containerInfoDir, "c1"), 0755)
+	os.WriteFile(path.Join(containerInfoDir, "c1", "config.json"), []byte(`{"Id":"c1","status":"stop","image":"`+used.ID+`"}`), 0644)
+
+	exists := func(id string) bool {
+		_, err := GetImage(id)
+		return err == nil
+	}
+	until := time.Now().Add(-24 * time.Hour)
+	size, err := PruneImages(PruneOptions{Until: until, DryRun: true})
+	if err != nil || size != dangling.Size-base.Size || !exists(dangling.ID) {
+		t.Fatalf("dry run reclaimed %d %v", size, err)
+	}
+	if _, err := PruneImages(PruneOptions{Until: until}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(dangling.ID) || !exists(recent.ID) || !exists(base.ID) || !exists(used.ID) {
+		t.Errorf("prune until should only remove the old dangling image")
+	}
+	if _, err := PruneImages(PruneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(recent.ID) || !exists(base.ID) || !exists(used.ID) {
+		t.Errorf("prune should remove dangling images not used by containers")
+	}
+	if _, err := PruneImages(PruneOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(base.ID) || !exists(used.ID) {
+		t.Errorf("prune -a should remove all images not used by containers")
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Error(err)
+	}
+
+	// 没有被引用的镜像层、没有登记的目录、过期的临时文件以及错误的引用计数
+	unreferenced := "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	os.MkdirAll(LayerDir(unreferenced), 0755)
+	os.WriteFile(path.Join(LayerDir(unreferenced), "file"), []byte("unreferenced"), 0644)
+	orphan := path.Join(ImagesStoreDir, layersDir, "orphan")
+	os.MkdirAll(orphan, 0755)
+	os.WriteFile(path.Join(orphan, "file"), []byte("orphan"), 0644)
+	// 临时文件按 ctime 判断是否过期，无法直接修改 ctime，缩短过期时间后等待
+	defer func(expiry time.Duration) { tmpExpiry = expiry }(tmpExpiry)
+	tmpExpiry = 500 * time.Millisecond
+	stale := path.Join(ImagesStoreDir, tmpDir, downloadDir, "stale")
+	fresh := path.Join(ImagesStoreDir, tmpDir, "fresh")
+	os.MkdirAll(path.Dir(stale), 0755)
+	os.WriteFile(stale, []byte("stale"), 0644)
+	time.Sleep(time.Second)
+	// 正在解压的目录，文件的修改时间已经恢复为 tar 包中的时间
+	os.MkdirAll(fresh, 0755)
+	os.WriteFile(path.Join(fresh, "layer"), []byte("layer"), 0644)
+	for _, file := range []string{path.Join(fresh, "layer"), fresh} {
+		os.Chtimes(file, time.Unix(0, 0), time.Unix(0, 0))
+	}
+	err = withStore(true, func(s *store) error {
+		s.Layers[unreferenced] = &Layer{Digest: unreferenced, Size: 12}
+		s.Layers[used.Layers[0]].References = 3
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err = GarbageCollect(true)
+	if err != nil || size != 12+6+5 {
+		t.Fatalf("gc dry run reclaimed %d %v", size, err)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("dry run should not remove anything: %v", err)
+	}
+	if size, err := GarbageCollect(false); err != nil || size != 12+6+5 {
+		t.Fatalf("gc reclaimed %d %v", size, err)
+	}
+	for _, file := range []string{LayerDir(unreferenced), orphan, stale} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temporary dir should be kept: %v", err)
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Error(err)
+	}
+
+	imageUsage, layerUsage, err := DiskUsage()
+	if err != nil || imageUsage.Total != 1 || imageUsage.Active != 1 || imageUsage.Reclaimable != 0 || layerUsage.Active != layerUsage.Total {
+		t.Errorf("disk usage %+v %+v %v", imageUsage, layerUsage, err)
+	}
+}
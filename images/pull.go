@@ -0,0 +1,88 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 从镜像仓库拉取镜像，manifest list 按 opts.Platform 选择平台
+// 镜像层先下载到 tmp/downloads 中，中断后再次 pull 时续传，全部导入后删除
+func PullImage(ref string, opts *RegistryOptions) (*Image, error) {
+	name, tag, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	target, err := parsePlatform(opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newRegistryClient(name, opts, "pull")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%s: Pulling from %s\n", tag, c.remote)
+	mediaType, content, digest, err := c.getManifest(tag)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest of %s error %v", ref, err)
+	}
+	for isIndex(mediaType) {
+		var index ociIndex
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, fmt.Errorf("unmarshal manifest list error %v", err)
+		}
+		desc, err := selectManifest(&index, target)
+		if err != nil {
+			return nil, err
+		}
+		if mediaType, content, _, err = c.getManifest(desc.Digest); err != nil {
+			return nil, fmt.Errorf("get manifest %s error %v", desc.Digest, err)
+		}
+	}
+	if mediaType != mediaTypeOCIManifest && mediaType != mediaTypeDockerManifest {
+		return nil, fmt.Errorf("unsupported manifest media type %s", mediaType)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest error %v", err)
+	}
+	configContent, err := c.getBlob(manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("get image config error %v", err)
+	}
+	var config ociImageConfig
+	if err := json.Unmarshal(configContent, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal image config error %v", err)
+	}
+
+	dir := path.Join(ImagesStoreDir, tmpDir, downloadDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, layer := range manifest.Layers {
+		if !strings.HasPrefix(layer.Digest, "sha256:") {
+			return nil, fmt.Errorf("unsupported digest %s", layer.Digest)
+		}
+		file := strings.TrimPrefix(layer.Digest, "sha256:")
+		if err := c.downloadBlob(layer, filepath.Join(dir, file)); err != nil {
+			return nil, fmt.Errorf("download layer %s error %v", layer.Digest, err)
+		}
+		fmt.Printf("%s: Download complete\n", ShortID(layer.Digest))
+		layers = append(layers, file)
+	}
+	ref, _ = NormalizeReference(ref)
+	img, err := createImageFromConfig(dir, &config, layers, []string{ref})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range layers {
+		os.Remove(filepath.Join(dir, file))
+	}
+	fmt.Printf("Digest: %s\n", digest)
+	fmt.Printf("Status: Downloaded image for %s\n", ref)
+	return img, nil
+}
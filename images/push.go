@@ -0,0 +1,91 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 将镜像推送到镜像仓库，镜像层以未压缩的 tar 格式上传，仓库中已有的 blob 不再上传
+func PushImage(ref string, opts *RegistryOptions) error {
+	name, tag, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	img, err := GetImage(ref)
+	if err != nil {
+		return err
+	}
+	c, err := newRegistryClient(name, opts, "pull,push")
+	if err != nil {
+		return err
+	}
+	dir, err := TempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("The push refers to repository [%s]\n", strings.TrimSuffix(fullReference(ref), ":"+tag))
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	for _, digest := range img.Layers {
+		desc, err := c.pushLayer(dir, digest)
+		if err != nil {
+			return fmt.Errorf("push layer %s error %v", digest, err)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	config, err := json.Marshal(imageConfig(img))
+	if err != nil {
+		return err
+	}
+	manifest.Config = descriptor{MediaType: mediaTypeOCIConfig, Digest: sha256Digest(config), Size: int64(len(config))}
+	exists, _, err := c.blobExists(manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := c.uploadBlob(manifest.Config.Digest, strings.NewReader(string(config)), int64(len(config))); err != nil {
+			return fmt.Errorf("push image config error %v", err)
+		}
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := c.putManifest(tag, mediaTypeOCIManifest, content); err != nil {
+		return fmt.Errorf("push manifest error %v", err)
+	}
+	fmt.Printf("%s: digest: %s size: %d\n", tag, sha256Digest(content), len(content))
+	return nil
+}
+
+func (c *registryClient) pushLayer(dir, digest string) (descriptor, error) {
+	desc := descriptor{MediaType: mediaTypeOCILayer, Digest: digest}
+	exists, size, err := c.blobExists(digest)
+	if err != nil {
+		return desc, err
+	}
+	if exists && size > 0 {
+		desc.Size = size
+		fmt.Printf("%s: Layer already exists\n", ShortID(digest))
+		return desc, nil
+	}
+	f, size, err := packLayerFile(dir, digest)
+	if err != nil {
+		return desc, err
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+	desc.Size = size
+	if !exists {
+		if err := c.uploadBlob(digest, f, size); err != nil {
+			return desc, err
+		}
+		fmt.Printf("%s: Pushed\n", ShortID(digest))
+	} else {
+		fmt.Printf("%s: Layer already exists\n", ShortID(digest))
+	}
+	return desc, nil
+}
@@ -0,0 +1,78 @@
+package images
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultTag = "latest"
+	// 没有仓库地址的镜像来自 Docker Hub，只有一段的镜像名属于 library
+	defaultDomain      = "docker.io"
+	officialRepoPrefix = "library/"
+)
+
+var (
+	// 镜像名由斜杠分隔的小写路径组成，第一段可以是带端口的仓库地址，例如 localhost:5000/library/busybox
+	nameRegexp = regexp.MustCompile(`^([a-zA-Z0-9.-]+(:[0-9]+)?/)?[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	tagRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// 解析 name[:tag] 形式的镜像引用，省略 tag 时为 latest
+// 仓库地址中的端口号也包含冒号，只有最后一个斜杠之后的冒号才是 tag 的分隔符
+func ParseReference(ref string) (name, tag string, err error) {
+	name, tag = ref, DefaultTag
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if !nameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("invalid image name %q", ref)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid image tag %q", ref)
+	}
+	return familiarName(name), tag, nil
+}
+
+// 将镜像名拆分为仓库地址和仓库中的路径，例如 busybox 拆分为 docker.io 和 library/busybox
+// 第一段包含 . 或者 : 或者为 localhost 时是仓库地址
+func SplitDomain(name string) (domain, remote string) {
+	i := strings.Index(name, "/")
+	if i < 0 || !strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost" {
+		domain, remote = defaultDomain, name
+	} else {
+		domain, remote = name[:i], name[i+1:]
+	}
+	if domain == defaultDomain && !strings.Contains(remote, "/") {
+		remote = officialRepoPrefix + remote
+	}
+	return domain, remote
+}
+
+// Docker Hub 的镜像省略仓库地址和 library，docker.io/library/busybox 简写为 busybox
+func familiarName(name string) string {
+	domain, remote := SplitDomain(name)
+	if domain != defaultDomain {
+		return name
+	}
+	return strings.TrimPrefix(remote, officialRepoPrefix)
+}
+
+// 补全镜像引用的 tag，返回 name:tag
+func NormalizeReference(ref string) (string, error) {
+	name, tag, err := ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	return name + ":" + tag, nil
+}
+
+// 镜像ID的前 12 位，用于列表展示
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
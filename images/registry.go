@@ -0,0 +1,427 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Docker Hub 的 registry 地址与镜像名中的 docker.io 不同
+	dockerHubRegistry = "registry-1.docker.io"
+	// 下载中断后保留已下载的部分，下次从断点继续下载
+	downloadDir = "downloads"
+	// 单次 pull 中下载中断时的重试次数
+	downloadRetries = 3
+)
+
+// 访问镜像仓库的参数
+type RegistryOptions struct {
+	// 使用 HTTP 访问镜像仓库
+	Insecure bool
+	// 镜像仓库的用户名和密码，用于 basic 认证或者获取 token
+	Username string
+	Password string
+	// pull 时选择的平台，格式为 os/arch[/variant]，为空时使用当前平台
+	Platform string
+}
+
+// OCI Distribution API v2 客户端，一个客户端只访问一个仓库中的一个镜像
+type registryClient struct {
+	client *http.Client
+	// 镜像仓库的地址，例如 https://registry-1.docker.io
+	endpoint string
+	// 镜像在仓库中的路径，例如 library/busybox
+	remote string
+	opts   *RegistryOptions
+	// token 的权限，token 过期后重新认证时使用
+	actions string
+	// 认证后在每个请求中携带的 Authorization 头
+	authorization string
+}
+
+// 创建镜像仓库客户端并完成认证，actions 为 token 的权限，例如 pull 或者 pull,push
+func newRegistryClient(name string, opts *RegistryOptions, actions string) (*registryClient, error) {
+	domain, remote := SplitDomain(name)
+	if domain == defaultDomain {
+		domain = dockerHubRegistry
+	}
+	scheme := "https"
+	if opts.Insecure {
+		scheme = "http"
+	}
+	c := &registryClient{
+		client:   &http.Client{Timeout: 30 * time.Minute},
+		endpoint: scheme + "://" + domain,
+		remote:   remote,
+		opts:     opts,
+		actions:  actions,
+	}
+	if err := c.authenticate(actions); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 访问 /v2/ 获取认证方式：没有认证、basic 认证或者从认证服务获取 bearer token
+func (c *registryClient) authenticate(actions string) error {
+	resp, err := c.client.Get(c.endpoint + "/v2/")
+	if err != nil {
+		return fmt.Errorf("ping registry %s error %v", c.endpoint, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.opts.Username == "" {
+			return fmt.Errorf("registry %s requires basic auth, use --creds", c.endpoint)
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.opts.Username+":"+c.opts.Password))
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(params, actions)
+		if err != nil {
+			return err
+		}
+		c.authorization = "Bearer " + token
+		return nil
+	}
+	return fmt.Errorf("unsupported auth challenge %q of registry %s", resp.Header.Get("WWW-Authenticate"), c.endpoint)
+}
+
+func (c *registryClient) fetchToken(params map[string]string, actions string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:%s", c.remote, actions))
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get token from %s error %v", realm.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode token error %v", err)
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return "", fmt.Errorf("empty token from %s", realm.Host)
+	}
+	return body.Token, nil
+}
+
+// 解析 WWW-Authenticate 头，例如 Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
+
+// 发送请求，path 为 /v2/{remote}/ 之后的部分，也可以是上传时返回的完整 URL
+// 返回 401 时 token 可能已经过期（Docker Hub 的 token 约 300 秒有效），重新认证后重试一次
+// 请求内容不能重新读取（没有实现 io.Seeker）时直接返回 401
+func (c *registryClient) do(method, path string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	var seeker io.Seeker
+	var offset int64
+	if body != nil {
+		var ok bool
+		if seeker, ok = body.(io.Seeker); ok {
+			var err error
+			if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				seeker = nil
+			}
+		}
+	}
+	resp, err := c.send(method, path, header, body, size)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (body != nil && seeker == nil) {
+		return resp, err
+	}
+	resp.Body.Close()
+	logrus.Infof("registry %s returned 401, authenticate again", c.endpoint)
+	if err := c.authenticate(c.actions); err != nil {
+		return nil, err
+	}
+	if seeker != nil {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(method, path, header, body, size)
+}
+
+func (c *registryClient) send(method, path string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = fmt.Sprintf("%s/v2/%s/%s", c.endpoint, c.remote, path)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	// 上传地址可能是其他主机（例如对象存储），只向镜像仓库本身发送认证信息
+	if c.authorization != "" && req.URL.Scheme+"://"+req.URL.Host == c.endpoint {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	logrus.Debugf("registry request %s %s", method, target)
+	return c.client.Do(req)
+}
+
+// 按 tag 或者摘要获取 manifest，返回 manifest 的媒体类型、内容和摘要
+func (c *registryClient) getManifest(reference string) (string, []byte, string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join([]string{mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest}, ", "))
+	resp, err := c.do(http.MethodGet, "manifests/"+reference, header, nil, 0)
+	if err != nil {
+		return "", nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, "", responseError(resp)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, "", err
+	}
+	digest := sha256Digest(content)
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return "", nil, "", fmt.Errorf("manifest digest mismatch: expect %s, got %s", reference, digest)
+	}
+	if expected := resp.Header.Get("Docker-Content-Digest"); expected != "" && expected != digest {
+		return "", nil, "", fmt.Errorf("manifest digest mismatch: expect %s, got %s", expected, digest)
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(content, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+	return mediaType, content, digest, nil
+}
+
+// 获取 blob 内容并检查摘要，用于镜像配置等较小的 blob
+func (c *registryClient) getBlob(desc descriptor) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, "blobs/"+desc.Digest, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if digest := sha256Digest(content); digest != desc.Digest {
+		return nil, fmt.Errorf("blob digest mismatch: expect %s, got %s", desc.Digest, digest)
+	}
+	return content, nil
+}
+
+// 将 blob 下载到 file，file 中已有的内容通过 Range 请求续传，下载完成后检查摘要
+func (c *registryClient) downloadBlob(desc descriptor, file string) error {
+	var err error
+	for i := 0; i < downloadRetries; i++ {
+		if err = c.downloadBlobOnce(desc, file); err == nil {
+			break
+		}
+		logrus.Warnf("download blob %s error %v, retrying", ShortID(desc.Digest), err)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != desc.Digest {
+		// 内容错误的文件不能用于续传
+		os.Remove(file)
+		return fmt.Errorf("blob digest mismatch: expect %s, got %s", desc.Digest, digest)
+	}
+	return nil
+}
+
+func (c *registryClient) downloadBlobOnce(desc descriptor, file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		return nil
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(http.MethodGet, "blobs/"+desc.Digest, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 镜像仓库不支持 Range 时重新下载
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	default:
+		return responseError(resp)
+	}
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// 镜像仓库中是否已经有该 blob，存在时返回 blob 的大小
+func (c *registryClient) blobExists(digest string) (bool, int64, error) {
+	resp, err := c.do(http.MethodHead, "blobs/"+digest, nil, nil, 0)
+	if err != nil {
+		return false, 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, resp.ContentLength, nil
+	case http.StatusNotFound:
+		return false, 0, nil
+	}
+	return false, 0, responseError(resp)
+}
+
+// 单次上传 blob：POST 获取上传地址，再 PUT 全部内容
+func (c *registryClient) uploadBlob(digest string, body io.Reader, size int64) error {
+	resp, err := c.do(http.MethodPost, "blobs/uploads/", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError(resp)
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("invalid upload location %q", resp.Header.Get("Location"))
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(http.MethodPut, location.String(), header, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (c *registryClient) putManifest(reference, mediaType string, content []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+	resp, err := c.do(http.MethodPut, "manifests/"+reference, header, strings.NewReader(string(content)), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// 镜像仓库返回的错误，body 中通常是 {"errors":[{"code":...,"message":...}]}
+func responseError(resp *http.Response) error {
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(content, &body) == nil && len(body.Errors) > 0 {
+		return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, body.Errors[0].Code, body.Errors[0].Message)
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,246 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 内存中的镜像仓库，需要通过 token 认证，token 服务使用 basic 认证
+type fakeRegistry struct {
+	sync.Mutex
+	server    *httptest.Server
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	// 收到的 Range 请求头和上传次数
+	ranges  []string
+	uploads int
+	// 增加后之前发放的 token 失效，模拟 token 过期
+	generation int
+	// 不为空时上传地址指向该服务，模拟镜像仓库把上传重定向到对象存储
+	storage *httptest.Server
+	// 发送到上传服务的 Authorization 头
+	storageAuth []string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": fmt.Sprintf("t-%s@%d", req.URL.Query().Get("scope"), r.generation)})
+		return
+	}
+	if r.storage != nil && req.Host == strings.TrimPrefix(r.storage.URL, "http://") {
+		r.storageAuth = append(r.storageAuth, req.Header.Get("Authorization"))
+	} else if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer t-repository:app:") || !strings.HasSuffix(auth, fmt.Sprintf("@%d", r.generation)) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, "/v2/app/")
+	switch {
+	case strings.HasPrefix(p, "manifests/"):
+		key := strings.TrimPrefix(p, "manifests/")
+		if req.Method == http.MethodPut {
+			content, _ := io.ReadAll(req.Body)
+			r.manifests[key] = content
+			r.manifests[sha256Digest(content)] = content
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		content, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", sha256Digest(content))
+		w.Write(content)
+	case p == "blobs/uploads/":
+		location := "/v2/app/blobs/uploads/1?state=x"
+		if r.storage != nil {
+			location = r.storage.URL + location
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(p, "blobs/uploads/"):
+		content, _ := io.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if sha256Digest(content) != digest || req.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = content
+		r.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(p, "blobs/"):
+		content, ok := r.blobs[strings.TrimPrefix(p, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rg := req.Header.Get("Range"); rg != "" {
+			r.ranges = append(r.ranges, rg)
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	reg := newFakeRegistry(t)
+	opts := &RegistryOptions{Insecure: true, Username: "user", Password: "secret"}
+	ref := reg.host() + "/app:v1"
+
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "bin"), 0755)
+	os.WriteFile(path.Join(rootfs, "bin", "sh"), bytes.Repeat([]byte("sh"), 4096), 0755)
+	base, err := CommitImage(rootfs, ImageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ImageConfig{Env: []string{"PATH=/bin"}, Cmd: []string{"/bin/sh"}}
+	app, err := CommitImage(t.TempDir(), ImageOptions{Parent: base.ID, Tags: []string{ref}, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PushImage(ref, &RegistryOptions{Insecure: true, Username: "user", Password: "wrong"}); err == nil {
+		t.Error("push with wrong password should fail")
+	}
+	if err := PushImage(ref, opts); err != nil {
+		t.Fatal(err)
+	}
+	if reg.uploads != 3 {
+		t.Errorf("uploaded %d blobs, expect 2 layers and config", reg.uploads)
+	}
+	// 仓库中已有的 blob 不再上传
+	if err := PushImage(ref, opts); err != nil || reg.uploads != 3 {
+		t.Errorf("push again: uploads %d, error %v", reg.uploads, err)
+	}
+
+	setupStore(t)
+	img, err := PullImage(ref, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(img.Layers, app.Layers) || !reflect.DeepEqual(img.Config, config) || !img.Created.Equal(app.Created) {
+		t.Errorf("pulled image %+v, pushed %+v", img, app)
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Error(err)
+	}
+
+	// manifest list 按平台选择镜像
+	var manifest ociManifest
+	json.Unmarshal(reg.manifests["v1"], &manifest)
+	host := hostPlatform()
+	index, _ := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []descriptor{
+		{MediaType: mediaTypeOCIManifest, Digest: "sha256:" + strings.Repeat("0", 64), Size: 1, Platform: &platform{OS: "linux", Architecture: "s390x"}},
+		{MediaType: mediaTypeOCIManifest, Digest: sha256Digest(reg.manifests["v1"]), Size: int64(len(reg.manifests["v1"])), Platform: &host},
+	}})
+	reg.manifests["multi"] = index
+	setupStore(t)
+	if _, err := PullImage(reg.host()+"/app:multi", opts); err != nil {
+		t.Fatal(err)
+	}
+	platformOpts := *opts
+	platformOpts.Platform = "linux/mips64"
+	if _, err := PullImage(reg.host()+"/app:multi", &platformOpts); err == nil || !strings.Contains(err.Error(), "no image for platform") {
+		t.Errorf("pull missing platform: %v", err)
+	}
+
+	// 已经下载的部分通过 Range 请求续传
+	setupStore(t)
+	layer := manifest.Layers[0]
+	downloads := path.Join(ImagesStoreDir, tmpDir, downloadDir)
+	os.MkdirAll(downloads, 0755)
+	os.WriteFile(path.Join(downloads, strings.TrimPrefix(layer.Digest, "sha256:")), reg.blobs[layer.Digest][:100], 0644)
+	if _, err := PullImage(ref, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reg.ranges, []string{"bytes=100-"}) {
+		t.Errorf("range requests %v", reg.ranges)
+	}
+	if entries, _ := os.ReadDir(downloads); len(entries) != 0 {
+		t.Errorf("downloads not cleaned: %v", entries)
+	}
+
+	// 内容被篡改的 blob 不能导入，也不保留用于续传
+	setupStore(t)
+	tampered := append([]byte{}, reg.blobs[layer.Digest]...)
+	tampered[len(tampered)-1] ^= 0xff
+	reg.blobs[layer.Digest] = tampered
+	if _, err := PullImage(ref, opts); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("pull tampered layer: %v", err)
+	}
+	if entries, _ := os.ReadDir(downloads); len(entries) != 0 {
+		t.Errorf("tampered blob kept: %v", entries)
+	}
+}
+
+// token 过期后重新认证，上传到其他主机时不发送认证信息
+func TestRegistryReauthenticate(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.storage = httptest.NewServer(reg)
+	defer reg.storage.Close()
+	opts := &RegistryOptions{Insecure: true, Username: "user", Password: "secret"}
+	c, err := newRegistryClient(reg.host()+"/app", opts, "pull,push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg.Lock()
+	reg.generation++
+	reg.Unlock()
+	content := []byte("layer")
+	if err := c.uploadBlob(sha256Digest(content), bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reg.storageAuth, []string{""}) {
+		t.Errorf("authorization sent to storage: %q", reg.storageAuth)
+	}
+
+	reg.Lock()
+	reg.generation++
+	reg.Unlock()
+	if got, err := c.getBlob(descriptor{Digest: sha256Digest(content)}); err != nil || string(got) != "layer" {
+		t.Errorf("get blob after token expired: %q %v", got, err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull,push"`)
+	expected := map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/busybox:pull,push"}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, expected) {
+		t.Errorf("parse challenge: %s %v", scheme, params)
+	}
+	if scheme, params := parseChallenge(`Basic realm=registry`); scheme != "Basic" || params["realm"] != "registry" {
+		t.Errorf("parse basic challenge: %s %v", scheme, params)
+	}
+}
@@ -0,0 +1,218 @@
+package images
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 要保存的镜像和保存时使用的 tag
+type savedImage struct {
+	image *Image
+	tag   string
+}
+
+// 将镜像保存为 OCI 镜像布局的 tar 包，同时写入 docker save 格式的 manifest.json，docker 和 podman 都可以加载
+// 通过 tag 引用的镜像记录该 tag，通过镜像ID引用的镜像不记录 tag
+func SaveImages(w io.Writer, refs []string) error {
+	var saved []savedImage
+	err := withStore(false, func(s *store) error {
+		for _, ref := range refs {
+			img, tagged, err := s.lookup(ref)
+			if err != nil {
+				return err
+			}
+			item := savedImage{image: img}
+			if tagged {
+				item.tag, _ = NormalizeReference(ref)
+			}
+			saved = append(saved, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ow := &ociWriter{tw: tar.NewWriter(w), blobs: map[string]int64{}}
+	if err := ow.writeFile(ociLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	var manifests []dockerManifest
+	for _, item := range saved {
+		desc, dm, err := ow.writeImage(item.image)
+		if err != nil {
+			return err
+		}
+		if item.tag != "" {
+			_, tag, _ := ParseReference(item.tag)
+			desc.Annotations = map[string]string{
+				annotationImageName: fullReference(item.tag),
+				annotationRefName:   tag,
+			}
+			dm.RepoTags = []string{item.tag}
+		}
+		index.Manifests = append(index.Manifests, desc)
+		manifests = append(manifests, dm)
+	}
+	if err := ow.writeJSON(ociIndexFile, index); err != nil {
+		return err
+	}
+	if err := ow.writeJSON(dockerManifestFile, manifests); err != nil {
+		return err
+	}
+	return ow.tw.Close()
+}
+
+type ociWriter struct {
+	tw *tar.Writer
+	// 已经写入的 blob 的大小，多个镜像共用的镜像层只写入一次
+	blobs map[string]int64
+}
+
+// 写入镜像的各层、配置和 manifest，返回 manifest 的描述
+func (ow *ociWriter) writeImage(img *Image) (descriptor, dockerManifest, error) {
+	var dm dockerManifest
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	for _, digest := range img.Layers {
+		desc, err := ow.writeLayer(digest)
+		if err != nil {
+			return descriptor{}, dm, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		dm.Layers = append(dm.Layers, blobPath(digest))
+	}
+
+	config := imageConfig(img)
+	var err error
+	if manifest.Config, err = ow.writeBlob(mediaTypeOCIConfig, config); err != nil {
+		return descriptor{}, dm, err
+	}
+	dm.Config = blobPath(manifest.Config.Digest)
+	desc, err := ow.writeBlob(mediaTypeOCIManifest, manifest)
+	return desc, dm, err
+}
+
+// 镜像的 OCI 配置，save 和 push 时使用
+func imageConfig(img *Image) ociImageConfig {
+	host := hostPlatform()
+	config := ociImageConfig{
+		Created:      &img.Created,
+		Author:       img.Author,
+		Architecture: host.Architecture,
+		OS:           host.OS,
+		Variant:      host.Variant,
+		Config:       img.Config,
+		History:      img.History,
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = img.Layers
+	nonEmpty := 0
+	for _, h := range img.History {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(img.Layers) {
+		// 旧版本创建的镜像没有完整的构建历史，每层生成一条
+		config.History = nil
+		for range img.Layers {
+			config.History = append(config.History, History{Created: &img.Created})
+		}
+	}
+	return config
+}
+
+// 镜像层以未压缩的 tar 格式保存，镜像层的摘要就是 tar 包的摘要
+func (ow *ociWriter) writeLayer(digest string) (descriptor, error) {
+	if size, ok := ow.blobs[digest]; ok {
+		return descriptor{MediaType: mediaTypeOCILayer, Digest: digest, Size: size}, nil
+	}
+	dir, err := TempDir()
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer os.RemoveAll(dir)
+	f, size, err := packLayerFile(dir, digest)
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer f.Close()
+	if err := ow.tw.WriteHeader(ow.header(blobPath(digest), size)); err != nil {
+		return descriptor{}, err
+	}
+	if _, err := io.Copy(ow.tw, f); err != nil {
+		return descriptor{}, err
+	}
+	ow.blobs[digest] = size
+	return descriptor{MediaType: mediaTypeOCILayer, Digest: digest, Size: size}, nil
+}
+
+// 将 v 序列化为 JSON 写入 blobs 目录
+func (ow *ociWriter) writeBlob(mediaType string, v interface{}) (descriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, err
+	}
+	sum := sha256.Sum256(content)
+	desc := descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	if _, ok := ow.blobs[desc.Digest]; ok {
+		return desc, nil
+	}
+	ow.blobs[desc.Digest] = desc.Size
+	return desc, ow.writeFile(blobPath(desc.Digest), content)
+}
+
+func (ow *ociWriter) writeJSON(name string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ow.writeFile(name, content)
+}
+
+func (ow *ociWriter) writeFile(name string, content []byte) error {
+	if err := ow.tw.WriteHeader(ow.header(name, int64(len(content)))); err != nil {
+		return err
+	}
+	_, err := ow.tw.Write(content)
+	return err
+}
+
+func (ow *ociWriter) header(name string, size int64) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: size, ModTime: time.Unix(0, 0)}
+}
+
+// 将镜像层打包到 dir 下的临时文件中得到大小，同时检查镜像层是否被修改，返回的文件位于开头
+func packLayerFile(dir, digest string) (*os.File, int64, error) {
+	f, err := os.Create(filepath.Join(dir, strings.TrimPrefix(digest, "sha256:")+".tar"))
+	if err != nil {
+		return nil, 0, err
+	}
+	h := sha256.New()
+	if err := Pack(io.MultiWriter(f, h), LayerDir(digest)); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("pack layer %s error %v", digest, err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		f.Close()
+		return nil, 0, fmt.Errorf("layer %s is corrupted, got digest %s, run verify for details", digest, actual)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
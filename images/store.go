@@ -0,0 +1,653 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 镜像元数据文件，保存所有镜像的ID、tag、父镜像、镜像层等信息
+	repositoriesFile = "repositories.json"
+	// 以前每个镜像保存一份完整根文件系统的目录 rootfs/{镜像ID}，加载时迁移为镜像层
+	rootfsDir = "rootfs"
+	// 解压镜像层时的临时目录，与 layers 位于同一个文件系统中，完成后直接 rename 到 layers 目录
+	tmpDir   = "tmp"
+	lockFile = ".lock"
+)
+
+// 镜像元数据
+type Image struct {
+	// 镜像ID，为镜像元数据的 sha256 摘要
+	ID   string   `json:"id"`
+	Tags []string `json:"tags"`
+	// 父镜像ID，由 commit 生成的镜像记录提交时容器使用的镜像
+	Parent  string    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+	// 镜像层摘要，按从下到上的顺序，包括父镜像的各层
+	Layers []string `json:"layers"`
+	// 所有镜像层占用的空间，单位为字节
+	Size int64 `json:"size"`
+	// commit 时指定的作者和提交信息
+	Author  string      `json:"author,omitempty"`
+	Comment string      `json:"comment,omitempty"`
+	Config  ImageConfig `json:"config"`
+	// 包括父镜像在内的构建历史
+	History []History `json:"history,omitempty"`
+}
+
+// 创建镜像的参数
+type ImageOptions struct {
+	// 父镜像ID
+	Parent  string
+	Tags    []string
+	Author  string
+	Comment string
+	Config  ImageConfig
+	// 镜像的创建时间，为空时使用当前时间
+	Created time.Time
+	// 新镜像层的构建历史，为空时每个新镜像层生成一条
+	History []History
+}
+
+// 镜像仓库，镜像的 key 为镜像ID，镜像层的 key 为镜像层摘要
+type store struct {
+	Images map[string]*Image `json:"images"`
+	Layers map[string]*Layer `json:"layers"`
+	// 构建缓存，key 为父镜像、构建指令和输入内容的摘要，value 为该步骤生成的镜像ID
+	BuildCache map[string]string `json:"buildCache,omitempty"`
+}
+
+// 对镜像仓库加文件锁后加载元数据，write 为 true 时 fn 返回后保存修改
+// 同一时间只有一个 mydocker 进程读写镜像元数据
+func withStore(write bool, fn func(s *store) error) error {
+	if err := os.MkdirAll(ImagesStoreDir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path.Join(ImagesStoreDir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open image store lock error %v", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock image store error %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	s, migrated, err := loadStore()
+	if err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		if migrated {
+			// 迁移的旧镜像已经移动到 rootfs 目录，即使操作失败也需要保存
+			if saveErr := s.save(); saveErr != nil {
+				logrus.Errorf("save image store error %v", saveErr)
+			}
+		}
+		return err
+	}
+	if write || migrated {
+		return s.save()
+	}
+	return nil
+}
+
+func loadStore() (*store, bool, error) {
+	s := &store{Images: map[string]*Image{}}
+	content, err := os.ReadFile(path.Join(ImagesStoreDir, repositoriesFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, s); err != nil {
+			return nil, false, fmt.Errorf("unmarshal %s error %v", repositoriesFile, err)
+		}
+	}
+	if s.Layers == nil {
+		s.Layers = map[string]*Layer{}
+	}
+	if s.BuildCache == nil {
+		s.BuildCache = map[string]string{}
+	}
+	migrated, err := s.migrateLegacyImages()
+	if err != nil {
+		return s, migrated, err
+	}
+	flattened, err := s.migrateRootfsImages()
+	return s, migrated || flattened, err
+}
+
+// 先写入临时文件再重命名，写入中断不会损坏镜像元数据
+func (s *store) save() error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := path.Join(ImagesStoreDir, repositoriesFile)
+	if err := os.WriteFile(file+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// 以前的镜像是手动解压到 ImagesStoreDir/{镜像名} 的目录，将这些目录转换为镜像层并登记为 {镜像名}:latest
+func (s *store) migrateLegacyImages() (bool, error) {
+	entries, err := os.ReadDir(ImagesStoreDir)
+	if err != nil {
+		return false, err
+	}
+	migrated := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || name == rootfsDir || name == tmpDir || name == layersDir {
+			continue
+		}
+		ref, err := NormalizeReference(name)
+		if err != nil {
+			logrus.Warnf("skip legacy image directory %s: %v", name, err)
+			continue
+		}
+		if s.byTag(ref) != nil {
+			logrus.Warnf("skip legacy image directory %s: tag %s already exists", name, ref)
+			continue
+		}
+		// 旧版本启动的容器直接把该目录作为只读层挂载，容器配置中没有镜像信息，只能通过挂载信息判断
+		if mountedAsBranch(path.Join(ImagesStoreDir, name)) {
+			logrus.Warnf("legacy image directory %s is mounted by container, migrate it later", name)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return migrated, err
+		}
+		img := &Image{Tags: []string{ref}, Created: info.ModTime()}
+		if err := s.migrateRootfs(img, path.Join(ImagesStoreDir, name)); err != nil {
+			return migrated, fmt.Errorf("migrate legacy image %s error %v", name, err)
+		}
+		img.ID = imageID(img)
+		s.Images[img.ID] = img
+		migrated = true
+		logrus.Infof("migrate legacy image directory %s to %s", name, ShortID(img.ID))
+	}
+	return migrated, nil
+}
+
+// 目录是否是某个 aufs 或 overlay 挂载的分支
+// overlay 的 lowerdir/upperdir 和 aufs 的 br 选项（brs=1）出现在 /proc/self/mountinfo 的超级块选项中，
+// 默认情况下 aufs 的分支只能通过 /sys/fs/aufs/si_{si}/br{n} 查看
+func mountedAsBranch(dir string) bool {
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	dir = path.Clean(dir)
+	isDir := func(branch string) bool {
+		// aufs 的分支后面带有权限，例如 /var/lib/mydocker/images/busybox=ro
+		if i := strings.LastIndex(branch, "="); i > 0 {
+			branch = branch[:i]
+		}
+		return branch != "" && path.Clean(branch) == dir
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// 超级块选项位于 " - " 之后的第三个字段：文件系统类型、挂载源、超级块选项
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 3 {
+			continue
+		}
+		for _, opt := range strings.Split(fields[2], ",") {
+			key, value, _ := strings.Cut(opt, "=")
+			switch {
+			case key == "lowerdir" || key == "upperdir":
+				for _, branch := range strings.Split(value, ":") {
+					if isDir(branch) {
+						return true
+					}
+				}
+			case strings.HasPrefix(opt, "br:"):
+				for _, branch := range strings.Split(strings.TrimPrefix(opt, "br:"), ":") {
+					if isDir(branch) {
+						return true
+					}
+				}
+			case key == "si" && fields[0] == "aufs":
+				branches, _ := filepath.Glob(path.Join("/sys/fs/aufs", "si_"+value, "br[0-9]*"))
+				for _, file := range branches {
+					if branch, err := os.ReadFile(file); err == nil && isDir(strings.TrimSpace(string(branch))) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// 没有镜像层的镜像保存在 rootfs/{镜像ID} 目录，将根文件系统转换为镜像层，镜像ID保持不变
+// 正在被运行中容器挂载的根文件系统暂不迁移
+func (s *store) migrateRootfsImages() (bool, error) {
+	migrated := false
+	for _, img := range s.Images {
+		if len(img.Layers) > 0 {
+			continue
+		}
+		users, err := ContainersUsing(img.ID)
+		if err != nil {
+			return migrated, err
+		}
+		running := false
+		for _, c := range users {
+			running = running || c.Running
+		}
+		if running {
+			logrus.Warnf("image %s is used by running container, migrate it to layers later", ShortID(img.ID))
+			continue
+		}
+		rootfs := path.Join(ImagesStoreDir, rootfsDir, img.ID)
+		if _, err := os.Stat(rootfs); err != nil {
+			logrus.Warnf("rootfs of image %s not found: %v", ShortID(img.ID), err)
+			continue
+		}
+		if err := s.migrateRootfs(img, rootfs); err != nil {
+			return migrated, fmt.Errorf("migrate image %s error %v", ShortID(img.ID), err)
+		}
+		migrated = true
+		logrus.Infof("migrate rootfs of image %s to layer %s", ShortID(img.ID), ShortID(img.Layers[0]))
+	}
+	return migrated, nil
+}
+
+// 将完整的根文件系统目录转换为镜像的唯一一层，完成后删除原目录
+func (s *store) migrateRootfs(img *Image, rootfs string) error {
+	r := packReader(rootfs)
+	defer r.Close()
+	dir, digest, err := unpackLayer(r)
+	if err != nil {
+		return err
+	}
+	layer, err := s.addLayer(dir, digest)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	layer.References++
+	img.Layers, img.Parent, img.Size = []string{digest}, "", layer.Size
+	return os.RemoveAll(rootfs)
+}
+
+func (s *store) byTag(ref string) *Image {
+	for _, img := range s.Images {
+		for _, tag := range img.Tags {
+			if tag == ref {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// 按 name[:tag]、完整镜像ID或者镜像ID前缀查找镜像
+// 返回的 tagged 表示是否通过 tag 找到，rmi 通过 tag 删除时只删除该 tag
+func (s *store) lookup(ref string) (img *Image, tagged bool, err error) {
+	if normalized, err := NormalizeReference(ref); err == nil {
+		if img := s.byTag(normalized); img != nil {
+			return img, true, nil
+		}
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	if _, err := hex.DecodeString(strings.Repeat("0", len(id)%2) + id); err == nil && id != "" {
+		var matches []*Image
+		for imgID, img := range s.Images {
+			if strings.HasPrefix(imgID, id) {
+				matches = append(matches, img)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], false, nil
+		}
+		if len(matches) > 1 {
+			return nil, false, fmt.Errorf("image id prefix %s is ambiguous", ref)
+		}
+	}
+	return nil, false, fmt.Errorf("image %s not found", ref)
+}
+
+// 将 tag 指向 img，tag 原来指向的镜像去掉该 tag
+func (s *store) setTag(img *Image, ref string) {
+	if old := s.byTag(ref); old != nil {
+		if old == img {
+			return
+		}
+		old.Tags = removeString(old.Tags, ref)
+	}
+	img.Tags = append(img.Tags, ref)
+	sort.Strings(img.Tags)
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// 镜像ID为镜像元数据（不包括 tag）的 sha256 摘要
+func imageID(img *Image) string {
+	content, _ := json.Marshal(struct {
+		Parent  string      `json:"parent,omitempty"`
+		Created time.Time   `json:"created"`
+		Layers  []string    `json:"layers"`
+		Author  string      `json:"author,omitempty"`
+		Comment string      `json:"comment,omitempty"`
+		Config  ImageConfig `json:"config"`
+	}{img.Parent, img.Created, img.Layers, img.Author, img.Comment, img.Config})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// 目录中所有文件占用的空间
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// 在镜像仓库所在的文件系统中创建临时目录，用于解压镜像层
+func TempDir() (string, error) {
+	dir := path.Join(ImagesStoreDir, tmpDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "")
+}
+
+// 所有镜像，按创建时间从新到旧排序
+func Images() ([]*Image, error) {
+	var list []*Image
+	err := withStore(false, func(s *store) error {
+		for _, img := range s.Images {
+			list = append(list, img)
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, err
+}
+
+// 按 name[:tag] 或者镜像ID查找镜像
+func GetImage(ref string) (*Image, error) {
+	var img *Image
+	err := withStore(false, func(s *store) error {
+		var err error
+		img, _, err = s.lookup(ref)
+		return err
+	})
+	return img, err
+}
+
+// 以 tar 格式的镜像层 diff 创建新镜像，新镜像的镜像层为父镜像的各层加上 diff
+// diff 中的 whiteout 文件在容器挂载时删除下层中对应的文件
+func CreateImage(diff io.Reader, opts ImageOptions) (*Image, error) {
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return nil, err
+	}
+	opts.Tags = tags
+	dir, digest, err := unpackLayer(diff)
+	if err != nil {
+		return nil, err
+	}
+	return createImage([]string{dir}, []string{digest}, opts)
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	var refs []string
+	for _, tag := range tags {
+		ref, err := NormalizeReference(tag)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// 将 unpackLayer 解压好的镜像层登记到仓库中并创建镜像，dirs 和 digests 按从下到上的顺序
+func createImage(dirs, digests []string, opts ImageOptions) (*Image, error) {
+	// 镜像层登记到仓库后目录已经被移动或者删除
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	refs, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		Parent:  opts.Parent,
+		Created: opts.Created,
+		Author:  opts.Author,
+		Comment: opts.Comment,
+		Config:  opts.Config,
+	}
+	if img.Created.IsZero() {
+		img.Created = time.Now()
+	}
+	history := opts.History
+	if len(history) == 0 {
+		for range dirs {
+			history = append(history, History{Created: &img.Created, Author: img.Author, Comment: img.Comment})
+		}
+	}
+	err = withStore(true, func(s *store) error {
+		if img.Parent != "" {
+			parent, ok := s.Images[img.Parent]
+			if !ok {
+				return fmt.Errorf("parent image %s not found", img.Parent)
+			}
+			img.Layers = append(img.Layers, parent.Layers...)
+			img.History = append(img.History, parent.History...)
+		}
+		for i, dir := range dirs {
+			if _, err := s.addLayer(dir, digests[i]); err != nil {
+				return err
+			}
+			img.Layers = append(img.Layers, digests[i])
+		}
+		img.History = append(img.History, history...)
+		for _, d := range img.Layers {
+			s.Layers[d].References++
+			img.Size += s.Layers[d].Size
+		}
+		img.ID = imageID(img)
+		if existing, ok := s.Images[img.ID]; ok {
+			// 重复导入相同的镜像，镜像层的引用计数不变
+			for _, d := range img.Layers {
+				s.Layers[d].References--
+			}
+			img = existing
+		} else {
+			s.Images[img.ID] = img
+		}
+		for _, ref := range refs {
+			s.setTag(img, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// 为镜像添加 tag，target 已经指向其他镜像时改为指向 source
+func TagImage(source, target string) error {
+	ref, err := NormalizeReference(target)
+	if err != nil {
+		return err
+	}
+	return withStore(true, func(s *store) error {
+		img, _, err := s.lookup(source)
+		if err != nil {
+			return err
+		}
+		s.setTag(img, ref)
+		return nil
+	})
+}
+
+// 删除镜像
+// 通过 tag 删除并且镜像还有其他 tag 时只删除该 tag；否则删除镜像的所有 tag 和根文件系统
+// 有子镜像或者被运行中的容器使用的镜像不能删除，被已停止的容器使用时需要 force
+func RemoveImage(ref string, force bool) error {
+	return withStore(true, func(s *store) error {
+		img, tagged, err := s.lookup(ref)
+		if err != nil {
+			return err
+		}
+		if tagged && len(img.Tags) > 1 {
+			normalized, _ := NormalizeReference(ref)
+			img.Tags = removeString(img.Tags, normalized)
+			fmt.Printf("Untagged: %s\n", normalized)
+			return nil
+		}
+		for _, other := range s.Images {
+			if other.Parent == img.ID {
+				return fmt.Errorf("image %s has dependent child image %s", ShortID(img.ID), ShortID(other.ID))
+			}
+		}
+		if err := s.removeImage(img, force); err != nil {
+			return err
+		}
+		// 同时删除没有 tag、也没有其他子镜像的父镜像，例如 build 生成的中间镜像
+		for parent := s.Images[img.Parent]; parent != nil && len(parent.Tags) == 0 && !s.hasChildren(parent.ID); parent = s.Images[parent.Parent] {
+			if users, err := ContainersUsing(parent.ID); err != nil || len(users) > 0 {
+				break
+			}
+			if err := s.removeImage(parent, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 删除镜像和不再被引用的镜像层，以及指向该镜像的构建缓存
+func (s *store) removeImage(img *Image, force bool) error {
+	users, err := ContainersUsing(img.ID)
+	if err != nil {
+		return err
+	}
+	for _, c := range users {
+		if c.Running {
+			return fmt.Errorf("image %s is being used by running container %s", ShortID(img.ID), c.ID)
+		}
+		if !force {
+			return fmt.Errorf("image %s is being used by stopped container %s, use -f to force removal", ShortID(img.ID), c.ID)
+		}
+	}
+	if err := s.releaseLayers(img); err != nil {
+		return err
+	}
+	delete(s.Images, img.ID)
+	for key, id := range s.BuildCache {
+		if id == img.ID {
+			delete(s.BuildCache, key)
+		}
+	}
+	for _, tag := range img.Tags {
+		fmt.Printf("Untagged: %s\n", tag)
+	}
+	fmt.Printf("Deleted: sha256:%s\n", img.ID)
+	return nil
+}
+
+func (s *store) hasChildren(id string) bool {
+	for _, other := range s.Images {
+		if other.Parent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 使用镜像的容器
+type ContainerRef struct {
+	ID      string
+	Running bool
+}
+
+// 查找使用镜像的容器，容器信息中的 image 字段为镜像ID
+func ContainersUsing(id string) ([]ContainerRef, error) {
+	users, err := imageUsers()
+	if err != nil {
+		return nil, err
+	}
+	return users[id], nil
+}
+
+// 读取所有容器的信息，返回每个镜像ID对应的容器
+// 容器状态为 running 但进程已经不存在时视为已停止
+func imageUsers() (map[string][]ContainerRef, error) {
+	users := map[string][]ContainerRef{}
+	entries, err := os.ReadDir(containerInfoDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(path.Join(containerInfoDir, entry.Name(), "config.json"))
+		if err != nil {
+			continue
+		}
+		var info struct {
+			Id     string `json:"Id"`
+			Pid    string `json:"pid"`
+			Status string `json:"status"`
+			Image  string `json:"image"`
+		}
+		if err := json.Unmarshal(content, &info); err != nil || info.Image == "" {
+			continue
+		}
+		running := false
+		if info.Status == "running" && info.Pid != "" {
+			if _, err := os.Stat(path.Join("/proc", info.Pid)); err == nil {
+				running = true
+			}
+		}
+		users[info.Image] = append(users[info.Image], ContainerRef{ID: info.Id, Running: running})
+	}
+	return users, nil
+}
@@ -0,0 +1,240 @@
+package images
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func setupStore(t *testing.T) {
+	dir := t.TempDir()
+	oldStoreDir, oldContainerDir := ImagesStoreDir, containerInfoDir
+	ImagesStoreDir, containerInfoDir = path.Join(dir, "images"), path.Join(dir, "containers")
+	t.Cleanup(func() { ImagesStoreDir, containerInfoDir = oldStoreDir, oldContainerDir })
+}
+
+// 按顺序叠加镜像的各层，得到容器看到的根文件系统
+func flatten(t *testing.T, img *Image) string {
+	dir := t.TempDir()
+	for _, digest := range img.Layers {
+		r := packReader(LayerDir(digest))
+		if err := Unpack(r, dir); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	return dir
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref, name, tag string
+	}{
+		{"busybox", "busybox", "latest"},
+		{"busybox:1.36", "busybox", "1.36"},
+		{"localhost:5000/library/busybox", "localhost:5000/library/busybox", "latest"},
+		{"localhost:5000/busybox:v1", "localhost:5000/busybox", "v1"},
+		{"docker.io/library/busybox:1.36", "busybox", "1.36"},
+		{"docker.io/grafana/grafana", "grafana/grafana", "latest"},
+	}
+	for _, tt := range tests {
+		name, tag, err := ParseReference(tt.ref)
+		if err != nil || name != tt.name || tag != tt.tag {
+			t.Errorf("parse %s got %s %s %v", tt.ref, name, tag, err)
+		}
+	}
+	for _, ref := range []string{"", "BusyBox", "busybox:", "busybox:-x", "a//b"} {
+		if _, _, err := ParseReference(ref); err == nil {
+			t.Errorf("parse %q expect error", ref)
+		}
+	}
+}
+
+func TestImageStore(t *testing.T) {
+	setupStore(t)
+	// 手动解压的旧镜像目录
+	legacy := path.Join(ImagesStoreDir, "busybox", "bin")
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path.Join(legacy, "sh"), []byte("12345"), 0755)
+
+	busybox, err := GetImage("busybox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busybox.Size != 5 || len(busybox.Tags) != 1 || busybox.Tags[0] != "busybox:latest" || len(busybox.Layers) != 1 {
+		t.Errorf("legacy image %+v", busybox)
+	}
+	if _, err := os.Stat(path.Join(LayerDir(busybox.Layers[0]), "bin", "sh")); err != nil {
+		t.Errorf("legacy rootfs not migrated: %v", err)
+	}
+
+	child, err := CommitImage(t.TempDir(), ImageOptions{Parent: busybox.ID, Tags: []string{"app:v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(child.Layers) != 2 || child.Layers[0] != busybox.Layers[0] {
+		t.Errorf("child layers %v", child.Layers)
+	}
+	if err := TagImage("app:v1", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := GetImage(child.ID[:8]); err != nil || img.ID != child.ID || len(img.Tags) != 2 {
+		t.Errorf("get by id prefix %+v %v", img, err)
+	}
+
+	// 有子镜像的镜像不能删除，通过 tag 删除有多个 tag 的镜像时只删除 tag
+	if err := RemoveImage("busybox", false); err == nil {
+		t.Errorf("remove parent image expect error")
+	}
+	if err := RemoveImage("app:v1", false); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := GetImage("app"); err != nil || len(img.Tags) != 1 {
+		t.Errorf("untag %+v %v", img, err)
+	}
+
+	// 被已停止的容器使用的镜像需要 force 才能删除
+	containerDir := path.Join(containerInfoDir, "1234567890")
+	os.MkdirAll(containerDir, 0755)
+	os.WriteFile(path.Join(containerDir, "config.json"), []byte(`{"Id":"1234567890","status":"stop","image":"`+child.ID+`"}`), 0644)
+	if err := RemoveImage("app", false); err == nil {
+		t.Errorf("remove image used by container expect error")
+	}
+	if err := RemoveImage("app", true); err != nil {
+		t.Fatal(err)
+	}
+	// 子镜像的新镜像层被删除，与父镜像共用的镜像层保留
+	if _, err := os.Stat(LayerDir(child.Layers[1])); !os.IsNotExist(err) {
+		t.Errorf("layer of removed image still exists")
+	}
+	if err := VerifyLayers(nil); err != nil {
+		t.Errorf("verify layers %v", err)
+	}
+	list, err := Images()
+	if err != nil || len(list) != 1 || list[0].ID != busybox.ID {
+		t.Errorf("images %v %v", list, err)
+	}
+
+	// 镜像层被修改后 verify 失败
+	os.WriteFile(path.Join(LayerDir(busybox.Layers[0]), "bin", "sh"), []byte("54321"), 0755)
+	if err := VerifyLayers([]string{"busybox"}); err == nil {
+		t.Errorf("verify modified layer expect error")
+	}
+}
+
+func TestCommitImage(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	os.WriteFile(path.Join(rootfs, "etc", "hosts"), []byte("hosts"), 0644)
+	os.WriteFile(path.Join(rootfs, "etc", "passwd"), []byte("root"), 0644)
+	base, err := CommitImage(rootfs, ImageOptions{Tags: []string{"base"}, Config: ImageConfig{Env: []string{"PATH=/bin", "A=1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// aufs 读写层：删除 hosts，修改 passwd，新增 app
+	diff := t.TempDir()
+	os.MkdirAll(path.Join(diff, "etc"), 0755)
+	os.MkdirAll(path.Join(diff, ".wh..wh.plnk"), 0700)
+	os.WriteFile(path.Join(diff, "etc", ".wh.hosts"), nil, 0444)
+	os.WriteFile(path.Join(diff, "etc", "passwd"), []byte("root app"), 0644)
+	os.WriteFile(path.Join(diff, "app"), []byte("app"), 0755)
+
+	cfg := base.Config
+	cfg.SetEnv("A=2")
+	for _, change := range []string{`CMD ["/app", "-v"]`, "ENV MODE prod"} {
+		if err := cfg.ApplyChange(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cfg.ApplyChange("EXPOSE 80"); err == nil {
+		t.Errorf("unsupported change expect error")
+	}
+	img, err := CommitImage(diff, ImageOptions{Parent: base.ID, Tags: []string{"app:v1"}, Author: "mydocker", Comment: "add app", Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = GetImage("app:v1")
+	if err != nil || img.Parent != base.ID || img.Author != "mydocker" || img.Comment != "add app" {
+		t.Fatalf("commit image %+v %v", img, err)
+	}
+	if strings.Join(img.Config.Env, " ") != "PATH=/bin A=2 MODE=prod" || strings.Join(img.Config.Cmd, " ") != "/app -v" {
+		t.Errorf("commit image config %+v", img.Config)
+	}
+	merged := flatten(t, img)
+	for name, content := range map[string]string{"etc/hosts": "", "etc/passwd": "root app", "app": "app", ".wh..wh.plnk": ""} {
+		data, err := os.ReadFile(path.Join(merged, name))
+		if content == "" && err == nil || content != "" && string(data) != content {
+			t.Errorf("%s content %q %v", name, data, err)
+		}
+	}
+}
+
+func TestSharedLayers(t *testing.T) {
+	setupStore(t)
+	rootfs := t.TempDir()
+	os.WriteFile(path.Join(rootfs, "sh"), []byte("sh"), 0755)
+	buf := &bytes.Buffer{}
+	if err := Pack(buf, rootfs); err != nil {
+		t.Fatal(err)
+	}
+	// 相同内容导入两次共用同一个镜像层
+	a, err := ImportImage(bytes.NewReader(buf.Bytes()), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ImportImage(bytes.NewReader(buf.Bytes()), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID == b.ID || a.Layers[0] != b.Layers[0] {
+		t.Fatalf("layers of a %v b %v", a.Layers, b.Layers)
+	}
+	if err := RemoveImage("a", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(LayerDir(b.Layers[0]), "sh")); err != nil {
+		t.Errorf("shared layer removed %v", err)
+	}
+	if err := RemoveImage("b", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(LayerDir(b.Layers[0])); !os.IsNotExist(err) {
+		t.Errorf("unreferenced layer still exists")
+	}
+}
+
+func TestMigrateMountedLegacyImage(t *testing.T) {
+	setupStore(t)
+	legacy := path.Join(ImagesStoreDir, "busybox")
+	if err := os.MkdirAll(path.Join(legacy, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path.Join(legacy, "bin", "sh"), []byte("12345"), 0755)
+	// 模拟旧版本启动的容器把镜像目录作为只读层挂载
+	mnt := t.TempDir()
+	if err := syscall.Mount("overlay", mnt, "overlay", 0, "lowerdir="+legacy+":"+t.TempDir()); err != nil {
+		t.Skipf("mount overlay error %v", err)
+	}
+	defer syscall.Unmount(mnt, syscall.MNT_DETACH)
+
+	if _, err := GetImage("busybox"); err == nil {
+		t.Error("mounted legacy image directory should not be migrated")
+	}
+	if _, err := os.Stat(path.Join(mnt, "bin", "sh")); err != nil {
+		t.Errorf("rootfs of running container removed: %v", err)
+	}
+
+	if err := syscall.Unmount(mnt, syscall.MNT_DETACH); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetImage("busybox"); err != nil {
+		t.Errorf("migrate legacy image after umount error %v", err)
+	}
+}
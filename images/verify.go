@@ -0,0 +1,94 @@
+package images
+
+import (
+	"fmt"
+	"mydocker/util"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// 重新计算镜像层的摘要，检查镜像层是否被修改，同时检查镜像层的引用计数
+// refs 为空时检查所有镜像层，否则只检查指定镜像的各层
+func VerifyLayers(refs []string) error {
+	var layers []*Layer
+	// 镜像引用了但是仓库中不存在的镜像层
+	missing := map[string]bool{}
+	expected := map[string]int{}
+	err := withStore(false, func(s *store) error {
+		selected := map[string]bool{}
+		for _, img := range s.Images {
+			for _, digest := range img.Layers {
+				expected[digest]++
+				if len(refs) == 0 {
+					selected[digest] = true
+				}
+			}
+		}
+		for _, ref := range refs {
+			img, _, err := s.lookup(ref)
+			if err != nil {
+				return err
+			}
+			for _, digest := range img.Layers {
+				selected[digest] = true
+			}
+		}
+		for digest, layer := range s.Layers {
+			if len(refs) == 0 || selected[digest] {
+				copied := *layer
+				layers = append(layers, &copied)
+			}
+		}
+		// 镜像引用了仓库中不存在的镜像层
+		for digest := range selected {
+			if _, ok := s.Layers[digest]; !ok {
+				layers = append(layers, &Layer{Digest: digest})
+				missing[digest] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(layers, func(i, j int) bool { return layers[i].Digest < layers[j].Digest })
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "LAYER\tSIZE\tREFERENCES\tSTATUS\n")
+	failed := 0
+	for _, layer := range layers {
+		status := "missing in store"
+		if !missing[layer.Digest] {
+			status = verifyLayer(layer, expected[layer.Digest])
+		}
+		if status != "ok" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", ShortID(layer.Digest), util.HumanSize(layer.Size), expected[layer.Digest], status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d layers failed verification", failed, len(layers))
+	}
+	return nil
+}
+
+func verifyLayer(layer *Layer, references int) string {
+	if _, err := os.Stat(LayerDir(layer.Digest)); err != nil {
+		return fmt.Sprintf("missing: %v", err)
+	}
+	digest, err := layerDigest(LayerDir(layer.Digest))
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if digest != layer.Digest {
+		return fmt.Sprintf("digest mismatch: %s", digest)
+	}
+	if layer.References != references {
+		return fmt.Sprintf("references %d, expect %d", layer.References, references)
+	}
+	return "ok"
+}
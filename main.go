@@ -17,20 +17,39 @@ func main() {
 
 	app.Commands = []cli.Command{ // 根据参数选择执行函数，例如 mydocker run 执行runCommand，run为函数中 cli 的Name
 		initCommand,
+		proxyCommand,
+		dnsCommand,
 		runCommand,
 		commitCommand,
+		buildCommand,
+		imagesCommand,
+		imageCommand,
+		rmiCommand,
+		tagCommand,
+		importCommand,
+		exportCommand,
+		loadCommand,
+		saveCommand,
+		pullCommand,
+		pushCommand,
+		verifyCommand,
 		listCommand,
 		logCommand,
 		execCommand,
 		stopCommand,
 		rmCommand,
+		portCommand,
+		updateCommand,
 		networkCommand,
+		containerManageCommand,
+		systemCommand,
 	}
 
 	app.Before = func(ctx *cli.Context) error {
 		// Log as JSON instead of the default ASCII formatter.
 		logrus.SetFormatter(&logrus.JSONFormatter{})
-		logrus.SetOutput(os.Stdout)
+		// 日志输出到标准错误，export、save 等命令向标准输出写入 tar 包时日志不会混入其中
+		logrus.SetOutput(os.Stderr)
 		return nil
 	}
 
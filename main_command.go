@@ -2,13 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"mydocker/cgroups/subsystems"
 	"mydocker/container"
 	"mydocker/images"
 	"mydocker/network"
 	"mydocker/util"
+	"net"
 	"os"
-	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -17,8 +21,8 @@ import (
 var runCommand = cli.Command{
 	Name: "run",
 	Usage: `Create a container with namespace and cgroups limit
-			mydocker run -ti [command]`,
-	Flags: []cli.Flag{
+			mydocker run -ti image [command]`,
+	Flags: append([]cli.Flag{
 		cli.BoolFlag{Name: "ti", Usage: "enable tty"},
 		cli.StringFlag{Name: "m", Usage: "memory limit"},
 		cli.StringFlag{Name: "cpushare", Usage: "cpushare limit"},
@@ -27,9 +31,16 @@ var runCommand = cli.Command{
 		cli.BoolFlag{Name: "d", Usage: "detach container, run as a daemon"},
 		cli.StringFlag{Name: "name", Usage: "Container name"},
 		cli.StringSliceFlag{Name: "e", Usage: "set environment"},
-		cli.StringFlag{Name: "net", Usage: "container network"},
-		cli.StringSliceFlag{ Name: "p", Usage: "port mapping"},
-	},
+		cli.StringFlag{Name: "entrypoint", Usage: "overwrite the default entrypoint of the image"},
+		cli.StringFlag{Name: "net", Usage: "container network name, or network mode: host, none, container:<id>"},
+		cli.StringSliceFlag{ Name: "p", Usage: "port mapping, eg: -p [hostIP:][hostPort[-end]:]containerPort[-end][/tcp|udp|sctp]"},
+		cli.StringSliceFlag{Name: "network-alias", Usage: "add network-scoped alias for the container in the network DNS"},
+		cli.BoolTFlag{Name: "userland-proxy", Usage: "use userland proxy for published ports, disable it with --userland-proxy=false to use hairpin NAT"},
+		cli.StringFlag{Name: "hostname", Usage: "container host name, default is container ID"},
+		cli.StringSliceFlag{Name: "add-host", Usage: "add a custom host-to-IP mapping to /etc/hosts, eg: --add-host myhost:192.168.1.10"},
+		cli.StringSliceFlag{Name: "dns", Usage: "set custom DNS servers"},
+		cli.StringSliceFlag{Name: "dns-search", Usage: "set custom DNS search domains"},
+	}, bandwidthFlags...),
 	/*
 		run命令执行的真正函数
 		1. 判断参数是否包含command
@@ -38,18 +49,18 @@ var runCommand = cli.Command{
 	*/
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
-			return fmt.Errorf("missing container command")
+			return fmt.Errorf("missing image name")
 		}
-		var cmdArray []string
-		for _, arg := range context.Args() {
-			cmdArray = append(cmdArray, arg)
+		imageName := context.Args().Get(0)
+		// 按 name[:tag] 或者镜像ID在镜像仓库中查找镜像
+		img, err := images.GetImage(imageName)
+		if err != nil {
+			return err
 		}
-		imageName := cmdArray[0]
-		cmdArray = cmdArray[1:]
-		imagePath := path.Join(images.ImagesStoreDir, imageName)
-		exist, _ := util.FileOrDirExits(imagePath)
-		if !exist{
-			return fmt.Errorf("image name %s not found in %s", imageName, images.ImagesStoreDir)
+		entrypoint, cmd := containerCommand(img.Config, context.IsSet("entrypoint"), context.String("entrypoint"), context.Args()[1:])
+		cmdArray := append(append([]string{}, entrypoint...), cmd...)
+		if len(cmdArray) == 0 {
+			return fmt.Errorf("no command specified and image %s has no Entrypoint or Cmd", imageName)
 		}
 		tty := context.Bool("ti")
 		detach := context.Bool("d")
@@ -68,14 +79,90 @@ var runCommand = cli.Command{
 		containerName := context.String("name")
 		nw := context.String("net")
 
+		// 镜像中的环境变量作为默认值，-e 指定的同名变量覆盖镜像中的值
+		config := img.Config
+		config.Env = append([]string{}, img.Config.Env...)
+		config.SetEnv(context.StringSlice("e")...)
 		envs := context.StringSlice("e")
 		portmapping := context.StringSlice("p")
+		// 提前检查端口映射格式，避免容器启动后才发现参数错误
+		for _, pm := range portmapping {
+			if _, err := network.ParsePortMapping(pm); err != nil {
+				return err
+			}
+		}
+		if len(portmapping) > 0 && !container.IsNetworkName(nw) {
+			return fmt.Errorf("port mapping requires a container network, eg: --net mybridge")
+		}
+		if strings.HasPrefix(nw, container.NetworkModeContainerPrefix) {
+			if _, err := container.GetNetworkContainer(nw); err != nil {
+				return err
+			}
+			if context.String("hostname") != "" || len(context.StringSlice("add-host")) > 0 || len(context.StringSlice("dns")) > 0 ||
+				len(context.StringSlice("dns-search")) > 0 {
+				return fmt.Errorf("hostname, add-host and dns options can not be used with network mode %s", nw)
+			}
+		}
+
+		for _, host := range context.StringSlice("add-host") {
+			if _, _, err := container.ParseExtraHost(host); err != nil {
+				return err
+			}
+		}
+		for _, dns := range context.StringSlice("dns") {
+			if net.ParseIP(dns) == nil {
+				return fmt.Errorf("invalid dns server %s", dns)
+			}
+		}
+
+		cinfo := &container.ContainerInfo{
+			Name:        containerName,
+			Volume:      volume,
+			PortMapping: portmapping,
+
+			UserlandProxy:  context.BoolT("userland-proxy"),
+			NetworkAliases: context.StringSlice("network-alias"),
+
+			Hostname:   context.String("hostname"),
+			ExtraHosts: context.StringSlice("add-host"),
+			DNS:        context.StringSlice("dns"),
+			DNSSearch:  context.StringSlice("dns-search"),
 
-		Run(tty, cmdArray, resConf, volume, containerName, imageName, envs, nw, portmapping)
+			NetworkMode: nw,
+			Image:       img.ID,
+			Env:         envs,
+			Entrypoint:  entrypoint,
+			Cmd:         cmd,
+			WorkingDir:  img.Config.WorkingDir,
+			User:        img.Config.User,
+		}
+		if err := parseBandwidthFlags(context, cinfo); err != nil {
+			return err
+		}
+		if (cinfo.IngressRate > 0 || cinfo.EgressRate > 0) && !container.IsNetworkName(nw) {
+			return fmt.Errorf("bandwidth limit requires a container network, eg: --net mybridge")
+		}
+		Run(tty, cmdArray, resConf, cinfo, img.ID, config.Env)
 		return nil
 	},
 }
 
+// 容器的 Entrypoint 和 Cmd，执行的命令为两者相加，有参数时参数代替镜像的 Cmd
+// 与 docker 相同，--entrypoint 会同时清除镜像的 Cmd，--entrypoint "" 表示不使用 Entrypoint
+func containerCommand(config images.ImageConfig, overrideEntrypoint bool, entrypoint string, args []string) ([]string, []string) {
+	entrypointArray, cmdArray := config.Entrypoint, config.Cmd
+	if overrideEntrypoint {
+		entrypointArray, cmdArray = nil, nil
+		if entrypoint != "" {
+			entrypointArray = []string{entrypoint}
+		}
+	}
+	if len(args) > 0 {
+		cmdArray = args
+	}
+	return entrypointArray, cmdArray
+}
+
 var initCommand = cli.Command{
 	Name:  "init",
 	Usage: "Init container process run user's process in container. Do not call it outside",
@@ -85,26 +172,418 @@ var initCommand = cli.Command{
 	*/
 	Action: func(ctx *cli.Context) error {
 		logrus.Infof("Init come on")
-		cmd := ctx.Args().Get(0)
-		logrus.Infof("command: %s", cmd)
-		err := container.RunContainerInitProcess()
+		containerId := ctx.Args().Get(0)
+		logrus.Infof("container: %s", containerId)
+		err := container.RunContainerInitProcess(containerId)
 		return err
 	},
 }
 
+var proxyCommand = cli.Command{
+	Name:   "proxy",
+	Usage:  "Userland proxy for published container ports. Do not call it outside",
+	Hidden: true,
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "proto", Value: "tcp", Usage: "protocol, tcp or udp"},
+		cli.StringFlag{Name: "host-addr", Usage: "host listen address, eg: 0.0.0.0:8080"},
+		cli.StringFlag{Name: "container-addr", Usage: "container address, eg: 192.168.10.2:80"},
+		cli.IntFlag{Name: "container-pid", Usage: "proxy exits when the container process exits"},
+	},
+	Action: func(ctx *cli.Context) error {
+		proxy := &network.Proxy{
+			Proto:         ctx.String("proto"),
+			HostAddr:      ctx.String("host-addr"),
+			ContainerAddr: ctx.String("container-addr"),
+			ContainerPid:  ctx.Int("container-pid"),
+		}
+		return proxy.Run()
+	},
+}
+
+var dnsCommand = cli.Command{
+	Name:   "dns",
+	Usage:  "Embedded DNS server of a container network. Do not call it outside",
+	Hidden: true,
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "network", Usage: "network name"},
+		cli.StringFlag{Name: "listen", Usage: "listen address, eg: 192.168.10.1:53"},
+	},
+	Action: func(ctx *cli.Context) error {
+		server := &network.DNSServer{
+			Network:    ctx.String("network"),
+			ListenAddr: ctx.String("listen"),
+		}
+		return server.Run()
+	},
+}
+
 var commitCommand = cli.Command{
 	Name:  "commit",
-	Usage: "commit a container into image, eg: ./mydocker commit 9871200000. This will be a tar in /root dir.",
+	Usage: "create a new image from a container's changes, eg: ./mydocker commit -m \"add app\" 9871200000 myapp:v1",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "author, a", Usage: "author, eg: \"John Hannibal Smith <hannibal@a-team.com>\""},
+		cli.StringFlag{Name: "message, m", Usage: "commit message"},
+		cli.StringSliceFlag{Name: "change, c", Usage: "apply CMD, ENTRYPOINT, ENV, WORKDIR, USER or LABEL instruction to the created image, eg: -c 'CMD [\"top\"]' -c 'ENV MODE=prod'"},
+		cli.BoolFlag{Name: "pause, p", Usage: "pause container during commit"},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 || len(ctx.Args()) > 2 {
+			return fmt.Errorf("usage: mydocker commit [OPTIONS] CONTAINER [REPOSITORY[:TAG]]")
+		}
+		return CommitContainer(ctx.Args().Get(0), ctx.Args().Get(1), &commitOptions{
+			author:  ctx.String("author"),
+			message: ctx.String("message"),
+			changes: ctx.StringSlice("change"),
+			pause:   ctx.Bool("pause"),
+		})
+	},
+}
+
+var imagesCommand = cli.Command{
+	Name:  "images",
+	Usage: "list images in the image store",
+	Flags: []cli.Flag{
+		cli.BoolFlag{Name: "all, a", Usage: "show all images, including intermediate images"},
+	},
+	Action: func(ctx *cli.Context) error {
+		return images.ListImages(ctx.Bool("all"))
+	},
+}
+
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "image inspection and cleanup commands",
+	Subcommands: []cli.Command{
+		{
+			Name:  "history",
+			Usage: "show the layers and build history of an image, eg: ./mydocker image history busybox:latest",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "no-trunc", Usage: "do not truncate layer digests and created by instructions"},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				return images.ImageHistory(ctx.Args().Get(0), ctx.Bool("no-trunc"))
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "display the config and manifest of images as JSON, eg: ./mydocker image inspect busybox:latest",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing image name")
+				}
+				return images.InspectImages(ctx.Args())
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "show files added (A), changed (C) and deleted (D) from image a to image b, eg: ./mydocker image diff busybox:latest myapp:v1",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("image diff requires two images")
+				}
+				return images.DiffImages(ctx.Args().Get(0), ctx.Args().Get(1))
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "remove dangling images, with -a remove all images not used by containers, eg: ./mydocker image prune --filter until=24h",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{Name: "all, a", Usage: "remove all images not used by containers, not just dangling ones"},
+			}, pruneFlags...),
+			Action: func(ctx *cli.Context) error {
+				until, err := pruneUntil(ctx)
+				if err != nil {
+					return err
+				}
+				size, err := images.PruneImages(images.PruneOptions{All: ctx.Bool("all"), Until: until, DryRun: ctx.Bool("dry-run")})
+				if err != nil {
+					return err
+				}
+				printReclaimed(size, ctx.Bool("dry-run"))
+				return nil
+			},
+		},
+	},
+}
+
+var rmiCommand = cli.Command{
+	Name:  "rmi",
+	Usage: "remove one or more images, eg: ./mydocker rmi busybox:latest",
+	Flags: []cli.Flag{
+		cli.BoolFlag{Name: "f", Usage: "force removal of images used by stopped containers"},
+	},
 	Action: func(ctx *cli.Context) error {
 		if len(ctx.Args()) < 1 {
-			return fmt.Errorf("missing container name")
+			return fmt.Errorf("missing image name")
+		}
+		for _, ref := range ctx.Args() {
+			if err := images.RemoveImage(ref, ctx.Bool("f")); err != nil {
+				return err
+			}
 		}
-		containerId := ctx.Args().Get(0)
-		commitContainer(containerId)
 		return nil
 	},
 }
 
+var tagCommand = cli.Command{
+	Name:  "tag",
+	Usage: "create a tag that refers to an image, eg: ./mydocker tag busybox:latest mybusybox:v1",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 2 {
+			return fmt.Errorf("usage: mydocker tag SOURCE_IMAGE[:TAG] TARGET_IMAGE[:TAG]")
+		}
+		return images.TagImage(ctx.Args().Get(0), ctx.Args().Get(1))
+	},
+}
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "import a rootfs tarball as image, eg: ./mydocker import busybox.tar busybox:latest, use - to read from stdin",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) != 2 {
+			return fmt.Errorf("usage: mydocker import TARBALL|- NAME[:TAG]")
+		}
+		var r io.Reader = os.Stdin
+		if src := ctx.Args().Get(0); src != "-" {
+			file, err := os.Open(src)
+			if err != nil {
+				return fmt.Errorf("open %s error %v", src, err)
+			}
+			defer file.Close()
+			r = file
+		}
+		img, err := images.ImportImage(r, ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("sha256:%s\n", img.ID)
+		return nil
+	},
+}
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export a container's filesystem as a tar archive, eg: ./mydocker export -o rootfs.tar 9871200000",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "o", Usage: "write to a file, instead of stdout"},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		return ExportContainer(ctx.Args().Get(0), ctx.String("o"))
+	},
+}
+
+var loadCommand = cli.Command{
+	Name:  "load",
+	Usage: "load images from a docker save archive or an OCI layout tarball, eg: ./mydocker load -i busybox.tar",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "input, i", Usage: "read from tar archive file, instead of stdin"},
+	},
+	Action: func(ctx *cli.Context) error {
+		var r io.Reader = os.Stdin
+		if input := ctx.String("input"); input != "" {
+			file, err := os.Open(input)
+			if err != nil {
+				return fmt.Errorf("open %s error %v", input, err)
+			}
+			defer file.Close()
+			r = file
+		}
+		_, err := images.LoadImages(r)
+		return err
+	},
+}
+
+var registryFlags = []cli.Flag{
+	cli.BoolFlag{Name: "insecure", Usage: "access the registry over plain HTTP"},
+	cli.StringFlag{Name: "creds", Usage: "credentials for the registry, format: username[:password]"},
+}
+
+func registryOptions(ctx *cli.Context) *images.RegistryOptions {
+	opts := &images.RegistryOptions{Insecure: ctx.Bool("insecure"), Platform: ctx.String("platform")}
+	if creds := ctx.String("creds"); creds != "" {
+		opts.Username, opts.Password, _ = strings.Cut(creds, ":")
+	}
+	return opts
+}
+
+// prune 命令共用的参数
+var pruneFlags = []cli.Flag{
+	cli.StringSliceFlag{Name: "filter", Usage: "filter values, only until=<timestamp|duration> is supported, eg: until=24h, until=2024-01-02T15:04:05Z"},
+	cli.BoolFlag{Name: "dry-run", Usage: "only print what would be removed"},
+}
+
+// 解析 --filter until=，为零值时不限制创建时间
+func pruneUntil(ctx *cli.Context) (time.Time, error) {
+	var until time.Time
+	for _, filter := range ctx.StringSlice("filter") {
+		key, value, _ := strings.Cut(filter, "=")
+		if key != "until" {
+			return until, fmt.Errorf("invalid filter %q, only until is supported", filter)
+		}
+		t, err := parseUntil(value)
+		if err != nil {
+			return until, err
+		}
+		until = t
+	}
+	return until, nil
+}
+
+// until 可以是相对现在的时长，例如 10m、24h，也可以是 RFC3339、日期、本地时间或者 Unix 时间戳
+func parseUntil(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{util.TIMESTAP, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid until filter %q", value)
+}
+
+var containerManageCommand = cli.Command{
+	Name:  "container",
+	Usage: "container management commands",
+	Subcommands: []cli.Command{
+		{
+			Name:  "prune",
+			Usage: "remove all stopped containers, including their write layers, mounts and logs, eg: ./mydocker container prune --filter until=24h",
+			Flags: pruneFlags,
+			Action: func(ctx *cli.Context) error {
+				until, err := pruneUntil(ctx)
+				if err != nil {
+					return err
+				}
+				size, err := PruneContainers(until, ctx.Bool("dry-run"))
+				if err != nil {
+					return err
+				}
+				printReclaimed(size, ctx.Bool("dry-run"))
+				return nil
+			},
+		},
+	},
+}
+
+var systemCommand = cli.Command{
+	Name:  "system",
+	Usage: "manage disk usage of mydocker",
+	Subcommands: []cli.Command{
+		{
+			Name:  "df",
+			Usage: "show disk usage of images, layers, containers, volumes and logs",
+			Action: func(ctx *cli.Context) error {
+				return SystemDiskUsage()
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "remove stopped containers, dangling images and unreferenced layers, eg: ./mydocker system prune -a --dry-run",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{Name: "all, a", Usage: "remove all images not used by containers, not just dangling ones"},
+			}, pruneFlags...),
+			Action: func(ctx *cli.Context) error {
+				until, err := pruneUntil(ctx)
+				if err != nil {
+					return err
+				}
+				return SystemPrune(ctx.Bool("all"), until, ctx.Bool("dry-run"))
+			},
+		},
+	},
+}
+
+var buildCommand = cli.Command{
+	Name:  "build",
+	Usage: "build an image from a build file, eg: ./mydocker build -f Buildfile -t myapp:v1 .",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "file, f", Usage: "path of the build file, default is Buildfile in the build context"},
+		cli.StringSliceFlag{Name: "tag, t", Usage: "name and optionally a tag in the name:tag format"},
+		cli.BoolFlag{Name: "no-cache", Usage: "do not use cache when building the image"},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing build context")
+		}
+		return BuildImage(ctx.Args().Get(0), ctx.String("file"), ctx.StringSlice("tag"), ctx.Bool("no-cache"))
+	},
+}
+
+var pullCommand = cli.Command{
+	Name:  "pull",
+	Usage: "pull an image from a registry, eg: ./mydocker pull --insecure localhost:5000/busybox:latest",
+	Flags: append([]cli.Flag{
+		cli.StringFlag{Name: "platform", Usage: "pull the image for platform os/arch[/variant], eg: linux/arm64"},
+	}, registryFlags...),
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing image name")
+		}
+		_, err := images.PullImage(ctx.Args().Get(0), registryOptions(ctx))
+		return err
+	},
+}
+
+var pushCommand = cli.Command{
+	Name:  "push",
+	Usage: "push an image to a registry, eg: ./mydocker push --insecure localhost:5000/busybox:latest",
+	Flags: registryFlags,
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing image name")
+		}
+		return images.PushImage(ctx.Args().Get(0), registryOptions(ctx))
+	},
+}
+
+var saveCommand = cli.Command{
+	Name:  "save",
+	Usage: "save images to an OCI layout tarball, eg: ./mydocker save -o busybox.tar busybox:latest",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "output, o", Usage: "write to a file, instead of stdout"},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing image name")
+		}
+		output := ctx.String("output")
+		if output == "" {
+			return images.SaveImages(os.Stdout, ctx.Args())
+		}
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("create %s error %v", output, err)
+		}
+		defer file.Close()
+		if err := images.SaveImages(file, ctx.Args()); err != nil {
+			os.Remove(output)
+			return err
+		}
+		return nil
+	},
+}
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "verify digests and reference counts of image layers, eg: ./mydocker verify [busybox:latest]",
+	Action: func(ctx *cli.Context) error {
+		return images.VerifyLayers(ctx.Args())
+	},
+}
+
 var listCommand = cli.Command{
 	Name: "ps",
 	Usage: "list all registering containers",
@@ -175,23 +654,88 @@ var rmCommand = cli.Command{
 	},
 }
 
+var portCommand = cli.Command{
+	Name: "port",
+	Usage: "list port mappings of a container, eg: ./mydocker port 容器ID",
+	Action: func (ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		containerId := ctx.Args().Get(0)
+		ListContainerPorts(containerId)
+		return nil
+	},
+}
+
+var updateCommand = cli.Command{
+	Name:  "update",
+	Usage: "update bandwidth limit of a running container, eg: ./mydocker update --egress-rate 10mbit 容器ID",
+	Flags: bandwidthFlags,
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return fmt.Errorf("missing container id")
+		}
+		return UpdateContainer(ctx, ctx.Args().Get(0))
+	},
+}
+
 var networkCommand = cli.Command{
 	Name: "network",
 	Usage: "container network commands",
 	Subcommands: []cli.Command{
 		{
 			Name: "create",
-			Usage: "create a container network, eg: ./mydocker network create --driver bridge --subnet 192.168.10.1/24 mybridge",
+			Usage: "create a container network, eg: ./mydocker network create --driver bridge --subnet 192.168.10.1/24 [--ipv6 --subnet-v6 fd00:10::/64] mybridge",
 			Flags: []cli.Flag{
-				cli.StringFlag{Name: "driver", Usage: "network driver"},
+				cli.StringFlag{Name: "driver", Value: "bridge", Usage: "network driver: bridge, macvlan, ipvlan, overlay or cni"},
 				cli.StringFlag{Name: "subnet", Usage: "subnet CIDR, eg: 192.168.10.0/24"},
+				cli.BoolFlag{Name: "ipv6", Usage: "enable IPv6 networking, dual-stack with the IPv4 subnet"},
+				cli.StringFlag{Name: "subnet-v6", Usage: "IPv6 subnet CIDR, eg: fd00:10::/64"},
+				cli.StringFlag{Name: "ipv6-mode", Value: network.IPv6ModeNAT, Usage: "IPv6 egress mode, nat (NAT66) or routed"},
+				cli.StringSliceFlag{Name: "o", Usage: "driver specific options, eg: -o mtu=1450 -o bridge_name=br0 -o enable_icc=false, -o parent=eth0 -o macvlan_mode=bridge"},
+				cli.BoolFlag{Name: "internal", Usage: "restrict external access to the network"},
+				cli.StringSliceFlag{Name: "allow", Usage: "allow traffic between this network and another mydocker bridge network"},
+				cli.StringSliceFlag{Name: "label", Usage: "set metadata on the network, eg: --label env=prod"},
+				cli.StringFlag{Name: "gateway", Usage: "IPv4 gateway of the subnet, default is the first address"},
+				cli.StringFlag{Name: "ip-range", Usage: "allocate container ip from a sub-range, eg: 192.168.10.128/25"},
+				cli.StringSliceFlag{Name: "aux-address", Usage: "auxiliary address used by network driver, eg: --aux-address router=192.168.10.254"},
 			},
 			Action: func (ctx *cli.Context) error {
 				if len(ctx.Args()) < 1 {
 					return fmt.Errorf("missing network name")
 				}
 				network.Init()
-				if err := network.CreateNetwork(ctx.String("driver"), ctx.String("subnet"), ctx.Args()[0]); err != nil {
+				options, err := parseKeyValues(ctx.StringSlice("o"), true)
+				if err != nil {
+					return err
+				}
+				labels, err := parseKeyValues(ctx.StringSlice("label"), false)
+				if err != nil {
+					return err
+				}
+				auxAddresses, err := parseKeyValues(ctx.StringSlice("aux-address"), true)
+				if err != nil {
+					return err
+				}
+				opts := &network.CreateOptions{
+					Driver:   ctx.String("driver"),
+					Subnet:   ctx.String("subnet"),
+					IPv6:     ctx.Bool("ipv6"),
+					Subnet6:  ctx.String("subnet-v6"),
+					IPv6Mode: ctx.String("ipv6-mode"),
+					Options:  options,
+					Internal: ctx.Bool("internal"),
+					Allow:    ctx.StringSlice("allow"),
+					Labels:   labels,
+
+					Gateway:      ctx.String("gateway"),
+					IPRange:      ctx.String("ip-range"),
+					AuxAddresses: auxAddresses,
+				}
+				if opts.IPv6 && opts.Subnet6 == "" {
+					return fmt.Errorf("--ipv6 requires --subnet-v6")
+				}
+				if err := network.CreateNetwork(ctx.Args()[0], opts); err != nil {
 					return fmt.Errorf("create network error: %+v", err)
 				}
 				return nil
@@ -199,10 +743,25 @@ var networkCommand = cli.Command{
 		},
 		{
 			Name: "list",
-			Usage: "list container network",
-			Action: func (ctx *cli.Context)  {
+			Usage: "list container network, eg: ./mydocker network list --filter driver=bridge --format json",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "table", Usage: "output format, table or json"},
+				cli.StringSliceFlag{Name: "filter", Usage: "filter output, eg: --filter driver=bridge --filter name=my --filter label=env=prod"},
+			},
+			Action: func (ctx *cli.Context) error {
 				network.Init()
-				network.ListNetwork()
+				return network.ListNetwork(ctx.String("format"), ctx.StringSlice("filter"))
+			},
+		},
+		{
+			Name: "inspect",
+			Usage: "display detailed information of a network, eg: ./mydocker network inspect mybridge",
+			Action: func (ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing network name")
+				}
+				network.Init()
+				return network.InspectNetwork(ctx.Args()[0])
 			},
 		},
 		{
@@ -215,9 +774,7 @@ var networkCommand = cli.Command{
 					return fmt.Errorf("network name is one word")
 				}
 				network.Init()
-				// 此部分需要注意，删除网桥时，NAT的POSTROUTING部分还没有删除，如果需要删除需要手动
-				// iptables -t nat -vnL POSTROUTING --line-numbers   此命令查看 POSTROUTING 部分，num表示行号
-				// iptables -t nat -D POSTROUTING {行号} 删除指定行号POSTROUTING
+				// 删除网桥时会同时删除 mydocker 表中该网络的 SNAT 和 FORWARD 规则
 				err := network.DeleteNetwork(ctx.Args()[0])
 				if err != nil{
 					return fmt.Errorf("remove network error: %+v", err)
@@ -225,5 +782,34 @@ var networkCommand = cli.Command{
 				return nil
 			},
 		},
+		{
+			Name:  "doctor",
+			Usage: "check network state against the kernel and repair drift, eg: ./mydocker network doctor --repair",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "repair", Usage: "repair the problems that can be repaired automatically"},
+			},
+			Action: func(ctx *cli.Context) error {
+				if err := network.Init(); err != nil {
+					return fmt.Errorf("load network state error: %v", err)
+				}
+				return network.Doctor(ctx.Bool("repair"))
+			},
+		},
 	},
-}
\ No newline at end of file
+}
+// 解析 key=value 形式的参数列表，requireValue 为 false 时允许只有 key
+func parseKeyValues(list []string, requireValue bool) (map[string]string, error) {
+	result := map[string]string{}
+	for _, item := range list {
+		kv := strings.SplitN(item, "=", 2)
+		if kv[0] == "" || (requireValue && len(kv) != 2) {
+			return nil, fmt.Errorf("invalid option %q, should be key=value", item)
+		}
+		if len(kv) == 2 {
+			result[kv[0]] = kv[1]
+		} else {
+			result[kv[0]] = ""
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"mydocker/container"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 未指定突发大小时至少允许 32KB 的突发，并且不小于 10ms 的流量，保证 TBF 能够达到设定的速率
+	minBurst = 32 * 1024
+	// TBF 队列最多缓存 50ms 的流量，超过后丢包
+	tbfLatencyMs = 50
+)
+
+var rateUnits = map[string]float64{
+	"":     1,
+	"bit":  1,
+	"kbit": 1e3,
+	"mbit": 1e6,
+	"gbit": 1e9,
+	"bps":  8,
+	"kbps": 8e3,
+	"mbps": 8e6,
+	"gbps": 8e9,
+}
+
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// 解析带宽速率，单位与 tc 一致：bit、kbit、mbit、gbit 为比特每秒，bps、kbps、mbps、gbps 为字节每秒，不带单位时为比特每秒
+// 返回字节每秒，none 表示不限制并返回 0
+// 0 表示不限制，为避免用户设置的限制被忽略，显式的 0 和不足 1 字节每秒（8bit）的速率都是错误
+func ParseRate(s string) (uint64, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "none") {
+		return 0, nil
+	}
+	bits, err := parseUnit(s, rateUnits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, eg: 10mbit, 1mbps, none", s)
+	}
+	if bits < 8 {
+		return 0, fmt.Errorf("invalid rate %q, should be at least 8bit, use none to remove the limit", s)
+	}
+	return uint64(bits / 8), nil
+}
+
+// 解析突发大小，单位与 tc 一致：b、kb(k)、mb(m)、gb(g)，不带单位时为字节
+func ParseSize(s string) (uint64, error) {
+	size, err := parseUnit(s, sizeUnits)
+	if err != nil || size > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid size %q, eg: 32kb, 1mb", s)
+	}
+	return uint64(size), nil
+}
+
+func parseUnit(s string, units map[string]float64) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	idx := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if idx < 0 {
+		idx = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:idx], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	unit, ok := units[s[idx:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[idx:])
+	}
+	return value * unit, nil
+}
+
+// 容器的带宽限制方向以容器为准，ingress 为进入容器的流量，egress 为容器发出的流量
+// 宿主机一端的 Veth 发出的流量就是进入容器的流量，直接在 Veth 上挂载 TBF 队列限速
+// 容器发出的流量对 Veth 来说是入方向，入方向不能排队整形，通过 ingress 队列的 u32 过滤器将流量重定向到 IFB 设备，在 IFB 设备的 TBF 队列上限速
+// 相当于:
+// tc qdisc replace dev {veth} root tbf rate {ingressRate} burst {ingressBurst} latency 50ms
+// ip link add ifb-{veth} type ifb
+// tc qdisc replace dev ifb-{veth} root tbf rate {egressRate} burst {egressBurst} latency 50ms
+// tc qdisc add dev {veth} ingress
+// tc filter add dev {veth} parent ffff: protocol all u32 match u32 0 0 action mirred egress redirect dev ifb-{veth}
+func setupBandwidth(ep *Endpoint, cinfo *container.ContainerInfo) error {
+	veth, err := netlink.LinkByName(ep.Device.Name)
+	if err != nil {
+		return fmt.Errorf("find veth %s error %v", ep.Device.Name, err)
+	}
+
+	if cinfo.IngressRate > 0 {
+		if err := netlink.QdiscReplace(newTbf(veth, cinfo.IngressRate, cinfo.IngressBurst)); err != nil {
+			return fmt.Errorf("set ingress rate on %s error %v", ep.Device.Name, err)
+		}
+	} else if err := delQdisc(veth, netlink.HANDLE_ROOT); err != nil {
+		return err
+	}
+
+	if cinfo.EgressRate == 0 {
+		if err := delQdisc(veth, netlink.HANDLE_INGRESS); err != nil {
+			return err
+		}
+		return deleteIfb(ep)
+	}
+	ifb, err := ensureIfb(ep)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscReplace(newTbf(ifb, cinfo.EgressRate, cinfo.EgressBurst)); err != nil {
+		return fmt.Errorf("set egress rate on %s error %v", ifb.Attrs().Name, err)
+	}
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: veth.Attrs().Index,
+			Parent:    netlink.HANDLE_INGRESS,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+		},
+	}
+	if err := netlink.QdiscReplace(ingress); err != nil {
+		return fmt.Errorf("add ingress qdisc on %s error %v", ep.Device.Name, err)
+	}
+	// Sel 为空时 u32 过滤器匹配所有报文，RedirIndex 生成 mirred egress redirect 动作
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: veth.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		RedirIndex: ifb.Attrs().Index,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("add redirect filter on %s error %v", ep.Device.Name, err)
+	}
+	return nil
+}
+
+// 清理端点的带宽限制，Veth 上的队列随 Veth 一起删除，IFB 设备需要单独删除
+func cleanupBandwidth(ep *Endpoint) {
+	if err := deleteIfb(ep); err != nil {
+		logrus.Warnf("delete ifb of %s error %v", ep.ID, err)
+	}
+}
+
+func newTbf(link netlink.Link, rate, burst uint64) *netlink.Tbf {
+	if burst == 0 {
+		burst = rate / 100
+		if burst < minBurst {
+			burst = minBurst
+		}
+	}
+	limit := burst + rate*tbfLatencyMs/1000
+	if burst > math.MaxUint32 {
+		burst = math.MaxUint32
+	}
+	if limit > math.MaxUint32 {
+		limit = math.MaxUint32
+	}
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+			Handle:    netlink.MakeHandle(1, 0),
+		},
+		Rate:   rate,
+		Buffer: uint32(burst),
+		Limit:  uint32(limit),
+	}
+}
+
+// 删除接口上 mydocker 添加的 TBF 或 ingress 队列，队列不存在时忽略
+func delQdisc(link netlink.Link, parent uint32) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdisc of %s error %v", link.Attrs().Name, err)
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent != parent || (q.Type() != "tbf" && q.Type() != "ingress") {
+			continue
+		}
+		if err := netlink.QdiscDel(q); err != nil {
+			return fmt.Errorf("delete %s qdisc of %s error %v", q.Type(), link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// IFB 设备名为 ifb-{veth名}
+func ifbName(ep *Endpoint) string {
+	return "ifb-" + ep.Device.Name
+}
+
+func ensureIfb(ep *Endpoint) (netlink.Link, error) {
+	name := ifbName(ep)
+	if l, err := netlink.LinkByName(name); err == nil {
+		return l, nil
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: la}); err != nil {
+		return nil, fmt.Errorf("add ifb device %s error %v", name, err)
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return nil, fmt.Errorf("set ifb device %s up error %v", name, err)
+	}
+	return l, nil
+}
+
+func deleteIfb(ep *Endpoint) error {
+	l, err := netlink.LinkByName(ifbName(ep))
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
+}
+
+// 按照容器信息中的带宽配置重新设置容器所有 bridge 网络端点的限速，用于 update 命令修改运行中容器的带宽
+func SetBandwidth(cinfo *container.ContainerInfo) error {
+	endpoints, err := GetEndpoints(cinfo.Id)
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		nw, ok := networks[ep.NetworkName]
+		if !ok || !nw.isBridge() {
+			logrus.Warnf("bandwidth limit is only supported on bridge network, skip %s", ep.NetworkName)
+			continue
+		}
+		if err := setupBandwidth(ep, cinfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"mydocker/container"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"8":       1,
+		"10mbit":  1250000,
+		"1.5Mbit": 187500,
+		"2kbps":   2000,
+		"1gbit":   125000000,
+		"none":    0,
+	} {
+		got, err := ParseRate(s)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "mbit", "10mb", "-1kbit", "0", "7bit", "0.5bps"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) expect error", s)
+		}
+	}
+	if size, err := ParseSize("64kb"); err != nil || size != 64*1024 {
+		t.Errorf("ParseSize(64kb) = %d, %v", size, err)
+	}
+}
+
+func TestSetupBandwidth(t *testing.T) {
+	la := netlink.NewLinkAttrs()
+	la.Name = "mydkbw0"
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "mydkbw0p"}); err != nil {
+		t.Skipf("can not create veth: %v", err)
+	}
+	veth, _ := netlink.LinkByName(la.Name)
+	defer netlink.LinkDel(veth)
+
+	ep := &Endpoint{ID: "mydkbw-test", Device: netlink.Veth{LinkAttrs: la}}
+	cinfo := &container.ContainerInfo{IngressRate: 1250000, EgressRate: 125000, EgressBurst: 64 * 1024}
+	if err := setupBandwidth(ep, cinfo); err != nil {
+		t.Skipf("tc is not supported: %v", err)
+	}
+	defer cleanupBandwidth(ep)
+
+	qdiscs := map[string]netlink.Qdisc{}
+	list, _ := netlink.QdiscList(veth)
+	for _, q := range list {
+		qdiscs[q.Type()] = q
+	}
+	if tbf, ok := qdiscs["tbf"].(*netlink.Tbf); !ok || tbf.Rate != cinfo.IngressRate {
+		t.Errorf("veth tbf qdisc %+v", qdiscs["tbf"])
+	}
+	if _, ok := qdiscs["ingress"]; !ok {
+		t.Error("veth ingress qdisc not found")
+	}
+	ifb, err := netlink.LinkByName(ifbName(ep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, _ := netlink.FilterList(veth, netlink.MakeHandle(0xffff, 0))
+	if len(filters) != 1 || filters[0].(*netlink.U32).RedirIndex != ifb.Attrs().Index {
+		t.Errorf("redirect filter %+v", filters)
+	}
+
+	// 修改速率后重新设置，取消 egress 限制时删除 IFB 设备
+	cinfo.IngressRate, cinfo.EgressRate = 2500000, 0
+	if err := setupBandwidth(ep, cinfo); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = netlink.QdiscList(veth)
+	for _, q := range list {
+		if tbf, ok := q.(*netlink.Tbf); ok && tbf.Rate != cinfo.IngressRate {
+			t.Errorf("tbf rate %d, want %d", tbf.Rate, cinfo.IngressRate)
+		}
+		if q.Type() == "ingress" {
+			t.Error("ingress qdisc not deleted")
+		}
+	}
+	if _, err := netlink.LinkByName(ifbName(ep)); err == nil {
+		t.Error("ifb device not deleted")
+	}
+}
@@ -3,12 +3,26 @@ package network
 import (
 	"fmt"
 	"net"
-	"os/exec"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const ipv6ForwardingPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+const (
+	// 网络选项: 网桥和容器 Veth 的 MTU
+	optionMTU = "mtu"
+	// 网络选项: Linux Bridge 设备名，默认与网络同名
+	optionBridgeName = "bridge_name"
+	// 网络选项: 是否允许同一网桥上的容器之间通信，默认 true
+	optionEnableICC = "enable_icc"
 )
 
 type BridgeNetworkDriver struct{}
@@ -17,27 +31,32 @@ func (b *BridgeNetworkDriver) Name() string{
 	return "bridge"
 }
 
-func (b *BridgeNetworkDriver) Create(subnet string, name string) (*Network, error){
-	// 通过net包中的net.ParseCIDR方法获取网段字符串的网关IP地址和网络IP段
-	ip, ipNet, _ := net.ParseCIDR(subnet)
-	ipNet.IP = ip
-	// 初始化网络对象
-	nw := &Network{
-		Name: name,
-		IpRange: ipNet,
+func (b *BridgeNetworkDriver) Create(nw *Network) error {
+	if _, err := bridgeMTU(nw); err != nil {
+		return err
+	}
+	if _, err := enableICC(nw); err != nil {
+		return err
+	}
+	if name := nw.device(); len(name) > 15 {
+		return fmt.Errorf("invalid %s %s, bridge name is longer than 15 characters", optionBridgeName, name)
 	}
 	// 配置Linux Bridge
 	err := b.initBridge(nw)
 	if err != nil {
 		logrus.Errorf("error init bridge")
 	}
-	// 返回配置好的网络
-	return nw, err
+	return err
 }
 
 // 删除bridge网络,相当于 ip link delete bridgeName type bridge
 func (b *BridgeNetworkDriver) Delete(network Network) error {
-	bridgeName := network.Name
+	bridgeName := network.device()
+	// 删除网络对应的SNAT和FORWARD规则
+	rules := append(bridgeRules(&network), networkIsolationRules(&network, true)...)
+	if err := delFirewallRules(rules...); err != nil {
+		logrus.Warnf("remove firewall rules of %s error: %v", bridgeName, err)
+	}
 	l, err := netlink.LinkByName(bridgeName)
 	if err != nil {
 		return err
@@ -47,7 +66,7 @@ func (b *BridgeNetworkDriver) Delete(network Network) error {
 
 // 连接容器网络端点到网络
 func (b *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
-	bridgeName := network.Name
+	bridgeName := network.device()
 	br, err := netlink.LinkByName(bridgeName)
 	if err != nil{
 		return err
@@ -55,6 +74,8 @@ func (b *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 
 	la := netlink.NewLinkAttrs()
 	la.Name = endpoint.ID[:5]
+	// Veth 两端使用与网桥相同的 MTU
+	la.MTU = br.Attrs().MTU
 	// 通过设置Veth接口的master属性，设置这个Veth的一端挂载到网络对应的Linux Bridge上
 	la.MasterIndex = br.Attrs().Index
 
@@ -76,18 +97,38 @@ func (b *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	 if err := netlink.LinkSetUp(&endpoint.Device); err != nil {
 		 return fmt.Errorf("error set endpoint device up: %v", err)
 	 }
+
+	// enable_icc=false 时将 Veth 设置为网桥的隔离端口，隔离端口之间不转发报文，容器只能访问网关和外部网络
+	if icc, _ := enableICC(network); !icc {
+		veth, err := netlink.LinkByName(la.Name)
+		if err != nil {
+			return err
+		}
+		if err := setBridgePortIsolated(veth); err != nil {
+			return fmt.Errorf("error isolate endpoint device: %v", err)
+		}
+	}
 	return nil
 }
 
 // 从网络上移除容器网络端点
+// 容器进程退出后 Veth 会随 Net Namespace 一起销毁，这里只处理容器仍在运行时的情况
 func (b *BridgeNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
-	return nil
+	l, err := netlink.LinkByName(endpoint.Device.Name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
 }
 
 func (b *BridgeNetworkDriver) initBridge(nw *Network) error {
 	// 创建Bridge虚拟设备
-	bridgeName := nw.Name
-	if err := createBridgeInterface(bridgeName); err != nil {
+	bridgeName := nw.device()
+	mtu, _ := bridgeMTU(nw)
+	if err := createBridgeInterface(bridgeName, mtu); err != nil {
 		return err
 	}
 	logrus.Infof("init bridge, target bridge name %s", bridgeName)
@@ -99,21 +140,92 @@ func (b *BridgeNetworkDriver) initBridge(nw *Network) error {
 		return fmt.Errorf("Error assigning address: %s on bridge: %s with an error of: %v", gatewayIP, bridgeName, err)
 	}
 	
+	// 双栈网络同时设置Bridge设备的IPv6网关地址，并开启宿主机的IPv6转发
+	if nw.IPv6 && nw.IpRange6 != nil {
+		if err := setInterfaceIP6(bridgeName, nw.IpRange6); err != nil {
+			return fmt.Errorf("Error assigning address: %s on bridge: %s with an error of: %v", nw.IpRange6, bridgeName, err)
+		}
+		if err := os.WriteFile(ipv6ForwardingPath, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("Error enable ipv6 forwarding: %v", err)
+		}
+	}
+
 	// 启动Bridge设备
 	if err := setInterfaceUP(bridgeName); err != nil {
 		return fmt.Errorf("Error set bridge up: %s, Error: %v", bridgeName, err)
 	}
 
 
-	// 设置iptables的SNAT规则
-	if err := setIpTables(bridgeName, nw.IpRange); err != nil {
-		return fmt.Errorf("Error setting iptables for %s: %v", bridgeName, err)
+	// 设置SNAT规则、FORWARD放行规则以及与其他网桥之间的隔离规则
+	rules := append(bridgeRules(nw), networkIsolationRules(nw, false)...)
+	if err := addFirewallRules(rules...); err != nil {
+		return fmt.Errorf("Error setting firewall for %s: %v", bridgeName, err)
 	}
 	
 	return nil
 }
 
-func createBridgeInterface(bridgeName string) error{
+// 网桥与其他 bridge 网络之间的隔离规则，all 为 false 时跳过 --allow 允许互通的网络
+// 删除网络时 all 为 true，删除所有可能存在的规则
+func networkIsolationRules(nw *Network, all bool) []*Rule {
+	var rules []*Rule
+	for _, other := range networks {
+		if other.Name == nw.Name || !other.isBridge() {
+			continue
+		}
+		if !all && nw.allows(other) {
+			continue
+		}
+		rules = append(rules, isolationRules(nw, other)...)
+	}
+	return rules
+}
+
+// 网络选项中指定的 MTU，未指定时返回 0 使用内核默认值
+func bridgeMTU(nw *Network) (int, error) {
+	value, ok := nw.Options[optionMTU]
+	if !ok {
+		return 0, nil
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < 68 || mtu > 65535 {
+		return 0, fmt.Errorf("invalid %s %s, should be between 68 and 65535", optionMTU, value)
+	}
+	return mtu, nil
+}
+
+func enableICC(nw *Network) (bool, error) {
+	value, ok := nw.Options[optionEnableICC]
+	if !ok {
+		return true, nil
+	}
+	icc, err := strconv.ParseBool(value)
+	if err != nil {
+		return true, fmt.Errorf("invalid %s %s, should be true or false", optionEnableICC, value)
+	}
+	return icc, nil
+}
+
+// 设置网桥端口的 isolated 属性，相当于 bridge link set dev {link} isolated on
+func setBridgePortIsolated(link netlink.Link) error {
+	return setBridgePortFlag(link, unix.IFLA_BRPORT_ISOLATED)
+}
+
+// 开启网桥端口的标志位，netlink 库没有提供 isolated、neigh_suppress 等属性的设置方法，
+// 直接发送 AF_BRIDGE 的 RTM_SETLINK 消息
+func setBridgePortFlag(link netlink.Link, attr int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(attr, []byte{1})
+	req.AddData(protinfo)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func createBridgeInterface(bridgeName string, mtu int) error{
 	_, err := net.InterfaceByName(bridgeName)
 	if err == nil || !strings.Contains(err.Error() ,"no such network interface"){
 		return fmt.Errorf("%s interface is existed", bridgeName)
@@ -123,6 +235,7 @@ func createBridgeInterface(bridgeName string) error{
 	// https://github.com/vishvananda/netlink
 	la := netlink.NewLinkAttrs()
     la.Name = bridgeName
+	la.MTU = mtu
 	mybridge := &netlink.Bridge{LinkAttrs: la}
 	err = netlink.LinkAdd(mybridge)
     if err != nil  {
@@ -154,6 +267,22 @@ func setInterfaceIP(name, rawIP string) error {
 	return netlink.AddrAdd(iface, addr)
 }
 
+// 设置接口的IPv6地址，关闭重复地址检测（DAD），地址添加后立即可用
+// 相当于 ip -6 addr add {ipNet} dev {name} nodad
+func setInterfaceIP6(name string, ipNet *net.IPNet) error {
+	iface, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	// 接口可能禁用了IPv6，先打开
+	disableIPv6 := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", name)
+	if err := os.WriteFile(disableIPv6, []byte("0"), 0644); err != nil {
+		logrus.Warnf("enable ipv6 on %s error %v", name, err)
+	}
+	addr := &netlink.Addr{IPNet: ipNet, Flags: unix.IFA_F_NODAD}
+	return netlink.AddrAdd(iface, addr)
+}
+
 func setInterfaceUP(interfaceName string) error {
 	iface, err := netlink.LinkByName(interfaceName)
 	if err != nil {
@@ -167,17 +296,3 @@ func setInterfaceUP(interfaceName string) error {
 	}
 	return nil
 }
-
-// 设置 iptables 对应的bridge的 MASQUERADE 规则
-func setIpTables(bridgeName string, subnet *net.IPNet) error {
-	// 使用命令行的方式添加iptables规则
-	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), bridgeName)
-	cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-	// 执行iptables命令配置SNAT规则
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("iptables set failed, %v", err)
-	}
-	logrus.Infof("iptables outputs: %s", output)
-	return nil
-}
\ No newline at end of file
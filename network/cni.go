@@ -0,0 +1,337 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 网络选项: CNI 配置文件目录
+	optionCNIConfDir = "cni_conf_dir"
+	// 网络选项: CNI 插件目录，多个目录用冒号分隔
+	optionCNIBinDir = "cni_bin_dir"
+	// 网络选项: 配置文件中的网络名，默认与 mydocker 网络同名
+	optionCNINetwork = "cni_network"
+	// 网络选项: 容器内的接口名，默认 eth0
+	optionCNIIfName = "cni_ifname"
+
+	defaultCNIConfDir = "/etc/cni/net.d"
+	defaultCNIBinDir  = "/opt/cni/bin"
+	defaultCNIIfName  = "eth0"
+)
+
+// cni 网络，调用已有的 CNI 插件配置容器网络，容器的地址、路由和 DNS 都由插件决定
+// 网络创建时只检查配置文件是否存在，容器连接时按 conflist 中的顺序执行插件 ADD，断开时逆序执行 DEL
+type CNINetworkDriver struct{}
+
+// CNI 插件的网络配置列表，对应 .conflist 文件，单个插件的 .conf 文件转换为只有一个插件的列表
+type cniConfList struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// CNI 插件的执行结果，同时兼容 0.2.0 的 ip4/ip6 格式
+type cniResult struct {
+	CNIVersion string `json:"cniVersion"`
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Mac     string `json:"mac"`
+		Sandbox string `json:"sandbox"`
+	} `json:"interfaces"`
+	IPs []struct {
+		Address   string `json:"address"`
+		Gateway   string `json:"gateway"`
+		Interface *int   `json:"interface"`
+	} `json:"ips"`
+	IP4 *struct {
+		IP string `json:"ip"`
+	} `json:"ip4"`
+	IP6 *struct {
+		IP string `json:"ip"`
+	} `json:"ip6"`
+	DNS struct {
+		Nameservers []string `json:"nameservers"`
+	} `json:"dns"`
+}
+
+// CNI 插件执行失败时输出的错误信息
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+func (d *CNINetworkDriver) Name() string {
+	return "cni"
+}
+
+func (d *CNINetworkDriver) Create(nw *Network) error {
+	conf, err := loadCNIConfList(nw)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("create cni network %s with %d plugins from %s", nw.Name, len(conf.Plugins), cniConfDir(nw))
+	return nil
+}
+
+// CNI 网络没有创建任何宿主机设备，删除网络时不需要清理
+func (d *CNINetworkDriver) Delete(network Network) error {
+	return nil
+}
+
+// 依次执行 conflist 中插件的 ADD，后一个插件通过 prevResult 获得前一个插件的结果
+// 最后的结果保存到网络端点中，用于 CHECK、DEL 以及 hosts、resolv.conf 和 network inspect
+func (d *CNINetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	conf, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	var result json.RawMessage
+	for i, plugin := range conf.Plugins {
+		out, err := execCNIPlugin(network, endpoint, conf, plugin, "ADD", result)
+		if err != nil {
+			rollbackCNIAdd(network, endpoint, conf, conf.Plugins[:i], result)
+			return err
+		}
+		result = out
+	}
+	if err := parseCNIResult(endpoint, result, cniIfName(network)); err != nil {
+		rollbackCNIAdd(network, endpoint, conf, conf.Plugins, result)
+		return err
+	}
+	endpoint.CNIResult = result
+	return nil
+}
+
+// ADD 失败时由运行时负责清理，逆序对已经执行成功的插件执行 DEL，释放 IPAM 地址、veth 和端口映射等资源
+func rollbackCNIAdd(network *Network, endpoint *Endpoint, conf *cniConfList, plugins []map[string]interface{}, result json.RawMessage) {
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if _, err := execCNIPlugin(network, endpoint, conf, plugins[i], "DEL", result); err != nil {
+			logrus.Warnf("cni DEL %v after failed ADD error %v", plugins[i]["type"], err)
+		}
+	}
+}
+
+// 逆序执行插件的 DEL，容器进程已经退出时 CNI_NETNS 为空，插件只清理宿主机上的资源（例如释放 IPAM 地址）
+func (d *CNINetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	conf, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for i := len(conf.Plugins) - 1; i >= 0; i-- {
+		if _, err := execCNIPlugin(network, endpoint, conf, conf.Plugins[i], "DEL", endpoint.CNIResult); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cni del error: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 执行插件的 CHECK，检查容器网络是否仍与 ADD 的结果一致，0.4.0 之前的版本不支持 CHECK
+func (d *CNINetworkDriver) Check(network *Network, endpoint *Endpoint) error {
+	conf, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	if conf.CNIVersion < "0.4.0" {
+		return nil
+	}
+	for _, plugin := range conf.Plugins {
+		if _, err := execCNIPlugin(network, endpoint, conf, plugin, "CHECK", endpoint.CNIResult); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cniConfDir(nw *Network) string {
+	if dir := nw.Options[optionCNIConfDir]; dir != "" {
+		return dir
+	}
+	return defaultCNIConfDir
+}
+
+func cniIfName(nw *Network) string {
+	if name := nw.Options[optionCNIIfName]; name != "" {
+		return name
+	}
+	return defaultCNIIfName
+}
+
+// 在配置目录中查找名称匹配的网络配置，按文件名顺序优先使用第一个匹配的文件
+func loadCNIConfList(nw *Network) (*cniConfList, error) {
+	name := nw.Options[optionCNINetwork]
+	if name == "" {
+		name = nw.Name
+	}
+	dir := cniConfDir(nw)
+	files, err := filepath.Glob(path.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		ext := path.Ext(file)
+		if ext != ".conflist" && ext != ".conf" && ext != ".json" {
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			logrus.Warnf("read cni config %s error %v", file, err)
+			continue
+		}
+		conf := &cniConfList{}
+		if ext == ".conflist" {
+			err = json.Unmarshal(content, conf)
+		} else {
+			var plugin map[string]interface{}
+			if err = json.Unmarshal(content, &plugin); err == nil {
+				conf.Name, _ = plugin["name"].(string)
+				conf.CNIVersion, _ = plugin["cniVersion"].(string)
+				conf.Plugins = []map[string]interface{}{plugin}
+			}
+		}
+		if err != nil {
+			logrus.Warnf("parse cni config %s error %v", file, err)
+			continue
+		}
+		if conf.Name != name {
+			continue
+		}
+		if len(conf.Plugins) == 0 {
+			return nil, fmt.Errorf("cni config %s has no plugins", file)
+		}
+		return conf, nil
+	}
+	return nil, fmt.Errorf("can not find cni network %s in %s", name, dir)
+}
+
+// 按照 CNI 规范执行插件：插件名为配置中的 type，参数通过环境变量传递，网络配置通过标准输入传递，结果从标准输出读取
+func execCNIPlugin(nw *Network, ep *Endpoint, conf *cniConfList, plugin map[string]interface{}, command string, prevResult json.RawMessage) (json.RawMessage, error) {
+	pluginType, _ := plugin["type"].(string)
+	if pluginType == "" {
+		return nil, fmt.Errorf("cni plugin config of %s has no type", conf.Name)
+	}
+	binDirs := nw.Options[optionCNIBinDir]
+	if binDirs == "" {
+		binDirs = defaultCNIBinDir
+	}
+	var binary string
+	for _, dir := range filepath.SplitList(binDirs) {
+		if _, err := os.Stat(path.Join(dir, pluginType)); err == nil {
+			binary = path.Join(dir, pluginType)
+			break
+		}
+	}
+	if binary == "" {
+		return nil, fmt.Errorf("can not find cni plugin %s in %s", pluginType, binDirs)
+	}
+
+	// 插件配置需要补充网络名、版本以及前一个插件的结果
+	stdin := map[string]interface{}{}
+	for k, v := range plugin {
+		stdin[k] = v
+	}
+	stdin["name"] = conf.Name
+	stdin["cniVersion"] = conf.CNIVersion
+	if len(prevResult) > 0 {
+		stdin["prevResult"] = prevResult
+	}
+	input, err := json.Marshal(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	// 容器进程退出后 Net Namespace 已经不存在，DEL 时传递空的 CNI_NETNS
+	netnsPath := ep.SandboxKey
+	if _, err := os.Stat(netnsPath); err != nil {
+		netnsPath = ""
+	}
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+ep.ContainerID,
+		"CNI_NETNS="+netnsPath,
+		"CNI_IFNAME="+cniIfName(nw),
+		"CNI_ARGS=",
+		"CNI_PATH="+binDirs,
+	)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	logrus.Infof("cni %s %s for container %s", command, pluginType, ep.ContainerID)
+	if err := cmd.Run(); err != nil {
+		cniErr := &cniError{}
+		if json.Unmarshal(stdout.Bytes(), cniErr) == nil && cniErr.Msg != "" {
+			return nil, fmt.Errorf("cni plugin %s %s error %d: %s %s", pluginType, command, cniErr.Code, cniErr.Msg, cniErr.Details)
+		}
+		return nil, fmt.Errorf("cni plugin %s %s error %v: %s", pluginType, command, err, strings.TrimSpace(stderr.String()))
+	}
+	if command != "ADD" {
+		return nil, nil
+	}
+	return json.RawMessage(bytes.TrimSpace(stdout.Bytes())), nil
+}
+
+// 从 ADD 的结果中解析容器接口的地址、MAC 和宿主机一端的接口名
+func parseCNIResult(ep *Endpoint, raw json.RawMessage, ifName string) error {
+	result := &cniResult{}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("parse cni result error %v", err)
+	}
+	ep.Device.PeerName = ifName
+	sandboxIndex := -1
+	for i, iface := range result.Interfaces {
+		if iface.Sandbox == "" {
+			// bridge 等插件的结果中宿主机上的接口依次为网桥和 Veth，以最后一个宿主机接口作为 Veth 一端
+			ep.Device.Name = iface.Name
+			continue
+		}
+		if iface.Name == ifName {
+			sandboxIndex = i
+			if mac, err := net.ParseMAC(iface.Mac); err == nil {
+				ep.MacAddress = mac
+			}
+		}
+	}
+
+	addresses := []string{}
+	for _, ip := range result.IPs {
+		if ip.Interface != nil && sandboxIndex >= 0 && *ip.Interface != sandboxIndex {
+			continue
+		}
+		addresses = append(addresses, ip.Address)
+	}
+	if result.IP4 != nil {
+		addresses = append(addresses, result.IP4.IP)
+	}
+	if result.IP6 != nil {
+		addresses = append(addresses, result.IP6.IP)
+	}
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid address %s in cni result", address)
+		}
+		if ip.To4() != nil && ep.IpAddress == nil {
+			ep.IpAddress = ip.To4()
+		} else if ip.To4() == nil && ep.IPv6Address == nil {
+			ep.IPv6Address = ip
+		}
+	}
+	ep.Nameservers = result.DNS.Nameservers
+	return nil
+}
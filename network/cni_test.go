@@ -0,0 +1,120 @@
+package network
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// 模拟 CNI 插件，记录每次调用的命令和参数，ADD 时输出固定的结果
+const fakeCNIPlugin = `#!/bin/sh
+read -r stdin
+echo "$CNI_COMMAND $(basename $0) $CNI_CONTAINERID $CNI_IFNAME $CNI_NETNS" >> "$CNI_TEST_LOG"
+case "$stdin" in *prevResult*) echo "prevResult $(basename $0)" >> "$CNI_TEST_LOG";; esac
+if [ "$CNI_COMMAND" = "ADD" ]; then
+  echo '{"cniVersion":"1.0.0","interfaces":[{"name":"cni0"},{"name":"veth1234"},{"name":"eth0","mac":"aa:bb:cc:dd:ee:ff","sandbox":"/proc/1/ns/net"}],"ips":[{"address":"10.88.0.5/16","gateway":"10.88.0.1","interface":2},{"address":"fd00::5/64","interface":2}],"dns":{"nameservers":["10.88.0.1"]}}'
+fi
+`
+
+// ADD 时失败的 CNI 插件
+const fakeCNIFailPlugin = `#!/bin/sh
+read -r stdin
+echo "$CNI_COMMAND $(basename $0) $CNI_CONTAINERID $CNI_IFNAME $CNI_NETNS" >> "$CNI_TEST_LOG"
+if [ "$CNI_COMMAND" = "ADD" ]; then
+  echo '{"cniVersion":"1.0.0","code":11,"msg":"no more addresses"}'
+  exit 1
+fi
+`
+
+const fakeCNIConfList = `{
+  "cniVersion": "1.0.0",
+  "name": "testcni",
+  "plugins": [{"type": "fakebridge"}, {"type": "fakeportmap"}]
+}`
+
+func TestCNINetworkDriver(t *testing.T) {
+	dir := t.TempDir()
+	binDir, confDir, logFile := path.Join(dir, "bin"), path.Join(dir, "net.d"), path.Join(dir, "cni.log")
+	os.MkdirAll(binDir, 0755)
+	os.MkdirAll(confDir, 0755)
+	for _, name := range []string{"fakebridge", "fakeportmap"} {
+		if err := os.WriteFile(path.Join(binDir, name), []byte(fakeCNIPlugin), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(path.Join(binDir, "fakefail"), []byte(fakeCNIFailPlugin), 0755)
+	if err := os.WriteFile(path.Join(confDir, "10-test.conflist"), []byte(fakeCNIConfList), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CNI_TEST_LOG", logFile)
+
+	driver := &CNINetworkDriver{}
+	nw := &Network{Name: "mycni", Driver: "cni", Options: map[string]string{optionCNIConfDir: confDir, optionCNIBinDir: binDir}}
+	if err := driver.Create(nw); err == nil {
+		t.Error("create network without matching cni config should fail")
+	}
+	nw.Options[optionCNINetwork] = "testcni"
+	if err := driver.Create(nw); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &Endpoint{ID: "cnitest123-mycni", ContainerID: "cnitest123", SandboxKey: "/proc/self/ns/net"}
+	if err := driver.Connect(nw, ep); err != nil {
+		t.Fatal(err)
+	}
+	if ep.IpAddress.String() != "10.88.0.5" || ep.IPv6Address.String() != "fd00::5" || ep.MacAddress.String() != "aa:bb:cc:dd:ee:ff" ||
+		ep.Device.Name != "veth1234" || ep.Device.PeerName != "eth0" || len(ep.Nameservers) != 1 {
+		t.Errorf("endpoint %+v", ep)
+	}
+	if err := driver.Check(nw, ep); err != nil {
+		t.Fatal(err)
+	}
+	// 容器进程退出后 CNI_NETNS 为空
+	ep.SandboxKey = "/proc/0/ns/net"
+	if err := driver.Disconnect(nw, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(logFile)
+	want := []string{
+		"ADD fakebridge cnitest123 eth0 /proc/self/ns/net",
+		"ADD fakeportmap cnitest123 eth0 /proc/self/ns/net",
+		"prevResult fakeportmap",
+		"CHECK fakebridge cnitest123 eth0 /proc/self/ns/net",
+		"prevResult fakebridge",
+		"CHECK fakeportmap cnitest123 eth0 /proc/self/ns/net",
+		"prevResult fakeportmap",
+		"DEL fakeportmap cnitest123 eth0 ",
+		"prevResult fakeportmap",
+		"DEL fakebridge cnitest123 eth0 ",
+		"prevResult fakebridge",
+	}
+	if got := strings.TrimSpace(string(content)); got != strings.Join(want, "\n") {
+		t.Errorf("cni calls:\n%s", got)
+	}
+
+	// 第三个插件 ADD 失败时逆序对前两个插件执行 DEL
+	os.Remove(logFile)
+	os.WriteFile(path.Join(confDir, "20-fail.conflist"), []byte(`{"cniVersion": "1.0.0", "name": "failcni",
+  "plugins": [{"type": "fakebridge"}, {"type": "fakeportmap"}, {"type": "fakefail"}]}`), 0644)
+	nw.Options[optionCNINetwork] = "failcni"
+	ep = &Endpoint{ID: "cnitest456-mycni", ContainerID: "cnitest456", SandboxKey: "/proc/self/ns/net"}
+	if err := driver.Connect(nw, ep); err == nil || ep.CNIResult != nil {
+		t.Fatalf("connect with failing plugin %v, result %s", err, ep.CNIResult)
+	}
+	content, _ = os.ReadFile(logFile)
+	want = []string{
+		"ADD fakebridge cnitest456 eth0 /proc/self/ns/net",
+		"ADD fakeportmap cnitest456 eth0 /proc/self/ns/net",
+		"prevResult fakeportmap",
+		"ADD fakefail cnitest456 eth0 /proc/self/ns/net",
+		"DEL fakeportmap cnitest456 eth0 /proc/self/ns/net",
+		"prevResult fakeportmap",
+		"DEL fakebridge cnitest456 eth0 /proc/self/ns/net",
+		"prevResult fakebridge",
+	}
+	if got := strings.TrimSpace(string(content)); got != strings.Join(want, "\n") {
+		t.Errorf("cni calls after failed add:\n%s", got)
+	}
+}
@@ -0,0 +1,440 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mydocker/util"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPort = 53
+	// 容器记录的 TTL，与 docker 内置 DNS 保持一致
+	dnsRecordTTL = 600
+	// 转发到宿主机 DNS 服务器的超时时间
+	dnsForwardTimeout = 5 * time.Second
+	// 宿主机 DNS 配置文件
+	hostResolvConf = "/etc/resolv.conf"
+)
+
+// 每个网络的 DNS 服务进程 pid 文件存放目录
+var defaultDNSPidPath = "/var/run/mydocker/network/dns/"
+
+// 网络内置的 DNS 服务，监听在网络的网关地址上
+// 解析同一网络中容器的名称、别名和ID，其余查询转发给宿主机的 DNS 服务器
+type DNSServer struct {
+	Network    string
+	ListenAddr string
+	Upstreams  []string
+}
+
+// 网络内置 DNS 服务的地址，即网络的网关地址
+func dnsServerIP(nw *Network) net.IP {
+	return nw.IpRange.IP
+}
+
+// 网络内置 DNS 服务的地址列表，用于生成容器的 resolv.conf
+func DNSServers(networkName string) []string {
+	nw, ok := networks[networkName]
+	if !ok || !dnsServerRunning(networkName) {
+		return nil
+	}
+	return []string{dnsServerIP(nw).String()}
+}
+
+func dnsPidFile(networkName string) string {
+	return path.Join(defaultDNSPidPath, networkName+".pid")
+}
+
+func dnsServerPid(networkName string) int {
+	content, err := os.ReadFile(dnsPidFile(networkName))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func dnsServerRunning(networkName string) bool {
+	pid := dnsServerPid(networkName)
+	if pid <= 0 {
+		return false
+	}
+	exist, _ := util.FileOrDirExits(fmt.Sprintf("/proc/%d", pid))
+	return exist
+}
+
+// 确保网络的 DNS 服务进程正在运行，未运行时通过 /proc/self/exe dns 启动
+func ensureDNSServer(nw *Network) error {
+	if dnsServerRunning(nw.Name) {
+		return nil
+	}
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readPipe.Close()
+
+	listenAddr := net.JoinHostPort(dnsServerIP(nw).String(), strconv.Itoa(dnsPort))
+	cmd := exec.Command("/proc/self/exe", "dns", "--network", nw.Name, "--listen", listenAddr)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{writePipe}
+	if err := cmd.Start(); err != nil {
+		writePipe.Close()
+		return err
+	}
+	writePipe.Close()
+
+	msg, _ := io.ReadAll(readPipe)
+	if string(msg) != childReadyMessage {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("start dns server for network %s error: %s", nw.Name, msg)
+	}
+	if err := os.MkdirAll(defaultDNSPidPath, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dnsPidFile(nw.Name), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		return err
+	}
+	_ = cmd.Process.Release()
+	logrus.Infof("dns server of network %s listen on %s", nw.Name, listenAddr)
+	return nil
+}
+
+// 结束网络的 DNS 服务进程
+func stopDNSServer(networkName string) {
+	if pid := dnsServerPid(networkName); pid > 0 && dnsServerRunning(networkName) {
+		if err := util.KillProcess(pid); err != nil {
+			logrus.Warnf("kill dns server %d of network %s error %v", pid, networkName, err)
+		}
+	}
+	_ = os.Remove(dnsPidFile(networkName))
+}
+
+// 读取宿主机 resolv.conf 中的 nameserver 作为上游 DNS 服务器
+func hostResolvers() []string {
+	f, err := os.Open(hostResolvConf)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], strconv.Itoa(dnsPort)))
+		}
+	}
+	return servers
+}
+
+// 在当前进程中运行 DNS 服务，由 dns 命令调用
+// 监听完成后通过文件描述符 3 的管道通知父进程
+func (s *DNSServer) Run() error {
+	readyPipe := os.NewFile(uintptr(3), "pipe")
+	if len(s.Upstreams) == 0 {
+		s.Upstreams = hostResolvers()
+	}
+
+	udpConn, err := net.ListenPacket("udp", s.ListenAddr)
+	if err != nil {
+		fmt.Fprint(readyPipe, err.Error())
+		readyPipe.Close()
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", s.ListenAddr)
+	if err != nil {
+		udpConn.Close()
+		fmt.Fprint(readyPipe, err.Error())
+		readyPipe.Close()
+		return err
+	}
+	fmt.Fprint(readyPipe, childReadyMessage)
+	readyPipe.Close()
+
+	go s.serveTCP(tcpListener)
+	return s.serveUDP(udpConn)
+}
+
+func (s *DNSServer) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+		go func() {
+			resp := s.handle(req, false)
+			if resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(dnsForwardTimeout))
+				req, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(req, true)
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// TCP 上的 DNS 报文前有两个字节的长度
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 处理一个 DNS 查询，返回响应报文
+func (s *DNSServer) handle(req []byte, tcp bool) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(req); err != nil {
+		logrus.Debugf("unpack dns query error %v", err)
+		return nil
+	}
+	if len(query.Questions) == 1 {
+		if answers, ok := s.resolve(query.Questions[0]); ok {
+			resp := dnsmessage.Message{
+				Header: dnsmessage.Header{
+					ID:                 query.ID,
+					Response:           true,
+					Authoritative:      true,
+					RecursionDesired:   query.RecursionDesired,
+					RecursionAvailable: true,
+				},
+				Questions: query.Questions,
+				Answers:   answers,
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				logrus.Errorf("pack dns response error %v", err)
+				return nil
+			}
+			return packed
+		}
+	}
+
+	resp, err := s.forward(req, tcp)
+	if err != nil {
+		logrus.Debugf("forward dns query error %v", err)
+		failed := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:               query.ID,
+				Response:         true,
+				RCode:            dnsmessage.RCodeServerFailure,
+				RecursionDesired: query.RecursionDesired,
+			},
+			Questions: query.Questions,
+		}
+		packed, _ := failed.Pack()
+		return packed
+	}
+	return resp
+}
+
+// 解析网络内的容器名称，ok 为 false 表示不是网络内的名称，需要转发
+func (s *DNSServer) resolve(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	all, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		logrus.Errorf("load endpoints error %v", err)
+		return nil, false
+	}
+	// 后台运行的容器退出后端点文件仍然保留，跳过进程已经不存在的容器，避免解析到失效或者被重新分配的地址
+	var endpoints []*Endpoint
+	for _, ep := range all {
+		if ep.NetworkName != s.Network {
+			continue
+		}
+		if _, running := containerRunning(ep.ContainerID); running {
+			endpoints = append(endpoints, ep)
+		}
+	}
+
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsRecordTTL}
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		for _, ep := range endpoints {
+			if ep.NetworkName != s.Network {
+				continue
+			}
+			for _, ip := range endpointIPs(ep) {
+				if reverseName(ip) != name {
+					continue
+				}
+				target, err := dnsmessage.NewName(ep.hostnames(s.Network)[0] + ".")
+				if err != nil {
+					return nil, false
+				}
+				hdr.Type = dnsmessage.TypePTR
+				return []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.PTRResource{PTR: target}}}, true
+			}
+		}
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		for _, ep := range endpoints {
+			if ep.NetworkName != s.Network || !ep.hasHostname(s.Network, name) {
+				continue
+			}
+			// 名称属于网络内的容器，即使没有对应类型的地址也不再转发
+			var answers []dnsmessage.Resource
+			for _, ip := range endpointIPs(ep) {
+				if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+					hdr.Type = dnsmessage.TypeA
+					var a [4]byte
+					copy(a[:], ip4)
+					answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: a}})
+				} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+					hdr.Type = dnsmessage.TypeAAAA
+					var aaaa [16]byte
+					copy(aaaa[:], ip.To16())
+					answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+				}
+			}
+			return answers, true
+		}
+	}
+	return nil, false
+}
+
+// 将查询转发给宿主机的 DNS 服务器，依次尝试直到成功
+func (s *DNSServer) forward(req []byte, tcp bool) ([]byte, error) {
+	if len(s.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream dns server")
+	}
+	var lastErr error
+	for _, upstream := range s.Upstreams {
+		network := "udp"
+		if tcp {
+			network = "tcp"
+		}
+		conn, err := net.DialTimeout(network, upstream, dnsForwardTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_ = conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+		var resp []byte
+		if tcp {
+			if err = writeTCPMessage(conn, req); err == nil {
+				resp, err = readTCPMessage(conn)
+			}
+		} else {
+			if _, err = conn.Write(req); err == nil {
+				buf := make([]byte, 65535)
+				var n int
+				n, err = conn.Read(buf)
+				resp = buf[:n]
+			}
+		}
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// 网络端点的所有地址
+func endpointIPs(ep *Endpoint) []net.IP {
+	var ips []net.IP
+	if ep.IpAddress != nil {
+		ips = append(ips, ep.IpAddress)
+	}
+	if ep.IPv6Address != nil {
+		ips = append(ips, ep.IPv6Address)
+	}
+	return ips
+}
+
+// 容器在网络中可以被解析的名称: 容器名、别名、容器ID，以及加上网络名后缀的形式
+func (ep *Endpoint) hostnames(networkName string) []string {
+	var base []string
+	for _, n := range append([]string{ep.ContainerName}, ep.Aliases...) {
+		if n != "" {
+			base = append(base, strings.ToLower(n))
+		}
+	}
+	base = append(base, ep.ContainerID)
+	names := append([]string{}, base...)
+	for _, n := range base {
+		names = append(names, n+"."+networkName)
+	}
+	return names
+}
+
+func (ep *Endpoint) hasHostname(networkName, name string) bool {
+	for _, n := range ep.hostnames(networkName) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 地址对应的反向解析名称，例如 192.168.10.2 对应 2.10.168.192.in-addr.arpa
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	ip6 := ip.To16()
+	var b strings.Builder
+	for i := len(ip6) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip6[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip6[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
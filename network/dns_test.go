@@ -0,0 +1,114 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"mydocker/container"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, s *DNSServer, name string, typ dnsmessage.Type) *dnsmessage.Message {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	req, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(s.handle(req, false)); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+// 在容器状态目录中写入容器信息，测试结束后删除
+func writeContainerInfo(t *testing.T, cinfo *container.ContainerInfo) {
+	dir := fmt.Sprintf(container.DefaultInfoLocation, cinfo.Id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	content, _ := json.Marshal(cinfo)
+	if err := os.WriteFile(path.Join(dir, container.ConfigName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSServerResolve(t *testing.T) {
+	origin := defaultEndpointPath
+	defer func() { defaultEndpointPath = origin }()
+	defaultEndpointPath = t.TempDir()
+	ep := &Endpoint{
+		ID:            "1234567890-testbridge",
+		ContainerID:   "1234567890",
+		ContainerName: "web",
+		Aliases:       []string{"www"},
+		IpAddress:     net.ParseIP("192.168.10.2").To4(),
+		NetworkName:   "testbridge",
+	}
+	if err := ep.dump(defaultEndpointPath); err != nil {
+		t.Fatal(err)
+	}
+	writeContainerInfo(t, &container.ContainerInfo{Id: ep.ContainerID, Status: container.RUNNING, Pid: strconv.Itoa(os.Getpid())})
+	// 已经退出的后台容器留下的端点不能被解析
+	exited := &Endpoint{
+		ID:            "0987654321-testbridge",
+		ContainerID:   "0987654321",
+		ContainerName: "gone",
+		IpAddress:     net.ParseIP("192.168.10.3").To4(),
+		NetworkName:   "testbridge",
+	}
+	if err := exited.dump(defaultEndpointPath); err != nil {
+		t.Fatal(err)
+	}
+	writeContainerInfo(t, &container.ContainerInfo{Id: exited.ContainerID, Status: container.RUNNING, Pid: "999999999"})
+	s := &DNSServer{Network: "testbridge"}
+
+	for _, name := range []string{"web.", "WWW.", "1234567890.", "web.testbridge."} {
+		resp := dnsQuery(t, s, name, dnsmessage.TypeA)
+		if len(resp.Answers) != 1 {
+			t.Fatalf("query %s got %d answers", name, len(resp.Answers))
+		}
+		if a := resp.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "192.168.10.2" {
+			t.Errorf("query %s got %v", name, a)
+		}
+	}
+
+	// 容器没有 IPv6 地址时返回空应答，不转发
+	if resp := dnsQuery(t, s, "web.", dnsmessage.TypeAAAA); resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Errorf("query AAAA got %+v", resp)
+	}
+
+	resp := dnsQuery(t, s, "2.10.168.192.in-addr.arpa.", dnsmessage.TypePTR)
+	if len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != "web." {
+		t.Errorf("query PTR got %+v", resp.Answers)
+	}
+
+	if resp := dnsQuery(t, s, "gone.", dnsmessage.TypeA); len(resp.Answers) != 0 {
+		t.Errorf("query exited container got %+v", resp.Answers)
+	}
+
+	// 其他网络的容器不可解析，没有上游服务器时返回 SERVFAIL
+	other := &DNSServer{Network: "other"}
+	if resp := dnsQuery(t, other, "web.", dnsmessage.TypeA); resp.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("query other network got %v", resp.RCode)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if got := reverseName(net.ParseIP("10.0.0.1")); got != "1.0.0.10.in-addr.arpa" {
+		t.Errorf("got %s", got)
+	}
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	if got := reverseName(net.ParseIP("2001:db8::1")); got != want {
+		t.Errorf("got %s", got)
+	}
+}
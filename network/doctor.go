@@ -0,0 +1,453 @@
+package network
+
+import (
+	"fmt"
+	"mydocker/container"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// network doctor 发现的网络状态文件与内核状态之间的差异
+// repair 为空的问题不能自动修复，需要手动处理
+type stateProblem struct {
+	Network  string
+	Endpoint string
+	Message  string
+	repair   func() error
+}
+
+// 检查网络状态文件、IPAM 以及宿主机上的网络设备，repair 为 true 时依次修复可以自动修复的问题
+// 输出每个问题及处理结果，仍有未解决的问题时返回错误
+func Doctor(repair bool) error {
+	problems := checkNetworkState()
+	if len(problems) == 0 {
+		fmt.Println("no problem found")
+		return nil
+	}
+
+	unresolved := 0
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "NETWORK\tENDPOINT\tPROBLEM\tSTATUS\n")
+	for _, p := range problems {
+		status := "repairable"
+		switch {
+		case p.repair == nil:
+			status = "manual"
+			unresolved++
+		case !repair:
+			unresolved++
+		default:
+			if err := p.repair(); err != nil {
+				status = fmt.Sprintf("repair failed: %v", err)
+				unresolved++
+			} else {
+				status = "repaired"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Network, p.Endpoint, p.Message, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if unresolved > 0 {
+		if !repair {
+			return fmt.Errorf("found %d problems, run mydocker network doctor --repair to repair", unresolved)
+		}
+		return fmt.Errorf("%d problems are not repaired", unresolved)
+	}
+	return nil
+}
+
+// 依次检查网络配置文件、网段重叠、网络设备、网络端点和 IPAM
+// 修复按照返回的顺序执行，网络设备的修复在网络端点之前，DNS 服务依赖网桥上的网关地址
+func checkNetworkState() []*stateProblem {
+	var problems []*stateProblem
+	problems = append(problems, checkCorruptNetworks()...)
+	problems = append(problems, checkOverlaps()...)
+	for _, nw := range sortedNetworks() {
+		problems = append(problems, checkNetworkDevice(nw)...)
+	}
+	endpoints, running, epProblems := checkEndpoints()
+	problems = append(problems, epProblems...)
+	for _, nw := range sortedNetworks() {
+		problems = append(problems, checkDNSServer(nw, running)...)
+	}
+	problems = append(problems, checkIPAM(endpoints)...)
+	return problems
+}
+
+func sortedNetworks() []*Network {
+	var list []*Network
+	for _, nw := range networks {
+		list = append(list, nw)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// 无法加载的网络配置文件，修复时重命名为 .corrupt，不再加载
+func checkCorruptNetworks() []*stateProblem {
+	var files []string
+	for file := range corruptNetworks {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var problems []*stateProblem
+	for _, file := range files {
+		file := file
+		_, name := path.Split(file)
+		problems = append(problems, &stateProblem{
+			Network: name,
+			Message: fmt.Sprintf("corrupt network file: %v", corruptNetworks[file]),
+			repair:  func() error { return quarantineStateFile(file) },
+		})
+	}
+	return problems
+}
+
+// 网段重叠的网络共用 IPAM 中的同一个位图，需要手动删除其中一个网络
+func checkOverlaps() []*stateProblem {
+	var problems []*stateProblem
+	nws := sortedNetworks()
+	for i, nw := range nws {
+		if !nw.usesIPAM() {
+			continue
+		}
+		rest := map[string]*Network{}
+		for _, other := range nws[i+1:] {
+			rest[other.Name] = other
+		}
+		if other, subnet := overlappingNetwork(nw, rest); other != nil {
+			problems = append(problems, &stateProblem{
+				Network: nw.Name,
+				Message: fmt.Sprintf("subnet overlaps with subnet %s of network %s", subnetString(subnet), other.Name),
+			})
+		}
+	}
+	return problems
+}
+
+// 检查网络在宿主机上的设备：bridge 网络的网桥和网关地址，overlay 网络的网桥和 VXLAN 设备，macvlan/ipvlan 网络的 parent 接口
+func checkNetworkDevice(nw *Network) []*stateProblem {
+	problem := func(msg string, repair func() error) []*stateProblem {
+		return []*stateProblem{{Network: nw.Name, Message: msg, repair: repair}}
+	}
+	switch nw.Driver {
+	case (&BridgeNetworkDriver{}).Name():
+		br, err := netlink.LinkByName(nw.device())
+		if err != nil {
+			return problem(fmt.Sprintf("bridge %s is missing", nw.device()), func() error { return recreateBridge(nw) })
+		}
+		if br.Type() != "bridge" {
+			return problem(fmt.Sprintf("device %s is a %s, not a bridge", nw.device(), br.Type()), nil)
+		}
+		var problems []*stateProblem
+		if !hasAddress(br, nw.IpRange) {
+			problems = append(problems, problem(fmt.Sprintf("gateway %s is missing on bridge %s", nw.IpRange, nw.device()), func() error {
+				return setInterfaceIP(nw.device(), nw.IpRange.String())
+			})...)
+		}
+		if nw.IPv6 && !hasAddress(br, nw.IpRange6) {
+			problems = append(problems, problem(fmt.Sprintf("gateway %s is missing on bridge %s", nw.IpRange6, nw.device()), func() error {
+				return setInterfaceIP6(nw.device(), nw.IpRange6)
+			})...)
+		}
+		if br.Attrs().Flags&net.FlagUp == 0 {
+			problems = append(problems, problem(fmt.Sprintf("bridge %s is down", nw.device()), func() error {
+				return setInterfaceUP(nw.device())
+			})...)
+		}
+		return problems
+	case (&OverlayNetworkDriver{}).Name():
+		vni, err := overlayVNI(nw)
+		if err != nil {
+			return problem(err.Error(), nil)
+		}
+		for _, name := range []string{nw.device(), vxlanName(vni)} {
+			if _, err := netlink.LinkByName(name); err != nil {
+				// 网桥和 VXLAN 设备需要一起创建，删除剩余的设备后重新创建
+				return problem(fmt.Sprintf("device %s is missing", name), func() error {
+					d := &OverlayNetworkDriver{}
+					if err := d.Delete(*nw); err != nil {
+						return err
+					}
+					return d.Create(nw)
+				})
+			}
+		}
+	case (&MacvlanNetworkDriver{}).Name(), (&IpvlanNetworkDriver{}).Name():
+		if _, err := netlink.LinkByName(nw.device()); err != nil {
+			return problem(fmt.Sprintf("parent interface %s is missing", nw.device()), nil)
+		}
+	}
+	return nil
+}
+
+// 网桥被删除后重新创建网桥、网关地址和防火墙规则，先删除可能残留的规则避免重复添加
+// 原来连接在网桥上的容器 Veth 已经随网桥一起删除，需要重新连接
+func recreateBridge(nw *Network) error {
+	rules := append(bridgeRules(nw), networkIsolationRules(nw, true)...)
+	if err := delFirewallRules(rules...); err != nil {
+		return err
+	}
+	return (&BridgeNetworkDriver{}).Create(nw)
+}
+
+func hasAddress(link netlink.Link, ipNet *net.IPNet) bool {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查网络端点：无法加载的端点文件、所在网络已经删除的端点、容器已经停止的端点，以及运行中容器的 Veth 和 CNI 状态
+// 返回所在网络存在的端点用于检查 IPAM，以及其中容器仍在运行的端点用于检查 DNS 服务
+func checkEndpoints() ([]*Endpoint, []*Endpoint, []*stateProblem) {
+	entries, err := os.ReadDir(defaultEndpointPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, []*stateProblem{{Message: fmt.Sprintf("read endpoint dir %s error %v", defaultEndpointPath, err)}}
+	}
+	var endpoints, running []*Endpoint
+	var problems []*stateProblem
+	for _, entry := range entries {
+		if entry.IsDir() || ignoredStateFile(entry.Name()) {
+			continue
+		}
+		file := path.Join(defaultEndpointPath, entry.Name())
+		ep := &Endpoint{ID: entry.Name()}
+		if err := ep.load(defaultEndpointPath); err != nil {
+			problems = append(problems, &stateProblem{
+				Endpoint: ep.ID,
+				Message:  fmt.Sprintf("corrupt endpoint file: %v", err),
+				repair:   func() error { return quarantineStateFile(file) },
+			})
+			continue
+		}
+		if ep.Network == nil {
+			problems = append(problems, &stateProblem{
+				Network:  ep.NetworkName,
+				Endpoint: ep.ID,
+				Message:  "network of endpoint does not exist",
+				repair:   func() error { return ep.remove(defaultEndpointPath) },
+			})
+			continue
+		}
+		endpoints = append(endpoints, ep)
+		cinfo, ok := containerRunning(ep.ContainerID)
+		if !ok {
+			// 容器异常退出时没有断开网络，断开连接释放地址、端口映射和带宽限制
+			problems = append(problems, &stateProblem{
+				Network:  ep.NetworkName,
+				Endpoint: ep.ID,
+				Message:  fmt.Sprintf("container %s is not running", ep.ContainerID),
+				repair:   func() error { return Disconnect(ep.NetworkName, cinfo) },
+			})
+			continue
+		}
+		running = append(running, ep)
+		problems = append(problems, checkEndpointDevice(ep)...)
+	}
+	return endpoints, running, problems
+}
+
+// 运行中容器的网络设备，Veth 丢失时需要重新连接网络
+func checkEndpointDevice(ep *Endpoint) []*stateProblem {
+	problem := func(msg string) []*stateProblem {
+		return []*stateProblem{{Network: ep.NetworkName, Endpoint: ep.ID, Message: msg}}
+	}
+	nw := ep.Network
+	switch {
+	case !nw.usesIPAM():
+		if err := (&CNINetworkDriver{}).Check(nw, ep); err != nil {
+			return problem(fmt.Sprintf("cni check failed: %v", err))
+		}
+	case nw.isBridge() || nw.Driver == (&OverlayNetworkDriver{}).Name():
+		veth, err := netlink.LinkByName(ep.Device.Name)
+		if err != nil {
+			return problem(fmt.Sprintf("veth %s is missing, reconnect the container", ep.Device.Name))
+		}
+		br, err := netlink.LinkByName(nw.device())
+		if err == nil && veth.Attrs().MasterIndex != br.Attrs().Index {
+			return problem(fmt.Sprintf("veth %s is not attached to bridge %s, reconnect the container", ep.Device.Name, nw.device()))
+		}
+	}
+	return nil
+}
+
+// 容器是否仍在运行，容器信息不存在时返回只有容器ID的信息，用于断开网络
+func containerRunning(id string) (*container.ContainerInfo, bool) {
+	configFile := path.Join(fmt.Sprintf(container.DefaultInfoLocation, id), container.ConfigName)
+	if _, err := os.Stat(configFile); err != nil {
+		return &container.ContainerInfo{Id: id}, false
+	}
+	cinfo, err := container.GetContainerInfoById(id)
+	if err != nil {
+		return &container.ContainerInfo{Id: id}, false
+	}
+	if cinfo.Status != container.RUNNING || cinfo.Pid == "" {
+		return cinfo, false
+	}
+	if _, err := os.Stat(fmt.Sprintf("/proc/%s", cinfo.Pid)); err != nil {
+		return cinfo, false
+	}
+	return cinfo, true
+}
+
+// 有容器连接的 bridge 网络需要运行内置 DNS 服务
+func checkDNSServer(nw *Network, endpoints []*Endpoint) []*stateProblem {
+	if !nw.isBridge() || dnsServerRunning(nw.Name) {
+		return nil
+	}
+	for _, ep := range endpoints {
+		if ep.NetworkName == nw.Name {
+			return []*stateProblem{{
+				Network: nw.Name,
+				Message: "dns server is not running",
+				repair:  func() error { return ensureDNSServer(nw) },
+			}}
+		}
+	}
+	return nil
+}
+
+// 根据网络的网关、保留地址和网络端点的地址计算每个网段应有的地址分配位图，与 IPAM 文件比较
+// 修复时用计算的结果重建 IPAM 文件：释放泄漏的地址、补充缺失的分配并删除不属于任何网络的网段
+// 重建在其他修复之后执行，重新加载端点信息，已经断开的端点不再占用地址
+func checkIPAM(endpoints []*Endpoint) []*stateProblem {
+	expected := expectedAllocations(endpoints)
+	rebuild := func() error {
+		current, err := loadEndpoints(defaultEndpointPath)
+		if err != nil {
+			return err
+		}
+		subnets := expectedAllocations(current)
+		ipAllocator.Subnets = &subnets
+		return ipAllocator.dump()
+	}
+
+	ipAllocator.Subnets = &map[string]string{}
+	if err := ipAllocator.load(); err != nil {
+		return []*stateProblem{{
+			Message: fmt.Sprintf("corrupt ipam file %s: %v", ipAllocator.SubnetAllocatorPath, err),
+			repair: func() error {
+				if err := quarantineStateFile(ipAllocator.SubnetAllocatorPath); err != nil {
+					return err
+				}
+				return rebuild()
+			},
+		}}
+	}
+	actual := *ipAllocator.Subnets
+
+	var messages []string
+	var subnets []string
+	for subnet := range actual {
+		subnets = append(subnets, subnet)
+	}
+	for subnet := range expected {
+		if _, ok := actual[subnet]; !ok {
+			subnets = append(subnets, subnet)
+		}
+	}
+	sort.Strings(subnets)
+	for _, subnet := range subnets {
+		_, sub, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		have := parseAllocation(sub, actual[subnet])
+		want, ok := expected[subnet]
+		if !ok {
+			if have.count() > 0 {
+				messages = append(messages, fmt.Sprintf("subnet %s does not belong to any network", subnet))
+			}
+			continue
+		}
+		expect := parseAllocation(sub, want)
+		var leaked, missing []string
+		for _, ip := range have.list() {
+			if !expect.allocated(ip) {
+				leaked = append(leaked, ip.String())
+			}
+		}
+		for _, ip := range expect.list() {
+			if !have.allocated(ip) {
+				missing = append(missing, ip.String())
+			}
+		}
+		if len(leaked) > 0 {
+			messages = append(messages, fmt.Sprintf("leaked addresses %s in subnet %s", strings.Join(leaked, ","), subnet))
+		}
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("addresses %s in use are not allocated in subnet %s", strings.Join(missing, ","), subnet))
+		}
+	}
+
+	var problems []*stateProblem
+	for _, msg := range messages {
+		// 重建 IPAM 文件的结果与执行次数无关，每个问题都可以通过重建修复
+		problems = append(problems, &stateProblem{Message: msg, repair: rebuild})
+	}
+	return problems
+}
+
+// 计算网络和端点应有的 IPAM 分配情况，key 与 IPAM 一致为网段的网络地址
+func expectedAllocations(endpoints []*Endpoint) map[string]string {
+	allocations := map[string]*allocation{}
+	mark := func(subnet *net.IPNet, ip net.IP) {
+		if subnet == nil || ip == nil {
+			return
+		}
+		_, sub, err := net.ParseCIDR(subnet.String())
+		if err != nil {
+			return
+		}
+		if _, ok := allocations[sub.String()]; !ok {
+			allocations[sub.String()] = parseAllocation(sub, "")
+		}
+		if err := allocations[sub.String()].set(ip, true); err != nil {
+			logrus.Warnf("ip %s is out of subnet %s", ip, sub)
+		}
+	}
+	for _, nw := range networks {
+		if !nw.usesIPAM() {
+			continue
+		}
+		if hasGatewayAddress(nw.IpRange) {
+			mark(nw.IpRange, nw.IpRange.IP)
+		}
+		for _, addr := range nw.AuxAddresses {
+			mark(nw.IpRange, net.ParseIP(addr))
+		}
+		if nw.IPv6 && hasGatewayAddress(nw.IpRange6) {
+			mark(nw.IpRange6, nw.IpRange6.IP)
+		}
+	}
+	for _, ep := range endpoints {
+		if ep.Network == nil || !ep.Network.usesIPAM() {
+			continue
+		}
+		mark(ep.Network.IpRange, ep.IpAddress)
+		if ep.Network.IPv6 {
+			mark(ep.Network.IpRange6, ep.IPv6Address)
+		}
+	}
+	result := map[string]string{}
+	for subnet, alloc := range allocations {
+		result[subnet] = alloc.String()
+	}
+	return result
+}
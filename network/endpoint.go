@@ -1,27 +1,144 @@
 package network
 
 import (
+	"encoding/json"
 	"fmt"
 	"mydocker/container"
 	"net"
 	"os"
-	"os/exec"
+	"path"
 	"runtime"
-	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
+var defaultEndpointPath = "/var/lib/mydocker/network/endpoint/"
+
 // 定义网络端点，用于连接容器与网络，保证容器内部与网络的通信
 type Endpoint struct {
-	ID          string           `json:"id"`
-	Device      netlink.Veth     `json:"device"`
-	IpAddress   net.IP           `json:"ip"`
-	MacAddress  net.HardwareAddr `json:"mac"`
-	PortMapping []string         `json:"portmapping"`
-	Network     *Network
+	ID           string           `json:"id"`
+	ContainerID  string           `json:"containerId"`
+	Device       netlink.Veth     `json:"device"`
+	IpAddress    net.IP           `json:"ip"`
+	IPv6Address  net.IP           `json:"ip6,omitempty"`
+	MacAddress   net.HardwareAddr `json:"mac"`
+	PortMapping  []string         `json:"portmapping"`
+	PortBindings []PortBinding    `json:"portBindings"`
+	NetworkName  string           `json:"network"`
+	Network      *Network         `json:"-"`
+
+	// 容器名和别名，用于网络内置 DNS 解析
+	ContainerName string   `json:"containerName"`
+	Aliases       []string `json:"aliases"`
+
+	// 是否为端口映射启动用户态代理，关闭时改为添加 hairpin NAT 规则
+	UserlandProxy bool  `json:"userlandProxy"`
+	ProxyPids     []int `json:"proxyPids"`
+
+	// 容器 Net Namespace 的路径 /proc/<pid>/ns/net
+	SandboxKey string `json:"sandboxKey,omitempty"`
+	// cni 网络中插件 ADD 的结果，以及结果中的 DNS 服务器
+	CNIResult   json.RawMessage `json:"cniResult,omitempty"`
+	Nameservers []string        `json:"nameservers,omitempty"`
+}
+
+// 保存网络端点信息，文件名为端点ID
+func (ep *Endpoint) dump(dumpPath string) error {
+	if err := os.MkdirAll(dumpPath, os.ModePerm); err != nil {
+		return fmt.Errorf("can not create endpoint dump path %s error %v", dumpPath, err)
+	}
+	epJson, err := json.Marshal(ep)
+	if err != nil {
+		return fmt.Errorf("error marshal endpoint %s json error %v", ep.ID, err)
+	}
+	return writeStateFile(path.Join(dumpPath, ep.ID), epJson)
+}
+
+func (ep *Endpoint) load(dumpPath string) error {
+	contentBytes, err := os.ReadFile(path.Join(dumpPath, ep.ID))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contentBytes, ep); err != nil {
+		return fmt.Errorf("error unmarshal endpoint %s json error %v", ep.ID, err)
+	}
+	ep.Network = networks[ep.NetworkName]
+	return nil
+}
+
+func (ep *Endpoint) remove(dumpPath string) error {
+	err := os.Remove(path.Join(dumpPath, ep.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 端点所在网络的网桥设备名，网络信息未加载时使用网络名
+func (ep *Endpoint) bridgeName() string {
+	if ep.Network != nil {
+		return ep.Network.device()
+	}
+	return ep.NetworkName
+}
+
+// 加载所有保存的网络端点信息
+func loadEndpoints(dumpPath string) ([]*Endpoint, error) {
+	entries, err := os.ReadDir(dumpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, entry := range entries {
+		if entry.IsDir() || ignoredStateFile(entry.Name()) {
+			continue
+		}
+		ep := &Endpoint{ID: entry.Name()}
+		if err := ep.load(dumpPath); err != nil {
+			logrus.Errorf("error load endpoint: %v", err)
+			continue
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// 获取容器连接的所有网络端点
+func GetEndpoints(containerId string) ([]*Endpoint, error) {
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return nil, err
+	}
+	var result []*Endpoint
+	for _, ep := range endpoints {
+		if ep.ContainerID == containerId {
+			result = append(result, ep)
+		}
+	}
+	return result, nil
+}
+
+// 运行中的容器已经发布的所有端口映射
+func publishedPorts() ([]PortBinding, error) {
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []PortBinding
+	for _, ep := range endpoints {
+		// 跳过已经停止或者被删除的容器遗留的端点
+		cinfo, err := container.GetContainerInfoById(ep.ContainerID)
+		if err != nil || cinfo.Status != container.RUNNING {
+			continue
+		}
+		bindings = append(bindings, ep.PortBindings...)
+	}
+	return bindings, nil
 }
 
 // 配置容器网络端点的地址和路由
@@ -31,6 +148,8 @@ func configEndpointIPAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 	if err != nil {
 		return fmt.Errorf("fail config endpoint: %v", err)
 	}
+	// Veth 移动到容器的 Net Namespace 后 MAC 地址不变，记录下来用于 network inspect
+	ep.MacAddress = l.Attrs().HardwareAddr
 
 	// 将容器的网络端点加入到容器的网络空间中，并使这个函数下面的操作都在这个网络空间中进行
 	// 执行完函数后，恢复为默认的网络空间
@@ -67,39 +186,205 @@ func configEndpointIPAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 		Gw: ep.Network.IpRange.IP,
 		Dst: cidr,
 	}
+	// ipvlan l3 模式下默认路由直接指向接口，相当于 route add -net 0.0.0.0/0 dev {容器内接口}
+	gatewayless := gatewaylessRoute(ep.Network)
+	if gatewayless {
+		defaultRoute.Gw = nil
+		defaultRoute.Scope = netlink.SCOPE_LINK
+	}
 
 	// 调用netlink的RouteAdd，添加路由到容器的网络空间
 	// RouteAdd函数相当于route add命令
-	if err := netlink.RouteAdd(defaultRoute); err != nil {
+	if !ep.Network.hasGateway() {
+		logrus.Infof("network %s has no gateway, skip default route", ep.NetworkName)
+	} else if err := netlink.RouteAdd(defaultRoute); err != nil {
 		return err
 	}
+
+	// 双栈网络同时配置容器的 IPv6 地址和默认路由
+	// 相当于 ip -6 route add ::/0 via {bridge网桥IPv6地址} dev {容器内Veth端点设备}
+	if ep.IPv6Address != nil && ep.Network.IpRange6 != nil {
+		interfaceIp6 := *ep.Network.IpRange6
+		interfaceIp6.IP = ep.IPv6Address
+		if err := setInterfaceIP6(ep.Device.PeerName, &interfaceIp6); err != nil {
+			return fmt.Errorf("%s,%v,%s", ep.Device.PeerName, ep.Network, err)
+		}
+		_, cidr6, _ := net.ParseCIDR("::/0")
+		defaultRoute6 := &netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Gw:        ep.Network.IpRange6.IP,
+			Dst:       cidr6,
+		}
+		if gatewayless {
+			defaultRoute6.Gw = nil
+			defaultRoute6.Scope = netlink.SCOPE_LINK
+		}
+		if !ep.Network.hasGateway() {
+			return nil
+		}
+		if err := netlink.RouteAdd(defaultRoute6); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // 配置端口映射
 func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
-	// 遍历容器端口映射列表
+	// 解析容器端口映射列表
+	var bindings []PortBinding
 	for _, pm := range ep.PortMapping {
-		portMapping := strings.Split(pm, ":")
-		if len(portMapping) != 2 {
-			logrus.Errorf("port mapping format error, %v", pm)
-			continue
+		pbs, err := ParsePortMapping(pm)
+		if err != nil {
+			return err
 		}
+		bindings = append(bindings, pbs...)
+	}
+	if len(bindings) == 0 {
+		return nil
+	}
+
+	// 分配宿主机端口，并检查是否与其他容器已发布的端口冲突
+	published, err := publishedPorts()
+	if err != nil {
+		return err
+	}
+	if ep.PortBindings, err = allocateHostPorts(bindings, published); err != nil {
+		return err
+	}
+
+	// 所有端口映射规则一次性提交
+	if err := addFirewallRules(portMappingRules(ep)...); err != nil {
+		return err
+	}
 
-		// 使用 exec.Command 方法配置iptables的PREROUTING中添加DNAT规则
-		// 将宿主机的端口请求转发到容器的地址和端口上
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s", portMapping[0],
-			ep.IpAddress.String(), portMapping[1])
-		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-		output, err := cmd.Output()
+	if !ep.UserlandProxy {
+		return enableHairpinNAT(ep)
+	}
+	// 为每个端口映射启动用户态代理，处理宿主机本地和同一网桥容器的访问
+	for _, pb := range ep.PortBindings {
+		if pb.Proto == "sctp" {
+			logrus.Warnf("userland proxy does not support sctp, port %s only works from outside", pb)
+			continue
+		}
+		containerIP := ep.IpAddress
+		if ip := net.ParseIP(pb.HostIP); ip != nil && ip.To4() == nil && ep.IPv6Address != nil {
+			containerIP = ep.IPv6Address
+		}
+		pid, err := startProxy(pb, containerIP, cinfo.Pid)
 		if err != nil {
-			logrus.Errorf("iptables output: %v", output)
 			return err
 		}
+		ep.ProxyPids = append(ep.ProxyPids, pid)
 	}
 	return nil
 }
 
+// 关闭用户态代理时，需要内核直接处理本地访问和 hairpin 流量
+// 1. 开启网桥的 route_localnet，允许目的地址为 127.0.0.1 的报文经过 DNAT 后路由到网桥
+// 2. 开启容器 Veth 在网桥上的 hairpin 模式，允许容器通过宿主机地址访问自己发布的端口
+func enableHairpinNAT(ep *Endpoint) error {
+	routeLocalnet := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", ep.bridgeName())
+	if err := os.WriteFile(routeLocalnet, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable route_localnet of %s error %v", ep.NetworkName, err)
+	}
+	l, err := netlink.LinkByName(ep.Device.Name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetHairpin(l, true)
+}
+
+// 端口映射对应的DNAT规则，将宿主机的端口请求转发到容器的地址和端口上
+// 相当于 iptables -t nat -A PREROUTING [-d {hostIP}] -p {proto} -m {proto} --dport {hostPort} -j DNAT --to-destination {ip}:{containerPort}
+// 未指定宿主机地址时只匹配目的地址为本机地址的报文，避免把容器访问外部同端口服务的流量也转发回容器
+// 开启用户态代理时，网桥内部的流量交给代理处理，DNAT规则排除网桥接口
+// 关闭用户态代理时，额外添加 OUTPUT 链的DNAT规则处理宿主机本地访问，并对本地和网桥内部的访问做 SNAT，
+// 保证容器的回包经过宿主机还原地址
+func portMappingRules(ep *Endpoint) []*Rule {
+	var rules []*Rule
+	for _, pb := range ep.PortBindings {
+		comment := fmt.Sprintf("mydocker:%s:%s:%s:%d", ep.ID, pb.Proto, pb.HostIP, pb.HostPort)
+		hostIP := net.ParseIP(pb.HostIP)
+		switch {
+		case hostIP == nil:
+			// 未指定宿主机地址时，双栈网络同时发布 IPv4 和 IPv6 端口
+			rules = append(rules, portBindingRules(ep, pb, nil, ep.IpAddress, comment)...)
+			if ep.IPv6Address != nil {
+				rules = append(rules, portBindingRules(ep, pb, nil, ep.IPv6Address, comment+":6")...)
+			}
+		case hostIP.To4() != nil:
+			rules = append(rules, portBindingRules(ep, pb, hostIP, ep.IpAddress, comment)...)
+		case ep.IPv6Address != nil:
+			rules = append(rules, portBindingRules(ep, pb, hostIP, ep.IPv6Address, comment)...)
+		default:
+			logrus.Warnf("endpoint %s has no ipv6 address, skip port mapping %s", ep.ID, pb)
+		}
+	}
+	return rules
+}
+
+// 单个端口映射到容器地址 containerIP 的规则，hostIP 为空时匹配宿主机的所有本地地址
+func portBindingRules(ep *Endpoint, pb PortBinding, hostIP, containerIP net.IP, comment string) []*Rule {
+	bridgeName := ep.bridgeName()
+	bits := 8 * net.IPv6len
+	if containerIP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	dnat := &Rule{
+		Chain:   ChainPrerouting,
+		Proto:   pb.Proto,
+		DPort:   pb.HostPort,
+		Action:  ActionDNAT,
+		ToIP:    containerIP,
+		ToPort:  pb.ContainerPort,
+		Comment: comment,
+	}
+	if hostIP == nil {
+		dnat.DstLocal = true
+	} else {
+		dnat.Dst = &net.IPNet{IP: hostIP, Mask: net.CIDRMask(bits, bits)}
+	}
+	if ep.UserlandProxy {
+		dnat.NotInIface = bridgeName
+		return []*Rule{dnat}
+	}
+	rules := []*Rule{dnat}
+
+	output := *dnat
+	output.Chain = ChainOutput
+	output.Comment = comment + ":output"
+	rules = append(rules, &output)
+
+	containerNet := &net.IPNet{IP: containerIP, Mask: net.CIDRMask(bits, bits)}
+	var sources []*net.IPNet
+	if bits == 8*net.IPv4len {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		sources = append(sources, loopback)
+		if ep.Network != nil {
+			_, subnet, _ := net.ParseCIDR(ep.Network.IpRange.String())
+			sources = append(sources, subnet)
+		}
+	} else if ep.Network != nil && ep.Network.IpRange6 != nil {
+		// IPv6 没有 route_localnet，宿主机本地通过 ::1 访问的流量无法转发到容器
+		_, subnet6, _ := net.ParseCIDR(ep.Network.IpRange6.String())
+		sources = append(sources, subnet6)
+	}
+	for i, src := range sources {
+		rules = append(rules, &Rule{
+			Chain:    ChainPostrouting,
+			OutIface: bridgeName,
+			Src:      src,
+			Dst:      containerNet,
+			Proto:    pb.Proto,
+			DPort:    pb.ContainerPort,
+			Action:   ActionMasquerade,
+			Comment:  fmt.Sprintf("%s:hairpin%d", comment, i),
+		})
+	}
+	return rules
+}
+
 func enterContainerNetNS(link *netlink.Link, cinfo *container.ContainerInfo) func() {
 
 	// 找到容器的Net Namespace
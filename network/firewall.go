@@ -0,0 +1,230 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 逻辑链名，由各个防火墙后端映射到自己的表和链上
+// nftables 后端: inet mydocker 表中的 prerouting/output/postrouting/forward/isolation 链
+// iptables 后端: nat/filter 表中的 MYDOCKER-PREROUTING/MYDOCKER-OUTPUT/MYDOCKER-POSTROUTING/MYDOCKER-FORWARD/MYDOCKER-ISOLATION 链
+const (
+	ChainPrerouting  = "PREROUTING"
+	ChainOutput      = "OUTPUT"
+	ChainPostrouting = "POSTROUTING"
+	ChainForward     = "FORWARD"
+	// 网络隔离规则，同样挂在 FORWARD 上，但先于 FORWARD 链中的放行规则匹配
+	// 只包含 DROP 规则，不匹配的报文继续由 FORWARD 链处理
+	ChainIsolation = "ISOLATION"
+)
+
+// 规则动作，名称与 iptables 的 target 保持一致
+const (
+	ActionAccept     = "ACCEPT"
+	ActionDrop       = "DROP"
+	ActionReturn     = "RETURN"
+	ActionMasquerade = "MASQUERADE"
+	ActionDNAT       = "DNAT"
+)
+
+// 防火墙表名，也是 iptables 自定义链的前缀
+const firewallTableName = "mydocker"
+
+// 通过环境变量强制指定防火墙后端: nftables 或 iptables
+const envFirewallBackend = "MYDOCKER_FIREWALL"
+
+// 与后端无关的防火墙规则描述
+// 同一条规则的 Comment 需要唯一，nftables 后端删除规则时依靠 Comment 定位规则
+type Rule struct {
+	Chain       string     // 逻辑链名
+	InIface     string     // 入接口，相当于 -i
+	NotInIface  string     // 排除的入接口，相当于 ! -i
+	OutIface    string     // 出接口，相当于 -o
+	NotOutIface string     // 排除的出接口，相当于 ! -o
+	Src         *net.IPNet // 源地址段，相当于 -s
+	Dst         *net.IPNet // 目的地址段，相当于 -d
+	DstLocal    bool       // 目的地址为本机地址，相当于 -m addrtype --dst-type LOCAL
+	Proto       string     // 协议 tcp/udp/sctp
+	DPort       int        // 目的端口
+	Action      string     // 规则动作
+	ToIP        net.IP     // DNAT 目的地址
+	ToPort      int        // DNAT 目的端口
+	Comment     string     // 规则标识
+}
+
+// 规则适用的 IP 协议族
+const (
+	familyAny  = 0 // 规则中没有地址，同时适用于 IPv4 和 IPv6
+	familyIPv4 = 4
+	familyIPv6 = 6
+)
+
+// 根据规则中的地址判断规则适用的协议族
+func (r *Rule) family() int {
+	for _, ip := range []net.IP{ipOfNet(r.Src), ipOfNet(r.Dst), r.ToIP} {
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return familyIPv4
+		}
+		return familyIPv6
+	}
+	return familyAny
+}
+
+func ipOfNet(ipNet *net.IPNet) net.IP {
+	if ipNet == nil {
+		return nil
+	}
+	return ipNet.IP
+}
+
+// 防火墙后端接口，所有的修改都以批量的方式原子地生效
+type Firewall interface {
+	// 后端名称
+	Name() string
+	// 创建 mydocker 专用的表和链，重复调用不会产生副作用
+	Setup() error
+	// 添加一组规则
+	AddRules(rules ...*Rule) error
+	// 删除一组规则，不存在的规则会被忽略
+	DelRules(rules ...*Rule) error
+}
+
+var firewall Firewall
+
+// 选择防火墙后端，优先使用 nftables，不支持 nftables 的主机回退到 iptables 命令
+func newFirewall() (Firewall, error) {
+	switch backend := os.Getenv(envFirewallBackend); backend {
+	case "nftables":
+		return &NftablesFirewall{}, nil
+	case "iptables":
+		return &IptablesFirewall{}, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %s", backend)
+	}
+
+	if nftablesAvailable() {
+		return &NftablesFirewall{}, nil
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return &IptablesFirewall{}, nil
+	}
+	return nil, fmt.Errorf("neither nftables nor iptables is available")
+}
+
+// 初始化防火墙后端，并创建 mydocker 专用的表和链
+func initFirewall() error {
+	fw, err := newFirewall()
+	if err != nil {
+		return err
+	}
+	if err := fw.Setup(); err != nil {
+		return fmt.Errorf("setup %s firewall error: %v", fw.Name(), err)
+	}
+	logrus.Debugf("use %s firewall backend", fw.Name())
+	firewall = fw
+	return nil
+}
+
+func addFirewallRules(rules ...*Rule) error {
+	if firewall == nil {
+		return fmt.Errorf("firewall is not initialized")
+	}
+	return firewall.AddRules(rules...)
+}
+
+func delFirewallRules(rules ...*Rule) error {
+	if firewall == nil {
+		return fmt.Errorf("firewall is not initialized")
+	}
+	return firewall.DelRules(rules...)
+}
+
+// 网络出口的 SNAT 规则以及 FORWARD 放行规则
+// 相当于 iptables -t nat -A POSTROUTING -s {subnet} ! -o {bridge} -j MASQUERADE
+// IPv6 网段在 NAT 模式下同样添加 MASQUERADE 规则（NAT66），routed 模式下只放行转发
+// internal 网络不添加 SNAT 规则，并在 ISOLATION 链中丢弃进出网桥的转发流量，只允许网桥内部通信
+func bridgeRules(nw *Network) []*Rule {
+	bridgeName := nw.device()
+	_, cidr, _ := net.ParseCIDR(nw.IpRange.String())
+	var rules []*Rule
+	if nw.Internal {
+		rules = append(rules,
+			&Rule{
+				Chain:       ChainIsolation,
+				InIface:     bridgeName,
+				NotOutIface: bridgeName,
+				Action:      ActionDrop,
+				Comment:     fmt.Sprintf("mydocker:%s:internal-in", nw.Name),
+			},
+			&Rule{
+				Chain:      ChainIsolation,
+				NotInIface: bridgeName,
+				OutIface:   bridgeName,
+				Action:     ActionDrop,
+				Comment:    fmt.Sprintf("mydocker:%s:internal-out", nw.Name),
+			},
+		)
+	} else {
+		rules = append(rules, &Rule{
+			Chain:       ChainPostrouting,
+			Src:         cidr,
+			NotOutIface: bridgeName,
+			Action:      ActionMasquerade,
+			Comment:     fmt.Sprintf("mydocker:%s:masquerade", nw.Name),
+		})
+	}
+	rules = append(rules,
+		&Rule{
+			Chain:   ChainForward,
+			InIface: bridgeName,
+			Action:  ActionAccept,
+			Comment: fmt.Sprintf("mydocker:%s:forward-in", nw.Name),
+		},
+		&Rule{
+			Chain:    ChainForward,
+			OutIface: bridgeName,
+			Action:   ActionAccept,
+			Comment:  fmt.Sprintf("mydocker:%s:forward-out", nw.Name),
+		},
+	)
+	if nw.IPv6 && nw.IpRange6 != nil && nw.IPv6Mode != IPv6ModeRouted && !nw.Internal {
+		_, cidr6, _ := net.ParseCIDR(nw.IpRange6.String())
+		rules = append(rules, &Rule{
+			Chain:       ChainPostrouting,
+			Src:         cidr6,
+			NotOutIface: bridgeName,
+			Action:      ActionMasquerade,
+			Comment:     fmt.Sprintf("mydocker:%s:masquerade6", nw.Name),
+		})
+	}
+	return rules
+}
+
+// 两个网桥之间的隔离规则，丢弃两个方向上经过宿主机转发的流量
+// 相当于 iptables -A MYDOCKER-ISOLATION -i {a} -o {b} -j DROP
+func isolationRules(a, b *Network) []*Rule {
+	return []*Rule{
+		{
+			Chain:    ChainIsolation,
+			InIface:  a.device(),
+			OutIface: b.device(),
+			Action:   ActionDrop,
+			Comment:  fmt.Sprintf("mydocker:%s:isolate:%s", a.Name, b.Name),
+		},
+		{
+			Chain:    ChainIsolation,
+			InIface:  b.device(),
+			OutIface: a.device(),
+			Action:   ActionDrop,
+			Comment:  fmt.Sprintf("mydocker:%s:isolate:%s", b.Name, a.Name),
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestIptablesRuleArgs(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.10.0/24")
+	args, err := iptablesRuleArgs(bridgeRules(&Network{Name: "testbridge", IpRange: subnet})[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-s 192.168.10.0/24 ! -o testbridge -m comment --comment mydocker:testbridge:masquerade -j MASQUERADE"
+	if got := strings.Join(args, " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	args, err = iptablesRuleArgs(&Rule{
+		Chain:    ChainPrerouting,
+		DstLocal: true,
+		Proto:    "tcp",
+		DPort:    8080,
+		Action:   ActionDNAT,
+		ToIP:     net.ParseIP("192.168.10.2"),
+		ToPort:   80,
+		Comment:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "-p tcp -m addrtype --dst-type LOCAL -m tcp --dport 8080 -m comment --comment test -j DNAT --to-destination 192.168.10.2:80"
+	if got := strings.Join(args, " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	args, err = iptablesRuleArgs(&Rule{
+		Chain:    ChainPrerouting,
+		DstLocal: true,
+		Proto:    "tcp",
+		DPort:    8080,
+		Action:   ActionDNAT,
+		ToIP:     net.ParseIP("fd00::2"),
+		ToPort:   80,
+		Comment:  "test6",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "-p tcp -m addrtype --dst-type LOCAL -m tcp --dport 8080 -m comment --comment test6 -j DNAT --to-destination [fd00::2]:80"
+	if got := strings.Join(args, " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRuleFamily(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.10.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00::/64")
+	nw := &Network{Name: "testbridge", IpRange: subnet, IPv6: true, IpRange6: subnet6}
+	families := map[string]int{}
+	for _, rule := range bridgeRules(nw) {
+		families[rule.Comment] = rule.family()
+	}
+	want := map[string]int{
+		"mydocker:testbridge:masquerade":  familyIPv4,
+		"mydocker:testbridge:masquerade6": familyIPv6,
+		"mydocker:testbridge:forward-in":  familyAny,
+		"mydocker:testbridge:forward-out": familyAny,
+	}
+	for comment, family := range want {
+		if families[comment] != family {
+			t.Errorf("rule %s family %d, want %d", comment, families[comment], family)
+		}
+	}
+
+	// routed 模式不做 NAT66
+	nw.IPv6Mode = IPv6ModeRouted
+	if rules := bridgeRules(nw); len(rules) != 3 {
+		t.Errorf("routed mode got %d rules", len(rules))
+	}
+}
+
+func TestIsolationRules(t *testing.T) {
+	origin := networks
+	defer func() { networks = origin }()
+	_, subnet, _ := net.ParseCIDR("192.168.10.0/24")
+	networks = map[string]*Network{
+		"br0":  {Name: "br0", Driver: "bridge", IpRange: subnet, Options: map[string]string{optionBridgeName: "mybr0"}},
+		"br1":  {Name: "br1", Driver: "bridge", IpRange: subnet, Allow: []string{"br2"}},
+		"mac0": {Name: "mac0", Driver: "macvlan", IpRange: subnet},
+	}
+	nw := &Network{Name: "br2", Driver: "bridge", IpRange: subnet}
+	// br1 允许与 br2 互通，macvlan 网络不经过宿主机转发
+	rules := networkIsolationRules(nw, false)
+	if len(rules) != 2 || rules[0].Comment != "mydocker:br2:isolate:br0" || rules[1].Comment != "mydocker:br0:isolate:br2" ||
+		rules[0].OutIface != "mybr0" {
+		t.Errorf("got isolation rules %+v", rules)
+	}
+	if rules := networkIsolationRules(nw, true); len(rules) != 4 {
+		t.Errorf("got %d rules when deleting network", len(rules))
+	}
+
+	// internal 网络没有 SNAT 规则
+	nw.Internal = true
+	for _, rule := range bridgeRules(nw) {
+		if rule.Action == ActionMasquerade {
+			t.Errorf("internal network has masquerade rule %s", rule.Comment)
+		}
+	}
+}
+
+func TestNftablesFirewall(t *testing.T) {
+	if !nftablesAvailable() {
+		t.Skip("nftables is not available")
+	}
+	fw := &NftablesFirewall{}
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("192.168.250.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:250::/64")
+	nw := &Network{Name: "mydockertest", IpRange: subnet, IPv6: true, IpRange6: subnet6, IPv6Mode: IPv6ModeNAT}
+	rules := append(bridgeRules(nw), isolationRules(nw, &Network{Name: "mydockertest1", Driver: "bridge"})...)
+	rules = append(rules, &Rule{
+		Chain:    ChainPrerouting,
+		DstLocal: true,
+		Proto:    "tcp",
+		DPort:    18080,
+		Action:   ActionDNAT,
+		ToIP:     net.ParseIP("192.168.250.2"),
+		ToPort:   80,
+		Comment:  "mydocker:test:port",
+	})
+	// 模拟 iptables-nft 创建的默认策略为 DROP 的 FORWARD 链，主机上已经有 ip filter 表时不修改
+	conn, err := nftables.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hostChain *nftables.Chain
+	if chains, _ := iptablesNftForwardChains(conn, false); len(chains) == 0 {
+		table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+		policy := nftables.ChainPolicyDrop
+		hostChain = conn.AddChain(&nftables.Chain{Name: ChainForward, Table: table, Type: nftables.ChainTypeFilter,
+			Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Policy: &policy})
+		if err := conn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			conn.DelTable(table)
+			conn.Flush()
+		}()
+	}
+	if err := fw.AddRules(rules...); err != nil {
+		t.Fatal(err)
+	}
+	if hostChain != nil {
+		comments, _ := nftRuleComments(conn, hostChain)
+		if _, ok := comments["mydocker:mydockertest:forward-in"]; !ok || len(comments) != 2 {
+			t.Errorf("forward rules in iptables FORWARD chain with DROP policy: %v", comments)
+		}
+	}
+	if err := fw.DelRules(rules...); err != nil {
+		t.Fatal(err)
+	}
+	if hostChain != nil {
+		if comments, _ := nftRuleComments(conn, hostChain); len(comments) != 0 {
+			t.Errorf("forward rules left in iptables FORWARD chain: %v", comments)
+		}
+	}
+	// 重复删除不存在的规则不应报错
+	if err := fw.DelRules(rules...); err != nil {
+		t.Fatal(err)
+	}
+}
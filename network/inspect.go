@@ -0,0 +1,247 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// network inspect 输出的网络详细信息
+type NetworkDetail struct {
+	Name     string            `json:"name"`
+	Driver   string            `json:"driver"`
+	Subnet   string            `json:"subnet"`
+	Gateway  string            `json:"gateway,omitempty"`
+	Subnet6  string            `json:"subnet6,omitempty"`
+	Gateway6 string            `json:"gateway6,omitempty"`
+	IPRange  string            `json:"ipRange,omitempty"`
+	IPv6Mode string            `json:"ipv6Mode,omitempty"`
+	Device   string            `json:"device,omitempty"`
+	MTU      int               `json:"mtu,omitempty"`
+	Internal bool              `json:"internal"`
+	Allow    []string          `json:"allow,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	IPAM     []IPAMUsage       `json:"ipam"`
+
+	AuxAddresses map[string]string `json:"auxAddresses,omitempty"`
+
+	Containers []ContainerEndpoint `json:"containers"`
+}
+
+// 网段的地址分配情况
+type IPAMUsage struct {
+	Subnet    string `json:"subnet"`
+	Allocated int    `json:"allocated"`
+	Free      int    `json:"free"`
+}
+
+// 连接到网络的容器
+type ContainerEndpoint struct {
+	ContainerID string `json:"containerId"`
+	Name        string `json:"name"`
+	IPv4Address string `json:"ipv4Address"`
+	IPv6Address string `json:"ipv6Address,omitempty"`
+	MacAddress  string `json:"macAddress,omitempty"`
+	Veth        string `json:"veth,omitempty"`
+}
+
+// network list 输出的网络摘要
+type networkSummary struct {
+	Name     string            `json:"name"`
+	Driver   string            `json:"driver"`
+	Subnet   string            `json:"subnet"`
+	Subnet6  string            `json:"subnet6,omitempty"`
+	Internal bool              `json:"internal"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+func (nw *Network) summary() *networkSummary {
+	s := &networkSummary{
+		Name:     nw.Name,
+		Driver:   nw.Driver,
+		Internal: nw.Internal,
+		Labels:   nw.Labels,
+	}
+	if nw.IpRange != nil {
+		s.Subnet = subnetString(nw.IpRange)
+	}
+	if nw.IpRange6 != nil {
+		s.Subnet6 = subnetString(nw.IpRange6)
+	}
+	return s
+}
+
+// IpRange 中保存的是网关地址和掩码，展示时转换为网段地址
+func subnetString(ipRange *net.IPNet) string {
+	return (&net.IPNet{IP: ipRange.IP.Mask(ipRange.Mask), Mask: ipRange.Mask}).String()
+}
+
+// 查询网络的网关、设备、IPAM 使用情况以及连接的容器
+func inspectNetwork(nw *Network) (*NetworkDetail, error) {
+	s := nw.summary()
+	detail := &NetworkDetail{
+		Name:     nw.Name,
+		Driver:   nw.Driver,
+		Subnet:   s.Subnet,
+		Subnet6:  s.Subnet6,
+		IPv6Mode: nw.IPv6Mode,
+		Device:   nw.device(),
+		Internal: nw.Internal,
+		Allow:    nw.Allow,
+		Options:  nw.Options,
+		Labels:   nw.Labels,
+
+		AuxAddresses: nw.AuxAddresses,
+		Containers:   []ContainerEndpoint{},
+	}
+	if nw.AllocRange != nil {
+		detail.IPRange = nw.AllocRange.String()
+	}
+	// macvlan/ipvlan 网络的网关是物理网络的路由器，同样记录在 IpRange 中
+	if hasGatewayAddress(nw.IpRange) {
+		detail.Gateway = nw.IpRange.IP.String()
+	}
+	if hasGatewayAddress(nw.IpRange6) {
+		detail.Gateway6 = nw.IpRange6.IP.String()
+	}
+	if detail.Device != "" {
+		if link, err := netlink.LinkByName(detail.Device); err == nil {
+			detail.MTU = link.Attrs().MTU
+		} else {
+			logrus.Warnf("find device %s of network %s error %v", detail.Device, nw.Name, err)
+		}
+	}
+
+	for _, ipRange := range []*net.IPNet{nw.IpRange, nw.IpRange6} {
+		if ipRange == nil {
+			continue
+		}
+		allocated, total, err := ipAllocator.Usage(ipRange)
+		if err != nil {
+			return nil, err
+		}
+		detail.IPAM = append(detail.IPAM, IPAMUsage{Subnet: subnetString(ipRange), Allocated: allocated, Free: total - allocated})
+	}
+
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, ep := range endpoints {
+		if ep.NetworkName != nw.Name {
+			continue
+		}
+		c := ContainerEndpoint{
+			ContainerID: ep.ContainerID,
+			Name:        ep.ContainerName,
+			IPv4Address: ep.IpAddress.String(),
+			MacAddress:  ep.MacAddress.String(),
+			Veth:        ep.Device.Name,
+		}
+		if ep.IPv6Address != nil {
+			c.IPv6Address = ep.IPv6Address.String()
+		}
+		detail.Containers = append(detail.Containers, c)
+	}
+	sort.Slice(detail.Containers, func(i, j int) bool {
+		return detail.Containers[i].Name < detail.Containers[j].Name
+	})
+	return detail, nil
+}
+
+// 以 JSON 格式打印网络的详细信息
+func InspectNetwork(networkName string) error {
+	nw, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf("no such network: %s", networkName)
+	}
+	detail, err := inspectNetwork(nw)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(detail, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// 解析 network list 的过滤条件，支持 driver=、name=（名称包含）和 label=key 或 label=key=value
+func parseNetworkFilters(filters []string) (func(nw *Network) bool, error) {
+	var matchers []func(nw *Network) bool
+	for _, f := range filters {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid filter %q, should be key=value", f)
+		}
+		value := kv[1]
+		switch kv[0] {
+		case "driver":
+			matchers = append(matchers, func(nw *Network) bool { return nw.Driver == value })
+		case "name":
+			matchers = append(matchers, func(nw *Network) bool { return strings.Contains(nw.Name, value) })
+		case "label":
+			label := strings.SplitN(value, "=", 2)
+			matchers = append(matchers, func(nw *Network) bool {
+				v, ok := nw.Labels[label[0]]
+				return ok && (len(label) == 1 || v == label[1])
+			})
+		default:
+			return nil, fmt.Errorf("unsupported filter %q, supported filters: driver, name, label", kv[0])
+		}
+	}
+	return func(nw *Network) bool {
+		for _, match := range matchers {
+			if !match(nw) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// 用于 ./mydocker network list 命令查询当前创建的网络，format 为 table 或 json
+func ListNetwork(format string, filters []string) error {
+	match, err := parseNetworkFilters(filters)
+	if err != nil {
+		return err
+	}
+	var list []*networkSummary
+	for _, nw := range networks {
+		if match(nw) {
+			list = append(list, nw.summary())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(list, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %s, should be table or json", format)
+	}
+
+	// 使用tabwriter进行网络展示
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "NAME\tIpRange\tIpRange6\tDriver\n")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Subnet, s.Subnet6, s.Driver)
+	}
+	// 输出到标准输出
+	return w.Flush()
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"net"
+	"path"
+	"testing"
+)
+
+func TestNetworkFilters(t *testing.T) {
+	nws := []*Network{
+		{Name: "frontend", Driver: "bridge", Labels: map[string]string{"env": "prod"}},
+		{Name: "backend", Driver: "bridge", Labels: map[string]string{"env": "dev"}},
+		{Name: "lan", Driver: "macvlan"},
+	}
+	tests := []struct {
+		filters []string
+		want    string
+	}{
+		{[]string{"driver=bridge"}, "frontend,backend,"},
+		{[]string{"driver=bridge", "label=env=prod"}, "frontend,"},
+		{[]string{"name=back"}, "backend,"},
+		{[]string{"label=env"}, "frontend,backend,"},
+	}
+	for _, tt := range tests {
+		match, err := parseNetworkFilters(tt.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, nw := range nws {
+			if match(nw) {
+				got += nw.Name + ","
+			}
+		}
+		if got != tt.want {
+			t.Errorf("filters %v got %s, want %s", tt.filters, got, tt.want)
+		}
+	}
+	for _, f := range []string{"driver", "id=123", "name="} {
+		if _, err := parseNetworkFilters([]string{f}); err == nil {
+			t.Errorf("filter %q expect error", f)
+		}
+	}
+}
+
+func TestInspectNetwork(t *testing.T) {
+	dir := t.TempDir()
+	oldAllocator, oldEndpointPath := ipAllocator, defaultEndpointPath
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+	defaultEndpointPath = path.Join(dir, "endpoint")
+	defer func() { ipAllocator, defaultEndpointPath = oldAllocator, oldEndpointPath }()
+
+	_, ipRange, _ := net.ParseCIDR("192.168.20.0/24")
+	gateway, _ := ipAllocator.Allocate(ipRange)
+	ip, _ := ipAllocator.Allocate(ipRange)
+	ipRange.IP = gateway
+	nw := &Network{Name: "inspectnet", IpRange: ipRange, Driver: "bridge", Labels: map[string]string{"env": "test"}}
+	mac, _ := net.ParseMAC("02:42:c0:a8:14:02")
+	ep := &Endpoint{ID: "1234567890-inspectnet", ContainerID: "1234567890", ContainerName: "web", NetworkName: nw.Name, IpAddress: ip, MacAddress: mac}
+	ep.Device.Name = "12345"
+	if err := ep.dump(defaultEndpointPath); err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err := inspectNetwork(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Gateway != "192.168.20.1" || detail.Subnet != "192.168.20.0/24" || detail.Device != nw.Name {
+		t.Errorf("detail %+v", detail)
+	}
+	if len(detail.IPAM) != 1 || detail.IPAM[0].Allocated != 2 || detail.IPAM[0].Free != 252 {
+		t.Errorf("ipam usage %+v", detail.IPAM)
+	}
+	want := ContainerEndpoint{ContainerID: "1234567890", Name: "web", IPv4Address: "192.168.20.2", MacAddress: mac.String(), Veth: "12345"}
+	if len(detail.Containers) != 1 || detail.Containers[0] != want {
+		t.Errorf("containers %+v", detail.Containers)
+	}
+}
@@ -1,17 +1,26 @@
 package network
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
 	"mydocker/util"
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-const ipamDefaultAllocatorPath = "/var/lib/mydocker/network/ipam/subnet.json"
+const (
+	ipamDefaultAllocatorPath = "/var/lib/mydocker/network/ipam/subnet.json"
+	// 使用位图记录分配情况的网段的最大主机位数，更大的网段只记录已分配的地址
+	maxBitmapBits = 16
+)
 
 // 存放IP地址分配信息
 type IPAM struct {
@@ -31,27 +40,20 @@ func (ipam *IPAM) load() error{
 		return err
 	}
 	if !exist {
-		pth, _ := path.Split(ipamDefaultAllocatorPath)
+		pth, _ := path.Split(ipam.SubnetAllocatorPath)
 		_ = os.MkdirAll(pth, 0644)
-		_, err = os.Create(ipamDefaultAllocatorPath)
+		_, err = os.Create(ipam.SubnetAllocatorPath)
 		return err
 	}
-	subnetConfigFile, err := os.Open(ipam.SubnetAllocatorPath)
+	// 位图大小随网段增长，需要读取完整的文件内容
+	contentBytes, err := os.ReadFile(ipam.SubnetAllocatorPath)
 	if err != nil {
 		return err
 	}
-	defer subnetConfigFile.Close()
-
-	contentBytes := make([]byte, 2000)
-	n, err := subnetConfigFile.Read(contentBytes)
-	if err != nil{
-		return err
-	}
-	err = json.Unmarshal(contentBytes[:n], ipam.Subnets)
-	if err != nil {
-		return err
+	if len(contentBytes) == 0 {
+		return nil
 	}
-	return nil
+	return json.Unmarshal(contentBytes, ipam.Subnets)
 }
 
 // 将IPAM信息写入配置文件
@@ -62,7 +64,9 @@ func (ipam *IPAM) dump() error {
 	}
 	if !exist {
 		dir, _ := path.Split(ipam.SubnetAllocatorPath)
-		return os.MkdirAll(dir, 0644)
+		if err := os.MkdirAll(dir, 0644); err != nil {
+			return err
+		}
 	}
 	subnetConfigFile, err := os.OpenFile(ipam.SubnetAllocatorPath, os.O_TRUNC | os.O_CREATE | os.O_WRONLY, 0644)
 	if err != nil {
@@ -83,7 +87,268 @@ func (ipam *IPAM) dump() error {
 }
 
 
+// 网段可分配的地址数量，超过 int 范围时返回 math.MaxInt
+// IPv4 去掉网络地址和广播地址，IPv6 去掉网络地址（Subnet-Router anycast 地址）
+func subnetPoolSize(sub *net.IPNet) int {
+	ones, bits := sub.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if bits == 8*net.IPv4len {
+		size.Sub(size, big.NewInt(2))
+	} else {
+		size.Sub(size, big.NewInt(1))
+	}
+	switch {
+	case size.Sign() < 0:
+		return 0
+	case !size.IsInt64() || size.Int64() > math.MaxInt:
+		return math.MaxInt
+	}
+	return int(size.Int64())
+}
+
+// 地址数不超过 2^maxBitmapBits 的网段使用位图记录分配情况
+func usesBitmap(sub *net.IPNet) bool {
+	ones, bits := sub.Mask.Size()
+	return bits-ones <= maxBitmapBits
+}
+
+// 位图索引 idx 对应网段中第 idx+1 个地址，IP 地址按大整数计算，同时适用于 IPv4 和 IPv6
+func indexToIP(sub *net.IPNet, idx int) net.IP {
+	base := sub.IP.To4()
+	if base == nil {
+		base = sub.IP.To16()
+	}
+	n := new(big.Int).SetBytes(base)
+	n.Add(n, big.NewInt(int64(idx)+1))
+	ip := make(net.IP, len(base))
+	b := n.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// IP 地址在网段位图中的索引
+func ipToIndex(sub *net.IPNet, ip net.IP) (int, error) {
+	base := sub.IP.To4()
+	addr := ip.To4()
+	if base == nil {
+		base, addr = sub.IP.To16(), ip.To16()
+	}
+	if addr == nil || !sub.Contains(ip) {
+		return -1, fmt.Errorf("ip %s is not in subnet %s", ip, sub)
+	}
+	n := new(big.Int).SetBytes(addr)
+	n.Sub(n, new(big.Int).SetBytes(base))
+	n.Sub(n, big.NewInt(1))
+	if !n.IsInt64() || n.Int64() < 0 || n.Int64() >= int64(subnetPoolSize(sub)) {
+		return -1, fmt.Errorf("ip %s is out of allocation range of subnet %s", ip, sub)
+	}
+	return int(n.Int64()), nil
+}
+
+// 网段中地址的分配情况，在 IPAM 文件中编码为字符串
+// 使用位图的网段第 idx 个字符对应网段中第 idx+1 个地址，'1' 表示已分配；
+// 更大的网段（IPv4 /15 及更大、IPv6 /64 等）只记录已分配的地址，以逗号分隔，不生成完整的位图
+type allocation struct {
+	sub    *net.IPNet
+	bitmap []byte
+	ips    map[string]net.IP
+}
+
+func parseAllocation(sub *net.IPNet, value string) *allocation {
+	a := &allocation{sub: sub}
+	if usesBitmap(sub) {
+		size := subnetPoolSize(sub)
+		// 旧版本的 /16 位图包含广播地址和网段之外的地址，截掉多余的部分
+		if len(value) > size {
+			value = value[:size]
+		}
+		a.bitmap = []byte(value + strings.Repeat("0", size-len(value)))
+		return a
+	}
+	a.ips = map[string]net.IP{}
+	if strings.Trim(value, "01") == "" {
+		// 旧版本为大网段生成的 2^16 位图，转换为已分配地址的集合
+		for idx := 0; idx < len(value); idx++ {
+			if value[idx] == '1' {
+				a.add(indexToIP(sub, idx))
+			}
+		}
+		return a
+	}
+	for _, s := range strings.Split(value, ",") {
+		if ip := net.ParseIP(s); ip != nil {
+			a.add(ip)
+		}
+	}
+	return a
+}
+
+func (a *allocation) normalize(ip net.IP) net.IP {
+	if a.sub.IP.To4() != nil {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+func (a *allocation) add(ip net.IP) {
+	if ip = a.normalize(ip); ip != nil {
+		a.ips[ip.String()] = ip
+	}
+}
+
+func (a *allocation) String() string {
+	if a.bitmap != nil {
+		return string(a.bitmap)
+	}
+	var list []string
+	for _, ip := range a.list() {
+		list = append(list, ip.String())
+	}
+	return strings.Join(list, ",")
+}
+
+// 检查地址是否是网段中可以分配的主机地址，使用位图时返回位图索引
+func (a *allocation) index(ip net.IP) (int, error) {
+	if a.bitmap != nil {
+		return ipToIndex(a.sub, ip)
+	}
+	addr := a.normalize(ip)
+	if addr == nil || !a.sub.Contains(addr) {
+		return -1, fmt.Errorf("ip %s is not in subnet %s", ip, a.sub)
+	}
+	if addr.Equal(a.sub.IP) || (len(addr) == net.IPv4len && addr.Equal(lastAddress(a.sub))) {
+		return -1, fmt.Errorf("ip %s is out of allocation range of subnet %s", ip, a.sub)
+	}
+	return -1, nil
+}
+
+func (a *allocation) allocated(ip net.IP) bool {
+	idx, err := a.index(ip)
+	if err != nil {
+		return false
+	}
+	if a.bitmap != nil {
+		return a.bitmap[idx] == '1'
+	}
+	_, ok := a.ips[a.normalize(ip).String()]
+	return ok
+}
+
+func (a *allocation) set(ip net.IP, allocated bool) error {
+	idx, err := a.index(ip)
+	if err != nil {
+		return err
+	}
+	switch {
+	case a.bitmap != nil && allocated:
+		a.bitmap[idx] = '1'
+	case a.bitmap != nil:
+		a.bitmap[idx] = '0'
+	case allocated:
+		a.add(ip)
+	default:
+		delete(a.ips, a.normalize(ip).String())
+	}
+	return nil
+}
+
+// 按地址顺序返回已分配的地址
+func (a *allocation) list() []net.IP {
+	var list []net.IP
+	if a.bitmap != nil {
+		for idx, c := range a.bitmap {
+			if c == '1' {
+				list = append(list, indexToIP(a.sub, idx))
+			}
+		}
+		return list
+	}
+	for _, ip := range a.ips {
+		list = append(list, ip)
+	}
+	sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i], list[j]) < 0 })
+	return list
+}
+
+func (a *allocation) count() int {
+	if a.bitmap != nil {
+		return bytes.Count(a.bitmap, []byte("1"))
+	}
+	return len(a.ips)
+}
+
+// 按顺序查找第一个没有分配、并且在 ipRange 中的地址
+// 从 ipRange 的第一个地址对应的索引开始查找，ipRange 可以位于大网段中的任意位置
+// 只记录已分配地址的网段最多检查 count()+1 个地址就能找到空闲地址
+func (a *allocation) next(ipRange *net.IPNet) net.IP {
+	start, end := 0, subnetPoolSize(a.sub)
+	if ipRange != nil {
+		first, last := ipOffset(a.sub, ipRange.IP.Mask(ipRange.Mask)), ipOffset(a.sub, lastAddress(ipRange))
+		if first.Cmp(big.NewInt(int64(end))) >= 0 || last.Sign() < 0 {
+			return nil
+		}
+		if first.Sign() > 0 {
+			start = int(first.Int64())
+		}
+		if last.Cmp(big.NewInt(int64(end))) < 0 {
+			end = int(last.Int64()) + 1
+		}
+	}
+	for idx := start; idx < end; idx++ {
+		if a.bitmap != nil && a.bitmap[idx] != '0' {
+			continue
+		}
+		candidate := indexToIP(a.sub, idx)
+		if a.bitmap == nil {
+			if _, ok := a.ips[candidate.String()]; ok {
+				continue
+			}
+		}
+		return candidate
+	}
+	return nil
+}
+
+// 地址相对于网段中第一个可分配地址的偏移，即位图索引，可能为负数或者超出可分配的范围
+func ipOffset(sub *net.IPNet, ip net.IP) *big.Int {
+	base, addr := sub.IP.To4(), ip.To4()
+	if base == nil {
+		base, addr = sub.IP.To16(), ip.To16()
+	}
+	n := new(big.Int).SetBytes(addr)
+	n.Sub(n, new(big.Int).SetBytes(base))
+	return n.Sub(n, big.NewInt(1))
+}
+
+// 网段的最后一个地址，IPv4 为广播地址
+func lastAddress(n *net.IPNet) net.IP {
+	ip := n.IP.To4()
+	if ip == nil || len(n.Mask) != net.IPv4len {
+		ip = n.IP.To16()
+	}
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^n.Mask[len(n.Mask)-len(ip)+i]
+	}
+	return last
+}
+
 func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
+	return ipam.allocate(subnet, nil, nil)
+}
+
+// 在网段的 ipRange 子网段中分配地址，对应 network create --ip-range，ipRange 为空时在整个网段中分配
+func (ipam *IPAM) AllocateInRange(subnet, ipRange *net.IPNet) (net.IP, error) {
+	return ipam.allocate(subnet, ipRange, nil)
+}
+
+// 分配网段中指定的地址，用于指定网关地址和 --aux-address 保留地址，地址已被分配时返回错误
+func (ipam *IPAM) Reserve(subnet *net.IPNet, ip net.IP) error {
+	_, err := ipam.allocate(subnet, nil, ip)
+	return err
+}
+
+func (ipam *IPAM) allocate(subnet, ipRange *net.IPNet, want net.IP) (ip net.IP, err error) {
 	// 存放网段中地址分配信息的数组
 	ipam.Subnets = &map[string]string{}
 
@@ -98,34 +363,26 @@ func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
 		return nil, err
 	}
 
-	// for subnet: 10.10.0/24, its mask is 255.255.255.0
-	// so 'ones' will be 24 and 'bits' will be 32.
-	ones, bits := sub.Mask.Size()
-
-	if _, exist := (*ipam.Subnets)[sub.String()]; !exist{
-		// 分配位图
-		(*ipam.Subnets)[sub.String()] = strings.Repeat("0", 1 << uint8(bits-ones))
-	}
-
-	for idx := range (*ipam.Subnets)[sub.String()] {
-		if (*ipam.Subnets)[sub.String()][idx] == '0' {
-			ip = sub.IP
-			ipalloc := []rune((*ipam.Subnets)[sub.String()])
-			ipalloc[idx] = '1'
-			(*ipam.Subnets)[sub.String()] = string(ipalloc)
-			for t := 3; t >= 0; t-- {
-				// TODO: 这种写法能导致溢出错误，不知道原书为何这么写，总之需要 idx >> x后结果在0-255之间，否则会出现溢出bug
-				ip[3-t] += uint8(idx >> (t*8))
-			}
-			// TODO: 这种写法有bug，如果在最后一部分IP为255，+1得256导致错误
-			ip[3] += 1
-			break
+	alloc := parseAllocation(sub, (*ipam.Subnets)[sub.String()])
+	if want != nil {
+		if _, err := alloc.index(want); err != nil {
+			return nil, err
+		}
+		if alloc.allocated(want) {
+			return nil, fmt.Errorf("ip %s is already allocated in subnet %s", want, sub)
+		}
+		ip = want
+	} else if ip = alloc.next(ipRange); ip == nil {
+		if ipRange != nil {
+			return nil, fmt.Errorf("no available ip in range %s of subnet %s", ipRange, sub)
 		}
+		return nil, fmt.Errorf("no available ip in subnet %s", sub)
 	}
-	
-	ipam.dump()
-
-	return 
+	if err := alloc.set(ip, true); err != nil {
+		return nil, err
+	}
+	(*ipam.Subnets)[sub.String()] = alloc.String()
+	return ip, ipam.dump()
 }
 
 func (ipam *IPAM) Release(subnet *net.IPNet, ipAddr *net.IP) error {
@@ -137,21 +394,35 @@ func (ipam *IPAM) Release(subnet *net.IPNet, ipAddr *net.IP) error {
 		return err
 	}
 
-	// 计算IP地址在网段位图数组中得索引位置
-	idx := 0
-	// 将IP地址转换为4个字节的表示方式
-	releaseIP := ipAddr.To4()
-	// TODO: 由于IP是从1开始分配的，所以转换成索引应减1,仅限在子网掩码在24时奏效
-	releaseIP[3] -= 1
-	for t := uint(4) ; t > 0 ; t--{
-		idx += int(releaseIP[t-1] - subnet.IP.To4()[t-1]) << ((4-t) * 8)
-		logrus.Info(int(releaseIP[t-1] - subnet.IP[t-1]) << ((4-t) * 8))
+	// 网段的key与Allocate保持一致，使用网段的网络地址，而不是网关地址
+	_, sub, err := net.ParseCIDR(subnet.String())
+	if err != nil {
+		return err
+	}
+
+	value, ok := (*ipam.Subnets)[sub.String()]
+	if !ok {
+		return fmt.Errorf("ip %s is not allocated in subnet %s", ipAddr, sub)
+	}
+	alloc := parseAllocation(sub, value)
+	if err := alloc.set(*ipAddr, false); err != nil {
+		return err
 	}
-	ipalloc := []byte((*ipam.Subnets)[subnet.String()])
-	ipalloc[idx] = '0'
-	(*ipam.Subnets)[subnet.String()] = string(ipalloc)
+	(*ipam.Subnets)[sub.String()] = alloc.String()
 
 	// 保存释放掉IP后的网段IP分配信息
-	ipam.dump()
-	return nil
+	return ipam.dump()
+}
+
+// 网段中已分配的地址数量和可分配的地址总数，用于 network inspect 展示 IPAM 使用情况
+func (ipam *IPAM) Usage(subnet *net.IPNet) (allocated int, total int, err error) {
+	ipam.Subnets = &map[string]string{}
+	if err := ipam.load(); err != nil {
+		return 0, 0, err
+	}
+	_, sub, err := net.ParseCIDR(subnet.String())
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseAllocation(sub, (*ipam.Subnets)[sub.String()]).count(), subnetPoolSize(sub), nil
 }
@@ -1,7 +1,12 @@
 package network
 
 import (
+	"fmt"
+	"mydocker/container"
 	"net"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -24,4 +29,268 @@ func TestRelease(t *testing.T){
 func TestInit(t *testing.T) {
 	Init()
 	t.Logf("%v", networks["testbridge"])
-}
\ No newline at end of file
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	_, ipnet, _ := net.ParseCIDR("fd00:10::/64")
+	for _, want := range []string{"fd00:10::1", "fd00:10::2"} {
+		ip, err := ipam.Allocate(ipnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != want {
+			t.Errorf("alloc ip %s, want %s", ip, want)
+		}
+	}
+	// /64 网段只记录已分配的地址，不生成位图
+	if value := (*ipam.Subnets)[ipnet.String()]; value != "fd00:10::1,fd00:10::2" {
+		t.Errorf("allocation of /64 %q", value)
+	}
+
+	ip := net.ParseIP("fd00:10::1")
+	if err := ipam.Release(ipnet, &ip); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := ipam.Allocate(ipnet); ip.String() != "fd00:10::1" {
+		t.Errorf("alloc released ip got %s", ip)
+	}
+}
+
+func TestAllocateIPv4Boundary(t *testing.T) {
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	_, ipnet, _ := net.ParseCIDR("10.20.0.0/30")
+	var ips []string
+	for {
+		ip, err := ipam.Allocate(ipnet)
+		if err != nil {
+			break
+		}
+		ips = append(ips, ip.String())
+	}
+	// /30 网段去掉网络地址和广播地址后只有两个可用地址
+	if len(ips) != 2 || ips[0] != "10.20.0.1" || ips[1] != "10.20.0.2" {
+		t.Errorf("alloc ips %v", ips)
+	}
+}
+
+func TestAllocateInRangeAndReserve(t *testing.T) {
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	_, ipnet, _ := net.ParseCIDR("10.30.0.0/24")
+	_, ipRange, _ := net.ParseCIDR("10.30.0.128/30")
+	if err := ipam.Reserve(ipnet, net.ParseIP("10.30.0.129").To4()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.Reserve(ipnet, net.ParseIP("10.30.0.129").To4()); err == nil {
+		t.Error("reserve allocated ip should fail")
+	}
+	var ips []string
+	for {
+		ip, err := ipam.AllocateInRange(ipnet, ipRange)
+		if err != nil {
+			break
+		}
+		ips = append(ips, ip.String())
+	}
+	if len(ips) != 3 || ips[0] != "10.30.0.128" || ips[1] != "10.30.0.130" || ips[2] != "10.30.0.131" {
+		t.Errorf("alloc ips in range %v", ips)
+	}
+	if ip, _ := ipam.Allocate(ipnet); ip.String() != "10.30.0.1" {
+		t.Errorf("alloc ip out of range got %s", ip)
+	}
+}
+
+func TestAllocateIPv4Slash16Boundary(t *testing.T) {
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/16")
+	if size := subnetPoolSize(ipnet); size != 65534 {
+		t.Errorf("pool size of /16 %d", size)
+	}
+	// 占满除最后一个地址之外的所有地址
+	ipam.Subnets = &map[string]string{ipnet.String(): strings.Repeat("1", 65533) + "0"}
+	if err := ipam.dump(); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := ipam.Allocate(ipnet); err != nil || ip.String() != "10.0.255.254" {
+		t.Fatalf("alloc last ip %v %v", ip, err)
+	}
+	// 不能分配广播地址 10.0.255.255 和网段之外的 10.1.0.0
+	if ip, err := ipam.Allocate(ipnet); err == nil {
+		t.Errorf("alloc ip %s in full /16", ip)
+	}
+	if err := ipam.Reserve(ipnet, net.ParseIP("10.0.255.255").To4()); err == nil {
+		t.Error("reserve broadcast address should fail")
+	}
+	if allocated, total, _ := ipam.Usage(ipnet); allocated != 65534 || total != 65534 {
+		t.Errorf("usage %d/%d", allocated, total)
+	}
+
+	// 比 /16 大的 IPv4 网段只记录已分配的地址，旧版本的位图读取时转换
+	_, large, _ := net.ParseCIDR("10.0.0.0/8")
+	if size := subnetPoolSize(large); size != 1<<24-2 {
+		t.Errorf("pool size of /8 %d", size)
+	}
+	(*ipam.Subnets)[large.String()] = "011"
+	ipam.dump()
+	if ip, err := ipam.Allocate(large); err != nil || ip.String() != "10.0.0.1" {
+		t.Fatalf("alloc ip in /8 %v %v", ip, err)
+	}
+	if value := (*ipam.Subnets)[large.String()]; value != "10.0.0.1,10.0.0.2,10.0.0.3" {
+		t.Errorf("allocation of /8 %q", value)
+	}
+	if err := ipam.Reserve(large, net.ParseIP("10.255.255.255").To4()); err == nil {
+		t.Error("reserve broadcast address of /8 should fail")
+	}
+	ip := net.ParseIP("10.255.255.254").To4()
+	if err := ipam.Reserve(large, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.Release(large, &ip); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateNetworkAddressesRollback(t *testing.T) {
+	oldAllocator := ipAllocator
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	defer func() { ipAllocator = oldAllocator }()
+
+	_, subnet, _ := net.ParseCIDR("10.40.0.0/24")
+	// 10.40.0.2 已经分配给容器，保留地址冲突时不能被释放
+	if err := ipAllocator.Reserve(subnet, net.ParseIP("10.40.0.2").To4()); err != nil {
+		t.Fatal(err)
+	}
+	_, ipRange, _ := net.ParseCIDR("10.40.0.0/24")
+	nw := &Network{Name: "auxnet", IpRange: ipRange, AuxAddresses: map[string]string{"a": "10.40.0.10", "b": "10.40.0.2"}}
+	if err := allocateNetworkAddresses(nw, ""); err == nil {
+		t.Fatal("reserve allocated aux address should fail")
+	}
+	_, sub, _ := net.ParseCIDR("10.40.0.0/24")
+	ipAllocator.Subnets = &map[string]string{}
+	ipAllocator.load()
+	alloc := parseAllocation(sub, (*ipAllocator.Subnets)[sub.String()])
+	if list := alloc.list(); len(list) != 1 || list[0].String() != "10.40.0.2" {
+		t.Errorf("allocated addresses after rollback %v", list)
+	}
+}
+
+func TestOverlayNetworkHasNoGateway(t *testing.T) {
+	oldAllocator := ipAllocator
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	defer func() { ipAllocator = oldAllocator }()
+
+	_, ipRange, _ := net.ParseCIDR("10.42.0.0/24")
+	nw := &Network{Name: "ovlnet", Driver: (&OverlayNetworkDriver{}).Name(), IpRange: ipRange}
+	if err := allocateNetworkAddresses(nw, "10.42.0.1"); err == nil {
+		t.Fatal("overlay network should not accept a gateway")
+	}
+	if err := allocateNetworkAddresses(nw, ""); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ipAllocator.Allocate(nw.IpRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.42.0.1" {
+		t.Errorf("first endpoint of overlay network got %s", ip)
+	}
+	ipAllocator.Release(nw.IpRange, &ip)
+	releaseNetworkAddresses(nw)
+	if allocated, _, _ := ipAllocator.Usage(nw.IpRange); allocated != 0 {
+		t.Errorf("allocated %d addresses after release", allocated)
+	}
+}
+
+func TestAllocateInRangeOfLargeSubnet(t *testing.T) {
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, ipRange, _ := net.ParseCIDR("10.200.0.0/16")
+	for _, want := range []string{"10.200.0.0", "10.200.0.1"} {
+		if ip, err := ipam.AllocateInRange(ipnet, ipRange); err != nil || ip.String() != want {
+			t.Fatalf("alloc ip in range %v %v, want %s", ip, err, want)
+		}
+	}
+	// 网段最后的 /30 去掉广播地址后只有三个可用地址
+	_, tail, _ := net.ParseCIDR("10.255.255.252/30")
+	var ips []string
+	for {
+		ip, err := ipam.AllocateInRange(ipnet, tail)
+		if err != nil {
+			break
+		}
+		ips = append(ips, ip.String())
+	}
+	if len(ips) != 3 || ips[2] != "10.255.255.254" {
+		t.Errorf("alloc ips at the end of subnet %v", ips)
+	}
+}
+
+// 连接失败时释放已经分配的 IPv4 和 IPv6 地址
+func TestConnectRollback(t *testing.T) {
+	oldAllocator, oldDrivers, oldNetworks := ipAllocator, drivers, networks
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(t.TempDir(), "subnet.json")}
+	drivers = map[string]NetworkDriver{"bridge": &BridgeNetworkDriver{}}
+	defer func() { ipAllocator, drivers, networks = oldAllocator, oldDrivers, oldNetworks }()
+
+	_, subnet, _ := net.ParseCIDR("10.41.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:41::/64")
+	// 网桥设备不存在，驱动连接失败
+	networks = map[string]*Network{"mydkrb": {Name: "mydkrb", Driver: "bridge", IpRange: subnet, IPv6: true, IpRange6: subnet6}}
+	if err := Connect("mydkrb", &container.ContainerInfo{Id: "rollback01", Pid: "1"}); err == nil {
+		t.Fatal("connect to network without bridge should fail")
+	}
+	for _, sub := range []*net.IPNet{subnet, subnet6} {
+		if used, _, err := ipAllocator.Usage(sub); err != nil || used != 0 {
+			t.Errorf("%s has %d addresses allocated after failed connect: %v", sub, used, err)
+		}
+	}
+}
+
+// 删除失败的驱动，用于验证删除失败时不释放网络的地址
+type failDeleteDriver struct{ BridgeNetworkDriver }
+
+func (d *failDeleteDriver) Delete(network Network) error {
+	return fmt.Errorf("device busy")
+}
+
+// 有容器连接或者驱动删除失败时，网络和网关地址都保留
+func TestDeleteNetworkKeepsAddresses(t *testing.T) {
+	oldAllocator, oldDrivers, oldNetworks := ipAllocator, drivers, networks
+	oldNetworkPath, oldEndpointPath := defaultNetworkPath, defaultEndpointPath
+	dir := t.TempDir()
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+	defaultNetworkPath, defaultEndpointPath = path.Join(dir, "network"), path.Join(dir, "endpoint")
+	drivers = map[string]NetworkDriver{"bridge": &failDeleteDriver{}}
+	defer func() {
+		ipAllocator, drivers, networks = oldAllocator, oldDrivers, oldNetworks
+		defaultNetworkPath, defaultEndpointPath = oldNetworkPath, oldEndpointPath
+	}()
+
+	_, subnet, _ := net.ParseCIDR("10.42.0.0/24")
+	gateway := net.ParseIP("10.42.0.1").To4()
+	if err := ipAllocator.Reserve(subnet, gateway); err != nil {
+		t.Fatal(err)
+	}
+	nw := &Network{Name: "mydkdel", Driver: "bridge", IpRange: &net.IPNet{IP: gateway, Mask: subnet.Mask}}
+	networks = map[string]*Network{nw.Name: nw}
+	if err := nw.dump(defaultNetworkPath); err != nil {
+		t.Fatal(err)
+	}
+	ep := &Endpoint{ID: "c1-mydkdel", ContainerID: "c1", NetworkName: nw.Name}
+	if err := ep.dump(defaultEndpointPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteNetwork(nw.Name); err == nil || !strings.Contains(err.Error(), "active endpoints") {
+		t.Errorf("delete network with endpoints: %v", err)
+	}
+	ep.remove(defaultEndpointPath)
+	if err := DeleteNetwork(nw.Name); err == nil {
+		t.Error("delete network should fail when driver fails")
+	}
+	if used, _, _ := ipAllocator.Usage(subnet); used != 1 {
+		t.Errorf("gateway should stay allocated, %d addresses allocated", used)
+	}
+	if _, err := os.Stat(path.Join(defaultNetworkPath, nw.Name)); err != nil {
+		t.Errorf("network file should be kept: %v", err)
+	}
+}
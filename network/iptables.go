@@ -0,0 +1,238 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// iptables 后端，用于不支持 nftables 的主机
+// 规则写入 MYDOCKER-* 自定义链，内置链中只保留一条跳转规则
+// 批量修改通过 iptables-restore --noflush 提交，每个表内的修改是原子的
+// IPv6 规则通过 ip6tables 下发，没有地址的规则同时下发到 iptables 和 ip6tables
+type IptablesFirewall struct {
+	// 主机上是否有 ip6tables 命令
+	ipv6 bool
+}
+
+func (f *IptablesFirewall) Name() string {
+	return "iptables"
+}
+
+// 逻辑链对应的 iptables 表
+func iptablesTable(chain string) string {
+	if chain == ChainForward || chain == ChainIsolation {
+		return "filter"
+	}
+	return "nat"
+}
+
+// 跳转到自定义链的内置链
+func iptablesBuiltinChain(chain string) string {
+	if chain == ChainIsolation {
+		return ChainForward
+	}
+	return chain
+}
+
+// 逻辑链对应的自定义链名
+func iptablesChain(chain string) string {
+	return strings.ToUpper(firewallTableName) + "-" + chain
+}
+
+// 协议族对应的命令，iptables 或 ip6tables
+func iptablesCommand(family int) string {
+	if family == familyIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func runIptables(family int, args ...string) ([]byte, error) {
+	command := iptablesCommand(family)
+	output, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %v, %s", command, strings.Join(args, " "), err, output)
+	}
+	return output, nil
+}
+
+// 规则需要下发到的协议族
+func (f *IptablesFirewall) families(rule *Rule) ([]int, error) {
+	switch family := rule.family(); family {
+	case familyIPv6:
+		if !f.ipv6 {
+			return nil, fmt.Errorf("rule %s: ip6tables is not available", rule.Comment)
+		}
+		return []int{familyIPv6}, nil
+	case familyAny:
+		if f.ipv6 {
+			return []int{familyIPv4, familyIPv6}, nil
+		}
+	}
+	return []int{familyIPv4}, nil
+}
+
+func (f *IptablesFirewall) Setup() error {
+	families := []int{familyIPv4}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		f.ipv6 = true
+		families = append(families, familyIPv6)
+	}
+	for _, family := range families {
+		// ISOLATION 在 FORWARD 之后插入到 FORWARD 内置链的链首，先于 MYDOCKER-FORWARD 匹配
+		for _, chain := range []string{ChainPrerouting, ChainOutput, ChainPostrouting, ChainForward, ChainIsolation} {
+			table := iptablesTable(chain)
+			myChain := iptablesChain(chain)
+			// 创建自定义链，链已存在时 -L 成功，直接跳过
+			if _, err := runIptables(family, "-t", table, "-n", "-L", myChain); err != nil {
+				if _, err := runIptables(family, "-t", table, "-N", myChain); err != nil {
+					return err
+				}
+			}
+			// 内置链跳转到自定义链，插入到链首保证优先于其他规则匹配
+			builtin := iptablesBuiltinChain(chain)
+			if _, err := runIptables(family, "-t", table, "-C", builtin, "-j", myChain); err != nil {
+				if _, err := runIptables(family, "-t", table, "-I", builtin, "-j", myChain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *IptablesFirewall) AddRules(rules ...*Rule) error {
+	return f.restore("-A", rules, nil)
+}
+
+func (f *IptablesFirewall) DelRules(rules ...*Rule) error {
+	// iptables-restore 删除不存在的规则会使整个批次失败，先过滤掉不存在的规则
+	exists := func(family int, rule *Rule, args []string) bool {
+		checkArgs := append([]string{"-t", iptablesTable(rule.Chain), "-C", iptablesChain(rule.Chain)}, args...)
+		_, err := runIptables(family, checkArgs...)
+		return err == nil
+	}
+	return f.restore("-D", rules, exists)
+}
+
+// 按协议族和表生成 iptables-restore 的输入并提交，filter 不为空时跳过返回 false 的规则
+func (f *IptablesFirewall) restore(op string, rules []*Rule, filter func(family int, rule *Rule, args []string) bool) error {
+	for _, family := range []int{familyIPv4, familyIPv6} {
+		var tables []string
+		lines := map[string][]string{}
+		for _, rule := range rules {
+			families, err := f.families(rule)
+			if err != nil {
+				return err
+			}
+			if !containsFamily(families, family) {
+				continue
+			}
+			args, err := iptablesRuleArgs(rule)
+			if err != nil {
+				return err
+			}
+			if filter != nil && !filter(family, rule, args) {
+				continue
+			}
+			table := iptablesTable(rule.Chain)
+			if _, ok := lines[table]; !ok {
+				tables = append(tables, table)
+			}
+			line := append([]string{op, iptablesChain(rule.Chain)}, args...)
+			lines[table] = append(lines[table], strings.Join(line, " "))
+		}
+		if len(tables) == 0 {
+			continue
+		}
+
+		var input bytes.Buffer
+		for _, table := range tables {
+			fmt.Fprintf(&input, "*%s\n", table)
+			for _, line := range lines[table] {
+				fmt.Fprintln(&input, line)
+			}
+			fmt.Fprintln(&input, "COMMIT")
+		}
+		command := iptablesCommand(family) + "-restore"
+		logrus.Debugf("%s input: %s", command, input.String())
+
+		cmd := exec.Command(command, "--noflush")
+		cmd.Stdin = &input
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %v, %s", command, err, output)
+		}
+	}
+	return nil
+}
+
+func containsFamily(families []int, family int) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// 将规则转换为 iptables 参数，不包含表名和链名
+func iptablesRuleArgs(rule *Rule) ([]string, error) {
+	var args []string
+	if rule.Proto != "" {
+		args = append(args, "-p", rule.Proto)
+	}
+	if rule.Src != nil {
+		args = append(args, "-s", rule.Src.String())
+	}
+	if rule.Dst != nil {
+		args = append(args, "-d", rule.Dst.String())
+	}
+	if rule.InIface != "" {
+		args = append(args, "-i", rule.InIface)
+	}
+	if rule.NotInIface != "" {
+		args = append(args, "!", "-i", rule.NotInIface)
+	}
+	if rule.OutIface != "" {
+		args = append(args, "-o", rule.OutIface)
+	}
+	if rule.NotOutIface != "" {
+		args = append(args, "!", "-o", rule.NotOutIface)
+	}
+	if rule.DstLocal {
+		args = append(args, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	if rule.DPort != 0 {
+		if rule.Proto == "" {
+			return nil, fmt.Errorf("rule %s: destination port requires protocol", rule.Comment)
+		}
+		args = append(args, "-m", rule.Proto, "--dport", strconv.Itoa(rule.DPort))
+	}
+	if rule.Comment != "" {
+		args = append(args, "-m", "comment", "--comment", rule.Comment)
+	}
+
+	switch rule.Action {
+	case ActionAccept, ActionDrop, ActionReturn, ActionMasquerade:
+		args = append(args, "-j", rule.Action)
+	case ActionDNAT:
+		if rule.ToIP == nil {
+			return nil, fmt.Errorf("rule %s: DNAT requires destination address", rule.Comment)
+		}
+		dest := rule.ToIP.String()
+		if rule.ToPort != 0 {
+			// IPv6 地址需要加方括号，例如 [fd00::2]:80
+			dest = net.JoinHostPort(dest, strconv.Itoa(rule.ToPort))
+		}
+		args = append(args, "-j", ActionDNAT, "--to-destination", dest)
+	default:
+		return nil, fmt.Errorf("rule %s: unknown action %s", rule.Comment, rule.Action)
+	}
+	return args, nil
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// 网络选项: ipvlan 模式 l2/l3/l3s
+const optionIpvlanMode = "ipvlan_mode"
+
+var ipvlanModes = map[string]netlink.IPVlanMode{
+	"l2":  netlink.IPVLAN_MODE_L2,
+	"l3":  netlink.IPVLAN_MODE_L3,
+	"l3s": netlink.IPVLAN_MODE_L3S,
+}
+
+// ipvlan 网络，容器接口与宿主机的物理接口共用 MAC 地址，适用于限制 MAC 地址数量的物理网络
+// l2 模式与 macvlan 类似；l3/l3s 模式下由 parent 接口按三层转发，容器内的默认路由直接指向接口而不经过网关
+type IpvlanNetworkDriver struct{}
+
+func (d *IpvlanNetworkDriver) Name() string {
+	return "ipvlan"
+}
+
+func (d *IpvlanNetworkDriver) Create(nw *Network) error {
+	if _, err := parentLink(nw); err != nil {
+		return err
+	}
+	if _, err := ipvlanMode(nw); err != nil {
+		return err
+	}
+	logrus.Infof("create ipvlan network %s on %s", nw.Name, nw.Options[optionParent])
+	return nil
+}
+
+// ipvlan 网络没有创建任何宿主机设备，删除网络时不需要清理
+func (d *IpvlanNetworkDriver) Delete(network Network) error {
+	return nil
+}
+
+func (d *IpvlanNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	parent, err := parentLink(network)
+	if err != nil {
+		return err
+	}
+	mode, err := ipvlanMode(network)
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = subInterfaceName(endpoint)
+	la.ParentIndex = parent.Attrs().Index
+	// 相当于 ip link add link {parent} name cif-xxxxx type ipvlan mode {mode}
+	if err := netlink.LinkAdd(&netlink.IPVlan{LinkAttrs: la, Mode: mode}); err != nil {
+		return fmt.Errorf("error add ipvlan device: %v", err)
+	}
+	setSubInterfaceDevice(endpoint, la.Name)
+	return nil
+}
+
+func (d *IpvlanNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return deleteSubInterface(endpoint)
+}
+
+func ipvlanMode(nw *Network) (netlink.IPVlanMode, error) {
+	name := nw.Options[optionIpvlanMode]
+	if name == "" {
+		return netlink.IPVLAN_MODE_L2, nil
+	}
+	mode, ok := ipvlanModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown %s %s", optionIpvlanMode, name)
+	}
+	return mode, nil
+}
+
+// ipvlan l3/l3s 模式不处理 ARP/NDP，容器内的默认路由不能经过网关
+func gatewaylessRoute(nw *Network) bool {
+	if nw.Driver != (&IpvlanNetworkDriver{}).Name() {
+		return false
+	}
+	mode, err := ipvlanMode(nw)
+	return err == nil && mode != netlink.IPVLAN_MODE_L2
+}
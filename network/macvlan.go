@@ -0,0 +1,123 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// 网络选项: 容器接口所在的宿主机物理接口
+	optionParent = "parent"
+	// 网络选项: macvlan 模式 bridge/private/vepa/passthru
+	optionMacvlanMode = "macvlan_mode"
+)
+
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+	"private":  netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":     netlink.MACVLAN_MODE_VEPA,
+	"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+}
+
+// macvlan 网络，容器接口直接挂在宿主机的物理接口上，拥有独立的 MAC 地址，与物理网络处于同一个二层网段
+// 没有网桥和 NAT，网关为物理网络中的路由器，宿主机与容器之间默认不能直接通信
+type MacvlanNetworkDriver struct{}
+
+func (d *MacvlanNetworkDriver) Name() string {
+	return "macvlan"
+}
+
+func (d *MacvlanNetworkDriver) Create(nw *Network) error {
+	if _, err := parentLink(nw); err != nil {
+		return err
+	}
+	if _, err := macvlanMode(nw); err != nil {
+		return err
+	}
+	logrus.Infof("create macvlan network %s on %s", nw.Name, nw.Options[optionParent])
+	return nil
+}
+
+// macvlan 网络没有创建任何宿主机设备，删除网络时不需要清理
+func (d *MacvlanNetworkDriver) Delete(network Network) error {
+	return nil
+}
+
+func (d *MacvlanNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	parent, err := parentLink(network)
+	if err != nil {
+		return err
+	}
+	mode, err := macvlanMode(network)
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = subInterfaceName(endpoint)
+	la.ParentIndex = parent.Attrs().Index
+	// 相当于 ip link add link {parent} name cif-xxxxx type macvlan mode {mode}
+	if err := netlink.LinkAdd(&netlink.Macvlan{LinkAttrs: la, Mode: mode}); err != nil {
+		return fmt.Errorf("error add macvlan device: %v", err)
+	}
+	setSubInterfaceDevice(endpoint, la.Name)
+	return nil
+}
+
+func (d *MacvlanNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return deleteSubInterface(endpoint)
+}
+
+func macvlanMode(nw *Network) (netlink.MacvlanMode, error) {
+	name := nw.Options[optionMacvlanMode]
+	if name == "" {
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	}
+	mode, ok := macvlanModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown %s %s", optionMacvlanMode, name)
+	}
+	return mode, nil
+}
+
+// 获取网络的 parent 接口，并确保接口处于启动状态
+func parentLink(nw *Network) (netlink.Link, error) {
+	name := nw.Options[optionParent]
+	if name == "" {
+		return nil, fmt.Errorf("%s network requires parent interface, eg: -o parent=eth0", nw.Driver)
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("parent interface %s: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return nil, fmt.Errorf("set parent interface %s up: %v", name, err)
+	}
+	return l, nil
+}
+
+// macvlan/ipvlan 子接口的名称，与 bridge 驱动中 Veth 在容器内一端的名称一致
+func subInterfaceName(ep *Endpoint) string {
+	return "cif-" + ep.ID[:5]
+}
+
+// macvlan/ipvlan 没有宿主机一端，只用 PeerName 记录需要移动到容器中的接口名
+func setSubInterfaceDevice(ep *Endpoint, name string) {
+	ep.Device = netlink.Veth{PeerName: name}
+}
+
+// 子接口移动到容器的 Net Namespace 后随容器一起销毁，这里只处理接口仍在宿主机上的情况
+func deleteSubInterface(ep *Endpoint) error {
+	if ep.Device.PeerName == "" {
+		return nil
+	}
+	l, err := netlink.LinkByName(ep.Device.PeerName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 创建 dummy 接口作为 macvlan/ipvlan 的 parent 接口
+// 内核没有 dummy 模块时退回到 veth 接口
+func newTestParent(t *testing.T, name string) {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: la}); err != nil {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "p"}); err != nil {
+			t.Skipf("can not create parent interface: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		if l, err := netlink.LinkByName(name); err == nil {
+			_ = netlink.LinkDel(l)
+		}
+	})
+}
+
+func testSubInterfaceDriver(t *testing.T, driver NetworkDriver, options map[string]string, check func(l netlink.Link)) {
+	nw := &Network{Name: "testvlan", Driver: driver.Name(), Options: map[string]string{}}
+	if err := driver.Create(nw); err == nil {
+		t.Fatal("create network without parent should fail")
+	}
+	nw.Options = options
+	if err := driver.Create(nw); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &Endpoint{ID: "1234567890-testvlan"}
+	if err := driver.Connect(nw, ep); err != nil {
+		t.Skipf("%s is not supported: %v", driver.Name(), err)
+	}
+	l, err := netlink.LinkByName(ep.Device.PeerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, _ := netlink.LinkByName(options[optionParent])
+	if l.Attrs().ParentIndex != parent.Attrs().Index {
+		t.Errorf("parent index %d, want %d", l.Attrs().ParentIndex, parent.Attrs().Index)
+	}
+	check(l)
+
+	if err := driver.Disconnect(nw, ep); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := netlink.LinkByName(ep.Device.PeerName); err == nil {
+		t.Errorf("%s not deleted", ep.Device.PeerName)
+	}
+	if err := driver.Delete(*nw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMacvlanDriver(t *testing.T) {
+	newTestParent(t, "mydkparent0")
+	nw := &Network{Options: map[string]string{optionParent: "mydkparent0", optionMacvlanMode: "unknown"}}
+	if err := (&MacvlanNetworkDriver{}).Create(nw); err == nil {
+		t.Error("create network with unknown mode should fail")
+	}
+
+	options := map[string]string{optionParent: "mydkparent0", optionMacvlanMode: "private"}
+	testSubInterfaceDriver(t, &MacvlanNetworkDriver{}, options, func(l netlink.Link) {
+		macvlan, ok := l.(*netlink.Macvlan)
+		if !ok {
+			t.Fatalf("link type %s", l.Type())
+		}
+		if macvlan.Mode != netlink.MACVLAN_MODE_PRIVATE {
+			t.Errorf("macvlan mode %v", macvlan.Mode)
+		}
+	})
+}
+
+func TestIpvlanDriver(t *testing.T) {
+	options := map[string]string{optionParent: "mydkparent1", optionIpvlanMode: "l3"}
+	if !gatewaylessRoute(&Network{Driver: "ipvlan", Options: options}) {
+		t.Error("ipvlan l3 network should use gatewayless route")
+	}
+
+	newTestParent(t, "mydkparent1")
+	testSubInterfaceDriver(t, &IpvlanNetworkDriver{}, options, func(l netlink.Link) {
+		ipvlan, ok := l.(*netlink.IPVlan)
+		if !ok {
+			t.Fatalf("link type %s", l.Type())
+		}
+		if ipvlan.Mode != netlink.IPVLAN_MODE_L3 {
+			t.Errorf("ipvlan mode %v", ipvlan.Mode)
+		}
+	})
+}
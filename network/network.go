@@ -7,10 +7,8 @@ import (
 	"mydocker/util"
 	"net"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
-	"text/tabwriter"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -19,13 +17,104 @@ type Network struct {
 	Name    string     // 网络名
 	IpRange *net.IPNet // IP 地址段
 	Driver  string     // 网络驱动名称
+
+	// IPv6 配置，IpRange6 的 IP 为网关地址
+	IPv6     bool       `json:"ipv6"`
+	IpRange6 *net.IPNet `json:"ipRange6,omitempty"`
+	IPv6Mode string     `json:"ipv6Mode,omitempty"`
+
+	// 驱动相关的选项，由 network create -o key=value 指定
+	Options map[string]string `json:"options,omitempty"`
+
+	// internal 网络不能访问外部网络
+	Internal bool `json:"internal"`
+	// 允许与当前网络互通的其他网络，mydocker 网桥之间默认相互隔离
+	Allow []string `json:"allow,omitempty"`
+
+	// 网络的元数据标签，由 network create --label key=value 指定
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// 容器地址的分配范围，由 --ip-range 指定，为空时在整个网段中分配
+	AllocRange *net.IPNet `json:"allocRange,omitempty"`
+	// 网段中保留给网络中其他设备的地址，不会分配给容器，由 --aux-address name=ip 指定
+	AuxAddresses map[string]string `json:"auxAddresses,omitempty"`
+}
+
+// 是否允许与另一个网络互通，任意一方在 --allow 中指定对方即可
+func (nw *Network) allows(other *Network) bool {
+	for _, name := range nw.Allow {
+		if name == other.Name {
+			return true
+		}
+	}
+	for _, name := range other.Allow {
+		if name == nw.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为 bridge 网络，只有 bridge 网络在宿主机上有网关地址，支持端口映射和内置 DNS
+func (nw *Network) isBridge() bool {
+	return nw.Driver == (&BridgeNetworkDriver{}).Name()
+}
+
+// 是否由 mydocker 的 IPAM 分配地址并配置容器内的地址和路由，cni 网络由插件完成这些工作
+func (nw *Network) usesIPAM() bool {
+	return nw.Driver != (&CNINetworkDriver{}).Name()
+}
+
+// 容器是否通过网关访问外部网络，overlay 网络的网桥上没有网关地址，容器内不添加默认路由
+func (nw *Network) hasGateway() bool {
+	return nw.Driver != (&OverlayNetworkDriver{}).Name()
+}
+
+// 网络在宿主机上对应的设备，bridge 网络为网桥（默认与网络同名，可以通过 -o bridge_name 指定），macvlan/ipvlan 网络为 parent 接口
+// cni 网络的设备由插件创建，返回空字符串
+func (nw *Network) device() string {
+	if !nw.usesIPAM() {
+		return ""
+	}
+	if parent, ok := nw.Options[optionParent]; ok && !nw.isBridge() {
+		return parent
+	}
+	if name := nw.Options[optionBridgeName]; name != "" {
+		return name
+	}
+	return nw.Name
+}
+
+const (
+	// 容器 IPv6 地址访问外部网络时做 NAT66 地址转换
+	IPv6ModeNAT = "nat"
+	// 不做地址转换，需要上游路由器将 IPv6 网段路由到宿主机
+	IPv6ModeRouted = "routed"
+)
+
+// network create 命令的参数
+type CreateOptions struct {
+	Driver   string
+	Subnet   string // IPv4 网段
+	IPv6     bool
+	Subnet6  string // IPv6 网段
+	IPv6Mode string
+	Options  map[string]string
+	Internal bool
+	Allow    []string
+	Labels   map[string]string
+	// 网关地址，为空时使用网段中的第一个地址
+	Gateway string
+	// 容器地址的分配范围，必须在网段之内
+	IPRange      string
+	AuxAddresses map[string]string
 }
 
 type NetworkDriver interface {
 	// 驱动名称
 	Name() string
-	// 创建网络
-	Create(subnet string, name string) (*Network, error)
+	// 创建网络，nw 中已经填好了网段和网关地址
+	Create(nw *Network) error
 	// 删除网络
 	Delete(network Network) error
 	// 连接容器网络端点到网络
@@ -52,15 +141,6 @@ func (nw *Network) dump(dumpPath string) error {
 	// 保存文件名称为网络名
 	nwPath := path.Join(dumpPath, nw.Name)
 
-	// 打开保存文件用于写入，模式参数为存在内容则清空，只写入，不存在则创建
-	// O_TRUNC 如果文件已存在，打开时将会清空文件内容
-	nwFile, err := os.OpenFile(nwPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		logrus.Errorf("open file %s error %v", nwPath, err)
-		return err
-	}
-	defer nwFile.Close()
-
 	// 通过Json库序列化网络对象到json字符串
 	nwJson, err := json.Marshal(nw)
 	if err != nil {
@@ -68,69 +148,204 @@ func (nw *Network) dump(dumpPath string) error {
 		return err
 	}
 
-	// 网络配置的json字符串写入文件
-	if _, err := nwFile.Write(nwJson); err != nil {
+	// 先写入临时文件再重命名，写入过程中断不会留下不完整的网络配置
+	if err := writeStateFile(nwPath, nwJson); err != nil {
 		logrus.Errorf("error write network object json error %v", err)
 		return err
 	}
 	return nil
 }
 
-func (nw *Network) load(dumpPath string) error {
-	// 检查目录是否存在，不存在则创建目标目录
+func (nw *Network) remove(dumpPath string) error {
 	exist, err := util.FileOrDirExits(dumpPath)
 	if err != nil {
-		return fmt.Errorf("can not detect network dump path %s error %v", dumpPath, err)
+		return fmt.Errorf("can not judge network dir %s error %v", dumpPath, err)
 	}
 	if !exist {
-		return fmt.Errorf("can not find network dump path %s error %v", dumpPath, err)
+		return nil
 	}
-	nwConfigFile, err := os.Open(dumpPath)
-	if err != nil {
-		return err
+	return os.Remove(path.Join(dumpPath, nw.Name))
+}
+
+// 解析并检查 --ip-range 和 --aux-address，地址必须在网段之内
+func parseAddressOptions(nw *Network, opts *CreateOptions) error {
+	if opts.IPRange != "" {
+		_, ipRange, err := net.ParseCIDR(opts.IPRange)
+		if err != nil || !subnetContains(nw.IpRange, ipRange) {
+			return fmt.Errorf("invalid ip range %q, should be a sub range of subnet %s", opts.IPRange, nw.IpRange)
+		}
+		nw.AllocRange = ipRange
 	}
-	// 从配置文件中读取网络配置json字符串
-	contentBytes := make([]byte, 2000)
-	n, err := nwConfigFile.Read(contentBytes)
-	if err != nil {
-		return err
+	for name, addr := range opts.AuxAddresses {
+		ip := net.ParseIP(addr)
+		if ip == nil || !nw.IpRange.Contains(ip) {
+			return fmt.Errorf("invalid aux address %s=%s, should be in subnet %s", name, addr, nw.IpRange)
+		}
 	}
-	err = json.Unmarshal(contentBytes[:n], nw)
-	if err != nil {
-		logrus.Errorf("error unmarshal %s network json data error %v", dumpPath, err)
-		return err
+	if len(opts.AuxAddresses) > 0 {
+		nw.AuxAddresses = opts.AuxAddresses
 	}
 	return nil
 }
 
-func (nw *Network) remove(dumpPath string) error {
-	exist, err := util.FileOrDirExits(dumpPath)
-	if err != nil {
-		return fmt.Errorf("can not judge network dir %s error %v", dumpPath, err)
+// inner 是否为 outer 的子网段
+func subnetContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// 通过IPAM分配网关IP和保留地址，未指定网关时获取网段中第一个ip作为网关ip
+// nw.IpRange 的 IP 保存网关地址，overlay 网络没有网关，不占用地址，IP 保持为网段地址
+// 部分地址分配失败时只释放本次已经分配成功的地址，分配失败的地址可能已经被其他端点占用
+func allocateNetworkAddresses(nw *Network, gateway string) error {
+	var reserved []net.IP
+	rollback := func() {
+		for _, ip := range reserved {
+			if err := ipAllocator.Release(nw.IpRange, &ip); err != nil {
+				logrus.Warnf("release address %s of network %s error %v", ip, nw.Name, err)
+			}
+		}
 	}
-	if !exist {
-		return nil
+	if !nw.hasGateway() {
+		if gateway != "" {
+			return fmt.Errorf("%s network has no gateway, can not set gateway %s", nw.Driver, gateway)
+		}
+	} else if gateway == "" {
+		gatewayIp, err := ipAllocator.Allocate(nw.IpRange)
+		if err != nil {
+			return err
+		}
+		nw.IpRange.IP = gatewayIp
+		reserved = append(reserved, nw.IpRange.IP)
+	} else {
+		gatewayIp := net.ParseIP(gateway)
+		if gatewayIp == nil || gatewayIp.To4() == nil || !nw.IpRange.Contains(gatewayIp) {
+			return fmt.Errorf("invalid gateway %q, should be in subnet %s", gateway, nw.IpRange)
+		}
+		if err := ipAllocator.Reserve(nw.IpRange, gatewayIp.To4()); err != nil {
+			return err
+		}
+		nw.IpRange.IP = gatewayIp.To4()
+		reserved = append(reserved, nw.IpRange.IP)
+	}
+	for name, addr := range nw.AuxAddresses {
+		ip := net.ParseIP(addr)
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		if err := ipAllocator.Reserve(nw.IpRange, ip); err != nil {
+			rollback()
+			return fmt.Errorf("reserve aux address %s error %v", name, err)
+		}
+		reserved = append(reserved, ip)
+	}
+	if nw.IPv6 && nw.hasGateway() {
+		gatewayIp6, err := ipAllocator.Allocate(nw.IpRange6)
+		if err != nil {
+			rollback()
+			return err
+		}
+		nw.IpRange6.IP = gatewayIp6
+	}
+	return nil
+}
+
+// 网段是否记录了网关地址，没有网关的网络 IpRange 的 IP 为网段地址
+// 旧版本创建的 overlay 网络仍然占用了网段中的第一个地址，释放时需要一起回收
+func hasGatewayAddress(n *net.IPNet) bool {
+	return n != nil && !n.IP.Equal(n.IP.Mask(n.Mask))
+}
+
+// 释放网络的网关地址和保留地址，地址未分配时忽略
+func releaseNetworkAddresses(nw *Network) {
+	if nw.IpRange == nil {
+		return
+	}
+	if hasGatewayAddress(nw.IpRange) {
+		if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
+			logrus.Warnf("release gateway %s of network %s error %v", nw.IpRange.IP, nw.Name, err)
+		}
+	}
+	for name, addr := range nw.AuxAddresses {
+		ip := net.ParseIP(addr)
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		if err := ipAllocator.Release(nw.IpRange, &ip); err != nil {
+			logrus.Warnf("release aux address %s of network %s error %v", name, nw.Name, err)
+		}
+	}
+	if nw.IPv6 && hasGatewayAddress(nw.IpRange6) {
+		if err := ipAllocator.Release(nw.IpRange6, &nw.IpRange6.IP); err != nil {
+			logrus.Warnf("release gateway %s of network %s error %v", nw.IpRange6.IP, nw.Name, err)
+		}
 	}
-	return os.Remove(path.Join(dumpPath, nw.Name))
 }
 
 // 创建网络
-func CreateNetwork(driver, subnet, name string) error {
+func CreateNetwork(name string, opts *CreateOptions) error {
+	driver, ok := drivers[opts.Driver]
+	if !ok {
+		return fmt.Errorf("unknown network driver %s", opts.Driver)
+	}
+	if _, exist := networks[name]; exist {
+		return fmt.Errorf("network %s already exists", name)
+	}
+	// cni 网络的网段由插件配置决定，只需要检查配置文件
+	if opts.Driver == (&CNINetworkDriver{}).Name() {
+		nw := &Network{Name: name, Driver: opts.Driver, Options: opts.Options, Labels: opts.Labels}
+		if err := driver.Create(nw); err != nil {
+			return err
+		}
+		return nw.dump(defaultNetworkPath)
+	}
 	// ParseCIDR将子网段字符串转化为 net.IPNet 对象
-	_, cidr, _ := net.ParseCIDR(subnet)
-	// 通过IPAM分配网关IP，获取网段中第一个ip作为网关ip
-	gatewayIp, err := ipAllocator.Allocate(cidr)
-	if err != nil {
+	_, cidr, err := net.ParseCIDR(opts.Subnet)
+	if err != nil || cidr.IP.To4() == nil {
+		return fmt.Errorf("invalid IPv4 subnet %q", opts.Subnet)
+	}
+	nw := &Network{
+		Name:     name,
+		Driver:   opts.Driver,
+		IPv6:     opts.IPv6,
+		Options:  opts.Options,
+		Internal: opts.Internal,
+		Allow:    opts.Allow,
+		Labels:   opts.Labels,
+	}
+	if opts.IPv6 {
+		_, cidr6, err := net.ParseCIDR(opts.Subnet6)
+		if err != nil || cidr6.IP.To4() != nil {
+			return fmt.Errorf("invalid IPv6 subnet %q", opts.Subnet6)
+		}
+		switch opts.IPv6Mode {
+		case "":
+			opts.IPv6Mode = IPv6ModeNAT
+		case IPv6ModeNAT, IPv6ModeRouted:
+		default:
+			return fmt.Errorf("unknown ipv6 mode %s, should be %s or %s", opts.IPv6Mode, IPv6ModeNAT, IPv6ModeRouted)
+		}
+		nw.IpRange6 = cidr6
+		nw.IPv6Mode = opts.IPv6Mode
+	}
+
+	nw.IpRange = cidr
+	if err := checkSubnetOverlap(nw); err != nil {
+		return err
+	}
+	if err := parseAddressOptions(nw, opts); err != nil {
+		return err
+	}
+	if err := allocateNetworkAddresses(nw, opts.Gateway); err != nil {
 		return err
 	}
-	cidr.IP = gatewayIp
 
 	//调用指定的网络驱动创建网络，此处的drivers字典是各个网络驱动的实例字典，通过调用网络驱动的Create方法创建网络
-	nw, err := drivers[driver].Create(cidr.String(), name)
-	if err != nil {
+	if err := driver.Create(nw); err != nil {
+		releaseNetworkAddresses(nw)
 		return err
 	}
-	nw.Driver = driver
 
 	// 保存网络信息，将网络信息保存在文件系统中，方便查询和在网络上连接端点
 	return nw.dump(defaultNetworkPath)
@@ -142,107 +357,219 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 	if !ok {
 		return fmt.Errorf("no such network: %s", networkName)
 	}
-	// 通过IPAM从网络的网段中获取可用的IP作为容器IP地址
-	ip, err := ipAllocator.Allocate(network.IpRange)
-	if err != nil {
-		return err
-	}
 	// 创建网络端点
 	ep := &Endpoint{
 		ID:          fmt.Sprintf("%s-%s", cinfo.Id, networkName),
-		IpAddress:   ip,
+		ContainerID: cinfo.Id,
+		NetworkName: networkName,
 		Network:     network,
 		PortMapping: cinfo.PortMapping,
+		SandboxKey:  fmt.Sprintf("/proc/%s/ns/net", cinfo.Pid),
+
+		ContainerName: cinfo.Name,
+		Aliases:       cinfo.NetworkAliases,
+		UserlandProxy: cinfo.UserlandProxy,
+	}
+	// 通过IPAM从网络的网段中获取可用的IP作为容器IP地址
+	var err error
+	if network.usesIPAM() {
+		if ep.IpAddress, err = ipAllocator.AllocateInRange(network.IpRange, network.AllocRange); err != nil {
+			return err
+		}
+		if network.IPv6 {
+			if ep.IPv6Address, err = ipAllocator.Allocate(network.IpRange6); err != nil {
+				releaseEndpointAddresses(network, ep)
+				return err
+			}
+		}
 	}
 	
-	logrus.Infof("network.go, Connet: ID = %s; IP: %s; Network: %s", ep.ID, ep.IpAddress, ep.Network.IpRange)
+	logrus.Infof("network.go, Connet: ID = %s; IP: %s %s; Network: %s", ep.ID, ep.IpAddress, ep.IPv6Address, ep.Network.IpRange)
+
+	// 连接失败时撤销已经完成的步骤：停止代理、删除带宽限制和端口映射，断开驱动并释放分配的地址
+	rollback := func(err error) error {
+		stopProxies(ep)
+		cleanupBandwidth(ep)
+		if len(ep.PortBindings) > 0 {
+			if delErr := delFirewallRules(portMappingRules(ep)...); delErr != nil {
+				logrus.Errorf("remove port mapping of %s error %v", ep.ID, delErr)
+			}
+		}
+		if disErr := drivers[network.Driver].Disconnect(network, ep); disErr != nil {
+			logrus.Errorf("driver disconnect endpoint %s error %v", ep.ID, disErr)
+		}
+		releaseEndpointAddresses(network, ep)
+		return err
+	}
 	
 	// 调用网络驱动Connet方法挂载和配置网络端点
 	if err = drivers[network.Driver].Connect(network, ep); err != nil {
-		return err
+		return rollback(err)
 	}
 
 	// 进入到容器的网络Nampespace配置容器网络设备的IP地址和路由
-	if err = configEndpointIPAddressAndRoute(ep, cinfo); err != nil {
-		return err
+	if network.usesIPAM() {
+		if err = configEndpointIPAddressAndRoute(ep, cinfo); err != nil {
+			return rollback(err)
+		}
 	}
 	
-	// 配置容器到宿主机的端口映射
-	return configPortMapping(ep, cinfo)
+	// 配置容器到宿主机的端口映射，macvlan/ipvlan 网络的容器直接处于物理网络中，不需要端口映射
+	// internal 网络不能从外部访问，同样忽略端口映射
+	switch {
+	case network.Internal && len(ep.PortMapping) > 0:
+		logrus.Warnf("internal network %s does not support port mapping, ignore %v", network.Name, ep.PortMapping)
+	case network.isBridge():
+		if err = configPortMapping(ep, cinfo); err != nil {
+			return rollback(err)
+		}
+	case len(ep.PortMapping) > 0:
+		logrus.Warnf("%s network does not support port mapping, ignore %v", network.Driver, ep.PortMapping)
+	}
+
+	// 配置容器的带宽限制，只有 bridge 网络的容器在宿主机上有 Veth 一端可以挂载 tc 队列
+	if cinfo.IngressRate > 0 || cinfo.EgressRate > 0 {
+		if network.isBridge() {
+			if err = setupBandwidth(ep, cinfo); err != nil {
+				return rollback(err)
+			}
+		} else {
+			logrus.Warnf("%s network does not support bandwidth limit, ignore", network.Driver)
+		}
+	}
+
+	// 保存网络端点信息，容器停止时根据端点信息释放IP和端口映射
+	if err = ep.dump(defaultEndpointPath); err != nil {
+		return rollback(err)
+	}
+
+	// 启动网络内置的 DNS 服务，DNS 服务根据保存的网络端点信息解析容器名称
+	if network.isBridge() {
+		if dnsErr := ensureDNSServer(network); dnsErr != nil {
+			logrus.Errorf("start dns server of network %s error %v", networkName, dnsErr)
+		}
+	}
+	// 将容器IP和网络的 DNS 服务写入容器的 hosts 和 resolv.conf
+	return UpdateEtcFiles(cinfo)
 }
 
-// https://github.com/xianlubird/mydocker/issues/52
-// 用于 ./mydocker network list 命令查询当前创建的网络
-func Init() error {
+// 断开容器与网络的连接，删除端口映射规则，释放容器IP并删除网络端点信息
+func Disconnect(networkName string, cinfo *container.ContainerInfo) error {
+	network, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf("no such network: %s", networkName)
+	}
+	ep := &Endpoint{ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName)}
+	if err := ep.load(defaultEndpointPath); err != nil {
+		return fmt.Errorf("load endpoint %s error %v", ep.ID, err)
+	}
 
-	// need to reset the rule of iptables FORWARD chain to ACCEPT, because
-	// docker 1.13+ changed the default iptables forwarding policy to DROP
-	// https://github.com/moby/moby/pull/28257/files
-	// https://github.com/kubernetes/kubernetes/issues/40182
-	// 看下你的环境iptables FORWARD链默认策略是什么，用这个查看iptables-save -t filter; 如果是DROP的话，试下这个iptables -P FORWARD ACCEPT
-	enableForwardCmd := exec.Command("iptables", "-P", "FORWARD", "ACCEPT")
-	if err := enableForwardCmd.Run(); err != nil {
-		return fmt.Errorf("failed to execute cmd %s", enableForwardCmd.Args)
+	stopProxies(ep)
+	cleanupBandwidth(ep)
+	if err := delFirewallRules(portMappingRules(ep)...); err != nil {
+		logrus.Errorf("remove port mapping of %s error %v", ep.ID, err)
+	}
+	if err := drivers[network.Driver].Disconnect(network, ep); err != nil {
+		logrus.Errorf("driver disconnect endpoint %s error %v", ep.ID, err)
+	}
+	releaseEndpointAddresses(network, ep)
+	if err := ep.remove(defaultEndpointPath); err != nil {
+		return err
+	}
+	// 容器被删除后状态目录已不存在，不需要更新
+	if exist, _ := util.FileOrDirExits(fmt.Sprintf(container.DefaultInfoLocation, cinfo.Id)); !exist {
+		return nil
 	}
+	return UpdateEtcFiles(cinfo)
+}
 
+// 释放端点分配的 IPv4 和 IPv6 地址
+func releaseEndpointAddresses(network *Network, ep *Endpoint) {
+	if network.usesIPAM() && ep.IpAddress != nil {
+		if err := ipAllocator.Release(network.IpRange, &ep.IpAddress); err != nil {
+			logrus.Errorf("release ip %s of %s error %v", ep.IpAddress, ep.ID, err)
+		}
+	}
+	if ep.IPv6Address != nil && network.IpRange6 != nil {
+		if err := ipAllocator.Release(network.IpRange6, &ep.IPv6Address); err != nil {
+			logrus.Errorf("release ip %s of %s error %v", ep.IPv6Address, ep.ID, err)
+		}
+	}
+}
 
-	// 判断网络配置目录是否存在，不存在则创建
-	exist, err := util.FileOrDirExits(defaultNetworkPath)
+// 根据容器当前连接的所有网络重新生成容器的 hosts、hostname 和 resolv.conf
+func UpdateEtcFiles(cinfo *container.ContainerInfo) error {
+	endpoints, err := GetEndpoints(cinfo.Id)
 	if err != nil {
-		return nil
+		return err
 	}
-	if !exist {
-		os.MkdirAll(defaultNetworkPath, os.ModePerm)
+	var ips []net.IP
+	var nameservers []string
+	for _, ep := range endpoints {
+		ips = append(ips, endpointIPs(ep)...)
+		nameservers = append(nameservers, DNSServers(ep.NetworkName)...)
+		nameservers = append(nameservers, ep.Nameservers...)
+	}
+	return container.WriteEtcFiles(cinfo, ips, nameservers)
+}
+
+// 断开容器连接的所有网络
+func DisconnectContainer(cinfo *container.ContainerInfo) error {
+	endpoints, err := GetEndpoints(cinfo.Id)
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		if err := Disconnect(ep.NetworkName, cinfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// https://github.com/xianlubird/mydocker/issues/52
+// 用于 ./mydocker network list 命令查询当前创建的网络
+func Init() error {
+
+	// 初始化防火墙后端，优先通过 netlink 操作 nftables，不支持时回退到 iptables
+	// 容器网络的转发放行规则由各个网络单独添加到 mydocker 的 FORWARD 链中，不再修改宿主机 FORWARD 链的默认策略
+	// nftables 后端在 iptables FORWARD 链默认策略为 DROP 时同时在该链中放行网桥的流量
+	if err := initFirewall(); err != nil {
+		logrus.Errorf("init firewall error: %v", err)
 	}
+	return Load()
+}
 
+// 加载网络驱动和网络配置，不初始化防火墙，只读取网络和端点信息的命令（例如 port）使用
+func Load() error {
 	// 初始化设备
 	drivers = make(map[string]NetworkDriver)
 	networks = make(map[string]*Network)
 
 	// 加载网络驱动
-	var bridgeDriver = BridgeNetworkDriver{}
-	drivers[bridgeDriver.Name()] = &bridgeDriver
-
-	// 检查网络配置目录中的所有文件
-	// filepath.Walk(path, func(string, os.FileInfo, error)) 函数会便利指定path目录，并执行第二个参数中函数指针处理每一个文件
-	filepath.Walk(defaultNetworkPath, func(nwPath string, info os.FileInfo, err error) error {
-		// 目录跳过
-		if info.IsDir() {
-			return nil
-		}
-
-		// 加载文件名作为网络名
-		_, nwName := path.Split(nwPath)
-		nw := &Network{
-			Name: nwName,
-		}
+	for _, driver := range []NetworkDriver{&BridgeNetworkDriver{}, &MacvlanNetworkDriver{}, &IpvlanNetworkDriver{}, &OverlayNetworkDriver{}, &CNINetworkDriver{}} {
+		drivers[driver.Name()] = driver
+	}
 
-		// 调用load方法加载网络配置信息
-		if err := nw.load(nwPath); err != nil {
-			logrus.Errorf("error load network: %s", err)
+	// 判断网络配置目录是否存在，不存在则创建
+	exist, err := util.FileOrDirExits(defaultNetworkPath)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		if err := os.MkdirAll(defaultNetworkPath, os.ModePerm); err != nil {
+			return err
 		}
+	}
 
-		// 将网络配置信息加入到 networks 字典中
-		networks[nwName] = nw
-		return nil
-	})
-
-	return nil
-}
-
-func ListNetwork() {
-	// 使用tabwriter进行网络展示
-	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
-	// 遍历网络信息
-	for _, nw := range networks {
-		fmt.Fprintf(w, "%s\t%s\t%s\n", nw.Name, nw.IpRange, nw.Driver)
-	}
-	// 输出到标准输出
-	if err := w.Flush(); err != nil {
-		logrus.Errorf("Flush error %v", err)
-		return
+	// 加载网络配置目录中的所有网络，损坏的文件不加入 networks，由 network doctor 报告和修复
+	networks, corruptNetworks, err = loadNetworks(defaultNetworkPath)
+	if err != nil {
+		networks = make(map[string]*Network)
+		return err
 	}
+	logCorruptNetworks()
+	return nil
 }
 
 func DeleteNetwork(networkName string) error {
@@ -253,14 +580,33 @@ func DeleteNetwork(networkName string) error {
 	}
 	logrus.Debugf("Delete network info load, Driver: %s; Name: %s; IPRange: %s", nw.Driver, nw.Name, nw.IpRange)
 
-	// 调用 IPAM 的实例 ipAllocator 释放网络的网关IP
-	if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
-		return fmt.Errorf("error remove network gateway IP : %s", err)
+	// 还有容器连接时不能删除，需要先断开或者删除这些容器
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return err
+	}
+	var active []string
+	for _, ep := range endpoints {
+		if ep.NetworkName == nw.Name {
+			active = append(active, ep.ContainerID)
+		}
+	}
+	if len(active) > 0 {
+		return fmt.Errorf("network %s has active endpoints of containers %s", nw.Name, strings.Join(active, ", "))
 	}
 
+	// 结束网络内置的 DNS 服务
+	stopDNSServer(nw.Name)
+
 	// 调用网络驱动删除网络创建的设备与配置
 	if err := drivers[nw.Driver].Delete(*nw); err != nil {
 		return fmt.Errorf("error remove network driver error: %s", err)
 	}
-	return nw.remove(defaultNetworkPath)
+	if err := nw.remove(defaultNetworkPath); err != nil {
+		return err
+	}
+	// 网络删除后再调用 IPAM 的实例 ipAllocator 释放网络的网关IP和保留地址
+	releaseNetworkAddresses(nw)
+	delete(networks, nw.Name)
+	return nil
 }
@@ -0,0 +1,531 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// nftables 后端，通过 netlink 直接操作内核中的 inet mydocker 表
+// 同一批次的修改在一次 Flush 中提交，内核保证整个批次原子生效
+type NftablesFirewall struct{}
+
+// 逻辑链对应的 nftables 基础链配置
+var nftChains = map[string]*nftables.Chain{
+	ChainPrerouting: {
+		Name:     "prerouting",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	},
+	ChainOutput: {
+		Name:     "output",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	},
+	ChainPostrouting: {
+		Name:     "postrouting",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	},
+	ChainForward: {
+		Name:     "forward",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	},
+	// 优先级高于 forward 链，forward 链中的 accept 不会跳过隔离规则
+	ChainIsolation: {
+		Name:     "isolation",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 1),
+	},
+}
+
+func (f *NftablesFirewall) Name() string {
+	return "nftables"
+}
+
+func nftTable() *nftables.Table {
+	return &nftables.Table{Family: nftables.TableFamilyINet, Name: firewallTableName}
+}
+
+func nftChain(table *nftables.Table, chain string) (*nftables.Chain, error) {
+	def, ok := nftChains[chain]
+	if !ok {
+		return nil, fmt.Errorf("unknown chain %s", chain)
+	}
+	c := *def
+	c.Table = table
+	return &c, nil
+}
+
+// 判断内核是否支持 nftables
+func nftablesAvailable() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTables()
+	return err == nil
+}
+
+func (f *NftablesFirewall) Setup() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	// AddTable 和 AddChain 不带 NLM_F_EXCL 标志，表和链已存在时不会报错
+	table := conn.AddTable(nftTable())
+	for chain := range nftChains {
+		c, _ := nftChain(table, chain)
+		conn.AddChain(c)
+	}
+	return conn.Flush()
+}
+
+func (f *NftablesFirewall) AddRules(rules ...*Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	table := nftTable()
+	for _, rule := range rules {
+		chain, err := nftChain(table, rule.Chain)
+		if err != nil {
+			return err
+		}
+		exprs, err := nftRuleExprs(rule)
+		if err != nil {
+			return err
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, rule.Comment),
+		})
+	}
+	forward := hostForwardRules(rules)
+	if err := addHostForwardRules(conn, forward); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	return legacyForwardRules(true, forward)
+}
+
+func (f *NftablesFirewall) DelRules(rules ...*Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	table := nftTable()
+
+	// 按链分组需要删除的规则注释
+	comments := map[string]map[string]bool{}
+	for _, rule := range rules {
+		if rule.Comment == "" {
+			return fmt.Errorf("rule without comment can not be deleted")
+		}
+		if comments[rule.Chain] == nil {
+			comments[rule.Chain] = map[string]bool{}
+		}
+		comments[rule.Chain][rule.Comment] = true
+	}
+
+	deleted := 0
+	for chainName, wanted := range comments {
+		chain, err := nftChain(table, chainName)
+		if err != nil {
+			return err
+		}
+		existing, err := conn.GetRules(table, chain)
+		if err != nil {
+			return fmt.Errorf("list rules of chain %s error: %v", chain.Name, err)
+		}
+		for _, r := range existing {
+			comment, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if !ok || !wanted[comment] {
+				continue
+			}
+			if err := conn.DelRule(r); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	forward := hostForwardRules(rules)
+	n, err := delHostForwardRules(conn, forward)
+	if err != nil {
+		return err
+	}
+	deleted += n
+	if deleted > 0 {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+	}
+	return legacyForwardRules(false, forward)
+}
+
+// 宿主机上的 iptables filter 表 FORWARD 链默认策略为 DROP 时（例如安装了 docker），
+// 报文在 inet mydocker 表的 forward 链中被 accept 之后，仍然会被 iptables 的 FORWARD 链丢弃，
+// 因此把 FORWARD 逻辑链中的放行规则同时插入到 iptables FORWARD 链的链首，删除网络时一并删除
+// iptables-nft 的 FORWARD 链位于 nftables 的 ip filter 和 ip6 filter 表中，直接通过 netlink 修改；
+// iptables-legacy 的 FORWARD 链通过 iptables 命令修改
+// ISOLATION 链中的 DROP 在 inet mydocker 表中生效，不会被 iptables 中的放行规则绕过
+func hostForwardRules(rules []*Rule) []*Rule {
+	var forward []*Rule
+	for _, rule := range rules {
+		if rule.Chain == ChainForward && rule.Action == ActionAccept {
+			forward = append(forward, rule)
+		}
+	}
+	return forward
+}
+
+// iptables-nft 创建的 FORWARD 链，policyDrop 为 true 时只返回默认策略为 DROP 的链
+func iptablesNftForwardChains(conn *nftables.Conn, policyDrop bool) ([]*nftables.Chain, error) {
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("list nftables chains error: %v", err)
+	}
+	var result []*nftables.Chain
+	for _, c := range chains {
+		if c.Table == nil || c.Table.Name != "filter" || c.Name != ChainForward {
+			continue
+		}
+		if c.Table.Family != nftables.TableFamilyIPv4 && c.Table.Family != nftables.TableFamilyIPv6 {
+			continue
+		}
+		if policyDrop && (c.Policy == nil || *c.Policy != nftables.ChainPolicyDrop) {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// 规则是否适用于 ip 或 ip6 表
+func ruleMatchesTable(rule *Rule, family nftables.TableFamily) bool {
+	switch rule.family() {
+	case familyIPv4:
+		return family == nftables.TableFamilyIPv4
+	case familyIPv6:
+		return family == nftables.TableFamilyIPv6
+	}
+	return true
+}
+
+func nftRuleComments(conn *nftables.Conn, chain *nftables.Chain) (map[string]*nftables.Rule, error) {
+	existing, err := conn.GetRules(chain.Table, chain)
+	if err != nil {
+		return nil, fmt.Errorf("list rules of chain %s error: %v", chain.Name, err)
+	}
+	comments := map[string]*nftables.Rule{}
+	for _, r := range existing {
+		if comment, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok {
+			comments[comment] = r
+		}
+	}
+	return comments, nil
+}
+
+func addHostForwardRules(conn *nftables.Conn, rules []*Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	chains, err := iptablesNftForwardChains(conn, true)
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		existing, err := nftRuleComments(conn, chain)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if _, ok := existing[rule.Comment]; ok || !ruleMatchesTable(rule, chain.Table.Family) {
+				continue
+			}
+			exprs, err := nftRuleExprs(rule)
+			if err != nil {
+				return err
+			}
+			conn.InsertRule(&nftables.Rule{
+				Table:    chain.Table,
+				Chain:    chain,
+				Exprs:    exprs,
+				UserData: userdata.AppendString(nil, userdata.TypeComment, rule.Comment),
+			})
+		}
+	}
+	return nil
+}
+
+// 删除时不检查默认策略，添加规则后策略可能已经被改回 ACCEPT
+func delHostForwardRules(conn *nftables.Conn, rules []*Rule) (int, error) {
+	if len(rules) == 0 {
+		return 0, nil
+	}
+	chains, err := iptablesNftForwardChains(conn, false)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, chain := range chains {
+		existing, err := nftRuleComments(conn, chain)
+		if err != nil {
+			return 0, err
+		}
+		for _, rule := range rules {
+			r, ok := existing[rule.Comment]
+			if !ok {
+				continue
+			}
+			if err := conn.DelRule(r); err != nil {
+				return 0, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// 使用 iptables-legacy 的主机上，FORWARD 链不在 nftables 中，通过 iptables 命令插入和删除放行规则
+func legacyForwardRules(add bool, rules []*Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	for _, family := range []int{familyIPv4, familyIPv6} {
+		output, err := exec.Command(iptablesCommand(family), "-V").CombinedOutput()
+		if err != nil || !strings.Contains(string(output), "legacy") {
+			continue
+		}
+		if add {
+			policy, err := runIptables(family, "-t", "filter", "-S", ChainForward)
+			if err != nil || !strings.Contains(string(policy), "-P FORWARD DROP") {
+				continue
+			}
+		}
+		for _, rule := range rules {
+			if rule.family() != familyAny && rule.family() != family {
+				continue
+			}
+			args, err := iptablesRuleArgs(rule)
+			if err != nil {
+				return err
+			}
+			_, checkErr := runIptables(family, append([]string{"-t", "filter", "-C", ChainForward}, args...)...)
+			switch {
+			case add && checkErr != nil:
+				_, err = runIptables(family, append([]string{"-t", "filter", "-I", ChainForward}, args...)...)
+			case !add && checkErr == nil:
+				_, err = runIptables(family, append([]string{"-t", "filter", "-D", ChainForward}, args...)...)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 接口名以 NUL 结尾，与 nft 命令行生成的匹配数据一致
+func nftIfname(name string) []byte {
+	return []byte(name + "\x00")
+}
+
+func nftProto(proto string) (byte, error) {
+	switch strings.ToLower(proto) {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "sctp":
+		return unix.IPPROTO_SCTP, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol %s", proto)
+}
+
+// 匹配接口名，neq 为 true 时表示不等于
+func nftMatchIface(key expr.MetaKey, name string, neq bool) []expr.Any {
+	op := expr.CmpOpEq
+	if neq {
+		op = expr.CmpOpNeq
+	}
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: nftIfname(name)},
+	}
+}
+
+// 网络层首部中源地址和目的地址的偏移
+// IPv4 首部中源地址位于 12 字节，目的地址位于 16 字节；IPv6 首部中分别位于 8 字节和 24 字节
+func nftAddrOffset(family int, src bool) uint32 {
+	switch {
+	case family == familyIPv6 && src:
+		return 8
+	case family == familyIPv6:
+		return 24
+	case src:
+		return 12
+	}
+	return 16
+}
+
+// 匹配网络层首部中 offset 位置的地址段
+func nftMatchIPNet(offset uint32, ipNet *nftIPNet) []expr.Any {
+	l := uint32(len(ipNet.ip))
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: l},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: l, Mask: ipNet.mask, Xor: make([]byte, l)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipNet.ip},
+	}
+}
+
+// 按掩码处理后的地址段
+type nftIPNet struct {
+	ip   []byte
+	mask []byte
+}
+
+func newNftIPNet(rule *Rule, ipNet *net.IPNet) (*nftIPNet, error) {
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		ip = ipNet.IP.To16()
+	}
+	mask := ipNet.Mask
+	if len(ip) != len(mask) {
+		return nil, fmt.Errorf("rule %s: invalid address %s", rule.Comment, ipNet)
+	}
+	masked := make([]byte, len(ip))
+	for i := range ip {
+		masked[i] = ip[i] & mask[i]
+	}
+	return &nftIPNet{ip: masked, mask: mask}, nil
+}
+
+// 规则协议族对应的 nfproto
+func nftFamily(family int) byte {
+	if family == familyIPv6 {
+		return unix.NFPROTO_IPV6
+	}
+	return unix.NFPROTO_IPV4
+}
+
+// 将规则转换为 nftables 表达式
+func nftRuleExprs(rule *Rule) ([]expr.Any, error) {
+	var exprs []expr.Any
+
+	// inet 表同时处理 IPv4 和 IPv6 报文，涉及地址的规则需要先限定协议族
+	family := rule.family()
+	if family != familyAny {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nftFamily(family)}},
+		)
+	} else if rule.Action == ActionDNAT {
+		return nil, fmt.Errorf("rule %s: DNAT requires destination address", rule.Comment)
+	}
+	if rule.InIface != "" {
+		exprs = append(exprs, nftMatchIface(expr.MetaKeyIIFNAME, rule.InIface, false)...)
+	}
+	if rule.NotInIface != "" {
+		exprs = append(exprs, nftMatchIface(expr.MetaKeyIIFNAME, rule.NotInIface, true)...)
+	}
+	if rule.OutIface != "" {
+		exprs = append(exprs, nftMatchIface(expr.MetaKeyOIFNAME, rule.OutIface, false)...)
+	}
+	if rule.NotOutIface != "" {
+		exprs = append(exprs, nftMatchIface(expr.MetaKeyOIFNAME, rule.NotOutIface, true)...)
+	}
+	if rule.Src != nil {
+		src, err := newNftIPNet(rule, rule.Src)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, nftMatchIPNet(nftAddrOffset(family, true), src)...)
+	}
+	if rule.Dst != nil {
+		dst, err := newNftIPNet(rule, rule.Dst)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, nftMatchIPNet(nftAddrOffset(family, false), dst)...)
+	}
+	if rule.DstLocal {
+		// 相当于 fib daddr type local
+		exprs = append(exprs,
+			&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		)
+	}
+	if rule.Proto != "" {
+		proto, err := nftProto(rule.Proto)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+	}
+	if rule.DPort != 0 {
+		if rule.Proto == "" {
+			return nil, fmt.Errorf("rule %s: destination port requires protocol", rule.Comment)
+		}
+		// tcp/udp/sctp 的目的端口都位于传输层首部偏移 2 字节处
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(rule.DPort))},
+		)
+	}
+
+	switch rule.Action {
+	case ActionAccept:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case ActionDrop:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case ActionReturn:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+	case ActionMasquerade:
+		exprs = append(exprs, &expr.Masq{})
+	case ActionDNAT:
+		to := rule.ToIP.To4()
+		if to == nil {
+			to = rule.ToIP.To16()
+		}
+		if to == nil {
+			return nil, fmt.Errorf("rule %s: DNAT requires destination address", rule.Comment)
+		}
+		nat := &expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(nftFamily(family)), RegAddrMin: 1}
+		exprs = append(exprs, &expr.Immediate{Register: 1, Data: to})
+		if rule.ToPort != 0 {
+			exprs = append(exprs, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(rule.ToPort))})
+			nat.RegProtoMin = 2
+		}
+		exprs = append(exprs, nat)
+	default:
+		return nil, fmt.Errorf("rule %s: unknown action %s", rule.Comment, rule.Action)
+	}
+	return exprs, nil
+}
@@ -0,0 +1,428 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 网络选项: VXLAN 网络标识，所有主机上的同一个 overlay 网络必须相同
+	optionVNI = "vni"
+	// 网络选项: 其他主机的 VTEP 地址，逗号分隔
+	optionPeers = "peers"
+	// 网络选项: 本机的 VTEP 地址，作为 VXLAN 报文的源地址
+	optionVtepLocal = "local"
+	// 网络选项: VXLAN 的 UDP 端口，默认 4789
+	optionVxlanPort = "vxlan_port"
+	// 网络选项: 所有主机共享的目录（例如 NFS），记录各主机上 overlay 网络端点的地址、MAC 和 VTEP
+	optionOverlayStore = "store"
+
+	defaultVxlanPort = 4789
+	// VXLAN 封装增加 50 字节的报文头，默认 MTU 在 1500 的基础上减去封装开销
+	defaultOverlayMTU = 1450
+)
+
+// overlay 网络，通过 VXLAN 隧道将多台主机上的网桥连接到同一个二层网段
+// 每台主机使用相同的网段和 VNI 创建网络，并通过 -o peers 指定其他主机的 VTEP 地址
+// 各主机的 IPAM 相互独立，需要通过 --ip-range 为每台主机划分不重叠的地址范围
+// 网桥上不配置网关地址，overlay 网络只用于容器之间跨主机通信，访问外部网络需要同时连接 bridge 网络
+type OverlayNetworkDriver struct{}
+
+func (d *OverlayNetworkDriver) Name() string {
+	return "overlay"
+}
+
+func (d *OverlayNetworkDriver) Create(nw *Network) error {
+	vni, err := overlayVNI(nw)
+	if err != nil {
+		return err
+	}
+	peers, err := overlayPeers(nw)
+	if err != nil {
+		return err
+	}
+	if _, err := vxlanPort(nw); err != nil {
+		return err
+	}
+	if local, ok := nw.Options[optionVtepLocal]; ok && net.ParseIP(local) == nil {
+		return fmt.Errorf("invalid %s %s", optionVtepLocal, local)
+	}
+	// 端点记录中的 VTEP 地址就是 local，其他主机根据它下发 FDB 表项
+	if _, ok := nw.Options[optionOverlayStore]; ok && nw.Options[optionVtepLocal] == "" {
+		return fmt.Errorf("overlay network option -o %s requires -o %s", optionOverlayStore, optionVtepLocal)
+	}
+	mtu, err := bridgeMTU(nw)
+	if err != nil {
+		return err
+	}
+	if mtu == 0 {
+		mtu = defaultOverlayMTU
+	}
+
+	bridgeName := nw.device()
+	if err := createBridgeInterface(bridgeName, mtu); err != nil {
+		return err
+	}
+	if err := setInterfaceUP(bridgeName); err != nil {
+		return err
+	}
+	if err := d.createVxlan(nw, vni, mtu); err != nil {
+		d.Delete(*nw)
+		return err
+	}
+	// 为每个 peer 添加全零 MAC 的 FDB 表项，广播、组播和未知单播报文复制到所有 peer（头端复制）
+	if err := addPeerFDB(vxlanName(vni), peers); err != nil {
+		d.Delete(*nw)
+		return err
+	}
+	if err := syncOverlayNeighbors(nw, vni); err != nil {
+		d.Delete(*nw)
+		return err
+	}
+	logrus.Infof("create overlay network %s, vni %d, peers %v", nw.Name, vni, peers)
+	return nil
+}
+
+// 创建 VXLAN 设备并挂载到网桥上
+// 相当于 ip link add vxlan{vni} type vxlan id {vni} local {local} dstport 4789 nolearning ; ip link set vxlan{vni} master {bridge} up
+func (d *OverlayNetworkDriver) createVxlan(nw *Network, vni, mtu int) error {
+	br, err := netlink.LinkByName(nw.device())
+	if err != nil {
+		return err
+	}
+	port, _ := vxlanPort(nw)
+	la := netlink.NewLinkAttrs()
+	la.Name = vxlanName(vni)
+	la.MTU = mtu
+	la.MasterIndex = br.Attrs().Index
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: la,
+		VxlanId:   vni,
+		SrcAddr:   net.ParseIP(nw.Options[optionVtepLocal]),
+		Port:      port,
+		// 开启学习，从隧道收到的报文学习远端容器 MAC 对应的 VTEP，之后的单播报文不再复制到所有 peer
+		Learning: true,
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return fmt.Errorf("error add vxlan device %s: %v", la.Name, err)
+	}
+	// 有共享目录时开启 neigh_suppress，相当于 bridge link set dev vxlan{vni} neigh_suppress on
+	// 网桥直接用 ARP 表项应答远端容器地址的 ARP 请求，不再复制到所有 peer，没有表项的地址仍然广播解析
+	if _, ok := nw.Options[optionOverlayStore]; ok {
+		link, err := netlink.LinkByName(la.Name)
+		if err != nil {
+			return err
+		}
+		if err := setBridgePortFlag(link, unix.IFLA_BRPORT_NEIGH_SUPPRESS); err != nil {
+			return fmt.Errorf("error set neigh_suppress of %s: %v", la.Name, err)
+		}
+	}
+	return setInterfaceUP(la.Name)
+}
+
+// 删除 VXLAN 设备和网桥，设备不存在时忽略
+func (d *OverlayNetworkDriver) Delete(network Network) error {
+	if vni, err := overlayVNI(&network); err == nil {
+		if l, err := netlink.LinkByName(vxlanName(vni)); err == nil {
+			if err := netlink.LinkDel(l); err != nil {
+				return err
+			}
+		}
+	}
+	l, err := netlink.LinkByName(network.device())
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
+}
+
+// 与 bridge 网络相同，创建 Veth 挂载到网桥上
+// 连接时重新下发 peer 的 FDB 表项，宿主机重启或者表项被手动删除后可以恢复
+// 有共享目录时将端点记录到共享目录，并根据其他主机的端点记录下发静态 FDB 和 ARP 表项
+func (d *OverlayNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	vni, err := overlayVNI(network)
+	if err != nil {
+		return err
+	}
+	peers, err := overlayPeers(network)
+	if err != nil {
+		return err
+	}
+	if err := (&BridgeNetworkDriver{}).Connect(network, endpoint); err != nil {
+		return err
+	}
+	if err := addPeerFDB(vxlanName(vni), peers); err != nil {
+		return err
+	}
+	if dir, ok := overlayStoreDir(network, vni); ok && endpoint.IpAddress != nil {
+		if err := saveOverlayEndpoint(dir, network, endpoint); err != nil {
+			return err
+		}
+	}
+	return syncOverlayNeighbors(network, vni)
+}
+
+// 删除 Veth 和共享目录中的端点记录，其他主机在下一次连接或断开端点时删除对应的表项
+func (d *OverlayNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	if err := (&BridgeNetworkDriver{}).Disconnect(network, endpoint); err != nil {
+		return err
+	}
+	vni, err := overlayVNI(network)
+	if err != nil {
+		return err
+	}
+	if dir, ok := overlayStoreDir(network, vni); ok {
+		if err := os.Remove(path.Join(dir, endpoint.ID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove overlay endpoint %s error %v", endpoint.ID, err)
+		}
+	}
+	return syncOverlayNeighbors(network, vni)
+}
+
+func vxlanName(vni int) string {
+	return fmt.Sprintf("vxlan%d", vni)
+}
+
+func overlayVNI(nw *Network) (int, error) {
+	value, ok := nw.Options[optionVNI]
+	if !ok {
+		return 0, fmt.Errorf("overlay network requires option -o %s=<1-16777215>", optionVNI)
+	}
+	vni, err := strconv.Atoi(value)
+	if err != nil || vni < 1 || vni > 1<<24-1 {
+		return 0, fmt.Errorf("invalid %s %s, should be between 1 and 16777215", optionVNI, value)
+	}
+	return vni, nil
+}
+
+func overlayPeers(nw *Network) ([]net.IP, error) {
+	var peers []net.IP
+	for _, s := range strings.Split(nw.Options[optionPeers], ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer address %s", s)
+		}
+		peers = append(peers, ip)
+	}
+	return peers, nil
+}
+
+func vxlanPort(nw *Network) (int, error) {
+	value, ok := nw.Options[optionVxlanPort]
+	if !ok {
+		return defaultVxlanPort, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s %s", optionVxlanPort, value)
+	}
+	return port, nil
+}
+
+// 下发 peer 的静态 FDB 表项，表项已经存在时忽略
+// 相当于 bridge fdb append 00:00:00:00:00:00 dev vxlan{vni} dst {peer}
+func addPeerFDB(vxlan string, peers []net.IP) error {
+	link, err := netlink.LinkByName(vxlan)
+	if err != nil {
+		return err
+	}
+	existing, err := netlink.NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	zeroMAC := net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	for _, peer := range peers {
+		found := false
+		for _, n := range existing {
+			if n.IP.Equal(peer) && n.HardwareAddr.String() == zeroMAC.String() {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		fdb := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			IP:           peer,
+			HardwareAddr: zeroMAC,
+		}
+		if err := netlink.NeighAppend(fdb); err != nil {
+			return fmt.Errorf("add fdb entry of peer %s error %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// 共享目录中的 overlay 网络端点记录，文件名为端点 ID
+type overlayEndpoint struct {
+	IP   net.IP           `json:"ip"`
+	Mac  net.HardwareAddr `json:"mac"`
+	Vtep net.IP           `json:"vtep"`
+}
+
+// 共享目录中保存该网络端点记录的目录，不同 VNI 的网络分开保存
+func overlayStoreDir(nw *Network, vni int) (string, bool) {
+	store, ok := nw.Options[optionOverlayStore]
+	if !ok {
+		return "", false
+	}
+	return path.Join(store, strconv.Itoa(vni)), true
+}
+
+// 由 IP 地址生成容器网卡的 MAC 地址 02:42:{IP 地址的后 4 字节}
+// 地址被回收后分配给新的容器时 MAC 不变，其他主机上还没有更新的 ARP 表项仍然有效
+func overlayMac(ip net.IP) net.HardwareAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ip = ip[len(ip)-4:]
+	return net.HardwareAddr{0x02, 0x42, ip[0], ip[1], ip[2], ip[3]}
+}
+
+// 设置容器一端 Veth 的 MAC 地址并记录到共享目录
+func saveOverlayEndpoint(dir string, nw *Network, endpoint *Endpoint) error {
+	peer, err := netlink.LinkByName(endpoint.Device.PeerName)
+	if err != nil {
+		return err
+	}
+	mac := overlayMac(endpoint.IpAddress)
+	if err := netlink.LinkSetHardwareAddr(peer, mac); err != nil {
+		return fmt.Errorf("set mac address of %s error %v", endpoint.Device.PeerName, err)
+	}
+	record, err := json.Marshal(overlayEndpoint{
+		IP:   endpoint.IpAddress,
+		Mac:  mac,
+		Vtep: net.ParseIP(nw.Options[optionVtepLocal]),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshal overlay endpoint %s json error %v", endpoint.ID, err)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("can not create overlay store %s error %v", dir, err)
+	}
+	return writeStateFile(path.Join(dir, endpoint.ID), record)
+}
+
+// 读取共享目录中的端点记录，无法解析的记录跳过
+func loadOverlayEndpoints(dir string) ([]overlayEndpoint, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []overlayEndpoint
+	for _, entry := range entries {
+		if entry.IsDir() || ignoredStateFile(entry.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var record overlayEndpoint
+		if err := json.Unmarshal(content, &record); err != nil || record.IP == nil || record.Vtep == nil || len(record.Mac) == 0 {
+			logrus.Warnf("skip invalid overlay endpoint %s", path.Join(dir, entry.Name()))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// 根据共享目录中其他主机的端点记录下发静态表项，删除已经没有记录的表项，没有共享目录时不做处理
+// 相当于 bridge fdb replace {mac} dev vxlan{vni} dst {vtep} self permanent ;
+// bridge fdb replace {mac} dev vxlan{vni} master static ; ip neigh replace {ip} lladdr {mac} dev {bridge} nud permanent
+// 远端 MAC 在网桥和 VXLAN 设备上都有静态表项，单播报文直接发往对应的 VTEP，不依赖泛洪和学习
+// 只在本机连接或断开容器时同步，还没有表项的远端容器仍然通过泛洪和学习通信
+func syncOverlayNeighbors(nw *Network, vni int) error {
+	dir, ok := overlayStoreDir(nw, vni)
+	if !ok {
+		return nil
+	}
+	records, err := loadOverlayEndpoints(dir)
+	if err != nil {
+		return fmt.Errorf("load overlay endpoints from %s error %v", dir, err)
+	}
+	vxlan, err := netlink.LinkByName(vxlanName(vni))
+	if err != nil {
+		return err
+	}
+	br, err := netlink.LinkByName(nw.device())
+	if err != nil {
+		return err
+	}
+	local := net.ParseIP(nw.Options[optionVtepLocal])
+	vteps := map[string]net.IP{}
+	macs := map[string]string{}
+	for _, r := range records {
+		if r.Vtep.Equal(local) {
+			continue
+		}
+		vteps[r.Mac.String()] = r.Vtep
+		macs[r.IP.String()] = r.Mac.String()
+		neighs := []*netlink.Neigh{
+			{LinkIndex: vxlan.Attrs().Index, Family: unix.AF_BRIDGE, Flags: netlink.NTF_SELF, State: netlink.NUD_PERMANENT, IP: r.Vtep, HardwareAddr: r.Mac},
+			{LinkIndex: vxlan.Attrs().Index, Family: unix.AF_BRIDGE, Flags: netlink.NTF_MASTER, State: netlink.NUD_NOARP, HardwareAddr: r.Mac},
+			{LinkIndex: br.Attrs().Index, State: netlink.NUD_PERMANENT, IP: r.IP, HardwareAddr: r.Mac},
+		}
+		for _, n := range neighs {
+			if err := netlink.NeighSet(n); err != nil {
+				return fmt.Errorf("add neighbor of overlay endpoint %s error %v", r.IP, err)
+			}
+		}
+	}
+
+	fdb, err := netlink.NeighList(vxlan.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	for _, n := range fdb {
+		// 只处理这里下发的表项，跳过 peer 的全零 MAC 表项、学习到的表项和网桥端口自身 MAC 的表项
+		// 网桥的表项带有 NDA_MASTER 属性，VXLAN 设备的表项带有 NTF_SELF 标志
+		self := n.Flags&netlink.NTF_SELF != 0 && n.State == netlink.NUD_PERMANENT
+		master := n.MasterIndex != 0 && n.State == netlink.NUD_NOARP
+		if !self && !master {
+			continue
+		}
+		if vtep, ok := vteps[n.HardwareAddr.String()]; ok && (master || vtep.Equal(n.IP)) {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil {
+			logrus.Warnf("delete fdb entry %s of %s error %v", n.HardwareAddr, vxlan.Attrs().Name, err)
+		}
+	}
+	arp, err := netlink.NeighList(br.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, n := range arp {
+		if n.State != netlink.NUD_PERMANENT || macs[n.IP.String()] == n.HardwareAddr.String() {
+			continue
+		}
+		if err := netlink.NeighDel(&n); err != nil {
+			logrus.Warnf("delete neighbor %s of %s error %v", n.IP, br.Attrs().Name, err)
+		}
+	}
+	return nil
+}
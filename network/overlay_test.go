@@ -0,0 +1,204 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// 在一台机器上用两个 Net Namespace 模拟两台主机，主机之间通过 Veth 连接作为底层网络
+// 每台主机上创建相同 VNI 的 overlay 网络并连接一个容器，验证两个容器可以跨主机通信
+// 两台主机共享同一个端点记录目录，验证连接和断开端点时下发和删除的静态 FDB 和 ARP 表项
+func TestOverlayTwoHosts(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("get net namespace error %v", err)
+	}
+	defer origin.Close()
+	defer netns.Set(origin)
+
+	var hosts, containers [2]netns.NsHandle
+	newNs := func() netns.NsHandle {
+		ns, err := netns.New()
+		if err != nil {
+			t.Skipf("create net namespace error %v", err)
+		}
+		t.Cleanup(func() { ns.Close() })
+		return ns
+	}
+	for i := range hosts {
+		hosts[i] = newNs()
+		netns.Set(origin)
+	}
+
+	// 底层网络，主机地址为 172.30.99.1 和 172.30.99.2
+	la := netlink.NewLinkAttrs()
+	la.Name = "mydkul0"
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "mydkul1"}); err != nil {
+		t.Skipf("can not create veth: %v", err)
+	}
+	underlay := func(i int) string { return fmt.Sprintf("172.30.99.%d", i+1) }
+	for i := range hosts {
+		l, _ := netlink.LinkByName(fmt.Sprintf("mydkul%d", i))
+		if err := netlink.LinkSetNsFd(l, int(hosts[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/24")
+	store := t.TempDir()
+	var nws [2]*Network
+	var eps [2]*Endpoint
+	containerIP := func(i int) string { return fmt.Sprintf("10.99.0.%d", i+10) }
+	for i := range hosts {
+		netns.Set(hosts[i])
+		if err := setInterfaceIP(fmt.Sprintf("mydkul%d", i), underlay(i)+"/24"); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceUP(fmt.Sprintf("mydkul%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		nw := &Network{Name: "mydkovl", Driver: "overlay", IpRange: subnet, Options: map[string]string{
+			optionVNI:          "4242",
+			optionPeers:        underlay(1 - i),
+			optionVtepLocal:    underlay(i),
+			optionOverlayStore: store,
+		}}
+		nws[i] = nw
+		driver := &OverlayNetworkDriver{}
+		if err := driver.Create(nw); err != nil {
+			t.Skipf("overlay is not supported: %v", err)
+		}
+		ep := &Endpoint{ID: fmt.Sprintf("ovl%02d-mydkovl", i), IpAddress: net.ParseIP(containerIP(i))}
+		eps[i] = ep
+		if err := driver.Connect(nw, ep); err != nil {
+			t.Fatal(err)
+		}
+		fdb, _ := netlink.NeighList(mustLinkIndex(t, "vxlan4242"), unix.AF_BRIDGE)
+		if !hasPeerFDB(fdb, underlay(1-i)) {
+			t.Errorf("host %d fdb %v missing peer %s", i, fdb, underlay(1-i))
+		}
+
+		// 将 Veth 的另一端移动到容器的 Net Namespace 中配置地址
+		containers[i] = newNs()
+		netns.Set(hosts[i])
+		peer, err := netlink.LinkByName(ep.Device.PeerName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetNsFd(peer, int(containers[i])); err != nil {
+			t.Fatal(err)
+		}
+		netns.Set(containers[i])
+		if err := setInterfaceIP(ep.Device.PeerName, containerIP(i)+"/24"); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceUP(ep.Device.PeerName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 主机 0 先连接端点，在下一次连接或断开端点时才会下发主机 1 上端点的表项
+	netns.Set(hosts[0])
+	if err := syncOverlayNeighbors(nws[0], 4242); err != nil {
+		t.Fatal(err)
+	}
+	for i := range hosts {
+		netns.Set(hosts[i])
+		remote := 1 - i
+		if !hasEndpointNeighbors(t, nws[i], containerIP(remote), underlay(remote)) {
+			t.Errorf("host %d missing static fdb and arp entries of %s", i, containerIP(remote))
+		}
+	}
+
+	netns.Set(containers[1])
+	ln, err := net.Listen("tcp", "10.99.0.11:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	netns.Set(containers[0])
+	conn, err := net.DialTimeout("tcp", "10.99.0.11:7777", 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial container on another host error %v", err)
+	}
+	defer conn.Close()
+	if msg, _ := io.ReadAll(conn); string(msg) != "hello" {
+		t.Errorf("got %q", msg)
+	}
+
+	// 主机 1 断开端点后删除记录，主机 0 同步时删除对应的表项
+	netns.Set(hosts[1])
+	if err := (&OverlayNetworkDriver{}).Disconnect(nws[1], eps[1]); err != nil {
+		t.Fatal(err)
+	}
+	netns.Set(hosts[0])
+	if err := syncOverlayNeighbors(nws[0], 4242); err != nil {
+		t.Fatal(err)
+	}
+	if hasEndpointNeighbors(t, nws[0], containerIP(1), underlay(1)) {
+		t.Errorf("static entries of %s should be removed after disconnect", containerIP(1))
+	}
+	if records, _ := loadOverlayEndpoints(path.Join(store, "4242")); len(records) != 1 || !records[0].IP.Equal(eps[0].IpAddress) {
+		t.Errorf("overlay endpoints %v", records)
+	}
+}
+
+// 网络所在主机上是否有远端端点的静态表项：VXLAN 设备上 MAC 到 VTEP 的 FDB 表项和网桥上的 ARP 表项
+func hasEndpointNeighbors(t *testing.T, nw *Network, ip, vtep string) bool {
+	mac := overlayMac(net.ParseIP(ip)).String()
+	var fdb, master, arp bool
+	neighs, _ := netlink.NeighList(mustLinkIndex(t, "vxlan4242"), unix.AF_BRIDGE)
+	for _, n := range neighs {
+		if n.HardwareAddr.String() != mac {
+			continue
+		}
+		if n.Flags&netlink.NTF_SELF != 0 && n.IP.String() == vtep {
+			fdb = true
+		}
+		if n.MasterIndex != 0 && n.State == netlink.NUD_NOARP {
+			master = true
+		}
+	}
+	neighs, _ = netlink.NeighList(mustLinkIndex(t, nw.device()), netlink.FAMILY_V4)
+	for _, n := range neighs {
+		if n.IP.String() == ip && n.HardwareAddr.String() == mac && n.State == netlink.NUD_PERMANENT {
+			arp = true
+		}
+	}
+	return fdb && master && arp
+}
+
+func mustLinkIndex(t *testing.T, name string) int {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Attrs().Index
+}
+
+func hasPeerFDB(fdb []netlink.Neigh, peer string) bool {
+	for _, n := range fdb {
+		if n.IP.String() == peer && n.HardwareAddr.String() == "00:00:00:00:00:00" {
+			return true
+		}
+	}
+	return false
+}
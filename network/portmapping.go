@@ -0,0 +1,237 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 未指定宿主机端口时，从该范围中分配端口，与 docker 的默认范围保持一致
+const (
+	defaultPortRangeStart = 49153
+	defaultPortRangeEnd   = 65535
+	portRangeFile         = "/proc/sys/net/ipv4/ip_local_port_range"
+)
+
+// 一条端口映射，宿主机 HostIP:HostPort 转发到容器的 ContainerPort
+type PortBinding struct {
+	HostIP        string `json:"hostIp"`        // 空表示绑定宿主机的所有地址
+	HostPort      int    `json:"hostPort"`      // 0 表示需要自动分配
+	HostPortEnd   int    `json:"hostPortEnd"`   // 非 0 表示从 [HostPort, HostPortEnd] 中选择一个端口
+	ContainerPort int    `json:"containerPort"` // 容器端口
+	Proto         string `json:"proto"`         // tcp/udp/sctp
+}
+
+func (pb PortBinding) String() string {
+	hostIP := pb.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", pb.ContainerPort, pb.Proto, net.JoinHostPort(hostIP, strconv.Itoa(pb.HostPort)))
+}
+
+// 宿主机端口是否与另一条映射冲突，协议相同、端口相同且地址重叠时冲突
+func (pb PortBinding) conflicts(other PortBinding) bool {
+	if pb.Proto != other.Proto || pb.HostPort != other.HostPort {
+		return false
+	}
+	return pb.HostIP == "" || other.HostIP == "" || net.ParseIP(pb.HostIP).Equal(net.ParseIP(other.HostIP))
+}
+
+// 解析 -p 参数，格式为 [hostIP:][hostPort[-end]:]containerPort[-end][/tcp|udp|sctp]
+// 端口范围会展开为多条映射，IPv6 地址需要使用 [] 括起来，例如 [::1]:8080:80
+func ParsePortMapping(spec string) ([]PortBinding, error) {
+	proto := "tcp"
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		proto = strings.ToLower(rest[i+1:])
+		rest = rest[:i]
+	}
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return nil, fmt.Errorf("invalid protocol %q in port mapping %s", proto, spec)
+	}
+
+	// 拆分出宿主机地址
+	hostIP := ""
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid host ip in port mapping %s", spec)
+		}
+		hostIP = rest[1:end]
+		rest = rest[end+2:]
+		if !strings.Contains(rest, ":") {
+			return nil, fmt.Errorf("missing host port in port mapping %s", spec)
+		}
+	}
+	parts := strings.Split(rest, ":")
+	var hostPart, containerPart string
+	switch len(parts) {
+	case 1:
+		containerPart = parts[0]
+	case 2:
+		hostPart, containerPart = parts[0], parts[1]
+	case 3:
+		if hostIP != "" {
+			return nil, fmt.Errorf("invalid port mapping %s", spec)
+		}
+		hostIP, hostPart, containerPart = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid port mapping %s", spec)
+	}
+	if hostIP != "" {
+		ip := net.ParseIP(hostIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host ip %s in port mapping %s", hostIP, spec)
+		}
+		if ip.IsUnspecified() {
+			hostIP = ""
+		} else {
+			hostIP = ip.String()
+		}
+	}
+
+	containerStart, containerEnd, err := parsePortRange(containerPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container port in port mapping %s: %v", spec, err)
+	}
+	hostStart, hostEnd := 0, 0
+	if hostPart != "" {
+		if hostStart, hostEnd, err = parsePortRange(hostPart); err != nil {
+			return nil, fmt.Errorf("invalid host port in port mapping %s: %v", spec, err)
+		}
+	}
+
+	var bindings []PortBinding
+	count := containerEnd - containerStart + 1
+	switch {
+	case hostPart == "":
+		// 宿主机端口自动分配
+		for i := 0; i < count; i++ {
+			bindings = append(bindings, PortBinding{HostIP: hostIP, ContainerPort: containerStart + i, Proto: proto})
+		}
+	case hostEnd-hostStart+1 == count:
+		// 宿主机端口范围与容器端口范围一一对应
+		for i := 0; i < count; i++ {
+			bindings = append(bindings, PortBinding{HostIP: hostIP, HostPort: hostStart + i, ContainerPort: containerStart + i, Proto: proto})
+		}
+	case count == 1:
+		// 从宿主机端口范围中选择一个端口映射到单个容器端口
+		bindings = append(bindings, PortBinding{HostIP: hostIP, HostPort: hostStart, HostPortEnd: hostEnd, ContainerPort: containerStart, Proto: proto})
+	default:
+		return nil, fmt.Errorf("host port range and container port range do not match in port mapping %s", spec)
+	}
+	return bindings, nil
+}
+
+// 解析 port 或者 start-end 形式的端口范围
+func parsePortRange(s string) (int, int, error) {
+	startStr, endStr := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		startStr, endStr = s[:i], s[i+1:]
+	}
+	start, err := parsePort(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parsePort(endStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return start, end, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// 自动分配宿主机端口时使用的端口范围，优先读取内核的临时端口范围
+func dynamicPortRange() (int, int) {
+	content, err := os.ReadFile(portRangeFile)
+	if err != nil {
+		return defaultPortRangeStart, defaultPortRangeEnd
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return defaultPortRangeStart, defaultPortRangeEnd
+	}
+	start, err1 := parsePort(fields[0])
+	end, err2 := parsePort(fields[1])
+	if err1 != nil || err2 != nil || end < start {
+		return defaultPortRangeStart, defaultPortRangeEnd
+	}
+	return start, end
+}
+
+// 判断宿主机端口当前是否被其他程序占用
+func hostPortInUse(pb PortBinding) bool {
+	addr := net.JoinHostPort(pb.HostIP, strconv.Itoa(pb.HostPort))
+	switch pb.Proto {
+	case "tcp":
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return true
+		}
+		l.Close()
+	case "udp":
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return true
+		}
+		c.Close()
+	}
+	return false
+}
+
+// 为端口映射分配宿主机端口，并检查与已发布端口的冲突
+// published 为其他容器已经发布的端口映射
+func allocateHostPorts(bindings []PortBinding, published []PortBinding) ([]PortBinding, error) {
+	used := append([]PortBinding{}, published...)
+	isFree := func(pb PortBinding) bool {
+		for _, u := range used {
+			if pb.conflicts(u) {
+				return false
+			}
+		}
+		return !hostPortInUse(pb)
+	}
+
+	result := make([]PortBinding, 0, len(bindings))
+	for _, pb := range bindings {
+		switch {
+		case pb.HostPort != 0 && pb.HostPortEnd == 0:
+			if !isFree(pb) {
+				return nil, fmt.Errorf("host port %s:%d/%s is already allocated", pb.HostIP, pb.HostPort, pb.Proto)
+			}
+		default:
+			start, end := pb.HostPort, pb.HostPortEnd
+			if start == 0 {
+				start, end = dynamicPortRange()
+			}
+			found := false
+			for port := start; port <= end; port++ {
+				pb.HostPort = port
+				if isFree(pb) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no free host port in range %d-%d for container port %d/%s", start, end, pb.ContainerPort, pb.Proto)
+			}
+			pb.HostPortEnd = 0
+		}
+		used = append(used, pb)
+		result = append(result, pb)
+	}
+	return result, nil
+}
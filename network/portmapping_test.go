@@ -0,0 +1,59 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []PortBinding
+	}{
+		{"80", []PortBinding{{ContainerPort: 80, Proto: "tcp"}}},
+		{"8080:80", []PortBinding{{HostPort: 8080, ContainerPort: 80, Proto: "tcp"}}},
+		{"127.0.0.1:8080:80/udp", []PortBinding{{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Proto: "udp"}}},
+		{"127.0.0.1::80", []PortBinding{{HostIP: "127.0.0.1", ContainerPort: 80, Proto: "tcp"}}},
+		{"0.0.0.0:53:53/udp", []PortBinding{{HostPort: 53, ContainerPort: 53, Proto: "udp"}}},
+		{"[::1]:8080:80", []PortBinding{{HostIP: "::1", HostPort: 8080, ContainerPort: 80, Proto: "tcp"}}},
+		{"8000-8001:80-81", []PortBinding{
+			{HostPort: 8000, ContainerPort: 80, Proto: "tcp"},
+			{HostPort: 8001, ContainerPort: 81, Proto: "tcp"},
+		}},
+		{"8000-8010:80/sctp", []PortBinding{{HostPort: 8000, HostPortEnd: 8010, ContainerPort: 80, Proto: "sctp"}}},
+	}
+	for _, c := range cases {
+		got, err := ParsePortMapping(c.spec)
+		if err != nil {
+			t.Errorf("parse %s error %v", c.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parse %s got %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{"", "abc", "80/icmp", "8000-8002:80-81", "1.2.3.4:5:6:7", "99999", "x.x.x.x:80:80"} {
+		if _, err := ParsePortMapping(spec); err == nil {
+			t.Errorf("parse %q should fail", spec)
+		}
+	}
+}
+
+func TestAllocateHostPorts(t *testing.T) {
+	published := []PortBinding{{HostPort: 18080, ContainerPort: 80, Proto: "tcp"}}
+	if _, err := allocateHostPorts([]PortBinding{{HostIP: "127.0.0.1", HostPort: 18080, ContainerPort: 80, Proto: "tcp"}}, published); err == nil {
+		t.Errorf("conflict with published port should fail")
+	}
+	// 协议不同不冲突
+	if _, err := allocateHostPorts([]PortBinding{{HostPort: 18080, ContainerPort: 80, Proto: "udp"}}, published); err != nil {
+		t.Errorf("allocate udp port error %v", err)
+	}
+	got, err := allocateHostPorts([]PortBinding{{HostPort: 18080, HostPortEnd: 18090, ContainerPort: 80, Proto: "tcp"}}, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].HostPort == 18080 || got[0].HostPortEnd != 0 {
+		t.Errorf("allocate from range got %+v", got[0])
+	}
+}
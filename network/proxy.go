@@ -0,0 +1,253 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"mydocker/util"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UDP 会话空闲超时时间，客户端和容器任意一方发送数据都会刷新
+var udpConnTrackTimeout = 90 * time.Second
+
+const (
+	// 检查容器进程是否存活的间隔
+	proxyWatchInterval = time.Second
+	// 代理、DNS 等子进程完成监听后通过管道返回给父进程的消息
+	childReadyMessage = "ready"
+)
+
+// 端口映射的用户态代理，负责宿主机本地访问（127.0.0.1）以及同一网桥上容器访问已发布端口的流量
+// 这部分流量不经过 PREROUTING 链，DNAT 规则无法处理
+type Proxy struct {
+	Proto         string
+	HostAddr      string // 监听地址 hostIP:hostPort
+	ContainerAddr string // 转发目标 containerIP:containerPort
+	ContainerPid  int    // 容器进程退出后代理随之退出
+}
+
+// 启动代理进程，通过 /proc/self/exe proxy 重新执行 mydocker 的 proxy 命令，与 init 命令的启动方式一致
+// 代理进程脱离当前会话，容器在后台运行时 mydocker run 退出后代理继续工作
+func startProxy(pb PortBinding, containerIP net.IP, containerPid string) (int, error) {
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readPipe.Close()
+
+	cmd := exec.Command("/proc/self/exe", "proxy",
+		"--proto", pb.Proto,
+		"--host-addr", net.JoinHostPort(pb.HostIP, strconv.Itoa(pb.HostPort)),
+		"--container-addr", net.JoinHostPort(containerIP.String(), strconv.Itoa(pb.ContainerPort)),
+		"--container-pid", containerPid,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{writePipe}
+	if err := cmd.Start(); err != nil {
+		writePipe.Close()
+		return 0, err
+	}
+	writePipe.Close()
+
+	// 等待代理进程完成端口监听
+	msg, _ := io.ReadAll(readPipe)
+	if string(msg) != childReadyMessage {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, fmt.Errorf("start proxy for %s error: %s", pb, msg)
+	}
+	// 代理进程由 init 进程接管，这里不需要 Wait
+	_ = cmd.Process.Release()
+	return cmd.Process.Pid, nil
+}
+
+// 结束网络端点的所有代理进程
+func stopProxies(ep *Endpoint) {
+	for _, pid := range ep.ProxyPids {
+		if err := util.KillProcess(pid); err != nil {
+			logrus.Warnf("kill proxy process %d error %v", pid, err)
+		}
+	}
+	ep.ProxyPids = nil
+}
+
+// 在当前进程中运行代理，由 proxy 命令调用
+// 监听完成后通过文件描述符 3 的管道通知父进程
+func (p *Proxy) Run() error {
+	readyPipe := os.NewFile(uintptr(3), "pipe")
+
+	var serve func() error
+	switch p.Proto {
+	case "tcp":
+		l, err := net.Listen("tcp", p.HostAddr)
+		if err != nil {
+			fmt.Fprint(readyPipe, err.Error())
+			readyPipe.Close()
+			return err
+		}
+		serve = func() error { return p.serveTCP(l) }
+	case "udp":
+		conn, err := net.ListenPacket("udp", p.HostAddr)
+		if err != nil {
+			fmt.Fprint(readyPipe, err.Error())
+			readyPipe.Close()
+			return err
+		}
+		serve = func() error { return p.serveUDP(conn) }
+	default:
+		err := fmt.Errorf("userland proxy does not support protocol %s", p.Proto)
+		fmt.Fprint(readyPipe, err.Error())
+		readyPipe.Close()
+		return err
+	}
+	fmt.Fprint(readyPipe, childReadyMessage)
+	readyPipe.Close()
+
+	go p.watchContainer()
+	return serve()
+}
+
+// 容器进程退出后结束代理进程
+func (p *Proxy) watchContainer() {
+	if p.ContainerPid <= 0 {
+		return
+	}
+	procDir := fmt.Sprintf("/proc/%d", p.ContainerPid)
+	for {
+		time.Sleep(proxyWatchInterval)
+		if exist, _ := util.FileOrDirExits(procDir); !exist {
+			logrus.Infof("container process %d exited, stop proxy %s", p.ContainerPid, p.HostAddr)
+			os.Exit(0)
+		}
+	}
+}
+
+func (p *Proxy) serveTCP(l net.Listener) error {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleTCP(client.(*net.TCPConn))
+	}
+}
+
+func (p *Proxy) handleTCP(client *net.TCPConn) {
+	defer client.Close()
+	backend, err := net.Dial("tcp", p.ContainerAddr)
+	if err != nil {
+		logrus.Errorf("proxy dial %s error %v", p.ContainerAddr, err)
+		return
+	}
+	defer backend.Close()
+
+	// 双向拷贝数据，一个方向结束后关闭对端的写方向
+	var wg sync.WaitGroup
+	pipe := func(dst, src *net.TCPConn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		_ = dst.CloseWrite()
+	}
+	wg.Add(2)
+	go pipe(backend.(*net.TCPConn), client)
+	go pipe(client, backend.(*net.TCPConn))
+	wg.Wait()
+}
+
+// UDP 会话，lastActive 为客户端或者容器最后一次发送数据的时间
+type udpSession struct {
+	backend    *net.UDPConn
+	lastActive time.Time
+}
+
+func (p *Proxy) serveUDP(conn net.PacketConn) error {
+	// 保护 sessions 和会话的 lastActive，会话只在持有锁时关闭，向容器转发时不会写入已经关闭的连接
+	var mu sync.Mutex
+	// 每个客户端地址对应一个连接到容器的 UDP 连接
+	sessions := map[string]*udpSession{}
+	timeout := udpConnTrackTimeout
+	backendAddr, err := net.ResolveUDPAddr("udp", p.ContainerAddr)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := clientAddr.String()
+		mu.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			backend, err := net.DialUDP("udp", nil, backendAddr)
+			if err != nil {
+				mu.Unlock()
+				logrus.Errorf("proxy dial %s error %v", p.ContainerAddr, err)
+				continue
+			}
+			session = &udpSession{backend: backend}
+			sessions[key] = session
+			// 将容器的回包转发给客户端，会话空闲超时后关闭
+			// 只有客户端发送数据的单向流量同样刷新空闲时间，不会被定期断开而更换源端口
+			go func(session *udpSession, clientAddr net.Addr, key string) {
+				// 调用时需要持有锁
+				closeSession := func() {
+					delete(sessions, key)
+					session.backend.Close()
+				}
+				defer func() {
+					mu.Lock()
+					if sessions[key] == session {
+						closeSession()
+					}
+					mu.Unlock()
+				}()
+				reply := make([]byte, 65535)
+				for {
+					mu.Lock()
+					deadline := session.lastActive.Add(timeout)
+					mu.Unlock()
+					_ = session.backend.SetReadDeadline(deadline)
+					n, err := session.backend.Read(reply)
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						// 等待期间客户端发送过数据时继续等待，判断空闲和关闭会话在同一次加锁中完成
+						mu.Lock()
+						idle := time.Since(session.lastActive) >= timeout
+						if idle {
+							closeSession()
+						}
+						mu.Unlock()
+						if idle {
+							return
+						}
+						continue
+					}
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					session.lastActive = time.Now()
+					mu.Unlock()
+					if _, err := conn.WriteTo(reply[:n], clientAddr); err != nil {
+						return
+					}
+				}
+			}(session, clientAddr, key)
+		}
+		session.lastActive = time.Now()
+		if _, err := session.backend.Write(buf[:n]); err != nil {
+			logrus.Errorf("proxy write to %s error %v", p.ContainerAddr, err)
+		}
+		mu.Unlock()
+	}
+}
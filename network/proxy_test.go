@@ -0,0 +1,149 @@
+package network
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyTCP(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p := &Proxy{Proto: "tcp", HostAddr: l.Addr().String(), ContainerAddr: backend.Addr().String()}
+	go p.serveTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &Proxy{Proto: "udp", HostAddr: conn.LocalAddr().String(), ContainerAddr: backend.LocalAddr().String()}
+	go p.serveUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+}
+
+// 只有客户端发送数据的单向流量在超时时间之后仍然使用同一个会话
+func TestProxyUDPOneWay(t *testing.T) {
+	oldTimeout := udpConnTrackTimeout
+	udpConnTrackTimeout = 200 * time.Millisecond
+	defer func() { udpConnTrackTimeout = oldTimeout }()
+
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	sources := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &Proxy{Proto: "udp", HostAddr: conn.LocalAddr().String(), ContainerAddr: backend.LocalAddr().String()}
+	go p.serveUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 12; i++ {
+		if _, err := client.Write([]byte("log")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	first := ""
+	for i := 0; i < 12; i++ {
+		select {
+		case source := <-sources:
+			if first == "" {
+				first = source
+			} else if source != first {
+				t.Fatalf("packet %d from %s, expect %s", i, source, first)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("received %d packets", i)
+		}
+	}
+}
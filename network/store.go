@@ -0,0 +1,172 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 无法加载的状态文件被 network doctor 重命名为 {文件名}.corrupt，加载时跳过
+	corruptSuffix = ".corrupt"
+	// 写入状态文件时先写入临时文件再重命名，避免进程中断留下不完整的文件
+	tmpSuffix = ".tmp"
+)
+
+// 网络配置目录中无法加载的文件及原因，key 为文件路径，由 network doctor 报告和修复
+var corruptNetworks map[string]error
+
+// 原子地写入状态文件：先写入同目录下的临时文件，再通过 rename 替换目标文件
+func writeStateFile(file string, data []byte) error {
+	tmp := file + tmpSuffix
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// 不是状态文件的文件：写入中断留下的临时文件和已经隔离的损坏文件
+func ignoredStateFile(name string) bool {
+	return strings.HasSuffix(name, tmpSuffix) || strings.HasSuffix(name, corruptSuffix)
+}
+
+// 隔离损坏的状态文件，保留文件内容用于排查问题
+func quarantineStateFile(file string) error {
+	return os.Rename(file, file+corruptSuffix)
+}
+
+// 加载网络配置目录中的所有网络，无法解析或者内容不完整的文件记录在 corrupt 中，不加入网络列表
+func loadNetworks(dumpPath string) (map[string]*Network, map[string]error, error) {
+	nws := map[string]*Network{}
+	corrupt := map[string]error{}
+	err := filepath.Walk(dumpPath, func(nwPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 网络配置目录本身无法读取时返回错误，其中的单个文件无法读取时记录为损坏
+			if nwPath == dumpPath {
+				return err
+			}
+			corrupt[nwPath] = err
+			return nil
+		}
+		if info.IsDir() {
+			if nwPath != dumpPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		_, nwName := path.Split(nwPath)
+		if ignoredStateFile(nwName) {
+			return nil
+		}
+		nw := &Network{Name: nwName}
+		if err := nw.load(nwPath); err != nil {
+			corrupt[nwPath] = err
+			return nil
+		}
+		if err := nw.validate(nwName); err != nil {
+			corrupt[nwPath] = err
+			return nil
+		}
+		nws[nwName] = nw
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("walk network dump path %s error %v", dumpPath, err)
+	}
+	return nws, corrupt, nil
+}
+
+// 检查加载的网络信息是否完整，避免后续使用时出现空指针
+func (nw *Network) validate(fileName string) error {
+	if nw.Name != fileName {
+		return fmt.Errorf("network name %q does not match file name %q", nw.Name, fileName)
+	}
+	if _, ok := drivers[nw.Driver]; !ok {
+		return fmt.Errorf("network %s has unknown driver %q", nw.Name, nw.Driver)
+	}
+	if !nw.usesIPAM() {
+		return nil
+	}
+	if nw.IpRange == nil || nw.IpRange.IP.To4() == nil {
+		return fmt.Errorf("network %s has no IPv4 subnet", nw.Name)
+	}
+	if nw.IPv6 && nw.IpRange6 == nil {
+		return fmt.Errorf("network %s has no IPv6 subnet", nw.Name)
+	}
+	return nil
+}
+
+func (nw *Network) load(dumpPath string) error {
+	// 网络信息可能超过固定大小的缓冲区，读取完整的文件内容
+	contentBytes, err := os.ReadFile(dumpPath)
+	if err != nil {
+		return fmt.Errorf("read network file %s error %v", dumpPath, err)
+	}
+	if err := json.Unmarshal(contentBytes, nw); err != nil {
+		return fmt.Errorf("unmarshal network file %s error %v", dumpPath, err)
+	}
+	return nil
+}
+
+// 两个网段是否有重叠的地址，网段的 IP 保存的是网关地址，需要先转换为网络地址
+func subnetsOverlap(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	_, na, err := net.ParseCIDR(a.String())
+	if err != nil {
+		return false
+	}
+	_, nb, err := net.ParseCIDR(b.String())
+	if err != nil {
+		return false
+	}
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
+
+// 查找与 nw 网段重叠的已有网络，所有网络共用同一个 IPAM，网段重叠会导致同一个地址被分配两次
+func overlappingNetwork(nw *Network, nws map[string]*Network) (*Network, *net.IPNet) {
+	names := make([]string, 0, len(nws))
+	for name := range nws {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		other := nws[name]
+		if other.Name == nw.Name || !other.usesIPAM() {
+			continue
+		}
+		if subnetsOverlap(nw.IpRange, other.IpRange) {
+			return other, other.IpRange
+		}
+		if nw.IPv6 && other.IPv6 && subnetsOverlap(nw.IpRange6, other.IpRange6) {
+			return other, other.IpRange6
+		}
+	}
+	return nil, nil
+}
+
+func checkSubnetOverlap(nw *Network) error {
+	if other, subnet := overlappingNetwork(nw, networks); other != nil {
+		return fmt.Errorf("subnet of network %s overlaps with subnet %s of network %s", nw.Name, subnetString(subnet), other.Name)
+	}
+	return nil
+}
+
+// 加载网络信息时记录损坏的文件，网络命令仍然可以使用其他网络
+func logCorruptNetworks() {
+	for file, err := range corruptNetworks {
+		logrus.Warnf("ignore corrupt network file %s: %v, run mydocker network doctor to repair", file, err)
+	}
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoadNetworks(t *testing.T) {
+	dir := t.TempDir()
+	oldDrivers := drivers
+	drivers = map[string]NetworkDriver{"bridge": &BridgeNetworkDriver{}, "cni": &CNINetworkDriver{}}
+	defer func() { drivers = oldDrivers }()
+
+	// 超过 2000 字节的网络信息
+	_, ipRange, _ := net.ParseCIDR("192.168.30.1/24")
+	labels := map[string]string{}
+	for i := 0; i < 100; i++ {
+		labels[fmt.Sprintf("label%d", i)] = strings.Repeat("v", 20)
+	}
+	big := &Network{Name: "big", Driver: "bridge", IpRange: ipRange, Labels: labels}
+	if err := big.dump(dir); err != nil {
+		t.Fatal(err)
+	}
+	cni := &Network{Name: "cninet", Driver: "cni"}
+	if err := cni.dump(dir); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"broken":              `{"Name":"broken",`,
+		"nosubnet":            `{"Name":"nosubnet","Driver":"bridge"}`,
+		"unknown":             `{"Name":"unknown","Driver":"foo"}`,
+		"renamed":             `{"Name":"other","Driver":"cni"}`,
+		"big.tmp":             `{`,
+		"old" + corruptSuffix: `{`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nws, corrupt, err := loadNetworks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nws) != 2 || nws["big"] == nil || len(nws["big"].Labels) != 100 || nws["cninet"] == nil {
+		t.Errorf("networks %v", nws)
+	}
+	for _, name := range []string{"broken", "nosubnet", "unknown", "renamed"} {
+		if corrupt[path.Join(dir, name)] == nil {
+			t.Errorf("%s should be corrupt", name)
+		}
+	}
+	if len(corrupt) != 4 {
+		t.Errorf("corrupt %v", corrupt)
+	}
+
+	if _, _, err := loadNetworks(path.Join(dir, "missing")); err == nil {
+		t.Errorf("missing dir expect error")
+	}
+}
+
+func TestSubnetsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"192.168.10.1/24", "192.168.10.0/24", true},
+		{"192.168.10.1/24", "192.168.10.128/25", true},
+		{"192.168.0.1/16", "192.168.10.1/24", true},
+		{"192.168.10.1/24", "192.168.11.1/24", false},
+		{"fd00:10::1/64", "fd00:10::/48", true},
+		{"fd00:10::1/64", "192.168.10.1/24", false},
+	}
+	for _, tt := range tests {
+		ipA, a, _ := net.ParseCIDR(tt.a)
+		ipB, b, _ := net.ParseCIDR(tt.b)
+		a.IP, b.IP = ipA, ipB
+		if got := subnetsOverlap(a, b); got != tt.want {
+			t.Errorf("overlap %s %s got %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	oldNetworks := networks
+	defer func() { networks = oldNetworks }()
+	_, existing, _ := net.ParseCIDR("10.10.0.1/16")
+	networks = map[string]*Network{"existing": {Name: "existing", Driver: "bridge", IpRange: existing}}
+	_, subnet, _ := net.ParseCIDR("10.10.20.0/24")
+	if err := checkSubnetOverlap(&Network{Name: "new", IpRange: subnet}); err == nil {
+		t.Errorf("overlapping subnet expect error")
+	}
+	_, subnet, _ = net.ParseCIDR("10.11.0.0/24")
+	if err := checkSubnetOverlap(&Network{Name: "new", IpRange: subnet}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckIPAM(t *testing.T) {
+	dir := t.TempDir()
+	oldAllocator, oldEndpointPath, oldNetworks := ipAllocator, defaultEndpointPath, networks
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+	defaultEndpointPath = path.Join(dir, "endpoint")
+	defer func() { ipAllocator, defaultEndpointPath, networks = oldAllocator, oldEndpointPath, oldNetworks }()
+
+	// 网关 .1 和容器 .2 正常分配，.3 已经没有端点使用，另一个网段不属于任何网络
+	_, ipRange, _ := net.ParseCIDR("192.168.40.0/24")
+	gateway, _ := ipAllocator.Allocate(ipRange)
+	ip, _ := ipAllocator.Allocate(ipRange)
+	ipAllocator.Allocate(ipRange)
+	_, orphan, _ := net.ParseCIDR("192.168.41.0/24")
+	ipAllocator.Allocate(orphan)
+	ipRange.IP = gateway
+	nw := &Network{Name: "ipamnet", Driver: "bridge", IpRange: ipRange}
+	networks = map[string]*Network{nw.Name: nw}
+	ep := &Endpoint{ID: "1234567890-ipamnet", ContainerID: "1234567890", NetworkName: nw.Name, IpAddress: ip}
+	if err := ep.dump(defaultEndpointPath); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, running, problems := checkEndpoints()
+	if len(endpoints) != 1 || len(running) != 0 || len(problems) != 1 || !strings.Contains(problems[0].Message, "not running") {
+		t.Fatalf("endpoints %v running %v problems %v", endpoints, running, problems)
+	}
+	problems = checkIPAM(endpoints)
+	if len(problems) != 2 {
+		t.Fatalf("problems %v", problems)
+	}
+	if !strings.Contains(problems[0].Message, "192.168.40.3") || !strings.Contains(problems[1].Message, "192.168.41.0/24") {
+		t.Errorf("problems %s; %s", problems[0].Message, problems[1].Message)
+	}
+	if err := problems[0].repair(); err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkIPAM(endpoints); len(problems) != 0 {
+		t.Errorf("problems after repair %v", problems)
+	}
+	if allocated, _, _ := ipAllocator.Usage(ipRange); allocated != 2 {
+		t.Errorf("allocated %d after repair, want 2", allocated)
+	}
+
+	// 损坏的 IPAM 文件被隔离后重建
+	os.WriteFile(ipAllocator.SubnetAllocatorPath, []byte("{"), 0644)
+	problems = checkIPAM(endpoints)
+	if len(problems) != 1 || problems[0].repair() != nil {
+		t.Fatalf("problems %v", problems)
+	}
+	if allocated, _, _ := ipAllocator.Usage(ipRange); allocated != 2 {
+		t.Errorf("allocated %d after rebuild, want 2", allocated)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"mydocker/network"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 打印容器发布的端口映射，格式与 docker port 一致，例如 80/tcp -> 0.0.0.0:32768
+func ListContainerPorts(containerId string) {
+	if err := network.Load(); err != nil {
+		logrus.Errorf("load networks error %v", err)
+	}
+	endpoints, err := network.GetEndpoints(containerId)
+	if err != nil {
+		logrus.Errorf("get endpoints of container %s error %v", containerId, err)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	for _, ep := range endpoints {
+		for _, pb := range ep.PortBindings {
+			fmt.Fprintf(w, "%s\n", pb)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		logrus.Errorf("Flush error %v", err)
+		return
+	}
+}
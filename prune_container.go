@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mydocker/cgroups"
+	"mydocker/container"
+	"mydocker/images"
+	"mydocker/network"
+	"mydocker/util"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 读取所有容器的信息，/var/run/mydocker 下没有 config.json 的目录不是容器，例如 network
+func loadContainers() ([]*container.ContainerInfo, error) {
+	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, "")
+	entries, err := os.ReadDir(dirUrl)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var containers []*container.ContainerInfo
+	for _, entry := range entries {
+		content, err := os.ReadFile(path.Join(dirUrl, entry.Name(), container.ConfigName))
+		if err != nil {
+			continue
+		}
+		var c container.ContainerInfo
+		if err := json.Unmarshal(content, &c); err != nil {
+			logrus.Warnf("unmarshal container %s config error %v", entry.Name(), err)
+			continue
+		}
+		containers = append(containers, &c)
+	}
+	return containers, nil
+}
+
+// 后台运行的容器退出后状态仍然是 running，需要检查进程是否还存在
+func containerRunning(c *container.ContainerInfo) bool {
+	if c.Status != container.RUNNING || c.Pid == "" {
+		return false
+	}
+	_, err := os.Stat(path.Join("/proc", c.Pid))
+	return err == nil
+}
+
+// 容器目录占用的空间，不包括挂载点 mnt，mnt 中的内容来自镜像层和读写层
+func containerSize(containerId string) int64 {
+	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, containerId)
+	entries, err := os.ReadDir(dirUrl)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if entry.Name() == container.AUFSMountLayer {
+			continue
+		}
+		size, _ := images.DirSize(path.Join(dirUrl, entry.Name()))
+		total += size
+	}
+	return total
+}
+
+// 删除所有已经停止的容器，返回释放的空间
+// until 不为零值时只删除在该时间之前创建的容器，dryRun 时只打印将要删除的容器
+func PruneContainers(until time.Time, dryRun bool) (int64, error) {
+	containers, err := loadContainers()
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	for _, c := range containers {
+		if containerRunning(c) {
+			continue
+		}
+		if !until.IsZero() {
+			created, err := time.ParseInLocation(util.TIMESTAP, c.CreateTime, time.Local)
+			if err != nil || !created.Before(until) {
+				continue
+			}
+		}
+		size := containerSize(c.Id)
+		if dryRun {
+			fmt.Printf("Would delete container: %s\n", c.Id)
+			reclaimed += size
+			continue
+		}
+		if err := cleanupContainer(c); err != nil {
+			logrus.Errorf("remove container %s error %v", c.Id, err)
+			continue
+		}
+		fmt.Printf("Deleted container: %s\n", c.Id)
+		reclaimed += size
+	}
+	return reclaimed, nil
+}
+
+// 清理停止的容器留下的网络、cgroup 和挂载，再删除容器目录
+// 只有 tty 模式的容器退出时会自动清理，后台运行的容器退出后这些资源都还在
+func cleanupContainer(c *container.ContainerInfo) error {
+	if c.Status == container.RUNNING {
+		network.Init()
+		if err := network.DisconnectContainer(c); err != nil {
+			logrus.Errorf("disconnect container %s network error %v", c.Id, err)
+		}
+		cgroupManager := cgroups.CgroupManager{Path: fmt.Sprintf(container.CGroup, c.Id)}
+		cgroupManager.Destroy()
+	}
+	rootURL := fmt.Sprintf(container.AUFSRootUrl, c.Id)
+	mntURL := path.Join(rootURL, container.AUFSMountLayer)
+	if mounted(mntURL) {
+		container.DeleteAUFSWorkSpace(rootURL, mntURL, c.Volume)
+		// 卸载失败时不能删除容器目录，否则会通过挂载点删除镜像层或者数据卷中的文件
+		if mounted(mntURL) {
+			return fmt.Errorf("mount point %s is still in use", mntURL)
+		}
+	}
+	return os.RemoveAll(rootURL)
+}
+
+// 通过 /proc/self/mountinfo 判断 dir 或者其中的目录是否是挂载点
+func mounted(dir string) bool {
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	// /var/run 通常是指向 /run 的符号链接，mountinfo 中是解析后的路径
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	dir = path.Clean(dir)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		if fields[4] == dir || strings.HasPrefix(fields[4], dir+"/") {
+			return true
+		}
+	}
+	return false
+}
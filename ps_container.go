@@ -38,7 +38,7 @@ func ListContainers(){
 		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Id, v.Name, v.Pid, v.Status, v.Command, v.CreateTime)
 	}
 	if err := w.Flush(); err != nil {
-		logrus.Errorf("Flush error ", err)
+		logrus.Errorf("Flush error %v", err)
 			return
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"mydocker/cgroups"
 	"mydocker/cgroups/subsystems"
@@ -8,20 +9,23 @@ import (
 	"mydocker/network"
 	"mydocker/util"
 	"os"
+	"os/exec"
 	"path"
-	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, containerName, imageName string, envSlice []string,
-	nw string, portmapping []string) {
+func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, cinfo *container.ContainerInfo, imageID string,
+	envSlice []string) {
 
 	// generate 10 bits random container ID
 	containerId := util.RandStringBytes(10)
+	cinfo.Id = containerId
+	volume := cinfo.Volume
+	nw := cinfo.NetworkMode
 
-	parent, writePipe := container.NewParentProcess(tty, volume, containerId, imageName, envSlice)
+	parent, writePipe := container.NewParentProcess(tty, volume, containerId, imageID, envSlice, nw)
 	if parent == nil {
 		logrus.Errorf("new parent process error")
 		return
@@ -33,7 +37,7 @@ func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, co
 	}
 
 	// record container info
-	_, err := container.RecordContainerInfo(parent.Process.Pid, comArray, containerName, containerId, volume)
+	_, err := container.RecordContainerInfo(cinfo, parent.Process.Pid, comArray)
 	if err != nil {
 		logrus.Errorf("Record container info error %v", err)
 		return
@@ -46,20 +50,25 @@ func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, co
 	// 将容器进程加入到各个subsystem挂载对应的cgroup中
 	_ = cgroupManager.Apply(parent.Process.Pid)
 
-	if nw != "" {
-		// config container network
-		network.Init()
-		cinfo := &container.ContainerInfo{
-			Id:          containerId,
-			Pid:         strconv.Itoa(parent.Process.Pid),
-			Name:        containerName,
-			PortMapping: portmapping,
+	switch {
+	case container.IsNetworkName(nw):
+		// config container network，连接网络后会根据容器IP更新 hosts 和 resolv.conf
+		if err := network.Init(); err != nil {
+			logrus.Errorf("init network error %v", err)
+			abortContainer(parent, cinfo, volume, &cgroupManager)
+			return
 		}
-
 		if err := network.Connect(nw, cinfo); err != nil {
 			logrus.Errorf("error connet network %v", err)
+			abortContainer(parent, cinfo, volume, &cgroupManager)
 			return
 		}
+	case strings.HasPrefix(nw, container.NetworkModeContainerPrefix):
+		// 共享其他容器的网络时，直接使用该容器的 hosts 和 resolv.conf
+	default:
+		if err := network.UpdateEtcFiles(cinfo); err != nil {
+			logrus.Errorf("write container etc files error %v", err)
+		}
 	}
 
 	// 对容器设置完限制后，初始化容器
@@ -67,6 +76,12 @@ func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, co
 
 	if tty {
 		_ = parent.Wait()
+		if container.IsNetworkName(nw) {
+			// 容器退出后断开网络，释放容器IP和端口映射
+			if err := network.DisconnectContainer(cinfo); err != nil {
+				logrus.Errorf("disconnect container %s network error %v", containerId, err)
+			}
+		}
 		// 删除 AUFS 挂载
 		rootURL := fmt.Sprintf(container.AUFSRootUrl, containerId)
 		mntURL := path.Join(rootURL, container.AUFSMountLayer)
@@ -77,9 +92,21 @@ func Run(tty bool, comArray []string, res *subsystems.ResourceConfig, volume, co
 
 }
 
+// 配置网络失败时 init 进程还阻塞在管道上等待命令，杀死容器进程并清理挂载、容器信息和 cgroup
+func abortContainer(parent *exec.Cmd, cinfo *container.ContainerInfo, volume string, cgroupManager *cgroups.CgroupManager) {
+	_ = parent.Process.Kill()
+	_ = parent.Wait()
+	rootURL := fmt.Sprintf(container.AUFSRootUrl, cinfo.Id)
+	mntURL := path.Join(rootURL, container.AUFSMountLayer)
+	container.DeleteAUFSWorkSpace(rootURL, mntURL, volume)
+	container.DeleteContainerInfo(cinfo.Id)
+	cgroupManager.Destroy()
+}
+
+// 命令以 JSON 数组传给 init 进程，镜像中的 Cmd 等参数可以包含空格
 func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
-	logrus.Infof("command all is %s", command)
-	_, _ = writePipe.WriteString(command)
+	logrus.Infof("command all is %s", strings.Join(comArray, " "))
+	command, _ := json.Marshal(comArray)
+	_, _ = writePipe.Write(command)
 	_ = writePipe.Close()
 }
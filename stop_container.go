@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"mydocker/cgroups"
 	"mydocker/container"
+	"mydocker/network"
 	"mydocker/util"
 	"os"
 	"path"
@@ -27,6 +28,11 @@ func StopContainer(containerId string) {
 		logrus.Errorf("can not stop a not running container, container ID = %s error %v", containerId, err)
 		return
 	}
+	// 先断开容器网络再结束进程，cni 插件执行 DEL 时容器的 Net Namespace 仍然存在，可以完整清理容器内的接口
+	network.Init()
+	if err := network.DisconnectContainer(c); err != nil {
+		logrus.Errorf("disconnect container %s network error %v", containerId, err)
+	}
 	pid := c.Pid
 	pidInt, err := strconv.Atoi(pid)
 	if err != nil{
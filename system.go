@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"mydocker/container"
+	"mydocker/images"
+	"mydocker/util"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 打印镜像、镜像层、容器读写层、数据卷和容器日志占用的空间
+// 数据卷是用户指定的宿主机目录，prune 不会删除，可以释放的空间总是 0
+func SystemDiskUsage() error {
+	imageUsage, layerUsage, err := images.DiskUsage()
+	if err != nil {
+		return err
+	}
+	containers, err := loadContainers()
+	if err != nil {
+		return err
+	}
+	var containerUsage, volumeUsage, logUsage images.Usage
+	volumes := map[string]bool{}
+	for _, c := range containers {
+		running := containerRunning(c)
+		dirUrl := fmt.Sprintf(container.DefaultInfoLocation, c.Id)
+
+		size, _ := images.DirSize(path.Join(dirUrl, container.AUFSWriteLayer))
+		containerUsage.Total++
+		containerUsage.Size += size
+		if running {
+			containerUsage.Active++
+		} else {
+			containerUsage.Reclaimable += size
+		}
+
+		if info, err := os.Stat(path.Join(dirUrl, container.LogFileName)); err == nil {
+			logUsage.Total++
+			logUsage.Size += info.Size()
+			if running {
+				logUsage.Active++
+			} else {
+				logUsage.Reclaimable += info.Size()
+			}
+		}
+
+		host := strings.Split(c.Volume, ":")[0]
+		if c.Volume == "" || host == "" {
+			continue
+		}
+		if _, ok := volumes[host]; !ok {
+			size, _ := images.DirSize(host)
+			volumeUsage.Total++
+			volumeUsage.Size += size
+		}
+		if running && !volumes[host] {
+			volumeUsage.Active++
+		}
+		volumes[host] = volumes[host] || running
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+	for _, row := range []struct {
+		name  string
+		usage images.Usage
+	}{
+		{"Images", imageUsage},
+		{"Layers", layerUsage},
+		{"Containers", containerUsage},
+		{"Volumes", volumeUsage},
+		{"Logs", logUsage},
+	} {
+		reclaimable := util.HumanSize(row.usage.Reclaimable)
+		if row.usage.Size > 0 {
+			reclaimable = fmt.Sprintf("%s (%d%%)", reclaimable, row.usage.Reclaimable*100/row.usage.Size)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", row.name, row.usage.Total, row.usage.Active, util.HumanSize(row.usage.Size), reclaimable)
+	}
+	return w.Flush()
+}
+
+// 依次删除停止的容器、没有被使用的镜像，再回收没有被引用的镜像层和过期的临时文件
+// all 为 false 时只删除悬空镜像，dryRun 时只打印将要删除的内容
+func SystemPrune(all bool, until time.Time, dryRun bool) error {
+	containerSpace, err := PruneContainers(until, dryRun)
+	if err != nil {
+		return err
+	}
+	imageSpace, err := images.PruneImages(images.PruneOptions{All: all, Until: until, DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+	layerSpace, err := images.GarbageCollect(dryRun)
+	if err != nil {
+		return err
+	}
+	printReclaimed(containerSpace+imageSpace+layerSpace, dryRun)
+	return nil
+}
+
+func printReclaimed(size int64, dryRun bool) {
+	if dryRun {
+		fmt.Printf("Total reclaimable space: %s\n", util.HumanSize(size))
+		return
+	}
+	fmt.Printf("Total reclaimed space: %s\n", util.HumanSize(size))
+}
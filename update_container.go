@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"mydocker/container"
+	"mydocker/network"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// run 和 update 命令共用的带宽限制参数
+var bandwidthFlags = []cli.Flag{
+	cli.StringFlag{Name: "ingress-rate", Usage: "limit the traffic into the container, eg: 10mbit, none means no limit"},
+	cli.StringFlag{Name: "ingress-burst", Usage: "burst size of ingress rate limit, eg: 64kb"},
+	cli.StringFlag{Name: "egress-rate", Usage: "limit the traffic out of the container, eg: 10mbit, none means no limit"},
+	cli.StringFlag{Name: "egress-burst", Usage: "burst size of egress rate limit, eg: 64kb"},
+}
+
+// 解析命令行中指定的带宽限制参数写入容器信息，没有指定的参数保持不变
+func parseBandwidthFlags(ctx *cli.Context, cinfo *container.ContainerInfo) error {
+	rates := map[string]*uint64{"ingress-rate": &cinfo.IngressRate, "egress-rate": &cinfo.EgressRate}
+	for name, value := range rates {
+		if !ctx.IsSet(name) {
+			continue
+		}
+		rate, err := network.ParseRate(ctx.String(name))
+		if err != nil {
+			return err
+		}
+		*value = rate
+	}
+	bursts := map[string]*uint64{"ingress-burst": &cinfo.IngressBurst, "egress-burst": &cinfo.EgressBurst}
+	for name, value := range bursts {
+		if !ctx.IsSet(name) {
+			continue
+		}
+		burst, err := network.ParseSize(ctx.String(name))
+		if err != nil {
+			return err
+		}
+		*value = burst
+	}
+	return nil
+}
+
+// 修改运行中容器的带宽限制，保存到容器信息中并立即重新设置容器网络端点上的 tc 队列
+func UpdateContainer(ctx *cli.Context, containerId string) error {
+	c, err := container.GetContainerInfoById(containerId)
+	if err != nil {
+		return fmt.Errorf("can not get container info %s error %v", containerId, err)
+	}
+	if c.Status != container.RUNNING {
+		return fmt.Errorf("can not update a not running container %s", containerId)
+	}
+	if err := parseBandwidthFlags(ctx, c); err != nil {
+		return err
+	}
+	if err := container.SaveContainerInfo(c); err != nil {
+		return err
+	}
+	if !container.IsNetworkName(c.NetworkMode) {
+		logrus.Warnf("container %s is not connected to a network, bandwidth limit takes no effect", containerId)
+		return nil
+	}
+	network.Init()
+	if err := network.SetBandwidth(c); err != nil {
+		return fmt.Errorf("set bandwidth of container %s error %v", containerId, err)
+	}
+	logrus.Infof("update container %s successfully", containerId)
+	return nil
+}
@@ -54,4 +54,18 @@ func RandStringBytes(n int) string{
 		b[i] = letterBytes[rand.Intn((len(letterBytes)))]
 	}
 	return string(b)
-}
\ No newline at end of file
+}
+// 以 1000 为进制格式化文件大小，与 docker images 的显示方式一致，例如 1.24MB
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}